@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apokalyptik/tcp-cl-proxy/clproxy"
+)
+
+// "clproxy bench" loads a proxy, or a backend directly to compare, with
+// sessions at a steady rate, for choosing -c and the like:
+//
+//	clproxy bench -target 127.0.0.1:8300 -connections 500 -rate 100/s -payload 4KB -duration 60s
+//
+// Each session connects, writes -payload, and reads until it has as much
+// back with -echo, checking it is the same, or else until the target has
+// been quiet for -wait, and hangs up. New sessions start at -rate, reached
+// gradually over -ramp if given, and no more than -connections are open at
+// once, later ones waiting their turn in a route's limiter as the proxy's
+// clients do. Once -duration is up no more are started, and when the last
+// has finished a summary is printed: the rate sessions were started at, how
+// many succeeded and how many failed at each stage, percentiles of the time
+// to connect and to the first byte back, and the throughput each way. The
+// exit status is 0 only if every session succeeded.
+
+// benchResult is how one session went
+type benchResult struct {
+	connect   time.Duration
+	firstByte time.Duration // 0 if nothing came back
+	sent      int64
+	received  int64
+	stage     string // where it failed, if it did
+	err       error
+}
+
+type bencher struct {
+	target  string
+	payload []byte
+	echo    bool
+	wait    time.Duration
+	timeout time.Duration
+
+	sync.Mutex
+	results []benchResult
+}
+
+// benchMain runs the bench subcommand and returns the exit status
+func benchMain(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	target := fs.String("target", "", "Connect to this address (host:port or unix:///path), the proxy's or a backend's")
+	connections := fs.Int("connections", 100, "Most sessions to have open at once")
+	var rate float64
+	fs.Func("rate", "Start this many sessions a second, e.g. 100/s (0 starts them as fast as -connections allows)", func(s string) error {
+		v, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(s), "/s"), 64)
+		if err != nil || v < 0 {
+			return fmt.Errorf("invalid rate %q", s)
+		}
+		rate = v
+		return nil
+	})
+	ramp := fs.Duration("ramp", 0, "Raise the rate steadily from nothing to -rate over this long at the start")
+	payload := clproxy.ByteSize(4 << 10)
+	fs.Var(&payload, "payload", "Bytes each session writes, e.g. 4KB")
+	echo := fs.Bool("echo", false, "Expect the payload back, and check it, as from an echo server")
+	duration := fs.Duration("duration", 10*time.Second, "Keep starting sessions for this long")
+	wait := fs.Duration("wait", time.Second, "Without -echo, hang up once the target has sent nothing for this long")
+	timeout := fs.Duration("timeout", 10*time.Second, "Give up on a session which hasn't finished in this long")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *target == "" || fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "usage: bench -target host:port [flags]")
+		return 2
+	}
+	if *connections <= 0 || *duration <= 0 || *ramp < 0 {
+		fmt.Fprintln(os.Stderr, "-connections and -duration must be positive, and -ramp can't be negative")
+		return 2
+	}
+	b := &bencher{target: *target, payload: make([]byte, payload), echo: *echo, wait: *wait, timeout: *timeout}
+	rand.Read(b.payload)
+	// Holds a token for each session open
+	open := make(chan struct{}, *connections)
+	var limit *benchLimit
+	if rate > 0 {
+		// A little burst so that oversleeping doesn't lose sessions
+		limit = &benchLimit{rate: rate, burst: max(1, rate/20), tokens: 1, last: time.Now()}
+	}
+	start := time.Now()
+	end := start.Add(*duration)
+	var wg sync.WaitGroup
+	for started := 0; time.Now().Before(end); started++ {
+		if limit != nil && !benchPace(limit, rate, start, *ramp, end) {
+			break
+		}
+		open <- struct{}{}
+		if started > 0 && !time.Now().Before(end) {
+			<-open
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-open }()
+			r := b.session()
+			b.Lock()
+			b.results = append(b.results, r)
+			b.Unlock()
+		}()
+	}
+	startedFor := time.Since(start)
+	wg.Wait()
+	return b.report(startedFor, time.Since(start))
+}
+
+// benchPace waits for the next session's turn at the rate, which is ramped
+// up from nothing over ramp, reporting false if end comes first
+func benchPace(limit *benchLimit, rate float64, start time.Time, ramp time.Duration, end time.Time) bool {
+	for {
+		now := time.Now()
+		if !now.Before(end) {
+			return false
+		}
+		if ramp > 0 {
+			// Never quite nothing, or the first session would never start
+			limit.refill(now)
+			limit.rate = max(rate*min(1, float64(now.Sub(start))/float64(ramp)), rate/100, 0.1)
+		}
+		ok, wait := limit.take(now)
+		if ok {
+			return true
+		}
+		// Wake up now and then for the ramp to raise the rate
+		time.Sleep(min(wait, 100*time.Millisecond, time.Until(end)))
+	}
+}
+
+// benchLimit holds up to burst tokens, refilled at rate a second, for
+// starting sessions at -rate
+type benchLimit struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens due by now
+func (l *benchLimit) refill(now time.Time) {
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+}
+
+// take takes a token if there is one, or says how long until there will be
+func (l *benchLimit) take(now time.Time) (bool, time.Duration) {
+	l.refill(now)
+	if l.tokens >= 1 {
+		l.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+}
+
+// session runs one session against the target
+func (b *bencher) session() (r benchResult) {
+	ctx, cancel := context.WithTimeout(context.Background(), b.timeout)
+	defer cancel()
+	start := time.Now()
+	network, address := clproxy.DialAddr(b.target)
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, address)
+	r.connect = time.Since(start)
+	if err != nil {
+		r.stage, r.err = "connect", err
+		return
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	written := make(chan error, 1)
+	sent := time.Now()
+	go func() {
+		n, err := conn.Write(b.payload)
+		r.sent = int64(n)
+		written <- err
+	}()
+	var got bytes.Buffer
+	buf := make([]byte, 32<<10)
+	for !b.echo || got.Len() < len(b.payload) {
+		if quiet := time.Now().Add(b.wait); !b.echo && quiet.Before(deadline) {
+			conn.SetReadDeadline(quiet)
+		}
+		n, err := conn.Read(buf)
+		if n > 0 && r.firstByte == 0 {
+			r.firstByte = time.Since(sent)
+		}
+		r.received += int64(n)
+		if b.echo {
+			got.Write(buf[:n])
+		}
+		if err != nil {
+			// Without -echo the target hanging up or going quiet is the end
+			done := !b.echo && (errors.Is(err, io.EOF) || errors.Is(err, os.ErrDeadlineExceeded) && time.Now().Before(deadline))
+			if !done && (!b.echo || got.Len() < len(b.payload)) {
+				r.stage, r.err = "receive", err
+			}
+			break
+		}
+	}
+	if err := <-written; err != nil && r.err == nil {
+		r.stage, r.err = "send", err
+	}
+	if r.err == nil && b.echo && !bytes.Equal(got.Bytes(), b.payload) {
+		r.stage, r.err = "verify", errors.New("the payload came back different")
+	}
+	return
+}
+
+// report prints the summary and returns the exit status
+func (b *bencher) report(startedFor, took time.Duration) int {
+	var connects, firstBytes []float64
+	var sent, received int64
+	failed := map[string]int{}
+	var lastErr error
+	for _, r := range b.results {
+		sent += r.sent
+		received += r.received
+		if r.err != nil {
+			failed[r.stage]++
+			lastErr = r.err
+			continue
+		}
+		connects = append(connects, r.connect.Seconds())
+		if r.firstByte > 0 {
+			firstBytes = append(firstBytes, r.firstByte.Seconds())
+		}
+	}
+	errs := len(b.results) - len(connects)
+	fmt.Printf("sessions=%d ok=%d error=%d rate=%.1f/s took=%f\n", len(b.results), len(connects), errs, float64(len(b.results))/startedFor.Seconds(), took.Seconds())
+	for _, l := range []struct {
+		name    string
+		samples []float64
+	}{{"connect", connects}, {"first_byte", firstBytes}} {
+		if len(l.samples) == 0 {
+			continue
+		}
+		fmt.Printf("%s p50=%f p90=%f p99=%f max=%f\n", l.name, benchPercentile(l.samples, 0.5), benchPercentile(l.samples, 0.9), benchPercentile(l.samples, 0.99), benchPercentile(l.samples, 1))
+	}
+	fmt.Printf("sent=%d received=%d up=%.3fMB/s down=%.3fMB/s\n", sent, received, float64(sent)/took.Seconds()/(1<<20), float64(received)/took.Seconds()/(1<<20))
+	if errs == 0 {
+		return 0
+	}
+	stages := make([]string, 0, len(failed))
+	for stage, n := range failed {
+		stages = append(stages, fmt.Sprintf("%s=%d", stage, n))
+	}
+	sort.Strings(stages)
+	fmt.Printf("errors %s last=%q\n", strings.Join(stages, " "), lastErr.Error())
+	return 1
+}
+
+// benchPercentile is the p'th percentile of samples, by nearest rank
+func benchPercentile(samples []float64, p float64) float64 {
+	sorted := slices.Sorted(slices.Values(samples))
+	return sorted[int(math.Ceil(p*float64(len(sorted))))-1]
+}
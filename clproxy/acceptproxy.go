@@ -0,0 +1,179 @@
+package clproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type acceptProxySettings struct {
+	// With -accept-proxy connections must start with a PROXY protocol header (v1
+	// or v2), as sent by HAProxy and most load balancers, and the client address
+	// it carries is used in place of the load balancer's everywhere. If
+	// acceptProxyFrom is set only connections from those networks are expected to
+	// send one; others are taken as direct clients.
+	acceptProxy        bool
+	acceptProxyFrom    string
+	acceptProxyTimeout time.Duration
+}
+
+type acceptProxyState struct {
+	trustedProxies []netip.Prefix
+}
+
+var errBadProxyHeader = errors.New("bad PROXY protocol header")
+
+func (p *Proxy) setupAcceptProxy() error {
+	for _, s := range splitList(p.acceptProxyFrom) {
+		prefix, err := parsePrefix(s)
+		if err != nil {
+			return err
+		}
+		p.trustedProxies = append(p.trustedProxies, prefix)
+	}
+	return nil
+}
+
+// trustedProxy reports whether conn comes from somewhere which must send a
+// PROXY header
+func (p *Proxy) trustedProxy(conn net.Conn) bool {
+	if len(p.trustedProxies) == 0 {
+		return true
+	}
+	ip, ok := addrIP(conn.RemoteAddr())
+	if !ok {
+		return false
+	}
+	for _, prefix := range p.trustedProxies {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxiedConn is a connection whose addresses came from a PROXY header
+type proxiedConn struct {
+	peekedConn
+	src, dst net.Addr
+}
+
+func (p *proxiedConn) RemoteAddr() net.Addr { return p.src }
+func (p *proxiedConn) LocalAddr() net.Addr  { return p.dst }
+
+// readProxyHeader reads the PROXY header from conn when one is expected. The
+// connection returned carries the client's addresses from the header, if it
+// gave any. Connections with a missing or broken header are logged and should
+// be dropped; nothing of theirs is ever sent to a backend.
+func (p *Proxy) readProxyHeader(conn net.Conn, timeout time.Duration) (net.Conn, bool) {
+	if !p.acceptProxy || !p.trustedProxy(conn) {
+		return conn, true
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	br := bufio.NewReader(conn)
+	src, dst, err := parseProxyHeader(br)
+	if err != nil {
+		if !p.logRejection(conn.RemoteAddr().String(), conn, "proxy_header", "error", err.Error()) {
+			p.logger.Warn("proxy header rejected", "client", conn.RemoteAddr().String(), "local", conn.LocalAddr().String(), "error", err.Error())
+		}
+		return conn, false
+	}
+	pc := &proxiedConn{
+		peekedConn: peekedConn{Conn: conn, r: br},
+		src:        conn.RemoteAddr(),
+		dst:        conn.LocalAddr(),
+	}
+	if src != nil {
+		pc.src, pc.dst = src, dst
+	}
+	return pc, true
+}
+
+// parseProxyHeader reads a v1 or v2 header, returning the addresses it
+// carries or nil ones for a LOCAL or UNKNOWN header
+func parseProxyHeader(br *bufio.Reader) (src, dst net.Addr, err error) {
+	sig, err := br.Peek(len(proxyV2Sig))
+	if err != nil && !bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return nil, nil, err
+	}
+	if bytes.Equal(sig, proxyV2Sig) {
+		return parseProxyV2(br)
+	}
+	if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return parseProxyV1(br)
+	}
+	return nil, nil, errBadProxyHeader
+}
+
+func parseProxyV1(br *bufio.Reader) (src, dst net.Addr, err error) {
+	// A v1 header is at most 107 bytes including the CRLF
+	line, err := br.ReadSlice('\n')
+	if err != nil || len(line) > 107 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errBadProxyHeader
+	}
+	f := strings.Fields(string(line[:len(line)-2]))
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, nil, errBadProxyHeader
+	}
+	s, err1 := netip.ParseAddr(f[2])
+	d, err2 := netip.ParseAddr(f[3])
+	sp, err3 := strconv.ParseUint(f[4], 10, 16)
+	dp, err4 := strconv.ParseUint(f[5], 10, 16)
+	if err := errors.Join(err1, err2, err3, err4); err != nil || s.Is4() != (f[1] == "TCP4") || d.Is4() != s.Is4() {
+		return nil, nil, errBadProxyHeader
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(s, uint16(sp))),
+		net.TCPAddrFromAddrPort(netip.AddrPortFrom(d, uint16(dp))), nil
+}
+
+func parseProxyV2(br *bufio.Reader) (src, dst net.Addr, err error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return nil, nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("%w: version %d", errBadProxyHeader, hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, nil, err
+	}
+	switch hdr[12] & 0xf {
+	case 0: // LOCAL, e.g. the load balancer's own health checks
+		return nil, nil, nil
+	case 1: // PROXY
+	default:
+		return nil, nil, fmt.Errorf("%w: command %d", errBadProxyHeader, hdr[12]&0xf)
+	}
+	var n int
+	switch hdr[13] {
+	case 0x11:
+		n = 4
+	case 0x21:
+		n = 16
+	default:
+		// Not TCP; the spec has us carry on with the real addresses
+		return nil, nil, nil
+	}
+	if len(body) < 2*n+4 {
+		return nil, nil, errBadProxyHeader
+	}
+	s, _ := netip.AddrFromSlice(body[:n])
+	d, _ := netip.AddrFromSlice(body[n : 2*n])
+	sp := binary.BigEndian.Uint16(body[2*n:])
+	dp := binary.BigEndian.Uint16(body[2*n+2:])
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(s.Unmap(), sp)),
+		net.TCPAddrFromAddrPort(netip.AddrPortFrom(d.Unmap(), dp)), nil
+}
@@ -0,0 +1,125 @@
+package clproxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type acceptRateSettings struct {
+	// -accept-rate caps how fast connections are accepted across every
+	// listener, with bursts of up to -accept-burst, as a blunt defence against
+	// connection storms. Past the rate, -accept-rate-action delay stops
+	// accepting for a while, leaving the kernel's backlog to absorb the burst,
+	// and close accepts connections and closes them straight away. Each
+	// connection accepted takes a token from a bucket, which costs a lock and a
+	// little arithmetic while there are tokens to spare.
+	acceptRate       float64
+	acceptBurst      int
+	acceptRateAction string
+}
+
+type acceptRateState struct {
+	// The accept rate limiter, nil without -accept-rate
+	acceptLimiter *tokenBucket
+
+	// Accepts which were delayed or closed, and when that last happened
+	acceptThrottled     atomic.Uint64
+	acceptLastThrottled atomic.Int64
+}
+
+// tokenBucket holds up to burst tokens, refilled at rate a second
+type tokenBucket struct {
+	sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// take takes a token if there is one, or says how long until there will be
+func (b *tokenBucket) take() (bool, time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+func (p *Proxy) setupAcceptRate() error {
+	if p.acceptRate < 0 || p.acceptBurst < 0 {
+		return fmt.Errorf("-accept-rate and -accept-burst can't be negative")
+	}
+	switch p.acceptRateAction {
+	case "delay", "close":
+	default:
+		return fmt.Errorf("unknown -accept-rate-action %q (want delay or close)", p.acceptRateAction)
+	}
+	if p.acceptRate == 0 {
+		return nil
+	}
+	burst := float64(p.acceptBurst)
+	if burst == 0 {
+		burst = max(1, p.acceptRate)
+	}
+	p.acceptLimiter = &tokenBucket{rate: p.acceptRate, burst: burst, tokens: burst, last: time.Now()}
+	return nil
+}
+
+// acceptWait holds an accept loop back until it may accept, with
+// -accept-rate-action delay
+func (p *Proxy) acceptWait() {
+	if p.acceptLimiter == nil || p.acceptRateAction != "delay" {
+		return
+	}
+	ok, wait := p.acceptLimiter.take()
+	if ok {
+		return
+	}
+	p.acceptThrottled.Add(1)
+	for !ok {
+		p.acceptLastThrottled.Store(time.Now().UnixNano())
+		time.Sleep(wait)
+		ok, wait = p.acceptLimiter.take()
+	}
+}
+
+// acceptAllowed reports whether a connection just accepted may be kept, and
+// closes it if not, with -accept-rate-action close
+func (p *Proxy) acceptAllowed(conn net.Conn) bool {
+	if p.acceptLimiter == nil || p.acceptRateAction != "close" {
+		return true
+	}
+	if ok, _ := p.acceptLimiter.take(); ok {
+		return true
+	}
+	p.acceptThrottled.Add(1)
+	p.acceptLastThrottled.Store(time.Now().UnixNano())
+	p.logRejection(p.remoteName(conn), conn, "accept_rate")
+	conn.Close()
+	return false
+}
+
+// statsAcceptRate adds the accept rate limiter to the stats summary. It is
+// throttling if it has held back an accept within the last second.
+func (p *Proxy) statsAcceptRate(w io.Writer) {
+	if p.acceptLimiter == nil {
+		return
+	}
+	state := "ok"
+	if time.Since(time.Unix(0, p.acceptLastThrottled.Load())) < time.Second {
+		state = "throttling"
+	}
+	p.acceptLimiter.Lock()
+	tokens := min(p.acceptLimiter.burst, p.acceptLimiter.tokens+time.Since(p.acceptLimiter.last).Seconds()*p.acceptLimiter.rate)
+	p.acceptLimiter.Unlock()
+	fmt.Fprintf(w, "accept_rate: state=%s action=%s tokens=%.0f throttled=%d\n", state, p.acceptRateAction, tokens, p.acceptThrottled.Load())
+}
@@ -0,0 +1,166 @@
+package clproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+type acmeCertSettings struct {
+	// With -acme-domains the certificates for TLS termination are obtained and
+	// renewed automatically from an ACME CA (Let's Encrypt unless
+	// -acme-directory says otherwise), answering the TLS-ALPN-01 challenge on
+	// our own TLS listeners, so those must be reachable on port 443 from the CA.
+	// Certificates are kept in acmeCache. When -tls-cert and -tls-key are given
+	// too, their certificate is served whenever an ACME one can't be had.
+	acmeDomains   string
+	acmeCache     string
+	acmeEmail     string
+	acmeDirectory string
+}
+
+type acmeCertState struct {
+	acmeManager *autocert.Manager
+
+	// What we know about each domain's certificate, for logging changes and
+	// for the stats
+	acmeState struct {
+		sync.Mutex
+		expires map[string]time.Time
+		errs    map[string]string
+	}
+}
+
+// How often we check on the certificates, which also starts issuance for
+// any we don't have yet
+const acmeCheckInterval = time.Hour
+
+// Warn when a certificate is this close to expiry, which means renewal (due
+// a month before) has been failing for a couple of weeks
+const acmeExpiryWarning = 14 * 24 * time.Hour
+
+// setupACME makes the ACME manager and the TLS config which uses it, keeping
+// any -tls-cert as the fallback
+func (p *Proxy) setupACME() error {
+	domains := splitList(p.acmeDomains)
+	if p.acmeCache == "" {
+		return errors.New("-acme-domains needs -acme-cache")
+	}
+	p.acmeManager = &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(p.acmeCache),
+		Email:      p.acmeEmail,
+	}
+	if p.acmeDirectory != "" {
+		p.acmeManager.Client = &acme.Client{DirectoryURL: p.acmeDirectory}
+	}
+	fallback := p.tlsConfig != nil
+	if !fallback {
+		p.tlsConfig = &tls.Config{}
+	}
+	p.tlsConfig.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert, err := p.acmeManager.GetCertificate(hello)
+		if err == nil || !fallback {
+			return cert, err
+		}
+		p.logger.Debug("acme certificate unavailable, using -tls-cert", "sni", hello.ServerName, "error", err.Error())
+		return p.tlsKeypair.Load(), nil
+	}
+	// Only offer the challenge protocol to the CA, so that ordinary
+	// clients' ALPN offers don't fail the handshake. The CA has no client
+	// certificate to give.
+	challenge := p.tlsConfig.Clone()
+	challenge.NextProtos = []string{acme.ALPNProto}
+	challenge.ClientAuth = tls.NoClientCert
+	p.tlsConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if slices.Contains(hello.SupportedProtos, acme.ALPNProto) {
+			return challenge, nil
+		}
+		return nil, nil
+	}
+	p.background = append(p.background, func() { p.watchACME(domains) })
+	return nil
+}
+
+// isACMEChallenge reports whether a handshake was the CA checking the
+// TLS-ALPN-01 challenge, which ends there rather than being proxied
+func (p *Proxy) isACMEChallenge(tc *tls.Conn) bool {
+	return p.acmeManager != nil && tc.ConnectionState().NegotiatedProtocol == acme.ALPNProto
+}
+
+// watchACME asks for each domain's certificate every acmeCheckInterval,
+// which gets it issued or renewed as needed, and logs what changed
+func (p *Proxy) watchACME(domains []string) {
+	for {
+		for _, d := range domains {
+			p.checkACME(d)
+		}
+		if !p.sleep(acmeCheckInterval) {
+			return
+		}
+	}
+}
+
+func (p *Proxy) checkACME(domain string) {
+	// Ask as a modern client would so we get the ECDSA certificate the
+	// clients will be served
+	cert, err := p.acmeManager.GetCertificate(&tls.ClientHelloInfo{
+		ServerName:       domain,
+		CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		SupportedCurves:  []tls.CurveID{tls.CurveP256},
+	})
+	var leaf *x509.Certificate
+	if err == nil {
+		if leaf = cert.Leaf; leaf == nil {
+			leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		}
+	}
+	p.acmeState.Lock()
+	defer p.acmeState.Unlock()
+	if err != nil {
+		if p.acmeState.errs[domain] != err.Error() {
+			p.logger.Error("acme certificate request failed", "domain", domain, "error", err.Error())
+		}
+		p.acmeState.errs[domain] = err.Error()
+		return
+	}
+	delete(p.acmeState.errs, domain)
+	old, ok := p.acmeState.expires[domain]
+	switch {
+	case !ok:
+		p.logger.Info("acme certificate loaded", "domain", domain, "expires", leaf.NotAfter.Format(time.RFC3339))
+	case !old.Equal(leaf.NotAfter):
+		p.logger.Info("acme certificate renewed", "domain", domain, "expires", leaf.NotAfter.Format(time.RFC3339))
+	}
+	p.acmeState.expires[domain] = leaf.NotAfter
+	if time.Until(leaf.NotAfter) < acmeExpiryWarning {
+		p.logger.Warn("acme certificate expires soon and hasn't been renewed", "domain", domain, "expires", leaf.NotAfter.Format(time.RFC3339))
+	}
+}
+
+// statsACME adds each domain's certificate expiry to the stats summary
+func (p *Proxy) statsACME(w io.Writer) {
+	if p.acmeManager == nil {
+		return
+	}
+	p.acmeState.Lock()
+	defer p.acmeState.Unlock()
+	for _, d := range splitList(p.acmeDomains) {
+		exp, ok := p.acmeState.expires[d]
+		if !ok {
+			fmt.Fprintf(w, "acme: domain=%s expires=none error=%q\n", d, p.acmeState.errs[d])
+			continue
+		}
+		fmt.Fprintf(w, "acme: domain=%s expires=%s days_left=%.1f\n", d, exp.Format(time.RFC3339), time.Until(exp).Hours()/24)
+	}
+}
@@ -0,0 +1,23 @@
+package clproxy
+
+import (
+	"net"
+	"net/netip"
+)
+
+// addrIP returns the IP address of a net.Addr, with IPv4-mapped IPv6
+// addresses turned back into plain IPv4 so that rules written either way
+// match. ok is false for addresses which aren't IP based.
+func addrIP(a net.Addr) (ip netip.Addr, ok bool) {
+	switch a := a.(type) {
+	case *net.TCPAddr:
+		ip, ok = netip.AddrFromSlice(a.IP)
+	case *net.UDPAddr:
+		ip, ok = netip.AddrFromSlice(a.IP)
+	default:
+		var ap netip.AddrPort
+		ap, err := netip.ParseAddrPort(a.String())
+		ip, ok = ap.Addr(), err == nil
+	}
+	return ip.Unmap(), ok
+}
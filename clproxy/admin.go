@@ -0,0 +1,163 @@
+package clproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type adminSettings struct {
+	// Access control for the stats port. Commands which change anything, rather
+	// than just report, need -stats-token when it is set, given by prefixing the
+	// command with "auth <token>", whatever the stats port is listening on. Put
+	// the stats port on a Unix socket alone with -s unix:///path, and
+	// -stats-unix-perm and -stats-unix-group restrict who can connect to it at
+	// all. Every command which would change something is written to the audit
+	// log, -stats-audit-log or else the operational log, with where it came from
+	// (the peer's pid, uid, and gid on a Linux Unix socket) and how it went.
+	statsToken        string
+	statsUnixPerm     fileMode
+	statsUnixGroup    string
+	statsAuditLogName string
+
+	// How long a stats client gets to take its answer, and how many may be
+	// connected at once
+	statsWriteTimeout time.Duration
+	statsMaxConns     int
+}
+
+type adminState struct {
+	statsConns atomic.Int64
+
+	auditLog *slog.Logger
+}
+
+// statsMutating holds the commands which change something when given at
+// least this many arguments. "trace" alone lists the traced addresses, while
+// "trace <ip>" adds one.
+var statsMutating = map[string]int{
+	"trace":      1,
+	"untrace":    0,
+	"loglevel":   1,
+	"quiet":      1,
+	"health":     0,
+	"disable":    0,
+	"enable":     0,
+	"set":        0,
+	"canary":     1,
+	"unban":      0,
+	"chaos":      1,
+	"capture":    1,
+	"uncapture":  0,
+	"throttle":   0,
+	"unthrottle": 0,
+}
+
+// setupStatsAudit opens -stats-audit-log, which is JSON like the access log
+func (p *Proxy) setupStatsAudit() (*reopenableFile, error) {
+	if p.statsAuditLogName == "" {
+		return nil, nil
+	}
+	f, err := p.openLogFile(p.statsAuditLogName)
+	if err != nil {
+		return nil, err
+	}
+	p.auditLog = slog.New(slog.NewJSONHandler(f, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	return f, nil
+}
+
+// statsAdmit counts a stats connection in, turning it away if there are
+// already -stats-max-conns
+func (p *Proxy) statsAdmit(c net.Conn) bool {
+	if p.statsMaxConns > 0 && p.statsConns.Add(1) > int64(p.statsMaxConns) {
+		p.statsConns.Add(-1)
+		c.SetWriteDeadline(time.Now().Add(statsReadTimeout))
+		fmt.Fprintln(c, "error: too many stats connections")
+		c.Close()
+		return false
+	}
+	return true
+}
+
+func (p *Proxy) statsDone() {
+	if p.statsMaxConns > 0 {
+		p.statsConns.Add(-1)
+	}
+}
+
+// statsAuth takes "auth <token>" off the front of args, reporting whether
+// the command may go ahead and what's left of it
+func (p *Proxy) statsAuth(w io.Writer, src string, args []string) ([]string, bool) {
+	authed := false
+	if args[0] == "auth" {
+		if len(args) < 3 {
+			fmt.Fprintln(w, "error: usage: auth <token> <command> [args]")
+			return nil, false
+		}
+		if p.statsToken == "" || subtle.ConstantTimeCompare([]byte(args[1]), []byte(p.statsToken)) != 1 {
+			p.audit(src, args[2:], "denied", "bad token")
+			fmt.Fprintln(w, "error: bad token")
+			return nil, false
+		}
+		authed, args = true, args[2:]
+	}
+	if n, ok := statsMutating[args[0]]; ok && len(args)-1 >= n && p.statsToken != "" && !authed {
+		p.audit(src, args, "denied", "no token")
+		fmt.Fprintf(w, "error: %s needs auth <token>\n", args[0])
+		return nil, false
+	}
+	return args, true
+}
+
+// auditWriter keeps the first line of a command's answer, which starts
+// "error:" if it failed
+type auditWriter struct {
+	io.Writer
+	first []byte
+	done  bool
+}
+
+func (a *auditWriter) Write(p []byte) (int, error) {
+	if !a.done {
+		line, _, found := bytes.Cut(p, []byte("\n"))
+		a.first = append(a.first, line...)
+		a.done = found
+	}
+	return a.Writer.Write(p)
+}
+
+// runStats runs a command, auditing it if it changes anything
+func (p *Proxy) runStats(w io.Writer, src string, cmd func(io.Writer, []string), args []string) {
+	n, mutating := statsMutating[args[0]]
+	if !mutating || len(args)-1 < n {
+		cmd(w, args[1:])
+		return
+	}
+	aw := &auditWriter{Writer: w}
+	cmd(aw, args[1:])
+	if msg, failed := strings.CutPrefix(string(aw.first), "error: "); failed {
+		p.audit(src, args, "error", msg)
+		return
+	}
+	p.audit(src, args, "ok", "")
+}
+
+// audit logs a command which would change something
+func (p *Proxy) audit(src string, args []string, outcome, msg string) {
+	l := p.auditLog
+	if l == nil {
+		l = p.logger
+	}
+	logArgs := []any{"source", src, "command", strings.Join(args, " "), "outcome", outcome}
+	if msg != "" {
+		logArgs = append(logArgs, "error", msg)
+	}
+	l.Log(context.Background(), slog.LevelInfo, "stats command", logArgs...)
+}
@@ -0,0 +1,212 @@
+package clproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type autobanSettings struct {
+	// With -autoban-threshold a client address which racks up that many strikes
+	// within -autoban-window is banned for -autoban-duration: its connections are
+	// closed as soon as they are accepted, before anything else is done with
+	// them. A strike is a connection we turned away after seeing its address,
+	// for a failed TLS handshake or a rejected SNI, -dynamic-dest, or SOCKS
+	// request, or a session which ended without a byte sent either way, as a
+	// client stuck reconnecting makes. Dial failures are the backends' doing and
+	// waiting in the queue is the limiter's, so neither counts. Bans are logged
+	// as they start and end, and can be listed and lifted on the stats port.
+	autobanThreshold int
+	autobanWindow    time.Duration
+	autobanDuration  time.Duration
+}
+
+type autobanState struct {
+	autoban struct {
+		sync.Mutex
+		m map[netip.Addr]*strikes
+	}
+
+	// Connections refused because their address was banned, and bans so far
+	bannedRefused atomic.Uint64
+	bansStarted   atomic.Uint64
+}
+
+// How many addresses to keep strikes and bans for, so that a flood of
+// addresses can't use up our memory
+const autobanMaxTracked = 65536
+
+type strikes struct {
+	since  time.Time // when the window started
+	count  int
+	banned time.Time // when the ban started, zero if there is none
+	expiry *time.Timer
+}
+
+func (p *Proxy) setupAutoban() error {
+	if p.autobanThreshold > 0 && (p.autobanWindow <= 0 || p.autobanDuration <= 0) {
+		return errors.New("-autoban-window and -autoban-duration must be positive")
+	}
+	return nil
+}
+
+// banned reports whether conn's address is banned, counting it if so
+func (p *Proxy) banned(conn net.Conn) bool {
+	if p.autobanThreshold <= 0 {
+		return false
+	}
+	ip, ok := addrIP(conn.RemoteAddr())
+	if !ok {
+		return false
+	}
+	p.autoban.Lock()
+	s := p.autoban.m[ip]
+	isBanned := s != nil && !s.banned.IsZero()
+	p.autoban.Unlock()
+	if isBanned {
+		p.bannedRefused.Add(1)
+		p.logRejection(p.remoteName(conn), conn, "banned", "action", p.denyAction)
+	}
+	return isBanned
+}
+
+// strike counts a strike against conn's address, banning it if that's one
+// too many
+func (p *Proxy) strike(conn net.Conn, why string) {
+	if p.autobanThreshold <= 0 {
+		return
+	}
+	ip, ok := addrIP(conn.RemoteAddr())
+	if !ok {
+		return
+	}
+	now := time.Now()
+	p.autoban.Lock()
+	s := p.autoban.m[ip]
+	if s == nil {
+		if len(p.autoban.m) >= autobanMaxTracked {
+			p.sweepStrikes(now)
+		}
+		if len(p.autoban.m) >= autobanMaxTracked {
+			p.autoban.Unlock()
+			return
+		}
+		s = &strikes{since: now}
+		p.autoban.m[ip] = s
+	}
+	if !s.banned.IsZero() {
+		p.autoban.Unlock()
+		return
+	}
+	if now.Sub(s.since) > p.autobanWindow {
+		s.since, s.count = now, 0
+	}
+	s.count++
+	count := s.count
+	if count >= p.autobanThreshold {
+		s.banned = now
+		s.expiry = time.AfterFunc(p.autobanDuration, func() { p.expireBan(ip, s) })
+	}
+	p.autoban.Unlock()
+	if count >= p.autobanThreshold {
+		p.bansStarted.Add(1)
+		p.logger.Warn("client banned", "client", ip.String(), "strikes", count, "last", why, "until", now.Add(p.autobanDuration).Format(time.RFC3339))
+	}
+}
+
+// sweepStrikes forgets addresses which aren't banned and whose window has
+// passed. The caller holds autoban's lock.
+func (p *Proxy) sweepStrikes(now time.Time) {
+	for ip, s := range p.autoban.m {
+		if s.banned.IsZero() && now.Sub(s.since) > p.autobanWindow {
+			delete(p.autoban.m, ip)
+		}
+	}
+}
+
+func (p *Proxy) expireBan(ip netip.Addr, s *strikes) {
+	p.autoban.Lock()
+	current := p.autoban.m[ip] == s
+	if current {
+		delete(p.autoban.m, ip)
+	}
+	p.autoban.Unlock()
+	if current {
+		p.logger.Info("client ban expired", "client", ip.String())
+	}
+}
+
+// statsBans answers "bans" on the stats port
+func (p *Proxy) statsBans(w io.Writer, args []string) {
+	if len(args) != 0 {
+		fmt.Fprintln(w, "error: usage: bans")
+		return
+	}
+	type ban struct {
+		ip    netip.Addr
+		since time.Time
+	}
+	var bans []ban
+	p.autoban.Lock()
+	for ip, s := range p.autoban.m {
+		if !s.banned.IsZero() {
+			bans = append(bans, ban{ip, s.banned})
+		}
+	}
+	p.autoban.Unlock()
+	slices.SortFunc(bans, func(a, b ban) int { return a.since.Compare(b.since) })
+	for _, b := range bans {
+		fmt.Fprintf(w, "client=%s since=%s remaining=%.0f\n", b.ip, b.since.Format(time.RFC3339), time.Until(b.since.Add(p.autobanDuration)).Seconds())
+	}
+}
+
+// statsUnban answers "unban <ip>" on the stats port
+func (p *Proxy) statsUnban(w io.Writer, args []string) {
+	if len(args) != 1 {
+		fmt.Fprintln(w, "error: usage: unban <ip>")
+		return
+	}
+	ip, err := netip.ParseAddr(args[0])
+	if err != nil {
+		fmt.Fprintf(w, "error: bad address %q\n", args[0])
+		return
+	}
+	ip = ip.Unmap()
+	p.autoban.Lock()
+	s := p.autoban.m[ip]
+	isBanned := s != nil && !s.banned.IsZero()
+	if isBanned {
+		s.expiry.Stop()
+		delete(p.autoban.m, ip)
+	}
+	p.autoban.Unlock()
+	if !isBanned {
+		fmt.Fprintf(w, "error: %s is not banned\n", ip)
+		return
+	}
+	p.logger.Info("client unbanned", "client", ip.String())
+	fmt.Fprintf(w, "unbanned %s\n", ip)
+}
+
+// statsAutoban adds the bans to the stats summary
+func (p *Proxy) statsAutoban(w io.Writer) {
+	if p.autobanThreshold <= 0 {
+		return
+	}
+	p.autoban.Lock()
+	active := 0
+	for _, s := range p.autoban.m {
+		if !s.banned.IsZero() {
+			active++
+		}
+	}
+	tracked := len(p.autoban.m)
+	p.autoban.Unlock()
+	fmt.Fprintf(w, "bans: active=%d started=%d refused=%d tracked=%d\n", active, p.bansStarted.Load(), p.bannedRefused.Load(), tracked)
+}
@@ -0,0 +1,303 @@
+package clproxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// backend holds the counters for a single backend address. Connections keep
+// a pointer to the backend they were dialed against, so its counters stay
+// correct even if the backend is dropped from the set while they run.
+type backend struct {
+	p      *Proxy
+	addr   string
+	spec   string      // the configured name addr was resolved from
+	backup atomic.Bool // only used when no primary backend will do; a reload may change it
+
+	// What to hand to the dialer for addr
+	network, path string
+
+	weight  atomic.Int64 // share of sessions relative to the other backends
+	current int64        // smooth weighted round-robin state, under pickLock
+
+	active   atomic.Int64 // sessions assigned to us, including any still dialing
+	sessions atomic.Uint64
+	errors   atomic.Uint64
+	dialTime atomic.Int64 // nanoseconds spent in successful dials
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+
+	failovers atomic.Uint64 // sessions served by this backup
+
+	// Health, see health.go. rise and fall belong to the health checker.
+	down     atomic.Bool
+	override atomic.Int32
+	rise     int
+	fall     int
+
+	// Disabled through the stats port, see maint.go
+	maint atomic.Bool
+
+	circuit breaker
+
+	// Connections dialed ahead of time, see pool.go
+	pool connPool
+
+	// Dropped from the set but still serving sessions, see drain.go
+	drain drainState
+}
+
+// dialed records the outcome of a dial against this backend
+func (b *backend) dialed(took time.Duration, err error) {
+	if err != nil {
+		b.errors.Add(1)
+		b.circuit.record(b.addr, true)
+		b.p.canary.record(b, true)
+		return
+	}
+	b.sessions.Add(1)
+	b.dialTime.Add(int64(took))
+}
+
+// closed records the end of a session which dialed this backend successfully
+func (b *backend) closed(in, out int64, failed bool) {
+	b.circuit.record(b.addr, failed)
+	b.p.canary.record(b, failed)
+	b.bytesIn.Add(in)
+	b.bytesOut.Add(out)
+}
+
+func (b *backend) String() string {
+	sessions := b.sessions.Load()
+	dial := 0.0
+	if sessions > 0 {
+		dial = time.Duration(b.dialTime.Load() / int64(sessions)).Seconds()
+	}
+	role := "primary"
+	if b.backup.Load() {
+		role = "backup"
+	}
+	out := fmt.Sprintf(
+		"backend=%s role=%s weight=%d %s %s circuit=%s active=%d sessions=%d failovers=%d errors=%d dial_avg=%f in=%d out=%d",
+		b.addr,
+		role,
+		b.weight.Load(),
+		b.maintString(),
+		b.healthString(),
+		b.circuit.String(),
+		b.active.Load(),
+		sessions,
+		b.failovers.Load(),
+		b.errors.Load(),
+		dial,
+		b.bytesIn.Load(),
+		b.bytesOut.Load())
+	if b.p.poolSize > 0 {
+		out += fmt.Sprintf(" pooled=%d", b.pool.len())
+	}
+	return out
+}
+
+// newBackend makes a backend for addr, which has yet to be given a weight
+func (p *Proxy) newBackend(addr string) *backend {
+	b := &backend{p: p, addr: addr, spec: addr}
+	b.circuit.p = p
+	b.network, b.path = DialAddr(addr)
+	return b
+}
+
+// newBackendSet makes an empty set of backends, chosen between by -balance
+func (p *Proxy) newBackendSet() *backendSet {
+	return &backendSet{p: p, m: map[string]*backend{}, balance: p.balance}
+}
+
+// backendSet is the collection of backends we know about, keyed by address
+// and kept in the order they were configured
+type backendSet struct {
+	sync.RWMutex
+	p       *Proxy
+	m       map[string]*backend
+	order   []*backend
+	ring    hashRing
+	balance string
+
+	// The configured backends, before resolution, and the last good
+	// resolution of each hostname among them. Guarded by resolveLock.
+	primarySpecs, backupSpecs []string
+	lastResolved              map[string][]string
+
+	// The weight and SRV target of each address from the last good SRV
+	// lookups
+	lastWeights map[string]int
+	lastFrom    map[string]string
+
+	// Where the primary backends come from with -backends-file, the file as
+	// last read, and the last problem reading it. Also guarded by
+	// resolveLock.
+	file     string
+	fileInfo os.FileInfo
+	fileErr  string
+
+	// Backends dropped from the set which still have sessions, under the
+	// set's own lock
+	draining []*backend
+
+	// Whether set backend has replaced the primaries, and the replaced
+	// backends which still had sessions, see setbackend.go. Also guarded by
+	// resolveLock.
+	setBackend bool
+	retired    []*backend
+}
+
+// lookup returns the backend for addr, if it is one we know about
+func (s *backendSet) lookup(addr string) (*backend, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	b, ok := s.m[addr]
+	return b, ok
+}
+
+// set replaces the known backends with the primary and backup addresses.
+// specs maps each address to the configured name it came from, if that was
+// different, and weights to its weight if that isn't 1. Backends which remain
+// keep their counters and sessions, and just take on the new weight; removed
+// ones are forgotten here but stay valid for any connections still holding
+// them.
+func (s *backendSet) set(primary, backup []string, specs map[string]string, weights map[string]int) {
+	s.Lock()
+	defer s.Unlock()
+	m := make(map[string]*backend, len(primary)+len(backup))
+	order := make([]*backend, 0, len(primary)+len(backup))
+	var primaries []*backend
+	for i, addr := range append(append([]string(nil), primary...), backup...) {
+		if _, dup := m[addr]; dup {
+			continue
+		}
+		b, ok := s.m[addr]
+		if !ok {
+			b = s.p.newBackend(addr)
+			if spec, ok := specs[addr]; ok {
+				b.spec = spec
+			}
+		}
+		b.backup.Store(i >= len(primary))
+		b.weight.Store(int64(max(weights[addr], 1)))
+		m[addr] = b
+		order = append(order, b)
+		if !b.backup.Load() {
+			primaries = append(primaries, b)
+		}
+	}
+	for addr, b := range s.m {
+		if _, ok := m[addr]; !ok {
+			b.pool.drain()
+			if b.startDrain() {
+				s.draining = append(s.draining, b)
+			}
+		}
+	}
+	s.m = m
+	s.order = order
+	s.ring = newHashRing(primaries)
+}
+
+// sibling returns an available backend resolved from the same name as b
+// but of the other address family, if there is one
+func (s *backendSet) sibling(b *backend) *backend {
+	s.RLock()
+	defer s.RUnlock()
+	var best *backend
+	for _, o := range s.order {
+		if o.spec != b.spec || o.backup.Load() != b.backup.Load() || o.isIPv6() == b.isIPv6() || !o.available() {
+			continue
+		}
+		if best == nil || o.active.Load() < best.active.Load() {
+			best = o
+		}
+	}
+	return best
+}
+
+func (b *backend) isIPv6() bool {
+	host, _, _ := net.SplitHostPort(b.addr)
+	ip := net.ParseIP(host)
+	return ip != nil && ip.To4() == nil
+}
+
+// candidates returns the available primary or backup backends, in
+// configured order
+func (s *backendSet) candidates(backup bool) []*backend {
+	s.RLock()
+	defer s.RUnlock()
+	var out []*backend
+	for _, b := range s.order {
+		if b.backup.Load() == backup && b.available() {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// hashRing returns the consistent hashing ring over the current backends
+func (s *backendSet) hashRing() hashRing {
+	s.RLock()
+	defer s.RUnlock()
+	return s.ring
+}
+
+// weights lists the backends' weights as addr=weight, in configured order
+func (s *backendSet) weights() []string {
+	var out []string
+	for _, b := range s.list() {
+		out = append(out, b.addr+"="+strconv.FormatInt(b.weight.Load(), 10))
+	}
+	return out
+}
+
+// list returns the known backends in configured order
+func (s *backendSet) list() []*backend {
+	s.RLock()
+	defer s.RUnlock()
+	return append([]*backend(nil), s.order...)
+}
+
+// find returns the backend with addr, or nil if there isn't one
+func (s *backendSet) find(addr string) *backend {
+	s.RLock()
+	defer s.RUnlock()
+	return s.m[addr]
+}
+
+// statsBackends answers "backends" on the stats port
+func (p *Proxy) statsBackends(w io.Writer, args []string) {
+	for _, rt := range p.allRoutes() {
+		bs := append(rt.backends.list(), rt.backends.drainingList()...)
+		// Each backend's share of the route's sessions, to compare with
+		// its share of the weight
+		var total uint64
+		for _, b := range bs {
+			total += b.sessions.Load()
+		}
+		for _, b := range bs {
+			if rt.name != "" {
+				fmt.Fprintf(w, "route=%s ", rt.name)
+			}
+			share := 0.0
+			if total > 0 {
+				share = float64(b.sessions.Load()) / float64(total)
+			}
+			fmt.Fprintf(w, "%s share=%.3f\n", b, share)
+		}
+	}
+	p.statsSNI(w)
+	p.statsOriginalDst(w)
+	p.statsDynamic(w)
+	p.statsPicked(w)
+	p.statsSOCKSServer(w)
+}
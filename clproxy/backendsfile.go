@@ -0,0 +1,111 @@
+package clproxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type backendsFileSettings struct {
+	// With -backends-file the primary backends are read from a file instead of
+	// -p, one "host:port [weight]" per line with # starting a comment, and the
+	// file is read again whenever it changes. A file which doesn't parse is
+	// rejected as a whole and the backends we have are kept.
+	backendsFile string
+}
+
+// How often to look for changes to backends files
+const backendsFilePoll = 2 * time.Second
+
+// readBackendsFile parses a backends file into backend specs, as -p would
+// take them
+func readBackendsFile(path string) ([]string, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var specs []string
+	sc := bufio.NewScanner(bytes.NewReader(buf))
+	for n := 1; sc.Scan(); n++ {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("%s:%d: want host:port [weight]", path, n)
+		}
+		addr := fields[0]
+		if !strings.HasPrefix(addr, unixPrefix) && !isWebSocketURL(addr) {
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+			}
+		}
+		if len(fields) == 2 {
+			if w, err := strconv.Atoi(fields[1]); err != nil || w < 1 {
+				return nil, fmt.Errorf("%s:%d: invalid weight %q", path, n, fields[1])
+			}
+			addr += "=" + fields[1]
+		}
+		specs = append(specs, addr)
+	}
+	return specs, sc.Err()
+}
+
+// loadBackendsFile reads s's backends file if it has changed since it was
+// last read, and reports whether it did. The caller holds resolveLock.
+func (s *backendSet) loadBackendsFile() (bool, error) {
+	fi, err := os.Stat(s.file)
+	if err != nil {
+		return false, err
+	}
+	if s.fileInfo != nil && fi.ModTime().Equal(s.fileInfo.ModTime()) && fi.Size() == s.fileInfo.Size() {
+		return false, nil
+	}
+	s.fileInfo = fi
+	specs, err := readBackendsFile(s.file)
+	if err != nil {
+		return false, err
+	}
+	s.primarySpecs = specs
+	return true, nil
+}
+
+// watchBackendsFiles applies changes to any route's backends file
+func (p *Proxy) watchBackendsFiles() {
+	for range p.ticks(backendsFilePoll) {
+		for _, rt := range p.allRoutes() {
+			s := rt.backends
+			p.resolveLock.Lock()
+			if s.file == "" {
+				p.resolveLock.Unlock()
+				continue
+			}
+			file := s.file
+			changed, err := s.loadBackendsFile()
+			// Only complain about a problem once, not every poll
+			repeated := err != nil && err.Error() == s.fileErr
+			s.fileErr = errString(err)
+			p.resolveLock.Unlock()
+			args := []any{"file", file}
+			if rt.name != "" {
+				args = append(args, "route", rt.name)
+			}
+			if err != nil {
+				if !repeated {
+					p.logger.Error("backends file rejected, keeping the previous backends", append(args, "error", err.Error())...)
+				}
+				continue
+			}
+			if changed {
+				p.logger.Info("backends file changed", args...)
+				s.resolve(rt.name)
+			}
+		}
+	}
+}
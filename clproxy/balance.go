@@ -0,0 +1,272 @@
+package clproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type balanceSettings struct {
+	// How to choose a backend for each connection when there are several
+	balance string
+}
+
+type balanceState struct {
+	// pickLock makes choosing a backend and counting the session against it one
+	// step, so that concurrent connections can't all see the same backend as
+	// the least loaded one.
+	pickLock sync.Mutex
+
+	// Backends picked by a balancer which aren't any route's, by address
+	picked struct {
+		sync.Mutex
+		m map[string]*backendSet
+	}
+
+	// The built in policies and those from Options, by name
+	balancers map[string]Balancer
+}
+
+var errNoBackends = errors.New("no backends available")
+
+// A Balancer chooses the backend for each session, for service discovery
+// of a program's own, say. The policies -balance names are Balancers, and
+// Options.Balancers adds more for -balance to name.
+//
+// Pick returns the address for the session described by info, usually one
+// of candidates, the route's available backends not yet tried, of which
+// there is always at least one. An address that isn't one of the route's
+// backends is dialed all the same, and listed by "backends" on the stats
+// port as a picked_backend; one that is but isn't a candidate is refused.
+// An error from Pick fails the session as having no backends would. ctx
+// ends with the session's -dial-timeout.
+//
+// Pick is called with a lock held, so picks never run at once, even for
+// different routes, and a Balancer needs no locking for state only Pick
+// touches; but every session waits on it, so it must be quick: one which asks
+// another service should keep the answer up to date in the background
+// rather than ask in Pick. Success and Failure report how each dial and
+// session went on the backend at addr, for passive health checks of the
+// Balancer's own; they are called without any lock held, from many sessions
+// at once.
+type Balancer interface {
+	Pick(ctx context.Context, info ConnInfo, candidates []Candidate) (string, error)
+	Success(addr string)
+	Failure(addr string, err error)
+}
+
+// A Candidate is a backend a Balancer may pick
+type Candidate struct {
+	Addr   string
+	Weight int64 // its share of sessions relative to the other backends
+	Active int64 // sessions on it now, including any still dialing
+	Backup bool  // only offered when no primary is available
+
+	b *backend
+}
+
+// policy makes a built in policy a Balancer. They rely on the health checks
+// and circuit breakers rather than feedback of their own.
+type policy func(s *backendSet, candidates []*backend, info ConnInfo) *backend
+
+func (p policy) Pick(ctx context.Context, info ConnInfo, candidates []Candidate) (string, error) {
+	bs := make([]*backend, len(candidates))
+	for i, c := range candidates {
+		bs[i] = c.b
+	}
+	return p(info.set, bs, info).addr, nil
+}
+
+func (policy) Success(addr string)            {}
+func (policy) Failure(addr string, err error) {}
+
+// The built in policies, by the name -balance gives them
+var policies = map[string]Balancer{
+	"roundrobin":  policy(pickRoundRobin),
+	"leastconn":   policy(pickLeastConn),
+	"source-hash": policy(pickSourceHash),
+}
+
+// pickRoundRobin takes turns between the candidates in proportion to their
+// weights, using smooth weighted round-robin so that a heavy backend's turns
+// are spread out rather than bunched together. With equal weights this is
+// plain round-robin.
+func pickRoundRobin(s *backendSet, candidates []*backend, info ConnInfo) *backend {
+	var best *backend
+	var total int64
+	for _, b := range candidates {
+		w := b.weight.Load()
+		b.current += w
+		total += w
+		if best == nil || b.current > best.current {
+			best = b
+		}
+	}
+	best.current -= total
+	return best
+}
+
+// pickLeastConn chooses the backend with the fewest active sessions for its
+// weight, breaking ties at random
+func pickLeastConn(s *backendSet, candidates []*backend, info ConnInfo) *backend {
+	var best []*backend
+	var least, leastWeight int64
+	for _, b := range candidates {
+		n, w := b.active.Load(), b.weight.Load()
+		// n/w against least/leastWeight, without the division
+		switch {
+		case best == nil || n*leastWeight < least*w:
+			least, leastWeight = n, w
+			best = append(best[:0], b)
+		case n*leastWeight == least*w:
+			best = append(best, b)
+		}
+	}
+	return best[rand.IntN(len(best))]
+}
+
+// pick chooses the backend for c according to the balancing policy and
+// counts c as active on it. Backups are only chosen when there are no
+// primaries to choose from, and -canary may take the session instead. The
+// session must be given back with release.
+func (s *backendSet) pick(c *client) (*backend, error) {
+	if b := s.p.canary.pick(s); b != nil {
+		return b, nil
+	}
+	if b, err := s.pickFrom(c, false, nil); err == nil {
+		return b, nil
+	}
+	return s.pickFrom(c, true, nil)
+}
+
+// pickFrom picks among the primary or backup backends, leaving out those in
+// skip
+func (s *backendSet) pickFrom(c *client, backup bool, skip []*backend) (*backend, error) {
+	candidates := slices.DeleteFunc(s.candidates(backup), func(b *backend) bool {
+		return slices.Contains(skip, b)
+	})
+	if len(candidates) == 0 {
+		return nil, errNoBackends
+	}
+	ctx, cancel := c.dialContext()
+	defer cancel()
+	info := c.info()
+	info.set = s
+	s.p.pickLock.Lock()
+	defer s.p.pickLock.Unlock()
+	offered := make([]Candidate, len(candidates))
+	for i, b := range candidates {
+		offered[i] = Candidate{Addr: b.addr, Weight: b.weight.Load(), Active: b.active.Load(), Backup: backup, b: b}
+	}
+	addr, err := s.p.balancers[s.balance].Pick(ctx, info, offered)
+	if err != nil {
+		return nil, err
+	}
+	// One of the route's backends must be a candidate, and any other not
+	// already tried
+	b := s.find(addr)
+	if b == nil {
+		b = s.p.pickedBackend(addr)
+	} else if !slices.Contains(candidates, b) {
+		b = nil
+	}
+	if b == nil || slices.Contains(skip, b) {
+		return nil, fmt.Errorf("balancer picked %s, which isn't available", addr)
+	}
+	b.active.Add(1)
+	c.probing(b, b.circuit.admit())
+	return b, nil
+}
+
+// feedback tells the balancer of c's route how c's dial or session on b
+// went, err being nil if it went well
+func (c *client) feedback(b *backend, err error) {
+	bal := c.p.balancers[c.pool().balance]
+	if err != nil {
+		bal.Failure(b.addr, err)
+	} else {
+		bal.Success(b.addr)
+	}
+}
+
+// pickedBackend returns the backend for addr, which a balancer picked from
+// outside the route's backends, making one if it's new. Like -original-dst
+// destinations, they are kept for their counters, and aren't health checked.
+func (p *Proxy) pickedBackend(addr string) *backend {
+	p.picked.Lock()
+	defer p.picked.Unlock()
+	s, ok := p.picked.m[addr]
+	if !ok {
+		s = p.newBackendSet()
+		s.set([]string{addr}, nil, nil, nil)
+		p.picked.m[addr] = s
+	}
+	return s.list()[0]
+}
+
+// statsPicked lists the backends picked from outside the routes'
+func (p *Proxy) statsPicked(w io.Writer) {
+	p.picked.Lock()
+	sets := make([]*backendSet, 0, len(p.picked.m))
+	for _, s := range p.picked.m {
+		sets = append(sets, s)
+	}
+	p.picked.Unlock()
+	for _, s := range sets {
+		for _, b := range s.list() {
+			fmt.Fprintf(w, "picked_backend %s\n", b)
+		}
+	}
+}
+
+// release ends a session counted against b by pick
+func (b *backend) release() {
+	b.active.Add(-1)
+	b.checkDrained()
+}
+
+// splitWeight splits the weight off a backend given as addr=weight. Backends
+// without one have a weight of 1.
+func splitWeight(spec string) (addr string, weight int, err error) {
+	i := strings.LastIndex(spec, "=")
+	if i < 0 {
+		return spec, 1, nil
+	}
+	if _, err := strconv.Atoi(spec[i+1:]); err != nil && isWebSocketURL(spec) {
+		// Part of the URL's query
+		return spec, 1, nil
+	}
+	addr = spec[:i]
+	weight, err = strconv.Atoi(spec[i+1:])
+	if err != nil || weight < 1 {
+		return spec, 0, fmt.Errorf("invalid weight in backend %q", spec)
+	}
+	return addr, weight, nil
+}
+
+// checkWeights rejects backend lists with a malformed weight
+func checkWeights(specs []string) error {
+	for _, spec := range specs {
+		if _, _, err := splitWeight(spec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitList splits a comma separated flag value, dropping empty entries
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
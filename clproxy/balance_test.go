@@ -0,0 +1,82 @@
+package clproxy
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+)
+
+// lastBalancer always picks the last candidate, and records its feedback
+type lastBalancer struct {
+	sync.Mutex
+	offered []Candidate
+	success []string
+}
+
+func (b *lastBalancer) Pick(ctx context.Context, info ConnInfo, candidates []Candidate) (string, error) {
+	b.offered = candidates
+	return candidates[len(candidates)-1].Addr, nil
+}
+
+func (b *lastBalancer) Success(addr string) {
+	b.Lock()
+	defer b.Unlock()
+	b.success = append(b.success, addr)
+}
+
+func (b *lastBalancer) Failure(addr string, err error) {}
+
+func TestBalancer(t *testing.T) {
+	bal := &lastBalancer{}
+	second := greeter(t, "two")
+	_, addr := startProxy(t, Options{
+		Backends:  []string{greeter(t, "one"), second},
+		Balance:   "last",
+		Balancers: map[string]Balancer{"last": bal},
+	})
+	conn := greeting(t, addr, "two")
+	conn.Write([]byte("q"))
+	conn.Close()
+	waitFor(t, "the balancer to hear how the session went", func() bool {
+		bal.Lock()
+		defer bal.Unlock()
+		return len(bal.success) > 0
+	})
+	if len(bal.offered) != 2 || bal.offered[1].Addr != second || bal.offered[1].Weight != 1 {
+		t.Errorf("offered %+v", bal.offered)
+	}
+	if bal.success[0] != second {
+		t.Errorf("told of a success on %s, want %s", bal.success[0], second)
+	}
+}
+
+func TestUnknownBalancer(t *testing.T) {
+	if _, err := New(Options{Backends: []string{"127.0.0.1:8300"}, Balance: "last"}); err == nil {
+		t.Error("New with an unknown balancer succeeded")
+	}
+}
+
+// The DialFunc makes the backend connections, here to a backend which isn't
+// at the configured address at all
+func TestDialFunc(t *testing.T) {
+	real := greeter(t, "hi")
+	var mu sync.Mutex
+	var asked []string
+	_, addr := startProxy(t, Options{
+		Backends: []string{"backend.invalid:1"},
+		DialFunc: func(ctx context.Context, addr string) (net.Conn, error) {
+			mu.Lock()
+			asked = append(asked, addr)
+			mu.Unlock()
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", real)
+		},
+	})
+	greeting(t, addr, "hi")
+	mu.Lock()
+	defer mu.Unlock()
+	if len(asked) != 1 || asked[0] != "backend.invalid:1" {
+		t.Errorf("DialFunc asked for %q", asked)
+	}
+}
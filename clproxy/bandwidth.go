@@ -0,0 +1,243 @@
+package clproxy
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+type bandwidthSettings struct {
+	// -max-rate-per-conn caps how fast each session may move data, in each
+	// direction separately, so that one bulk transfer can't crowd out the rest:
+	// with 5MB/s a session may send 5MB/s to its backend and receive 5MB/s from
+	// it at the same time. A token bucket of -max-rate-burst bytes lets short
+	// bursts through at full speed. Sessions are held back by not reading from
+	// the sending side, so it sees the usual TCP backpressure. Without a rate
+	// nothing is wrapped and the copy path is untouched.
+	maxRatePerConn byteRate
+	maxRateBurst   ByteSize
+
+	// -max-rate-total caps the data forwarded by every session together, again
+	// in each direction separately, with a bucket for each direction which all
+	// sessions draw from. Each read takes its bytes from the bucket and waits
+	// for any debt before reading again, so sessions take turns and a flow
+	// which always has data can't starve one which sends less. A session under
+	// both limits waits for whichever has it wait longer.
+	maxRateTotal byteRate
+
+	// Up is from the client to the backend and down from the backend to the
+	// client. A rate for one direction replaces -max-rate-per-conn or
+	// -max-rate-total in that direction.
+	maxRateUp        byteRate
+	maxRateDown      byteRate
+	maxRateTotalUp   byteRate
+	maxRateTotalDown byteRate
+}
+
+type bandwidthState struct {
+	// The limits for the data read from the client and from the backend
+	rateLimits map[string]*directionLimits
+}
+
+// directionLimits are the rates for the data read from one side
+type directionLimits struct {
+	name    string // up or down
+	perConn byteRate
+	total   byteRate
+	bucket  *tokenBucket           // shared, with a total
+	classes map[string]*classShare // with -bw-class
+
+	// Bytes forwarded by limited sessions, over the last second, and the
+	// time sessions have spent held back, in nanoseconds
+	bytes     atomic.Int64
+	current   atomic.Int64
+	throttled atomic.Int64
+}
+
+// The most a read takes from a shared bucket at once, so that turns are
+// short
+const totalRateChunk = 16 << 10
+
+// The smallest default burst, so that slow rates don't mean tiny reads
+const minRateBurst = 64 << 10
+
+func (p *Proxy) setupBandwidth() error {
+	for _, r := range []byteRate{p.maxRatePerConn, p.maxRateTotal, p.maxRateUp, p.maxRateDown, p.maxRateTotalUp, p.maxRateTotalDown, byteRate(p.maxRateBurst)} {
+		if r < 0 {
+			return errors.New("-max-rate-* flags can't be negative")
+		}
+	}
+	p.rateLimits["client"].perConn = cmp.Or(p.maxRateUp, p.maxRatePerConn)
+	p.rateLimits["client"].total = cmp.Or(p.maxRateTotalUp, p.maxRateTotal)
+	p.rateLimits["backend"].perConn = cmp.Or(p.maxRateDown, p.maxRatePerConn)
+	p.rateLimits["backend"].total = cmp.Or(p.maxRateTotalDown, p.maxRateTotal)
+	for _, l := range p.rateLimits {
+		if l.total > 0 {
+			l.bucket = p.newRateBucket(l.total)
+		}
+	}
+	if p.rateLimited() {
+		p.background = append(p.background, p.measureRates)
+	}
+	return p.setupBWClasses()
+}
+
+// limited reports whether l has any rate
+func (l *directionLimits) limited() bool {
+	return l.perConn > 0 || l.total > 0
+}
+
+// rateLimited reports whether the copy has to be wrapped at all
+func (p *Proxy) rateLimited() bool {
+	return p.rateLimits["client"].limited() || p.rateLimits["backend"].limited()
+}
+
+// rateBurst is the bucket size for a rate: -max-rate-burst, or else a tenth
+// of a second's worth
+func (p *Proxy) rateBurst(rate byteRate) float64 {
+	if p.maxRateBurst > 0 {
+		return float64(p.maxRateBurst)
+	}
+	return max(minRateBurst, float64(rate)/10)
+}
+
+func (p *Proxy) newRateBucket(rate byteRate) *tokenBucket {
+	burst := p.rateBurst(rate)
+	return &tokenBucket{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// debit takes n tokens from b, going into debt if there aren't that many,
+// and says how long it will be until the debt is paid off
+func (b *tokenBucket) debit(n float64) time.Duration {
+	b.Lock()
+	defer b.Unlock()
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate) - n
+	b.last = now
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// rateReader reads no faster than its buckets allow, counting the time it
+// spends waiting
+type rateReader struct {
+	r       io.Reader
+	limits  *directionLimits
+	conn    *tokenBucket // the session's own, or nil
+	class   *classShare  // with -bw-class
+	max     int
+	blocked *atomic.Int64
+}
+
+func (r *rateReader) Read(p []byte) (int, error) {
+	if len(p) > r.max {
+		p = p[:r.max]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.limits.bytes.Add(int64(n))
+		var wait, shared time.Duration
+		if r.conn != nil {
+			wait = r.conn.debit(float64(n))
+		}
+		if r.limits.bucket != nil {
+			shared = r.limits.bucket.debit(float64(n))
+		}
+		if r.class != nil {
+			r.class.window.Add(int64(n))
+			r.class.bytes.Add(int64(n))
+			shared = max(shared, r.class.bucket.debit(float64(n)))
+			if shared > 0 {
+				r.class.waited.Store(true)
+			}
+		}
+		if wait = max(wait, shared); wait > 0 {
+			time.Sleep(wait)
+			r.blocked.Add(int64(wait))
+			r.limits.throttled.Add(int64(wait))
+		}
+	}
+	return n, err
+}
+
+// limitRate wraps the direction of c's copy which reads from from in its
+// bandwidth limits, if it has any
+func (c *client) limitRate(r io.Reader, from string) io.Reader {
+	l := c.p.rateLimits[from]
+	if !l.limited() {
+		return r
+	}
+	rr := &rateReader{r: r, limits: l, max: math.MaxInt, blocked: &c.throttledUp}
+	if from == "backend" {
+		rr.blocked = &c.throttledDown
+	}
+	if l.perConn > 0 {
+		rr.conn = c.p.newRateBucket(l.perConn)
+		rr.max = int(rr.conn.burst)
+	}
+	if l.bucket != nil {
+		rr.max = min(rr.max, totalRateChunk)
+	}
+	if l.classes != nil {
+		rr.class = l.classes[cmp.Or(c.bwClass, "normal")]
+	}
+	return rr
+}
+
+// measureRates keeps the bytes forwarded over the last second up to date
+// for the stats
+func (p *Proxy) measureRates() {
+	last := map[string]int64{}
+	for range p.ticks(time.Second) {
+		for from, l := range p.rateLimits {
+			now := l.bytes.Load()
+			l.current.Store(now - last[from])
+			last[from] = now
+			for name, cs := range l.classes {
+				now := cs.bytes.Load()
+				cs.current.Store(now - last[from+name])
+				last[from+name] = now
+			}
+		}
+	}
+}
+
+// statsBandwidth adds a line for each limited direction to the stats
+// summary, with the bytes forwarded over the last second, the limits, the
+// fraction of -max-rate-total used, and the seconds sessions have spent held
+// back in all
+func (p *Proxy) statsBandwidth(w io.Writer) {
+	for _, from := range []string{"client", "backend"} {
+		l := p.rateLimits[from]
+		if !l.limited() {
+			continue
+		}
+		current := l.current.Load()
+		fmt.Fprintf(w, "bandwidth: direction=%s current=%d per_conn_limit=%d limit=%d", l.name, current, l.perConn, l.total)
+		if l.total > 0 {
+			fmt.Fprintf(w, " used=%.2f", float64(current)/float64(l.total))
+		}
+		fmt.Fprintf(w, " throttle_wait=%f\n", time.Duration(l.throttled.Load()).Seconds())
+		statsBWClasses(w, l)
+	}
+}
+
+// rateArgs returns the log fields saying whether c was held back by the
+// rate limits, and for how long in each direction
+func (c *client) rateArgs() []any {
+	if !c.p.rateLimited() {
+		return nil
+	}
+	up, down := time.Duration(c.throttledUp.Load()), time.Duration(c.throttledDown.Load())
+	args := []any{"throttled", up+down > 0, "throttle_wait_up", up.Seconds(), "throttle_wait_down", down.Seconds()}
+	if c.p.bwClass != "" {
+		args = append(args, "bw_class", cmp.Or(c.bwClass, "normal"))
+	}
+	return args
+}
@@ -0,0 +1,136 @@
+package clproxy
+
+import (
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// zeros is an endless source of data, as fast as it can be read
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// until is an endless source of data which runs dry at a given time
+type until time.Time
+
+func (u until) Read(p []byte) (int, error) {
+	if time.Now().After(time.Time(u)) {
+		return 0, io.EOF
+	}
+	return zeros{}.Read(p)
+}
+
+// copyLimited copies n bytes through a session's rate limit the way the
+// proxy does, 32KB at a time, and returns how long that took
+func copyLimited(p *Proxy, n int64) time.Duration {
+	c := &client{p: p}
+	r := c.limitRate(io.LimitReader(zeros{}, n), "client")
+	buf := make([]byte, 32<<10)
+	start := time.Now()
+	io.CopyBuffer(struct{ io.Writer }{io.Discard}, r, buf)
+	return time.Since(start)
+}
+
+// The burst goes through at once; past it a session should get its rate,
+// from a slow link's to a fast one's
+func TestRatePerConnAccuracy(t *testing.T) {
+	if testing.Short() {
+		t.Skip("takes a few seconds")
+	}
+	for _, rate := range []byteRate{100 << 10, 10 << 20, 1 << 30} {
+		p := rateProxy(rate, 0, 0)
+		// Half a second's worth past the burst
+		burst := int64(p.rateBurst(rate))
+		n := burst + int64(rate)/2
+		took := copyLimited(p, n)
+		got := float64(n-burst) / took.Seconds()
+		if ratio := got / float64(rate); ratio < 0.98 || ratio > 1.02 {
+			t.Errorf("%d bytes/s: moved %.0f bytes/s, %.1f%% of the rate", rate, got, ratio*100)
+		}
+	}
+}
+
+// rateProxy makes a proxy with the per session and total rates for data
+// from the client, and -max-rate-burst
+func rateProxy(perConn, total byteRate, burst ByteSize) *Proxy {
+	p := newProxy(&Options{})
+	p.maxRateBurst = burst
+	l := p.rateLimits["client"]
+	l.perConn, l.total = perConn, total
+	if total > 0 {
+		l.bucket = p.newRateBucket(total)
+	}
+	return p
+}
+
+// With both limits a session gets whichever rate is lower, and sessions
+// held back by the total share it evenly
+func TestRatePerConnAndTotal(t *testing.T) {
+	if testing.Short() {
+		t.Skip("takes a few seconds")
+	}
+	for _, tc := range []struct {
+		name           string
+		perConn, total byteRate
+		flows          int
+		want           byteRate // for each flow
+	}{
+		{"per-conn below total", 1 << 20, 4 << 20, 1, 1 << 20},
+		{"total below per-conn", 4 << 20, 1 << 20, 1, 1 << 20},
+		{"two flows sharing the total", 4 << 20, 2 << 20, 2, 1 << 20},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// A burst too small to matter
+			p := rateProxy(tc.perConn, tc.total, totalRateChunk)
+			const d = time.Second
+			end := until(time.Now().Add(d))
+			moved := make([]int64, tc.flows)
+			var wg sync.WaitGroup
+			for i := range moved {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					c := &client{p: p}
+					moved[i], _ = io.CopyBuffer(struct{ io.Writer }{io.Discard}, c.limitRate(end, "client"), make([]byte, 32<<10))
+				}()
+			}
+			wg.Wait()
+			for i, n := range moved {
+				got := float64(n) / d.Seconds()
+				if ratio := got / float64(tc.want); ratio < 0.9 || ratio > 1.1 {
+					t.Errorf("flow %d moved %.0f bytes/s, want %d", i, got, tc.want)
+				}
+			}
+		})
+	}
+}
+
+// What the rate limit costs a session which it never holds back
+func BenchmarkCopy(b *testing.B) {
+	for _, bc := range []struct {
+		name string
+		rate byteRate
+	}{
+		{"unlimited", 0},
+		{"limited", 1 << 50},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			c := &client{p: rateProxy(bc.rate, 0, 0)}
+			var r io.Reader = zeros{}
+			if bc.rate > 0 {
+				r = c.limitRate(r, "client")
+			}
+			buf := make([]byte, 32<<10)
+			w := struct{ io.Writer }{io.Discard}
+			b.SetBytes(int64(len(buf)))
+			for b.Loop() {
+				io.CopyBuffer(w, io.LimitReader(r, int64(len(buf))), buf)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package clproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// bindDeviceControl binds a backend socket to -bind-device before it
+// connects
+func (p *Proxy) bindDeviceControl(network, address string, raw syscall.RawConn) error {
+	var err error
+	cerr := raw.Control(func(fd uintptr) {
+		err = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, p.bindDevice)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// checkBindDevice makes sure -bind-device exists and that we're allowed to
+// bind to it, so that we fail now rather than on every dial
+func (p *Proxy) checkBindDevice() error {
+	if _, err := net.InterfaceByName(p.bindDevice); err != nil {
+		return fmt.Errorf("-bind-device %s: %w", p.bindDevice, err)
+	}
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	err = syscall.SetsockoptString(fd, syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, p.bindDevice)
+	if errors.Is(err, syscall.EPERM) {
+		return fmt.Errorf("-bind-device needs CAP_NET_RAW: %w", err)
+	}
+	if err != nil {
+		return fmt.Errorf("-bind-device %s: %w", p.bindDevice, err)
+	}
+	return nil
+}
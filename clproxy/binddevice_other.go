@@ -0,0 +1,16 @@
+//go:build !linux
+
+package clproxy
+
+import (
+	"errors"
+	"syscall"
+)
+
+func (p *Proxy) bindDeviceControl(network, address string, raw syscall.RawConn) error {
+	return p.checkBindDevice()
+}
+
+func (p *Proxy) checkBindDevice() error {
+	return errors.New("-bind-device is only supported on Linux, use -bind-source to pick the address instead")
+}
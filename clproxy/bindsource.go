@@ -0,0 +1,115 @@
+package clproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+type bindSourceSettings struct {
+	// Source addresses for connections to IPv4 and IPv6 backends, and optionally
+	// the range of source ports to use. Empty leaves the choice to the kernel.
+	bindSource      string
+	bindSource6     string
+	bindSourcePorts string
+
+	// With -bind-device (Linux only) backend connections are bound to a network
+	// interface, for policy routing which goes by device rather than address
+	bindDevice string
+}
+
+type bindSourceState struct {
+	sourceIP4     netip.Addr
+	sourceIP6     netip.Addr
+	sourcePortMin int
+	sourcePortMax int
+}
+
+// How many ports from the range to try before giving up
+const sourcePortTries = 16
+
+func (p *Proxy) setupBindSource() error {
+	if p.bindDevice != "" {
+		if err := p.checkBindDevice(); err != nil {
+			return err
+		}
+	}
+	for _, f := range []struct {
+		flag, value string
+		ip          *netip.Addr
+		is4         bool
+	}{
+		{"-bind-source", p.bindSource, &p.sourceIP4, true},
+		{"-bind-source6", p.bindSource6, &p.sourceIP6, false},
+	} {
+		if f.value == "" {
+			continue
+		}
+		ip, err := netip.ParseAddr(f.value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.flag, err)
+		}
+		if ip = ip.Unmap(); ip.Is4() != f.is4 {
+			return fmt.Errorf("%s %s is the wrong address family", f.flag, f.value)
+		}
+		// Make sure we can use it now rather than failing every dial
+		ln, err := net.Listen("tcp", netip.AddrPortFrom(ip, 0).String())
+		if err != nil {
+			return fmt.Errorf("%s %s is not an address of this host: %w", f.flag, f.value, err)
+		}
+		ln.Close()
+		*f.ip = ip
+	}
+	if p.bindSourcePorts != "" {
+		lo, hi, ok := strings.Cut(p.bindSourcePorts, "-")
+		min, err1 := strconv.Atoi(lo)
+		max, err2 := strconv.Atoi(hi)
+		if !ok || err1 != nil || err2 != nil || min < 1 || max > 65535 || min > max {
+			return fmt.Errorf("bad -bind-source-port-range %q, want e.g. 40000-45000", p.bindSourcePorts)
+		}
+		p.sourcePortMin, p.sourcePortMax = min, max
+	}
+	return nil
+}
+
+// dialFrom dials addr with d from the configured source address and port
+// range for addr's family, if there are any. Hostnames are taken to be IPv4
+// if there is an IPv4 source address.
+func (p *Proxy) dialFrom(ctx context.Context, d *net.Dialer, network, addr string) (net.Conn, error) {
+	if network != "tcp" || d.LocalAddr != nil || (!p.sourceIP4.IsValid() && !p.sourceIP6.IsValid() && p.sourcePortMin == 0) {
+		return d.DialContext(ctx, network, addr)
+	}
+	src := p.sourceIP4
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		if ip, err := netip.ParseAddr(host); err == nil && !ip.Unmap().Is4() {
+			src = p.sourceIP6
+		} else if err != nil && !src.IsValid() {
+			src = p.sourceIP6
+		}
+	}
+	if p.sourcePortMin == 0 {
+		if src.IsValid() {
+			d.LocalAddr = &net.TCPAddr{IP: src.AsSlice()}
+		}
+		return d.DialContext(ctx, network, addr)
+	}
+	var err error
+	for range sourcePortTries {
+		port := p.sourcePortMin + rand.IntN(p.sourcePortMax-p.sourcePortMin+1)
+		d.LocalAddr = &net.TCPAddr{IP: src.AsSlice(), Port: port}
+		var conn net.Conn
+		// A port still in use, or in TIME_WAIT with this backend, is
+		// skipped for another
+		conn, err = d.DialContext(ctx, network, addr)
+		if !errors.Is(err, syscall.EADDRINUSE) && !errors.Is(err, syscall.EADDRNOTAVAIL) {
+			return conn, err
+		}
+	}
+	return nil, fmt.Errorf("no free source port in %s: %w", p.bindSourcePorts, err)
+}
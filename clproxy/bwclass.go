@@ -0,0 +1,151 @@
+package clproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type bwClassSettings struct {
+	// -bw-class sorts clients into bandwidth classes by address, e.g.
+	//
+	//	-bw-class "10.0.9.0/24=high,10.0.20.0/24=low"
+	//
+	// so that when -max-rate-total is holding sessions back, the classes wanting
+	// more than they get share it by weight rather than evenly: high gets twice
+	// what normal does and four times what low does. Clients matching no CIDR
+	// are normal. Every shareInterval the classes which were held back are
+	// given what the rest didn't use, divided by weight, each through a bucket
+	// of its own which its sessions wait on as well as the total.
+	bwClass string
+}
+
+type bwClassState struct {
+	// Most specific prefix first
+	bwClassPrefixes []namedPrefix
+}
+
+var bwClassWeights = map[string]float64{"high": 4, "normal": 2, "low": 1}
+
+// How often the shares are worked out again
+const shareInterval = 100 * time.Millisecond
+
+// classShare is one class's part of one direction's -max-rate-total
+type classShare struct {
+	name   string
+	weight float64
+	bucket *tokenBucket
+
+	// Bytes forwarded since the last share out and in all, whether the
+	// class was held back since the last share out, and its share and
+	// bytes over the last second
+	window  atomic.Int64
+	bytes   atomic.Int64
+	waited  atomic.Bool
+	rate    atomic.Int64
+	current atomic.Int64
+}
+
+func (p *Proxy) setupBWClasses() error {
+	if p.bwClass == "" {
+		return nil
+	}
+	if p.rateLimits["client"].total <= 0 && p.rateLimits["backend"].total <= 0 {
+		return errors.New("-bw-class needs -max-rate-total, -max-rate-total-up, or -max-rate-total-down")
+	}
+	for _, item := range splitList(p.bwClass) {
+		cidr, name, ok := strings.Cut(item, "=")
+		name = strings.TrimSpace(name)
+		if !ok {
+			return fmt.Errorf("bad -bw-class %q, want cidr=class", item)
+		}
+		if _, ok := bwClassWeights[name]; !ok {
+			return fmt.Errorf("unknown bandwidth class %q in -bw-class (want high, normal, or low)", name)
+		}
+		prefix, err := parsePrefix(strings.TrimSpace(cidr))
+		if err != nil {
+			return fmt.Errorf("-bw-class: %w", err)
+		}
+		p.bwClassPrefixes = append(p.bwClassPrefixes, namedPrefix{prefix: prefix, name: name})
+	}
+	sort.SliceStable(p.bwClassPrefixes, func(i, j int) bool { return p.bwClassPrefixes[i].prefix.Bits() > p.bwClassPrefixes[j].prefix.Bits() })
+	for _, l := range p.rateLimits {
+		if l.total <= 0 {
+			continue
+		}
+		l.classes = map[string]*classShare{}
+		for name, weight := range bwClassWeights {
+			cs := &classShare{name: name, weight: weight, bucket: p.newRateBucket(l.total)}
+			cs.rate.Store(int64(l.total))
+			l.classes[name] = cs
+		}
+		p.background = append(p.background, func() { p.shareOut(l) })
+	}
+	return nil
+}
+
+// bwClassFor returns the class of a client at ip
+func (p *Proxy) bwClassFor(ip netip.Addr) string {
+	for _, np := range p.bwClassPrefixes {
+		if np.prefix.Contains(ip) {
+			return np.name
+		}
+	}
+	return "normal"
+}
+
+// setRate changes b's rate from now on
+func (b *tokenBucket) setRate(rate float64) {
+	b.Lock()
+	defer b.Unlock()
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.rate = rate
+}
+
+// shareOut divides l's total between its classes every shareInterval. The
+// classes which weren't held back keep what they used and may take more;
+// the rest share what's left by weight.
+func (p *Proxy) shareOut(l *directionLimits) {
+	total := float64(l.total)
+	for range p.ticks(shareInterval) {
+		left := total
+		var weights float64
+		var held []*classShare
+		for _, cs := range l.classes {
+			used := float64(cs.window.Swap(0)) / shareInterval.Seconds()
+			if cs.waited.Swap(false) {
+				held = append(held, cs)
+				weights += cs.weight
+				continue
+			}
+			left -= used
+			cs.bucket.setRate(total)
+			cs.rate.Store(int64(total))
+		}
+		left = max(left, total/20)
+		for _, cs := range held {
+			rate := left * cs.weight / weights
+			cs.bucket.setRate(rate)
+			cs.rate.Store(int64(rate))
+		}
+	}
+}
+
+// statsBWClasses adds a line for each class of each direction to the stats
+// summary, with its bytes over the last second and its current share
+func statsBWClasses(w io.Writer, l *directionLimits) {
+	for _, name := range []string{"high", "normal", "low"} {
+		cs := l.classes[name]
+		if cs == nil {
+			continue
+		}
+		fmt.Fprintf(w, "bandwidth_class: direction=%s class=%s weight=%g current=%d share=%d\n", l.name, name, cs.weight, cs.current.Load(), cs.rate.Load())
+	}
+}
@@ -0,0 +1,232 @@
+package clproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+type canaryRolloutSettings struct {
+	// With -canary a new backend build gets a slice of real sessions: each new
+	// session dials the canary instead of the primaries with -canary-percent
+	// chance. Failures are counted the way the circuit breaker counts them, for
+	// the canary and for the primaries, over -canary-window. Once the canary has
+	// had -canary-min-sessions sessions in the window, an error rate above
+	// -canary-max-error-rate, or above -canary-max-error-ratio times the
+	// primaries' rate when that is set, rolls it back: it gets no more sessions.
+	// The canary stats command shows how it's doing, and promotes it to be the
+	// only primary or aborts it by hand.
+	canaryAddr          string
+	canaryPercent       float64
+	canaryMaxErrorRate  float64
+	canaryMaxErrorRatio float64
+	canaryWindow        time.Duration
+	canaryMinSessions   int
+}
+
+type canaryRolloutState struct {
+	// The canary and what we know about it, nil without -canary
+	canary *canaryState
+}
+
+const (
+	canaryActive     = "active"
+	canaryRolledBack = "rolled-back"
+	canaryAborted    = "aborted"
+	canaryPromoted   = "promoted"
+)
+
+// errorWindow counts session outcomes over the last window, a bucket per
+// second
+type errorWindow struct {
+	buckets []circuitBucket
+}
+
+func (ew *errorWindow) record(now time.Time, window time.Duration, failed bool) {
+	size := max(int(window/time.Second), 1)
+	if len(ew.buckets) != size {
+		ew.buckets = make([]circuitBucket, size)
+	}
+	sec := now.Unix()
+	b := &ew.buckets[sec%int64(size)]
+	if b.second != sec {
+		*b = circuitBucket{second: sec}
+	}
+	b.total++
+	if failed {
+		b.failed++
+	}
+}
+
+// rate returns the sessions in the window and the fraction which failed
+func (ew *errorWindow) rate(now time.Time) (int, float64) {
+	sec := now.Unix()
+	total, failed := 0, 0
+	for _, b := range ew.buckets {
+		if sec-b.second < int64(len(ew.buckets)) {
+			total += b.total
+			failed += b.failed
+		}
+	}
+	if total == 0 {
+		return 0, 0
+	}
+	return total, float64(failed) / float64(total)
+}
+
+type canaryState struct {
+	sync.Mutex
+	p       *Proxy
+	backend *backend
+	rt      *route
+	state   string
+	canary  errorWindow
+	primary errorWindow
+}
+
+// setupCanary checks the canary flags and creates the canary backend for the
+// one route there is
+func (p *Proxy) setupCanary(routes []*route) error {
+	if p.canaryAddr == "" {
+		return nil
+	}
+	switch {
+	case len(routes) != 1:
+		return errors.New("-canary needs a single route")
+	case p.tunnelClient != "":
+		return errors.New("-canary can't be used with -tunnel-client")
+	case p.canaryPercent <= 0 || p.canaryPercent > 100:
+		return fmt.Errorf("-canary-percent must be more than 0 and at most 100, not %g", p.canaryPercent)
+	case p.canaryMaxErrorRate <= 0 || p.canaryMaxErrorRate > 1:
+		return fmt.Errorf("-canary-max-error-rate must be more than 0 and at most 1, not %g", p.canaryMaxErrorRate)
+	case p.canaryMaxErrorRatio < 0:
+		return fmt.Errorf("-canary-max-error-ratio can't be negative")
+	}
+	if err := p.checkBackendAddr(p.canaryAddr); err != nil {
+		return err
+	}
+	b := p.newBackend(p.canaryAddr)
+	b.weight.Store(1)
+	p.canary = &canaryState{p: p, backend: b, rt: routes[0], state: canaryActive}
+	p.logger.Info("canary started", "backend", p.canaryAddr, "percent", p.canaryPercent)
+	return nil
+}
+
+// pick gives the canary a session from s with -canary-percent chance, counting
+// it as active. It returns nil when the session should go to s as usual.
+func (cs *canaryState) pick(s *backendSet) *backend {
+	if cs == nil || s != cs.rt.backends || rand.Float64()*100 >= cs.p.canaryPercent {
+		return nil
+	}
+	cs.Lock()
+	defer cs.Unlock()
+	if cs.state != canaryActive {
+		return nil
+	}
+	cs.backend.active.Add(1)
+	return cs.backend
+}
+
+// record counts the outcome of a session on b, if it was the canary or one
+// of the primaries it is compared against, and rolls the canary back if it
+// is doing badly
+func (cs *canaryState) record(b *backend, failed bool) {
+	if cs == nil || b.backup.Load() {
+		return
+	}
+	cs.Lock()
+	defer cs.Unlock()
+	now := time.Now()
+	if b != cs.backend {
+		if cur, ok := cs.rt.backends.lookup(b.addr); ok && cur == b {
+			cs.primary.record(now, cs.p.canaryWindow, failed)
+		}
+		return
+	}
+	cs.canary.record(now, cs.p.canaryWindow, failed)
+	if cs.state != canaryActive {
+		return
+	}
+	n, rate := cs.canary.rate(now)
+	if n < cs.p.canaryMinSessions {
+		return
+	}
+	_, primaryRate := cs.primary.rate(now)
+	why := ""
+	switch {
+	case rate > cs.p.canaryMaxErrorRate:
+		why = "error rate"
+	case cs.p.canaryMaxErrorRatio > 0 && rate > primaryRate*cs.p.canaryMaxErrorRatio:
+		why = "error rate relative to the primaries"
+	default:
+		return
+	}
+	cs.state = canaryRolledBack
+	cs.p.logger.Error("canary rolled back, sending it no more sessions",
+		"backend", cs.backend.addr, "why", why, "sessions", n,
+		"canary_error_rate", rate, "primary_error_rate", primaryRate,
+		"max_error_rate", cs.p.canaryMaxErrorRate, "max_error_ratio", cs.p.canaryMaxErrorRatio)
+}
+
+func (cs *canaryState) String() string {
+	cs.Lock()
+	defer cs.Unlock()
+	now := time.Now()
+	n, rate := cs.canary.rate(now)
+	pn, primaryRate := cs.primary.rate(now)
+	return fmt.Sprintf("canary: backend=%s state=%s percent=%g canary_sessions=%d canary_error_rate=%f primary_sessions=%d primary_error_rate=%f",
+		cs.backend.addr, cs.state, cs.p.canaryPercent, n, rate, pn, primaryRate)
+}
+
+// statsCanary adds the canary's state to the stats summary when there is one
+func (p *Proxy) statsCanary(w io.Writer) {
+	if p.canary != nil {
+		fmt.Fprintln(w, p.canary)
+	}
+}
+
+// statsCanaryCommand answers "canary [promote|abort]" on the stats port.
+// Promoting makes the canary the route's only primary, as set backend would.
+func (p *Proxy) statsCanaryCommand(w io.Writer, args []string) {
+	if p.canary == nil {
+		fmt.Fprintln(w, "error: there is no -canary")
+		return
+	}
+	if len(args) > 1 || len(args) == 1 && args[0] != "promote" && args[0] != "abort" {
+		fmt.Fprintln(w, "error: usage: canary [promote|abort]")
+		return
+	}
+	if len(args) == 1 {
+		p.canary.Lock()
+		state := p.canary.state
+		if state == canaryActive || state == canaryRolledBack {
+			p.canary.state = canaryAborted
+			if args[0] == "promote" {
+				p.canary.state = canaryPromoted
+			}
+		}
+		p.canary.Unlock()
+		if state != canaryActive && state != canaryRolledBack {
+			fmt.Fprintf(w, "error: the canary has already been %s\n", state)
+			return
+		}
+		if args[0] == "promote" {
+			old, onOld, err := p.setPrimary(p.canary.rt, p.canaryAddr)
+			if err != nil {
+				fmt.Fprintf(w, "error: %s\n", err)
+				p.canary.Lock()
+				p.canary.state = state
+				p.canary.Unlock()
+				return
+			}
+			p.logger.Info("canary promoted", "backend", p.canaryAddr, "old", old, "sessions_on_old_backend", onOld)
+		} else {
+			p.logger.Warn("canary aborted", "backend", p.canaryAddr)
+		}
+	}
+	fmt.Fprintln(w, p.canary)
+	fmt.Fprintln(w, p.canary.backend)
+}
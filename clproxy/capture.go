@@ -0,0 +1,400 @@
+package clproxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type captureSettings struct {
+	// Traffic capture, for seeing the exact bytes of a session. "capture <ip|id>
+	// [bytes]" on the stats port records what sessions send each way from then
+	// on, for the session with that id or every session from that address until
+	// "uncapture", into a directory of -capture-dir for each session:
+	// client.bin and backend.bin hold what the client and the backend sent, up
+	// to [bytes] each, and session.json describes the session. Without
+	// -capture-dir the commands refuse, so capture can't be switched on by
+	// accident, and nothing is added to the copy path. With it, each read costs
+	// one extra buffered write while a session is captured.
+	//
+	// -capture-max-total caps what every capture writes together since
+	// startup; once it is reached captures stop where they are, whatever was
+	// asked for.
+	captureDir      string
+	captureMaxTotal ByteSize
+}
+
+type captureState struct {
+	// Addresses whose sessions are captured, and for how many bytes
+	capturedIPs   map[netip.Addr]int64
+	capturedLock  sync.Mutex
+	capturedCount atomic.Int64
+
+	// Bytes written by every capture, sessions captured, and sessions being
+	// captured
+	captureWritten  atomic.Int64
+	captureSessions atomic.Uint64
+	captureActive   atomic.Int64
+
+	// Whether we've warned that -capture-max-total is used up
+	captureFullWarned atomic.Bool
+}
+
+// How much of each direction is captured if the command doesn't say
+const captureDefaultBytes = 1 << 20
+
+// The buffer in front of each capture file
+const captureBuffer = 64 << 10
+
+// The client's reads are noted for replaying with their original timing.
+// Reads closer together than this are noted as one, and past captureMaxReads
+// the rest are added to the last one.
+const captureReadGap = 10 * time.Millisecond
+const captureMaxReads = 1000
+
+// A capture is one session's recording. captureEnded takes its place once
+// the session has stopped copying, so that it can't be started too late.
+type capture struct {
+	p       *Proxy
+	dir     string
+	limit   int64
+	started time.Time
+	stopped atomic.Bool
+	sides   map[string]*captureFile // by who sent it, client or backend
+}
+
+var captureEnded = &capture{}
+
+// captureFile is one direction of a capture. Only the copy reading that
+// direction touches it until the session ends.
+type captureFile struct {
+	f         *os.File
+	w         *bufio.Writer
+	n         int64
+	truncated bool
+	failed    bool
+	reads     [][2]float64 // seconds into the capture, and bytes
+}
+
+// CaptureSession is a captured session's session.json, as written under
+// -capture-dir and read back by the replay subcommand
+type CaptureSession struct {
+	ID             string       `json:"id"`
+	Client         string       `json:"client"`
+	Local          string       `json:"local"`
+	Backend        string       `json:"backend"`
+	BackendLocal   string       `json:"backend_local"`
+	Listener       string       `json:"listener,omitempty"`
+	Started        time.Time    `json:"started"`
+	CaptureStarted time.Time    `json:"capture_started"`
+	Ended          time.Time    `json:"ended"`
+	ClientBytes    int64        `json:"client_bytes"`
+	BackendBytes   int64        `json:"backend_bytes"`
+	Truncated      bool         `json:"truncated"`
+	ClientReads    [][2]float64 `json:"client_reads"`
+}
+
+func (p *Proxy) setupCapture() error {
+	if p.captureDir == "" {
+		return nil
+	}
+	if p.captureMaxTotal <= 0 {
+		return errors.New("-capture-max-total must be positive")
+	}
+	return os.MkdirAll(p.captureDir, 0700)
+}
+
+// captureIfWatched starts capturing c if its address is being captured
+func (c *client) captureIfWatched() {
+	if c.p.capturedCount.Load() == 0 {
+		return
+	}
+	ip, ok := addrIP(c.conn.RemoteAddr())
+	if !ok {
+		return
+	}
+	c.p.capturedLock.Lock()
+	limit, ok := c.p.capturedIPs[ip]
+	c.p.capturedLock.Unlock()
+	if ok {
+		c.startCapture(limit)
+	}
+}
+
+// startCapture begins recording c's traffic from now on, up to limit bytes
+// each way
+func (c *client) startCapture(limit int64) error {
+	switch c.capture.Load() {
+	case nil:
+	case captureEnded:
+		return errors.New("session has ended")
+	default:
+		return errors.New("already being captured")
+	}
+	if c.p.captureWritten.Load() >= int64(c.p.captureMaxTotal) {
+		return errors.New("-capture-max-total used up")
+	}
+	cp := &capture{
+		p:       c.p,
+		dir:     filepath.Join(c.p.captureDir, "session-"+c.UID),
+		limit:   limit,
+		started: time.Now(),
+		sides:   map[string]*captureFile{},
+	}
+	if err := os.Mkdir(cp.dir, 0700); err != nil {
+		return err
+	}
+	for _, from := range []string{"client", "backend"} {
+		f, err := os.OpenFile(filepath.Join(cp.dir, from+".bin"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			cp.close()
+			return err
+		}
+		cp.sides[from] = &captureFile{f: f, w: bufio.NewWriterSize(f, captureBuffer)}
+	}
+	if !c.capture.CompareAndSwap(nil, cp) {
+		cp.close()
+		os.RemoveAll(cp.dir)
+		return errors.New("session has ended or is already being captured")
+	}
+	c.p.captureSessions.Add(1)
+	c.p.captureActive.Add(1)
+	c.p.logger.Info("capture started", "id", c.UID, "client", c.name, "dir", cp.dir, "bytes", limit)
+	return nil
+}
+
+// record writes what was read from from to the capture, as far as the
+// limits allow
+func (cp *capture) record(from string, p []byte) {
+	if cp.stopped.Load() {
+		return
+	}
+	cf := cp.sides[from]
+	if cf.failed || cf.truncated {
+		return
+	}
+	n := int64(len(p))
+	if cf.n+n > cp.limit {
+		n = cp.limit - cf.n
+		cf.truncated = true
+	}
+	if cp.p.captureWritten.Add(n) > int64(cp.p.captureMaxTotal) {
+		cp.p.captureWritten.Add(-n)
+		cf.truncated = true
+		if !cp.p.captureFullWarned.Swap(true) {
+			cp.p.logger.Warn("-capture-max-total used up, captures stopped", "max", cp.p.captureMaxTotal.String())
+		}
+		return
+	}
+	if _, err := cf.w.Write(p[:n]); err != nil {
+		cf.failed = true
+		cp.p.logger.Warn("capture write failed", "dir", cp.dir, "error", err.Error())
+		return
+	}
+	if from == "client" {
+		cf.noteRead(time.Since(cp.started), n)
+	}
+	cf.n += n
+}
+
+// noteRead adds a read of n bytes at at to cf's timings
+func (cf *captureFile) noteRead(at time.Duration, n int64) {
+	last := len(cf.reads) - 1
+	if last >= 0 && (last+1 >= captureMaxReads || at.Seconds()-cf.reads[last][0] < captureReadGap.Seconds()) {
+		cf.reads[last][1] += float64(n)
+		return
+	}
+	cf.reads = append(cf.reads, [2]float64{at.Seconds(), float64(n)})
+}
+
+// close flushes and closes cp's files
+func (cp *capture) close() error {
+	var errs []error
+	for _, cf := range cp.sides {
+		errs = append(errs, cf.w.Flush(), cf.f.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// endCapture finishes c's capture, if it has one, writing session.json
+func (c *client) endCapture() {
+	cp := c.capture.Swap(captureEnded)
+	if cp == nil {
+		return
+	}
+	c.capturedTo = cp.dir
+	c.p.captureActive.Add(-1)
+	err := cp.close()
+	side := CaptureSession{
+		ID:             c.UID,
+		Client:         c.name,
+		Local:          c.conn.LocalAddr().String(),
+		Backend:        c.backend.addr,
+		BackendLocal:   c.server.LocalAddr().String(),
+		Listener:       c.listener,
+		Started:        c.start,
+		CaptureStarted: cp.started,
+		Ended:          c.done,
+		ClientBytes:    cp.sides["client"].n,
+		BackendBytes:   cp.sides["backend"].n,
+		Truncated:      cp.sides["client"].truncated || cp.sides["backend"].truncated,
+		ClientReads:    cp.sides["client"].reads,
+	}
+	if side.ClientReads == nil {
+		side.ClientReads = [][2]float64{}
+	}
+	b, _ := json.Marshal(side)
+	err = errors.Join(err, os.WriteFile(filepath.Join(cp.dir, "session.json"), append(b, '\n'), 0600))
+	if err != nil {
+		c.p.logger.Warn("capture incomplete", "id", c.UID, "dir", cp.dir, "error", err.Error())
+		return
+	}
+	c.p.logger.Info("capture finished", "id", c.UID, "dir", cp.dir, "client_bytes", side.ClientBytes, "backend_bytes", side.BackendBytes, "truncated", side.Truncated)
+}
+
+// captureReader hands what is read through it to the session's capture, if
+// it has one. It is only put in the copy path with -capture-dir.
+type captureReader struct {
+	r    io.Reader
+	c    *client
+	from string
+}
+
+func (r *captureReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if cp := r.c.capture.Load(); cp != nil {
+			cp.record(r.from, p[:n])
+		}
+	}
+	return n, err
+}
+
+// captureArgs returns the log field saying where c was captured to, once
+// the capture has ended
+func (c *client) captureArgs() []any {
+	if c.capturedTo == "" {
+		return nil
+	}
+	return []any{"capture", c.capturedTo}
+}
+
+// statsCapture answers "capture [ip|id [bytes]]" on the stats port. With no
+// arguments it lists the addresses and sessions being captured.
+func (p *Proxy) statsCapture(w io.Writer, args []string) {
+	if p.captureDir == "" {
+		fmt.Fprintln(w, "error: there is no -capture-dir")
+		return
+	}
+	if len(args) == 0 {
+		p.listCaptures(w)
+		return
+	}
+	if len(args) > 2 {
+		fmt.Fprintln(w, "error: usage: capture [ip|id [bytes]]")
+		return
+	}
+	limit := int64(captureDefaultBytes)
+	if len(args) == 2 {
+		n, err := parseByteSize(args[1])
+		if err != nil || n <= 0 {
+			fmt.Fprintf(w, "error: invalid size %q\n", args[1])
+			return
+		}
+		limit = n
+	}
+	if ip, err := netip.ParseAddr(args[0]); err == nil {
+		ip = ip.Unmap()
+		p.capturedLock.Lock()
+		if _, ok := p.capturedIPs[ip]; !ok {
+			p.capturedCount.Add(1)
+		}
+		p.capturedIPs[ip] = limit
+		p.capturedLock.Unlock()
+		started := 0
+		for _, c := range p.liveSessions() {
+			if cip, ok := addrIP(c.conn.RemoteAddr()); ok && cip == ip && c.startCapture(limit) == nil {
+				started++
+			}
+		}
+		p.logger.Info("capture enabled", "ip", ip.String(), "bytes", limit)
+		fmt.Fprintf(w, "capturing %s, %d sessions so far\n", ip, started)
+		return
+	}
+	c := p.findLive(args[0])
+	if c == nil {
+		fmt.Fprintf(w, "error: no session %q\n", args[0])
+		return
+	}
+	if err := c.startCapture(limit); err != nil {
+		fmt.Fprintf(w, "error: %v\n", err)
+		return
+	}
+	fmt.Fprintf(w, "capturing %s to %s\n", c.UID, c.capture.Load().dir)
+}
+
+// statsUncapture answers "uncapture <ip|id>" on the stats port. Sessions
+// stop being captured but keep what has been written.
+func (p *Proxy) statsUncapture(w io.Writer, args []string) {
+	if p.captureDir == "" {
+		fmt.Fprintln(w, "error: there is no -capture-dir")
+		return
+	}
+	if len(args) != 1 {
+		fmt.Fprintln(w, "error: usage: uncapture <ip|id>")
+		return
+	}
+	ip, err := netip.ParseAddr(args[0])
+	ip = ip.Unmap()
+	if err == nil {
+		p.capturedLock.Lock()
+		if _, ok := p.capturedIPs[ip]; ok {
+			delete(p.capturedIPs, ip)
+			p.capturedCount.Add(-1)
+		}
+		p.capturedLock.Unlock()
+	}
+	stopped := 0
+	for _, c := range p.liveSessions() {
+		cip, _ := addrIP(c.conn.RemoteAddr())
+		if cp := c.capture.Load(); cp != nil && (c.UID == args[0] || err == nil && cip == ip) && !cp.stopped.Swap(true) {
+			stopped++
+		}
+	}
+	p.logger.Info("capture disabled", "target", args[0], "sessions", stopped)
+	fmt.Fprintf(w, "not capturing %s, %d sessions stopped\n", args[0], stopped)
+}
+
+func (p *Proxy) listCaptures(w io.Writer) {
+	p.capturedLock.Lock()
+	ips := make([]netip.Addr, 0, len(p.capturedIPs))
+	for ip := range p.capturedIPs {
+		ips = append(ips, ip)
+	}
+	sort.Slice(ips, func(i, j int) bool { return ips[i].Less(ips[j]) })
+	for _, ip := range ips {
+		fmt.Fprintf(w, "ip=%s bytes=%d\n", ip, p.capturedIPs[ip])
+	}
+	p.capturedLock.Unlock()
+	for _, c := range p.liveSessions() {
+		if cp := c.capture.Load(); cp != nil && cp != captureEnded && !cp.stopped.Load() {
+			fmt.Fprintf(w, "id=%s client=%s bytes=%d dir=%s\n", c.UID, c.name, cp.limit, cp.dir)
+		}
+	}
+}
+
+// statsCaptureState adds the captures to the stats summary
+func (p *Proxy) statsCaptureState(w io.Writer) {
+	if p.captureDir != "" {
+		fmt.Fprintf(w, "capture: active=%d sessions=%d written=%d max=%d\n", p.captureActive.Load(), p.captureSessions.Load(), p.captureWritten.Load(), int64(p.captureMaxTotal))
+	}
+}
@@ -0,0 +1,301 @@
+package clproxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+type chaosSettings struct {
+	// Latency injection, for seeing how applications cope with a slow backend
+	// without touching it. With -inject-latency a -inject-latency-probability
+	// fraction of sessions are delayed by that much, give or take up to
+	// -inject-latency-jitter: before their backend is dialed, on each read of
+	// the backend's data as it is passed on to the client, or both, as
+	// -inject-latency-at says. Their log lines get chaos=latency. The
+	// experiment runs from startup and "chaos latency stop" and "chaos latency
+	// start" on the stats port stop and restart it; without -inject-latency
+	// nothing is ever delayed.
+	injectLatency            time.Duration
+	injectLatencyJitter      time.Duration
+	injectLatencyProbability float64
+	injectLatencyAt          string
+
+	// Failure injection, for rehearsing failovers. With
+	// -inject-failure-probability that fraction of sessions are broken in one of
+	// the -inject-failure-mode ways, picked at random for each: dial_error fails
+	// the session as if the backend had refused it, without dialing it;
+	// mid_stream_reset closes both sides abruptly, with a TCP reset where it
+	// can, after a random number of bytes up to -inject-failure-after either
+	// way; and stall stops forwarding for -inject-stall-duration after such a
+	// number of bytes. Their log lines get chaos=failure and the mode. Injected
+	// failures don't count against backends' error counts or circuit breakers,
+	// and are counted on their own. "chaos failure stop" and "chaos failure
+	// start" stop and restart the experiment.
+	injectFailureProbability float64
+	injectFailureMode        string
+	injectFailureAfter       ByteSize
+	injectStallDuration      time.Duration
+}
+
+type chaosState struct {
+	chaosLatencyOn atomic.Bool
+
+	// Sessions which were delayed
+	chaosLatencySessions atomic.Uint64
+
+	injectFailureModes []string
+	chaosFailureOn     atomic.Bool
+
+	// Sessions broken in each mode
+	chaosFailures map[string]*atomic.Uint64
+}
+
+// chaosError is an injected failure
+type chaosError struct {
+	err error
+}
+
+func (e *chaosError) Error() string { return "chaos: injected " + e.err.Error() }
+func (e *chaosError) Unwrap() error { return e.err }
+
+var errChaosDial = &chaosError{&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}}
+
+func (p *Proxy) setupChaos() error {
+	if p.injectLatency < 0 || p.injectLatencyJitter < 0 {
+		return fmt.Errorf("-inject-latency and -inject-latency-jitter can't be negative")
+	}
+	if p.injectLatencyProbability < 0 || p.injectLatencyProbability > 1 {
+		return fmt.Errorf("-inject-latency-probability must be between 0 and 1")
+	}
+	switch p.injectLatencyAt {
+	case "dial", "copy", "both":
+	default:
+		return fmt.Errorf("unknown -inject-latency-at %q (want dial, copy, or both)", p.injectLatencyAt)
+	}
+	p.chaosLatencyOn.Store(p.injectLatency > 0)
+	if p.injectFailureProbability < 0 || p.injectFailureProbability > 1 {
+		return fmt.Errorf("-inject-failure-probability must be between 0 and 1")
+	}
+	for _, mode := range splitList(p.injectFailureMode) {
+		if p.chaosFailures[mode] == nil {
+			return fmt.Errorf("unknown -inject-failure-mode %q (want dial_error, mid_stream_reset, or stall)", mode)
+		}
+		p.injectFailureModes = append(p.injectFailureModes, mode)
+	}
+	if p.injectFailureProbability > 0 && len(p.injectFailureModes) == 0 {
+		return errors.New("-inject-failure-probability needs an -inject-failure-mode")
+	}
+	p.chaosFailureOn.Store(p.injectFailureProbability > 0)
+	return nil
+}
+
+// chooseChaos decides whether c is part of the experiments
+func (c *client) chooseChaos() {
+	if c.p.chaosLatencyOn.Load() && rand.Float64() < c.p.injectLatencyProbability {
+		c.chaosLatency = true
+		c.p.chaosLatencySessions.Add(1)
+	}
+	if c.p.chaosFailureOn.Load() && rand.Float64() < c.p.injectFailureProbability {
+		c.chaosFailure = c.p.injectFailureModes[rand.IntN(len(c.p.injectFailureModes))]
+		c.chaosAfter = rand.Int64N(int64(c.p.injectFailureAfter) + 1)
+		c.p.chaosFailures[c.chaosFailure].Add(1)
+	}
+}
+
+// injectDialError fails c's session as if its backend had refused it, if
+// that's what it was picked for. It reports whether it did.
+func (c *client) injectDialError() bool {
+	if c.chaosFailure != "dial_error" {
+		return false
+	}
+	c.trace("chaos_failure", "mode", c.chaosFailure)
+	c.err = errChaosDial
+	return true
+}
+
+// faultReader breaks c's session once the bytes read in either direction
+// reach c.chaosAfter
+type faultReader struct {
+	r io.Reader
+	c *client
+}
+
+func (f *faultReader) Read(p []byte) (int, error) {
+	c := f.c
+	if until := c.chaosStallUntil.Load(); until != 0 {
+		time.Sleep(time.Until(time.Unix(0, until)))
+	}
+	n, err := f.r.Read(p)
+	if c.chaosBytes.Add(int64(n)) < c.chaosAfter || !c.chaosFired.CompareAndSwap(false, true) {
+		return n, err
+	}
+	c.trace("chaos_failure", "mode", c.chaosFailure, "after", c.chaosBytes.Load())
+	if c.chaosFailure == "stall" {
+		c.chaosStallUntil.Store(time.Now().Add(f.c.p.injectStallDuration).UnixNano())
+		time.Sleep(f.c.p.injectStallDuration)
+		return n, err
+	}
+	c.endOnce.Do(func() {
+		c.closedBy, c.reason = "proxy", "chaos_reset"
+	})
+	resetConn(c.conn)
+	resetConn(c.server)
+	return 0, &chaosError{syscall.ECONNRESET}
+}
+
+// injectFault wraps one direction of c's copy if it was picked to be reset
+// or stalled
+func (c *client) injectFault(r io.Reader) io.Reader {
+	if c.chaosFailure != "mid_stream_reset" && c.chaosFailure != "stall" {
+		return r
+	}
+	return &faultReader{r: r, c: c}
+}
+
+// resetConn closes conn with a TCP reset if it is TCP underneath
+func resetConn(conn net.Conn) {
+	for raw := conn; ; {
+		switch cc := raw.(type) {
+		case *net.TCPConn:
+			cc.SetLinger(0)
+			conn.Close()
+			return
+		case *tls.Conn:
+			raw = cc.NetConn()
+		case *peekedConn:
+			raw = cc.Conn
+		default:
+			conn.Close()
+			return
+		}
+	}
+}
+
+// chaosDelay is one injected delay: -inject-latency give or take up to
+// -inject-latency-jitter
+func (p *Proxy) chaosDelay() time.Duration {
+	d := p.injectLatency
+	if p.injectLatencyJitter > 0 {
+		d += time.Duration(rand.Int64N(int64(2*p.injectLatencyJitter+1))) - p.injectLatencyJitter
+	}
+	return max(0, d)
+}
+
+// delayDial holds c back before its dial if it is delayed there
+func (c *client) delayDial() {
+	if !c.chaosLatency || c.p.injectLatencyAt == "copy" {
+		return
+	}
+	d := c.p.chaosDelay()
+	c.trace("chaos_latency", "delay", d.Seconds())
+	time.Sleep(d)
+	c.chaosDelayed.Add(int64(d))
+}
+
+// delayReader delays each read of the backend's data for a delayed session
+type delayReader struct {
+	r io.Reader
+	c *client
+}
+
+func (d *delayReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	if n > 0 {
+		delay := d.c.p.chaosDelay()
+		time.Sleep(delay)
+		d.c.chaosDelayed.Add(int64(delay))
+	}
+	return n, err
+}
+
+// delayCopy wraps the copy from the backend if c is delayed there
+func (c *client) delayCopy(r io.Reader, from string) io.Reader {
+	if !c.chaosLatency || from != "backend" || c.p.injectLatencyAt == "dial" {
+		return r
+	}
+	return &delayReader{r: r, c: c}
+}
+
+// chaosArgs returns the log fields marking c as part of an experiment
+func (c *client) chaosArgs() []any {
+	var kinds []string
+	var args []any
+	if c.chaosLatency {
+		kinds = append(kinds, "latency")
+		args = append(args, "chaos_delay", time.Duration(c.chaosDelayed.Load()).Seconds())
+	}
+	if c.chaosFailure != "" {
+		kinds = append(kinds, "failure")
+		args = append(args, "mode", c.chaosFailure)
+	}
+	if kinds == nil {
+		return nil
+	}
+	return append([]any{"chaos", strings.Join(kinds, ",")}, args...)
+}
+
+// statsChaos answers "chaos [latency|failure start|stop]" on the stats port
+func (p *Proxy) statsChaos(w io.Writer, args []string) {
+	switch {
+	case len(args) == 0 && p.injectLatency <= 0 && p.injectFailureProbability <= 0:
+		fmt.Fprintln(w, "no chaos experiments")
+	case len(args) == 0:
+		p.statsChaosState(w)
+	case len(args) == 2 && slices.Contains([]string{"latency", "failure"}, args[0]) && (args[1] == "start" || args[1] == "stop"):
+		on := &p.chaosLatencyOn
+		if args[0] == "failure" {
+			on = &p.chaosFailureOn
+		}
+		if args[0] == "latency" && p.injectLatency <= 0 {
+			fmt.Fprintln(w, "error: there is no -inject-latency")
+			return
+		}
+		if args[0] == "failure" && p.injectFailureProbability <= 0 {
+			fmt.Fprintln(w, "error: there is no -inject-failure-probability")
+			return
+		}
+		on.Store(args[1] == "start")
+		p.logger.Info("chaos experiment", "chaos", args[0], "action", args[1])
+		p.statsChaosState(w)
+	default:
+		fmt.Fprintln(w, "error: usage: chaos [latency|failure start|stop]")
+	}
+}
+
+// statsChaosState adds the experiments to the stats summary
+func (p *Proxy) statsChaosState(w io.Writer) {
+	p.statsChaosLatency(w)
+	p.statsChaosFailure(w)
+}
+
+func (p *Proxy) statsChaosLatency(w io.Writer) {
+	if p.injectLatency <= 0 {
+		return
+	}
+	state := "stopped"
+	if p.chaosLatencyOn.Load() {
+		state = "running"
+	}
+	fmt.Fprintf(w, "chaos_latency: state=%s latency=%s jitter=%s probability=%g at=%s sessions=%d\n", state, p.injectLatency, p.injectLatencyJitter, p.injectLatencyProbability, p.injectLatencyAt, p.chaosLatencySessions.Load())
+}
+
+func (p *Proxy) statsChaosFailure(w io.Writer) {
+	if p.injectFailureProbability <= 0 {
+		return
+	}
+	state := "stopped"
+	if p.chaosFailureOn.Load() {
+		state = "running"
+	}
+	fmt.Fprintf(w, "chaos_failure: state=%s probability=%g modes=%s dial_error=%d mid_stream_reset=%d stall=%d\n", state, p.injectFailureProbability, strings.Join(p.injectFailureModes, ","),
+		p.chaosFailures["dial_error"].Load(), p.chaosFailures["mid_stream_reset"].Load(), p.chaosFailures["stall"].Load())
+}
@@ -0,0 +1,89 @@
+package clproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// testRoutes checks that the routes' listen and backend addresses, the stats
+// address, and the -flow-collector address are well formed, which otherwise
+// would only show when they are listened on or dialed, and that the routes'
+// limits are sane. Nothing is bound or resolved.
+func (p *Proxy) testRoutes(rts []*route) error {
+	for _, rt := range rts {
+		where := ""
+		if rt.name != "" {
+			where = fmt.Sprintf("route %q: ", rt.name)
+		}
+		if rt.opts().concurrency < 1 {
+			if rt.name == "" {
+				return errors.New("-c must be at least 1")
+			}
+			return fmt.Errorf("%sconcurrency must be at least 1", where)
+		}
+		for _, addr := range rt.opts().listen {
+			if err := checkAddr(addr); err != nil {
+				return fmt.Errorf("%slisten address %s: %w", where, addr, err)
+			}
+		}
+		for _, spec := range append(append([]string(nil), rt.backends.primarySpecs...), rt.backends.backupSpecs...) {
+			addr, _, _ := splitWeight(spec)
+			if strings.HasPrefix(addr, srvPrefix) {
+				continue
+			}
+			if err := checkAddr(addr); err != nil {
+				return fmt.Errorf("%sbackend %s: %w", where, addr, err)
+			}
+		}
+	}
+	if err := checkAddr(p.statsOn); err != nil {
+		return fmt.Errorf("-s %s: %w", p.statsOn, err)
+	}
+	if p.flowCollector != "" {
+		if network, _ := DialAddr(p.flowCollector); network != "tcp" {
+			return fmt.Errorf("-flow-collector %s: want a host:port", p.flowCollector)
+		}
+		if err := checkAddr(p.flowCollector); err != nil {
+			return fmt.Errorf("-flow-collector %s: %w", p.flowCollector, err)
+		}
+	}
+	return nil
+}
+
+// checkAddr checks that addr is a host:port, a unix:///path, or a ws:// or
+// wss:// URL
+func checkAddr(addr string) error {
+	network, path := DialAddr(addr)
+	switch network {
+	case "unix":
+		if path == "" {
+			return errors.New("no socket path")
+		}
+		return nil
+	case "ws":
+		u, err := url.Parse(path)
+		if err != nil {
+			return err
+		}
+		if u.Host == "" {
+			return errors.New("no host")
+		}
+		if u.Port() == "" {
+			// The scheme's port
+			return nil
+		}
+		path = u.Host
+	}
+	_, port, err := net.SplitHostPort(path)
+	if err != nil {
+		return err
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
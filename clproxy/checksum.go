@@ -0,0 +1,71 @@
+package clproxy
+
+import (
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+type checksumSettings struct {
+	// Compute a CRC-32C of everything forwarded in each direction and log it
+	// when the connection ends, for tracking down corruption. Off by default so
+	// that the copy path doesn't pay for it.
+	checksum bool
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// checksums holds the running digests for a connection
+type checksums struct {
+	in  hash.Hash32
+	out hash.Hash32
+}
+
+func newChecksums() *checksums {
+	return &checksums{in: crc32.New(castagnoli), out: crc32.New(castagnoli)}
+}
+
+func hexSum(h hash.Hash32) string {
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+// source returns the reader one direction of the copy should read from.
+// Latency and failure injection, rate limiting, capture, sniffing, tracing,
+// checksumming, and mirroring each wrap the connection only when enabled, so
+// the normal case copies straight from the socket and keeps io.Copy's fast
+// paths.
+func (c *client) source(r io.Reader, from string) io.Reader {
+	if c.chaosLatency {
+		r = c.delayCopy(r, from)
+	}
+	if c.chaosFailure != "" {
+		r = c.injectFault(r)
+	}
+	if c.p.rateLimited() {
+		r = c.limitRate(r, from)
+	}
+	if c.p.captureDir != "" {
+		r = &captureReader{r: r, c: c, from: from}
+	}
+	if c.p.sniffBytes > 0 {
+		r = &sniffReader{r: r, c: c, from: from}
+	}
+	if c.mirror != nil && from == "client" {
+		r = io.TeeReader(r, c.mirror)
+	}
+	if (c.p.logTLSInfo || c.p.logJA3) && from == "client" && c.hello == nil {
+		r = io.TeeReader(r, &helloSniffer{c: c})
+	}
+	if c.sums != nil {
+		if from == "client" {
+			r = io.TeeReader(r, c.sums.in)
+		} else {
+			r = io.TeeReader(r, c.sums.out)
+		}
+	}
+	if c.tracing {
+		r = &firstByteReader{r: r, fn: func() { c.trace("first_byte", "from", from) }}
+	}
+	return r
+}
@@ -0,0 +1,215 @@
+package clproxy
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+type circuitSettings struct {
+	// The passive circuit breaker watches real sessions to each backend. When at
+	// least circuitMinSessions have ended within circuitWindow and the fraction
+	// which failed reaches circuitThreshold, the circuit opens and the backend
+	// gets no new sessions for circuitCooldown. After that up to circuitProbes
+	// sessions are let through; if they all succeed the circuit closes, and if
+	// any fail it opens again. A probe which ends without an outcome, such as
+	// the loser of a Happy Eyeballs race, gives its place to another. A zero
+	// threshold disables the breaker.
+	circuitThreshold   float64
+	circuitWindow      time.Duration
+	circuitMinSessions int
+	circuitCooldown    time.Duration
+	circuitProbes      int
+}
+
+// Sessions which the backend ends within this long without sending anything
+// count as failures, as do dial errors and resets.
+var circuitEarlyClose = time.Second
+
+const (
+	circuitClosed = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+var circuitStates = []string{"closed", "open", "half-open"}
+
+type circuitBucket struct {
+	second int64
+	total  int
+	failed int
+}
+
+// breaker is the circuit state for one backend. The zero value is a closed
+// circuit.
+type breaker struct {
+	sync.Mutex
+	p        *Proxy
+	state    int
+	opened   time.Time
+	buckets  []circuitBucket // one per second of the window
+	probes   int             // sessions let through since half-opening
+	probesOK int
+
+	// Counts the times the circuit has half-opened, so that a probe slot
+	// given back late doesn't free one of a later round of probing
+	round uint64
+}
+
+// probeSlot is a session's place among a backend's probes
+type probeSlot struct {
+	b     *backend
+	round uint64
+}
+
+// allow reports whether the backend may be given a new session, moving an
+// open circuit to half-open once the cooldown has passed
+func (br *breaker) allow(addr string) bool {
+	if br.p.circuitThreshold <= 0 {
+		return true
+	}
+	br.Lock()
+	defer br.Unlock()
+	switch br.state {
+	case circuitOpen:
+		if time.Since(br.opened) < br.p.circuitCooldown {
+			return false
+		}
+		br.state, br.probes, br.probesOK = circuitHalfOpen, 0, 0
+		br.round++
+		br.p.logger.Info("circuit half-open", "backend", addr)
+		fallthrough
+	case circuitHalfOpen:
+		return br.probes < br.p.circuitProbes
+	}
+	return true
+}
+
+// admit counts a session given to the backend, which matters while probing.
+// It returns the round of probing the session is a probe in, or 0 if it
+// isn't one.
+func (br *breaker) admit() uint64 {
+	if br.p.circuitThreshold <= 0 {
+		return 0
+	}
+	br.Lock()
+	defer br.Unlock()
+	if br.state != circuitHalfOpen {
+		return 0
+	}
+	br.probes++
+	return br.round
+}
+
+// unadmit gives back the place of a probe in round which ended without its
+// outcome being recorded, so that another session can take it
+func (br *breaker) unadmit(round uint64) {
+	br.Lock()
+	defer br.Unlock()
+	if br.state == circuitHalfOpen && br.round == round && br.probes > 0 {
+		br.probes--
+	}
+}
+
+// probing notes that c was let through to b as a probe in round
+func (c *client) probing(b *backend, round uint64) {
+	if round != 0 {
+		c.probes = append(c.probes, probeSlot{b, round})
+	}
+}
+
+// settled notes that b's breaker has recorded c's outcome, which used up
+// any place c had among its probes
+func (c *client) settled(b *backend) {
+	c.probes = slices.DeleteFunc(c.probes, func(p probeSlot) bool { return p.b == b })
+}
+
+// release gives back c's session on b, taken by pick, along with its place
+// among b's probes if it has one and no outcome was recorded
+func (c *client) release(b *backend) {
+	for _, p := range c.probes {
+		if p.b == b {
+			b.circuit.unadmit(p.round)
+		}
+	}
+	c.settled(b)
+	b.release()
+}
+
+// record counts the outcome of a session and opens or closes the circuit as
+// needed
+func (br *breaker) record(addr string, failed bool) {
+	if br.p.circuitThreshold <= 0 {
+		return
+	}
+	br.Lock()
+	defer br.Unlock()
+	now := time.Now()
+	switch br.state {
+	case circuitOpen:
+		// Sessions which started before the circuit opened; they have
+		// already been counted for all the good they'd do.
+		return
+	case circuitHalfOpen:
+		if failed {
+			br.open(addr, now, "probe failed")
+			return
+		}
+		br.probesOK++
+		if br.probesOK >= br.p.circuitProbes {
+			br.state = circuitClosed
+			br.buckets = nil
+			br.p.logger.Info("circuit closed", "backend", addr)
+		}
+		return
+	}
+	size := max(int(br.p.circuitWindow/time.Second), 1)
+	if len(br.buckets) != size {
+		br.buckets = make([]circuitBucket, size)
+	}
+	sec := now.Unix()
+	b := &br.buckets[sec%int64(size)]
+	if b.second != sec {
+		*b = circuitBucket{second: sec}
+	}
+	b.total++
+	if failed {
+		b.failed++
+	}
+	total, failures := 0, 0
+	for _, b := range br.buckets {
+		if sec-b.second < int64(size) {
+			total += b.total
+			failures += b.failed
+		}
+	}
+	if total >= br.p.circuitMinSessions && float64(failures)/float64(total) >= br.p.circuitThreshold {
+		br.open(addr, now, "failure rate")
+	}
+}
+
+func (br *breaker) open(addr string, now time.Time, why string) {
+	br.state = circuitOpen
+	br.opened = now
+	br.buckets = nil
+	br.p.logger.Warn("circuit open", "backend", addr, "why", why, "cooldown", br.p.circuitCooldown.Seconds())
+}
+
+func (br *breaker) String() string {
+	br.Lock()
+	defer br.Unlock()
+	return circuitStates[br.state]
+}
+
+// sessionFailed decides whether a completed session counts against its
+// backend: a reset, or the backend hanging up early without saying anything.
+// Failures injected by -inject-failure-probability never do.
+func (c *client) sessionFailed() bool {
+	if c.closedBy != "backend" || c.chaosFailure != "" {
+		return false
+	}
+	if c.reason == "reset" {
+		return true
+	}
+	return c.bytesOut == 0 && c.done.Sub(c.dialed) < circuitEarlyClose
+}
@@ -0,0 +1,338 @@
+package clproxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type clientACLSettings struct {
+	// -allow and -deny restrict which clients may connect by their address, the
+	// one from the PROXY header with -accept-proxy. Deny wins: a client matching
+	// any -deny CIDR is refused, however specifically -allow names it. With
+	// -allow only clients matching one of its CIDRs are let in; with neither
+	// everyone is, as before. IPv4 clients on dual stack listeners, seen as
+	// IPv4-mapped IPv6, match IPv4 CIDRs. Clients of Unix socket listeners have
+	// no address to check and are always let in. Refused clients are closed
+	// before they are queued, so they never hold a concurrency slot, and are
+	// counted in the stats summary. Their log lines are rate limited like errors
+	// in quiet mode, at most ten per -log-aggregate-interval, unless they go to
+	// the -access-log, which gets one for every client.
+	clientAllow string
+	clientDeny  string
+
+	// With -acl-file the rules come from a file instead, one "allow <cidr>" or
+	// "deny <cidr>" per line with # starting a comment, and the most specific
+	// rule matching a client decides, deny winning between rules for the same
+	// CIDR. A client matching no rule is refused if the file has any allow
+	// rules, and let in if not. The file is read again on SIGHUP and whenever
+	// it changes; a file which doesn't parse is rejected as a whole and the
+	// rules we have are kept.
+	aclFile string
+}
+
+type clientACLState struct {
+	allowPrefixes []netip.Prefix
+	denyPrefixes  []netip.Prefix
+	acl           atomic.Pointer[aclRules]
+
+	// Serializes reloads, and holds the last reload's error
+	aclReload struct {
+		sync.Mutex
+		err string
+	}
+	deniedClients atomic.Uint64
+
+	// denialLog rate limits the "client denied" lines
+	denialLog struct {
+		sync.Mutex
+		since    time.Time
+		logged   int
+		unlogged uint64
+	}
+}
+
+// How often to look for changes to the ACL file
+const aclFilePoll = 2 * time.Second
+
+// aclRule is one line of the ACL file, or one CIDR of -allow or -deny
+type aclRule struct {
+	prefix netip.Prefix
+	allow  bool
+	line   int // in the ACL file, 0 for flags
+}
+
+func (r *aclRule) String() string {
+	action := "deny"
+	if r.allow {
+		action = "allow"
+	}
+	if r.line == 0 {
+		return "-" + action + " " + r.prefix.String()
+	}
+	return fmt.Sprintf("%s %s (line %d)", action, r.prefix, r.line)
+}
+
+// aclRules is the ACL file as last read, most specific rule first
+type aclRules struct {
+	rules    []aclRule
+	anyAllow bool
+	info     os.FileInfo
+}
+
+func (p *Proxy) setupClientACL() error {
+	if p.aclFile != "" {
+		if p.clientAllow != "" || p.clientDeny != "" {
+			return errors.New("-acl-file can't be used with -allow or -deny; put them in the file")
+		}
+		rules, err := readACLFile(p.aclFile)
+		if err != nil {
+			return err
+		}
+		p.acl.Store(rules)
+		p.onReload = append(p.onReload, func() { p.reloadACLFile(true) })
+		p.background = append(p.background, p.watchACLFile)
+		return nil
+	}
+	var err error
+	if p.allowPrefixes, err = parsePrefixes(p.clientAllow); err != nil {
+		return fmt.Errorf("bad -allow: %w", err)
+	}
+	if p.denyPrefixes, err = parsePrefixes(p.clientDeny); err != nil {
+		return fmt.Errorf("bad -deny: %w", err)
+	}
+	return nil
+}
+
+func parsePrefixes(s string) ([]netip.Prefix, error) {
+	var ps []netip.Prefix
+	for _, item := range splitList(s) {
+		p, err := parsePrefix(item)
+		if err != nil {
+			return nil, err
+		}
+		ps = append(ps, p)
+	}
+	return ps, nil
+}
+
+// readACLFile parses an ACL file
+func readACLFile(path string) (*aclRules, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	a := &aclRules{info: fi}
+	sc := bufio.NewScanner(bytes.NewReader(buf))
+	for n := 1; sc.Scan(); n++ {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 || fields[0] != "allow" && fields[0] != "deny" {
+			return nil, fmt.Errorf("%s:%d: want allow <cidr> or deny <cidr>", path, n)
+		}
+		p, err := parsePrefix(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		r := aclRule{prefix: p, allow: fields[0] == "allow", line: n}
+		a.rules = append(a.rules, r)
+		a.anyAllow = a.anyAllow || r.allow
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	slices.SortStableFunc(a.rules, func(x, y aclRule) int {
+		if x.prefix.Bits() != y.prefix.Bits() {
+			return y.prefix.Bits() - x.prefix.Bits()
+		}
+		if x.allow == y.allow {
+			return 0
+		}
+		if !x.allow {
+			return -1
+		}
+		return 1
+	})
+	return a, nil
+}
+
+// reloadACLFile reads the ACL file again, unless it is unchanged and force
+// isn't set, keeping the rules we have if it doesn't parse
+func (p *Proxy) reloadACLFile(force bool) {
+	p.aclReload.Lock()
+	defer p.aclReload.Unlock()
+	old := p.acl.Load()
+	if !force {
+		fi, err := os.Stat(p.aclFile)
+		if err == nil && fi.ModTime().Equal(old.info.ModTime()) && fi.Size() == old.info.Size() {
+			return
+		}
+	}
+	rules, err := readACLFile(p.aclFile)
+	if err != nil {
+		// Only complain about a problem once, not every poll
+		repeated := !force && err.Error() == p.aclReload.err
+		p.aclReload.err = err.Error()
+		if !repeated {
+			p.logger.Error("acl file rejected, keeping the previous rules", "file", p.aclFile, "error", err.Error())
+		}
+		return
+	}
+	p.aclReload.err = ""
+	p.acl.Store(rules)
+	p.logger.Info("acl file loaded", "file", p.aclFile, "rules", len(rules.rules))
+}
+
+func (p *Proxy) watchACLFile() {
+	for range p.ticks(aclFilePoll) {
+		p.reloadACLFile(false)
+	}
+}
+
+// aclEnabled reports whether clients' addresses are checked at all
+func (p *Proxy) aclEnabled() bool {
+	return p.aclFile != "" || p.allowPrefixes != nil || p.denyPrefixes != nil
+}
+
+// checkACL decides whether ip may connect, returning the rule which decided
+// it, if one did, and why it was refused
+func (p *Proxy) checkACL(ip netip.Addr) (ok bool, rule *aclRule, reason string) {
+	ip = ip.Unmap()
+	if p.aclFile != "" {
+		a := p.acl.Load()
+		for i := range a.rules {
+			if r := &a.rules[i]; r.prefix.Contains(ip) {
+				if r.allow {
+					return true, r, ""
+				}
+				return false, r, "deny"
+			}
+		}
+		if a.anyAllow {
+			return false, nil, "not_allowed"
+		}
+		return true, nil, ""
+	}
+	for _, prefix := range p.denyPrefixes {
+		if prefix.Contains(ip) {
+			return false, &aclRule{prefix: prefix}, "deny"
+		}
+	}
+	for _, prefix := range p.allowPrefixes {
+		if prefix.Contains(ip) {
+			return true, &aclRule{prefix: prefix, allow: true}, ""
+		}
+	}
+	if p.allowPrefixes != nil {
+		return false, nil, "not_allowed"
+	}
+	return true, nil, ""
+}
+
+// clientAllowed checks conn's address against the ACL, logging and counting
+// it if it is refused
+func (p *Proxy) clientAllowed(conn net.Conn) bool {
+	if !p.aclEnabled() {
+		return true
+	}
+	ip, ok := addrIP(conn.RemoteAddr())
+	if !ok {
+		return true
+	}
+	ok, rule, reason := p.checkACL(ip)
+	if ok {
+		return true
+	}
+	p.deniedClients.Add(1)
+	p.logDenial(conn, reason, rule)
+	return false
+}
+
+func (p *Proxy) logDenial(conn net.Conn, reason string, rule *aclRule) {
+	var ruleArgs []any
+	if rule != nil {
+		ruleArgs = []any{"rule", rule.String()}
+	}
+	// The access log gets every denial; only the operational log's lines
+	// are rate limited
+	if p.logRejection(p.remoteName(conn), conn, reason, append(ruleArgs, "action", p.denyAction)...) {
+		return
+	}
+	p.denialLog.Lock()
+	now := time.Now()
+	var unlogged uint64
+	if now.Sub(p.denialLog.since) >= p.logAggregateInterval {
+		unlogged = p.denialLog.unlogged
+		p.denialLog.since, p.denialLog.logged, p.denialLog.unlogged = now, 0, 0
+	}
+	log := p.denialLog.logged < quietErrors
+	if log {
+		p.denialLog.logged++
+	} else {
+		p.denialLog.unlogged++
+	}
+	p.denialLog.Unlock()
+	if unlogged > 0 {
+		p.logger.Warn("clients denied without a log line", "count", unlogged)
+	}
+	if log {
+		args := append([]any{"client", p.remoteName(conn), "local", conn.LocalAddr().String(), "reason", reason}, ruleArgs...)
+		args = append(args, "action", p.denyAction)
+		p.logger.Warn("client denied", args...)
+	}
+}
+
+// statsACL answers "acl test <ip>" on the stats port, saying which rule
+// would decide a client from ip
+func (p *Proxy) statsACL(w io.Writer, args []string) {
+	if len(args) != 2 || args[0] != "test" {
+		fmt.Fprintln(w, "error: usage: acl test <ip>")
+		return
+	}
+	ip, err := netip.ParseAddr(args[1])
+	if err != nil {
+		fmt.Fprintf(w, "error: bad address %q\n", args[1])
+		return
+	}
+	if !p.aclEnabled() {
+		fmt.Fprintln(w, "allow: there is no -allow, -deny, or -acl-file")
+		return
+	}
+	ok, rule, _ := p.checkACL(ip)
+	action := "deny"
+	if ok {
+		action = "allow"
+	}
+	switch {
+	case rule != nil:
+		fmt.Fprintf(w, "%s: %s\n", action, rule)
+	case ok:
+		fmt.Fprintln(w, "allow: no rule matches, and there are no allow rules")
+	default:
+		fmt.Fprintln(w, "deny: no allow rule matches")
+	}
+}
+
+// statsClientACL adds the number of refused clients to the stats summary
+func (p *Proxy) statsClientACL(w io.Writer) {
+	if p.aclEnabled() {
+		fmt.Fprintf(w, "denied: %d\n", p.deniedClients.Load())
+	}
+}
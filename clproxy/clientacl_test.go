@@ -0,0 +1,128 @@
+package clproxy
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// aclCase is a client and how the ACL should treat it
+type aclCase struct {
+	ip     string
+	ok     bool
+	rule   string // as logged, "" for none
+	reason string
+}
+
+func checkACLCases(t *testing.T, p *Proxy, name string, cases []aclCase) {
+	t.Helper()
+	for _, tc := range cases {
+		ok, rule, reason := p.checkACL(netip.MustParseAddr(tc.ip))
+		got := ""
+		if rule != nil {
+			got = rule.String()
+		}
+		if ok != tc.ok || got != tc.rule || reason != tc.reason {
+			t.Errorf("%s: %s: got %v %q %q, want %v %q %q", name, tc.ip, ok, got, reason, tc.ok, tc.rule, tc.reason)
+		}
+	}
+}
+
+func TestCheckACLFlags(t *testing.T) {
+	for _, tc := range []struct {
+		name, allow, deny string
+		cases             []aclCase
+	}{
+		{"deny only", "", "10.0.0.0/8", []aclCase{
+			{"10.1.2.3", false, "-deny 10.0.0.0/8", "deny"},
+			{"192.0.2.1", true, "", ""},
+			// IPv4 clients of dual stack listeners
+			{"::ffff:10.1.2.3", false, "-deny 10.0.0.0/8", "deny"},
+		}},
+		{"allow only", "10.0.0.0/8", "", []aclCase{
+			{"10.1.2.3", true, "-allow 10.0.0.0/8", ""},
+			{"192.0.2.1", false, "", "not_allowed"},
+			{"2001:db8::1", false, "", "not_allowed"},
+		}},
+		// Deny wins, however specifically -allow names the client
+		{"deny wins", "10.1.2.0/24,10.1.2.3/32", "10.0.0.0/8", []aclCase{
+			{"10.1.2.3", false, "-deny 10.0.0.0/8", "deny"},
+			{"10.2.0.1", false, "-deny 10.0.0.0/8", "deny"},
+			{"192.0.2.1", false, "", "not_allowed"},
+		}},
+		{"neither", "", "", []aclCase{
+			{"10.1.2.3", true, "", ""},
+			{"2001:db8::1", true, "", ""},
+		}},
+	} {
+		p := newProxy(&Options{})
+		p.clientAllow, p.clientDeny = tc.allow, tc.deny
+		if err := p.setupClientACL(); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		checkACLCases(t, p, tc.name, tc.cases)
+	}
+}
+
+func TestCheckACLFile(t *testing.T) {
+	for _, tc := range []struct {
+		name, file string
+		cases      []aclCase
+	}{
+		// The most specific rule decides, whichever order they are in
+		{"most specific", "deny 10.0.0.0/8\nallow 10.1.0.0/16 # the app servers\ndeny 10.1.2.3/32\n", []aclCase{
+			{"10.1.2.3", false, "deny 10.1.2.3/32 (line 3)", "deny"},
+			{"10.1.9.9", true, "allow 10.1.0.0/16 (line 2)", ""},
+			{"10.2.0.1", false, "deny 10.0.0.0/8 (line 1)", "deny"},
+			{"::ffff:10.1.9.9", true, "allow 10.1.0.0/16 (line 2)", ""},
+			// There are allow rules, so clients matching none are refused
+			{"192.0.2.1", false, "", "not_allowed"},
+		}},
+		// Deny wins between rules for the same CIDR
+		{"same cidr", "allow 10.0.0.0/8\ndeny 10.0.0.0/8\nallow 0.0.0.0/0\n", []aclCase{
+			{"10.1.2.3", false, "deny 10.0.0.0/8 (line 2)", "deny"},
+			{"192.0.2.1", true, "allow 0.0.0.0/0 (line 3)", ""},
+			{"2001:db8::1", false, "", "not_allowed"},
+		}},
+		// Without allow rules, clients matching none are let in
+		{"no allow", "# nothing but denials\ndeny 10.0.0.0/8\ndeny 2001:db8::/32\n", []aclCase{
+			{"10.1.2.3", false, "deny 10.0.0.0/8 (line 2)", "deny"},
+			{"2001:db8::1", false, "deny 2001:db8::/32 (line 3)", "deny"},
+			{"192.0.2.1", true, "", ""},
+		}},
+		{"empty", "", []aclCase{
+			{"192.0.2.1", true, "", ""},
+		}},
+	} {
+		path := filepath.Join(t.TempDir(), "acl")
+		if err := os.WriteFile(path, []byte(tc.file), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		rules, err := readACLFile(path)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		p := newProxy(&Options{})
+		p.aclFile = path
+		p.acl.Store(rules)
+		checkACLCases(t, p, tc.name, tc.cases)
+	}
+}
+
+func TestReadACLFileBad(t *testing.T) {
+	for _, file := range []string{
+		"allow\n",
+		"permit 10.0.0.0/8\n",
+		"allow 10.0.0.0/8 10.1.0.0/16\n",
+		"deny 10.0.0.0/33\n",
+	} {
+		path := filepath.Join(t.TempDir(), "acl")
+		if err := os.WriteFile(path, []byte(file), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readACLFile(path); err == nil {
+			t.Errorf("%q: no error", file)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package clproxy
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+type clientCertSettings struct {
+	// With a client CA bundle set, TLS clients must (or, with
+	// -tls-client-auth verify-if-given, may) present a certificate signed by one
+	// of its CAs
+	tlsClientCA   string
+	tlsClientAuth string
+
+	// A file of SHA-256 certificate fingerprints, one per line in hex, which are
+	// refused even though they verify. Reloaded on SIGHUP. Empty disables it.
+	tlsDeniedFile string
+}
+
+type clientCertState struct {
+	tlsDenied atomic.Pointer[map[string]bool]
+}
+
+var errCertDenied = errors.New("client certificate is denied")
+
+// setupClientAuth adds client certificate verification to cfg
+func (p *Proxy) setupClientAuth(cfg *tls.Config) error {
+	switch p.tlsClientAuth {
+	case "require":
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	case "verify-if-given":
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return fmt.Errorf("unknown -tls-client-auth %q, want require or verify-if-given", p.tlsClientAuth)
+	}
+	pem, err := os.ReadFile(p.tlsClientCA)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificates found in %s", p.tlsClientCA)
+	}
+	cfg.ClientCAs = pool
+	if p.tlsDeniedFile != "" {
+		if err := p.reloadDenied(); err != nil {
+			return err
+		}
+		p.onReload = append(p.onReload, func() { p.reloadDenied() })
+		cfg.VerifyConnection = p.checkDenied
+	}
+	return nil
+}
+
+// checkDenied fails the handshake of a client whose certificate is in the
+// denied list
+func (p *Proxy) checkDenied(cs tls.ConnectionState) error {
+	denied := p.tlsDenied.Load()
+	if len(cs.PeerCertificates) == 0 || denied == nil {
+		return nil
+	}
+	if (*denied)[fingerprint(cs.PeerCertificates[0])] {
+		return errCertDenied
+	}
+	return nil
+}
+
+func fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// loadDenied reads the denied fingerprints file. Colons, as printed by
+// openssl x509 -fingerprint, are allowed. Blank lines and lines starting with
+// # are ignored.
+func loadDenied(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	out := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if i := strings.LastIndexByte(line, '='); i >= 0 {
+			line = line[i+1:]
+		}
+		fp := strings.ToLower(strings.ReplaceAll(line, ":", ""))
+		if b, err := hex.DecodeString(fp); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("%s:%d: want a SHA-256 fingerprint", path, n)
+		}
+		out[fp] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// reloadDenied swaps in a freshly read denied list, keeping the old one if the
+// file is broken
+func (p *Proxy) reloadDenied() error {
+	denied, err := loadDenied(p.tlsDeniedFile)
+	if err != nil {
+		p.logger.Error("denied certificates not loaded", "file", p.tlsDeniedFile, "error", err.Error())
+		return err
+	}
+	p.tlsDenied.Store(&denied)
+	p.logger.Info("denied certificates loaded", "file", p.tlsDeniedFile, "entries", len(denied))
+	return nil
+}
+
+// certIdentity is the name a verified client certificate is known by: its
+// common name, or failing that its first DNS, email, or URI SAN
+func certIdentity(cert *x509.Certificate) string {
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	}
+	return ""
+}
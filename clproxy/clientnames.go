@@ -0,0 +1,112 @@
+package clproxy
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+type clientNamesSettings struct {
+	// A file mapping client CIDRs to friendly names for the logs, e.g.
+	//
+	//	10.3.7.0/24 billing-workers
+	//
+	// Empty disables naming.
+	clientNamesFile string
+}
+
+type clientNamesState struct {
+	// The current mapping, most specific prefix first. Replaced wholesale on
+	// reload so lookups never need a lock.
+	clientNames atomic.Pointer[[]namedPrefix]
+}
+
+type namedPrefix struct {
+	prefix netip.Prefix
+	name   string
+}
+
+// loadClientNames parses the client names file. Blank lines and lines
+// starting with # are ignored.
+func loadClientNames(path string) ([]namedPrefix, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var out []namedPrefix
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want \"<cidr> <name>\"", path, n)
+		}
+		prefix, err := parsePrefix(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, n, err.Error())
+		}
+		out = append(out, namedPrefix{prefix: prefix, name: fields[1]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].prefix.Bits() > out[j].prefix.Bits() })
+	return out, nil
+}
+
+// parsePrefix accepts a CIDR or a bare address, which is treated as a
+// single host. IPv4-mapped IPv6 prefixes are turned into plain IPv4 ones.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		ip, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		ip = ip.Unmap()
+		return netip.PrefixFrom(ip, ip.BitLen()), nil
+	}
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return p, err
+	}
+	if p.Addr().Is4In6() && p.Bits() >= 96 {
+		p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+	}
+	return p.Masked(), nil
+}
+
+// reloadClientNames swaps in a freshly read mapping, keeping the old one if
+// the file is broken
+func (p *Proxy) reloadClientNames() error {
+	names, err := loadClientNames(p.clientNamesFile)
+	if err != nil {
+		p.logger.Error("client names not loaded", "file", p.clientNamesFile, "error", err.Error())
+		return err
+	}
+	p.clientNames.Store(&names)
+	p.logger.Info("client names loaded", "file", p.clientNamesFile, "entries", len(names))
+	return nil
+}
+
+// clientName returns the name of the most specific prefix containing ip, or
+// "" if there isn't one
+func (p *Proxy) clientName(ip netip.Addr) string {
+	names := p.clientNames.Load()
+	if names == nil {
+		return ""
+	}
+	for _, np := range *names {
+		if np.prefix.Contains(ip) {
+			return np.name
+		}
+	}
+	return ""
+}
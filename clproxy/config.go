@@ -0,0 +1,228 @@
+package clproxy
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type configSettings struct {
+	// With -config the routes come from a YAML file instead of -l, -p and
+	// friends, e.g.
+	//
+	//	concurrency: 10
+	//	balance: leastconn
+	//	routes:
+	//	  - name: web
+	//	    listen: 0.0.0.0:80
+	//	    backend: [10.0.0.1:80, 10.0.0.2:80]
+	//	  - name: db
+	//	    listen: 127.0.0.1:5432
+	//	    backend: db.internal:5432
+	//	    concurrency: 50
+	//	    happy_eyeballs_delay: 0s
+	//
+	// Settings at the top level are the defaults for every route.
+	configFile string
+}
+
+// The flags which the config file replaces, and so can't be used with it
+var configFlags = []string{"l", "p", "p-backup", "backends-file", "c", "balance", "happy-eyeballs-delay", "tls-handshake-timeout", "accept-proxy-timeout", "sni-timeout", "route"}
+
+// routeSettings are the settings which may be given for each route or, as
+// defaults, at the top level. Nil means not given.
+type routeSettings struct {
+	Concurrency         *int           `yaml:"concurrency"`
+	Balance             *string        `yaml:"balance"`
+	HappyEyeballsDelay  *time.Duration `yaml:"happy_eyeballs_delay"`
+	TLSHandshakeTimeout *time.Duration `yaml:"tls_handshake_timeout"`
+	AcceptProxyTimeout  *time.Duration `yaml:"accept_proxy_timeout"`
+	SNITimeout          *time.Duration `yaml:"sni_timeout"`
+}
+
+type routeConfig struct {
+	Name          string     `yaml:"name"`
+	Listen        stringList `yaml:"listen"`
+	Backend       stringList `yaml:"backend"`
+	Backup        stringList `yaml:"backup"`
+	BackendsFile  string     `yaml:"backends_file"`
+	routeSettings `yaml:",inline"`
+}
+
+type config struct {
+	routeSettings `yaml:",inline"`
+	Routes        []routeConfig `yaml:"routes"`
+}
+
+// stringList is a list of addresses, given either as a YAML sequence or as
+// a comma separated string like the flags take
+type stringList []string
+
+func (l *stringList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*l = splitList(value.Value)
+		return nil
+	}
+	var list []string
+	if err := value.Decode(&list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+// apply copies the settings which were given onto a route which isn't in
+// use yet
+func (s *routeSettings) apply(rt *route) {
+	o := rt.opts()
+	if s.Concurrency != nil {
+		o.concurrency = *s.Concurrency
+	}
+	if s.Balance != nil {
+		rt.backends.balance = *s.Balance
+	}
+	if s.HappyEyeballsDelay != nil {
+		o.happyEyeballsDelay = *s.HappyEyeballsDelay
+	}
+	if s.TLSHandshakeTimeout != nil {
+		o.tlsHandshakeTimeout = *s.TLSHandshakeTimeout
+	}
+	if s.AcceptProxyTimeout != nil {
+		o.acceptProxyTimeout = *s.AcceptProxyTimeout
+	}
+	if s.SNITimeout != nil {
+		o.sniTimeout = *s.SNITimeout
+	}
+}
+
+// checkConfigFlags returns an error naming any flag given along with -config
+// which the config file replaces
+func (p *Proxy) checkConfigFlags() error {
+	var set []string
+	p.flags.Visit(func(f *flag.Flag) {
+		for _, name := range configFlags {
+			if f.Name == name {
+				set = append(set, p.flagSource(name))
+			}
+		}
+	})
+	if len(set) > 0 {
+		return fmt.Errorf("%s can't be used with -config; set them in %s instead", strings.Join(set, ", "), p.configFile)
+	}
+	return nil
+}
+
+// loadConfig reads and checks the routes in a config file. The routes'
+// backends are not resolved yet.
+func (p *Proxy) loadConfig(path string) ([]*route, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg config
+	dec := yaml.NewDecoder(bytes.NewReader(buf))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, err
+	}
+	if len(cfg.Routes) == 0 {
+		return nil, errors.New("no routes")
+	}
+	var out []*route
+	seen := map[string]bool{}
+	lines := routeLines(buf)
+	for i, rc := range cfg.Routes {
+		rt, err := p.configRoute(&cfg, i, rc, seen)
+		if err != nil {
+			if i < len(lines) {
+				err = fmt.Errorf("%s:%d: %w", path, lines[i], err)
+			}
+			return nil, err
+		}
+		out = append(out, rt)
+	}
+	return out, nil
+}
+
+// configRoute checks the i'th route in a config file and makes it, given the
+// names of those before it
+func (p *Proxy) configRoute(cfg *config, i int, rc routeConfig, seen map[string]bool) (*route, error) {
+	if rc.Name == "" {
+		return nil, fmt.Errorf("route %d has no name", i+1)
+	}
+	if seen[rc.Name] {
+		return nil, fmt.Errorf("route %q is given twice", rc.Name)
+	}
+	seen[rc.Name] = true
+	if len(rc.Listen) == 0 {
+		return nil, fmt.Errorf("route %q has no listen address", rc.Name)
+	}
+	if len(rc.Backend) == 0 && rc.BackendsFile == "" {
+		return nil, fmt.Errorf("route %q has no backend", rc.Name)
+	}
+	if len(rc.Backend) > 0 && rc.BackendsFile != "" {
+		return nil, fmt.Errorf("route %q has both backend and backends_file", rc.Name)
+	}
+	if err := checkWeights(append(append([]string(nil), rc.Backend...), rc.Backup...)); err != nil {
+		return nil, fmt.Errorf("route %q: %w", rc.Name, err)
+	}
+	rt := p.newRoute(rc.Name)
+	rt.opts().listen = rc.Listen
+	rt.backends.primarySpecs, rt.backends.backupSpecs = rc.Backend, rc.Backup
+	if rc.BackendsFile != "" {
+		rt.backends.file = rc.BackendsFile
+		if _, err := rt.backends.loadBackendsFile(); err != nil {
+			return nil, fmt.Errorf("route %q: %w", rc.Name, err)
+		}
+	}
+	cfg.routeSettings.apply(rt)
+	rc.routeSettings.apply(rt)
+	if rt.opts().concurrency < 1 {
+		return nil, fmt.Errorf("route %q: concurrency must be at least 1", rc.Name)
+	}
+	if _, ok := p.balancers[rt.backends.balance]; !ok {
+		return nil, fmt.Errorf("route %q: unknown balance %q", rc.Name, rt.backends.balance)
+	}
+	return rt, nil
+}
+
+// routeLines returns the line each route starts on in a config file, for
+// pointing errors at them
+func routeLines(buf []byte) []int {
+	var doc yaml.Node
+	if yaml.Unmarshal(buf, &doc) != nil || len(doc.Content) == 0 {
+		return nil
+	}
+	top := doc.Content[0]
+	for i := 0; i+1 < len(top.Content); i += 2 {
+		if top.Content[i].Value != "routes" {
+			continue
+		}
+		var lines []int
+		for _, n := range top.Content[i+1].Content {
+			lines = append(lines, n.Line)
+		}
+		return lines
+	}
+	return nil
+}
+
+// flagRoute is the single unnamed route described by the command line
+func (p *Proxy) flagRoute() (*route, error) {
+	rt := p.newRoute("")
+	rt.opts().listen = splitList(p.listenOn)
+	rt.backends.primarySpecs, rt.backends.backupSpecs = splitList(p.proxyTo), splitList(p.proxyBackup)
+	if p.backendsFile != "" {
+		rt.backends.file = p.backendsFile
+		if _, err := rt.backends.loadBackendsFile(); err != nil {
+			return nil, err
+		}
+	}
+	return rt, nil
+}
@@ -0,0 +1,68 @@
+package clproxy
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// goLive makes c findable by id from the stats port while it copies, and
+// starts capturing it if its address is being captured
+func (c *client) goLive() {
+	c.p.liveLock.Lock()
+	c.p.live[c.UID] = c
+	c.p.liveLock.Unlock()
+	c.captureIfWatched()
+}
+
+// goneLive undoes goLive once c has stopped copying, finishing any capture
+// and dropping any throttle
+func (c *client) goneLive() {
+	c.p.liveLock.Lock()
+	delete(c.p.live, c.UID)
+	c.p.liveLock.Unlock()
+	c.endCapture()
+	c.adminBucket.Store(nil)
+}
+
+// findLive returns the session copying data with id, or nil
+func (p *Proxy) findLive(id string) *client {
+	p.liveLock.Lock()
+	defer p.liveLock.Unlock()
+	return p.live[id]
+}
+
+// liveSessions returns the sessions copying data, oldest first
+func (p *Proxy) liveSessions() []*client {
+	p.liveLock.Lock()
+	defer p.liveLock.Unlock()
+	cs := make([]*client, 0, len(p.live))
+	for _, c := range p.live {
+		cs = append(cs, c)
+	}
+	sort.Slice(cs, func(i, j int) bool { return cs[i].ID < cs[j].ID })
+	return cs
+}
+
+// statsLive answers "conns" on the stats port with a line for each session
+// copying data
+func (p *Proxy) statsLive(w io.Writer, args []string) {
+	for _, c := range p.liveSessions() {
+		fmt.Fprintf(w, "id=%s client=%s backend=%s age=%f", c.UID, c.name, c.backend.addr, time.Since(c.start).Seconds())
+		if c.label != "" {
+			fmt.Fprintf(w, " client_name=%s", c.label)
+		}
+		if name := c.rt.logName(); name != "" {
+			fmt.Fprintf(w, " route=%s", name)
+		}
+		if b := c.adminBucket.Load(); b != nil {
+			rate := byteRate(b.rate)
+			fmt.Fprintf(w, " throttle=%s", rate.String())
+		}
+		if cp := c.capture.Load(); cp != nil && cp != captureEnded && !cp.stopped.Load() {
+			fmt.Fprintf(w, " capture=%s", cp.dir)
+		}
+		fmt.Fprintln(w)
+	}
+}
@@ -0,0 +1,281 @@
+package clproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+type dialSettings struct {
+	// When a backend name resolves to both IPv6 and IPv4 addresses, a dial which
+	// hasn't completed within this long races a dial to an address of the other
+	// family (RFC 8305 "Happy Eyeballs"). Whichever connects first is used.
+	happyEyeballsDelay time.Duration
+
+	// After a failed dial up to dialRetries other backends are tried, primaries
+	// first, before the client is given up on. dialTimeout, if set, bounds the
+	// time spent dialing for a connection across all of its attempts.
+	dialRetries int
+	dialTimeout time.Duration
+
+	// With -transparent (Linux only) backend connections are made from the
+	// client's own address, so the backend sees the real client
+	transparent bool
+}
+
+// A DialFunc makes connections to backends reached by means of a program's
+// own, such as an overlay network, in place of the proxy's own dialing; see
+// Options.DialFunc. addr is the backend's address as configured or picked,
+// and ctx ends with the session's -dial-timeout or the -health-timeout. It
+// is called from many connections at once.
+type DialFunc func(ctx context.Context, addr string) (net.Conn, error)
+
+type dialState struct {
+	dialFunc DialFunc
+}
+
+// Backends given as unix:///path/to/socket are dialed over a Unix domain socket
+const unixPrefix = "unix://"
+
+// DialAddr splits a backend or listen address into the network and address
+// to give net.Dial or net.Listen
+func DialAddr(addr string) (network, address string) {
+	if path, ok := strings.CutPrefix(addr, unixPrefix); ok {
+		return "unix", path
+	}
+	if isWebSocketURL(addr) {
+		return "ws", addr
+	}
+	return "tcp", addr
+}
+
+type dialResult struct {
+	backend *backend
+	conn    net.Conn
+	err     error
+	took    time.Duration
+	tlsTook time.Duration
+}
+
+// newDialer returns a dialer for backend connections, offering MPTCP and
+// TCP Fast Open if they are on, bound to -bind-device if set, and resolving
+// with -resolver
+func (p *Proxy) newDialer() *net.Dialer {
+	d := &net.Dialer{Resolver: p.resolver.dialer}
+	if p.multipathTCP {
+		d.SetMultipathTCP(true)
+	}
+	if p.tcpFastOpen {
+		d.Control = p.tfoDialControl
+	}
+	if p.bindDevice != "" {
+		d.Control = withControl(d.Control, p.bindDeviceControl)
+	}
+	return d
+}
+
+// dialer returns the dialer to reach b on behalf of c
+func (c *client) dialer(b *backend) *net.Dialer {
+	d := c.p.newDialer()
+	if c.p.transparent && b.network == "tcp" {
+		// Connect from the client's own address
+		ip, _ := addrIP(c.conn.RemoteAddr())
+		d.LocalAddr = &net.TCPAddr{IP: ip.AsSlice()}
+		d.Control = withControl(d.Control, transparentControl)
+	}
+	return d
+}
+
+// dialBackend makes a single connection attempt to b, including the TLS
+// handshake if -backend-tls is set, recording the outcome in b's counters
+func (c *client) dialBackend(ctx context.Context, b *backend) dialResult {
+	var r dialResult
+	if c.p.tunnelClient != "" {
+		r = c.tunnelDial(b)
+	} else {
+		r = c.p.connect(ctx, c.dialer(b), b, c.rt.opts().tlsHandshakeTimeout)
+	}
+	if !errors.Is(ctx.Err(), context.Canceled) {
+		// A dial cancelled because another won says nothing about b
+		b.dialed(r.took, r.err)
+		if r.err != nil {
+			c.feedback(b, r.err)
+		}
+	}
+	return r
+}
+
+// dialContext limits a dial to what is left of c's -dial-timeout
+func (c *client) dialContext() (context.Context, context.CancelFunc) {
+	if c.dialDeadline.IsZero() {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithDeadline(context.Background(), c.dialDeadline)
+}
+
+// dialExpired reports whether c's -dial-timeout has run out
+func (c *client) dialExpired() bool {
+	return !c.dialDeadline.IsZero() && !time.Now().Before(c.dialDeadline)
+}
+
+// attempts lists the backends c has dialed, in order
+func (c *client) attempts() string {
+	addrs := make([]string, len(c.tried))
+	for i, b := range c.tried {
+		addrs[i] = b.addr
+	}
+	return strings.Join(addrs, ",")
+}
+
+// connect makes a connection to b with d, or the DialFunc, through -socks5
+// or -http-proxy if set, completes the TLS handshake if -backend-tls is set,
+// and sends the -backend-prelude-file if there is one
+func (p *Proxy) connect(ctx context.Context, d *net.Dialer, b *backend, tlsTimeout time.Duration) dialResult {
+	start := time.Now()
+	var conn net.Conn
+	var err error
+	switch {
+	case p.dialFunc != nil && b.network != "ws":
+		conn, err = p.dialFunc(ctx, b.addr)
+	case b.network == "tcp":
+		conn, err = p.dialTCP(ctx, d, b.path)
+	case b.network == "ws":
+		conn, err = p.wsDial(ctx, d, b.path)
+	default:
+		conn, err = p.dialFrom(ctx, d, b.network, b.path)
+	}
+	took := time.Since(start)
+	p.nameResolver(err)
+	var tlsTook time.Duration
+	// A wss:// backend's TLS was done by the WebSocket dial
+	if err == nil && p.backendTLSConfig != nil && b.network != "ws" {
+		conn, err = p.backendHandshake(ctx, conn, b, tlsTimeout)
+		tlsTook = time.Since(start) - took
+	}
+	if err == nil && p.backendPreludeFile != "" {
+		if err = p.sendPrelude(ctx, conn); err != nil {
+			conn.Close()
+			conn = nil
+		}
+	}
+	return dialResult{backend: b, conn: conn, err: err, took: took, tlsTook: tlsTook}
+}
+
+// dialTCP connects to addr with d, through -socks5 or -http-proxy if set
+func (p *Proxy) dialTCP(ctx context.Context, d *net.Dialer, addr string) (net.Conn, error) {
+	switch {
+	case p.socksProxy != "":
+		return p.socksDial(ctx, d, addr)
+	case p.httpProxyURL != nil:
+		return p.httpProxyDial(ctx, d, addr)
+	}
+	return p.dialFrom(ctx, d, "tcp", addr)
+}
+
+// dial connects c to c.backend, racing an address of the other family if the
+// first attempt is slow or fails. If the other address wins c.backend is
+// switched over to it.
+func (c *client) dial() {
+	c.tried = append(c.tried, c.backend)
+	if conn, ok := c.backend.pool.take(c.p.poolIdleTimeout); ok {
+		c.trace("pool_take", "backend", c.backend.addr)
+		c.backend.dialed(0, nil)
+		c.server, c.err, c.pooled = conn, nil, true
+		c.p.wakePool()
+		return
+	}
+	c.trace("dial_start", "backend", c.backend.addr)
+	var alt *backend
+	delay := c.rt.opts().happyEyeballsDelay
+	if delay > 0 {
+		alt = c.pool().sibling(c.backend)
+	}
+	ctx, cancel := c.dialContext()
+	defer cancel()
+	if alt == nil {
+		r := c.dialBackend(ctx, c.backend)
+		if r.err != nil {
+			c.settled(c.backend)
+		}
+		c.server, c.err, c.tlsTook = r.conn, r.err, r.tlsTook
+		return
+	}
+
+	start := time.Now()
+	results := make(chan dialResult, 2)
+	go func(b *backend) { results <- c.dialBackend(ctx, b) }(c.backend)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	pending, altStarted := 1, false
+	startAlt := func() {
+		altStarted = true
+		c.tried = append(c.tried, alt)
+		pending++
+		alt.active.Add(1)
+		c.trace("dial_start", "backend", alt.addr, "race", true)
+		go func(b *backend) { results <- c.dialBackend(ctx, b) }(alt)
+	}
+	var first dialResult
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if !altStarted {
+				startAlt()
+			}
+			continue
+		case r := <-results:
+			pending--
+			if r.err != nil {
+				c.settled(r.backend)
+			}
+			if r.err == nil {
+				c.won(r, alt, altStarted, start)
+				cancel()
+				// A loser which connected anyway is of no use to us
+				go drainLosers(results, pending)
+				return
+			}
+			if first.err == nil {
+				first = r
+			}
+			if !altStarted {
+				startAlt()
+			}
+		}
+	}
+	// Both failed; report the first failure against the original backend
+	if altStarted {
+		c.release(alt)
+	}
+	c.server, c.err = nil, first.err
+}
+
+// won records the winner of a Happy Eyeballs race, moving c over to it and
+// giving up the losing backend's slot
+func (c *client) won(r dialResult, alt *backend, altStarted bool, start time.Time) {
+	switch {
+	case r.backend != c.backend:
+		c.release(c.backend)
+	case altStarted:
+		c.release(alt)
+	}
+	c.raced = altStarted
+	c.raceWinner = "ipv4"
+	if r.backend.isIPv6() {
+		c.raceWinner = "ipv6"
+	}
+	c.raceTook = time.Since(start).Seconds()
+	c.backend = r.backend
+	c.server, c.err, c.tlsTook = r.conn, nil, r.tlsTook
+}
+
+func drainLosers(results chan dialResult, pending int) {
+	for ; pending > 0; pending-- {
+		if r := <-results; r.conn != nil {
+			r.conn.Close()
+		}
+	}
+}
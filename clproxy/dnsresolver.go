@@ -0,0 +1,140 @@
+package clproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+type dnsResolverSettings struct {
+	// With -resolver every name we look up, backend hostnames, SRV records,
+	// -dynamic-dest targets, and the names of the mirror, flow collector,
+	// proxies, and tunnel we dial, is
+	// resolved by these DNS servers instead of the system's. Several servers are
+	// tried in order: the next is asked when one fails or doesn't answer within
+	// -resolver-timeout, but not when one says the name doesn't exist.
+	resolverAddrs   string
+	resolverTimeout time.Duration
+}
+
+// dnsResolver looks names up with each of its resolvers in turn
+type dnsResolver struct {
+	p         *Proxy
+	addrs     []string
+	resolvers []*net.Resolver
+
+	// For dialers given a hostname, which try the servers in order of
+	// connecting rather than of answering. Nil for the system's.
+	dialer *net.Resolver
+}
+
+// setupResolver checks -resolver and builds the resolvers for its servers
+func (p *Proxy) setupResolver() error {
+	p.resolveTimeout = p.resolverTimeout
+	if p.resolverAddrs == "" {
+		return nil
+	}
+	r := &dnsResolver{p: p}
+	for _, addr := range splitList(p.resolverAddrs) {
+		if ip, err := netip.ParseAddr(addr); err == nil {
+			addr = net.JoinHostPort(ip.String(), "53")
+		} else if _, err := netip.ParseAddrPort(addr); err != nil {
+			return fmt.Errorf("bad -resolver %q, want ip or ip:port", addr)
+		}
+		r.addrs = append(r.addrs, addr)
+		r.resolvers = append(r.resolvers, &net.Resolver{PreferGo: true, Dial: p.dnsDial(addr)})
+	}
+	r.dialer = &net.Resolver{PreferGo: true, Dial: p.dnsDial(r.addrs...)}
+	p.resolver = r
+	// Lookups are given the time to try every server
+	p.resolveTimeout = p.resolverTimeout * time.Duration(len(r.addrs))
+	return nil
+}
+
+// dnsDial returns a Dial for net.Resolver which connects to the first of
+// addrs it can, whatever server the resolver asks for
+func (p *Proxy) dnsDial(addrs ...string) func(ctx context.Context, network, _ string) (net.Conn, error) {
+	return func(ctx context.Context, network, _ string) (net.Conn, error) {
+		d := &net.Dialer{Timeout: p.resolverTimeout}
+		var err error
+		for _, addr := range addrs {
+			var conn net.Conn
+			if conn, err = d.DialContext(ctx, network, addr); err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
+
+// each calls lookup with each resolver in turn until one gives an answer,
+// which includes the name not existing
+func (r *dnsResolver) each(ctx context.Context, lookup func(context.Context, *net.Resolver) error) error {
+	var err error
+	for i, nr := range r.resolvers {
+		sctx, cancel := context.WithTimeout(ctx, r.p.resolverTimeout)
+		err = lookup(sctx, nr)
+		cancel()
+		var dnsErr *net.DNSError
+		isDNS := errors.As(err, &dnsErr)
+		if isDNS && r.p.resolverAddrs != "" {
+			// Not the server the system would have used
+			dnsErr.Server = r.addrs[i]
+		}
+		if err == nil || isDNS && dnsErr.IsNotFound || ctx.Err() != nil {
+			return err
+		}
+		if i+1 < len(r.resolvers) {
+			r.p.logger.Debug("resolver failed, trying the next", "resolver", r.addrs[i], "error", err.Error())
+		}
+	}
+	return err
+}
+
+func (r *dnsResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	var ips []net.IPAddr
+	err := r.each(ctx, func(ctx context.Context, nr *net.Resolver) (err error) {
+		ips, err = nr.LookupIPAddr(ctx, host)
+		return err
+	})
+	return ips, err
+}
+
+func (r *dnsResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	var ips []netip.Addr
+	err := r.each(ctx, func(ctx context.Context, nr *net.Resolver) (err error) {
+		ips, err = nr.LookupNetIP(ctx, network, host)
+		return err
+	})
+	return ips, err
+}
+
+func (r *dnsResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	var cname string
+	var srvs []*net.SRV
+	err := r.each(ctx, func(ctx context.Context, nr *net.Resolver) (err error) {
+		cname, srvs, err = nr.LookupSRV(ctx, service, proto, name)
+		return err
+	})
+	return cname, srvs, err
+}
+
+// nameResolver corrects the server named by a dialer's DNS error, which is
+// the system's even though it was -resolver's which was asked
+func (p *Proxy) nameResolver(err error) {
+	var dnsErr *net.DNSError
+	if p.resolverAddrs != "" && errors.As(err, &dnsErr) {
+		dnsErr.Server = strings.Join(p.resolver.addrs, ",")
+	}
+}
+
+// isDNSError reports whether err is a failure to resolve a name, rather than
+// to connect
+func isDNSError(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr)
+}
@@ -0,0 +1,88 @@
+package clproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+type downPayloadSettings struct {
+	// With -backend-down-payload a client whose session couldn't get a backend,
+	// because every dial and retry failed or there was nothing up to dial, is
+	// sent the file's bytes before it is closed, rather than just being dropped.
+	// That lets protocol aware clients show a sensible error, e.g. from a canned
+	// HTTP 503 or MySQL error packet. Such sessions are logged with
+	// served_maintenance=true and counted in the stats summary apart from the
+	// other failures. The file is read again on SIGHUP.
+	backendDownPayloadFile string
+}
+
+type downPayloadState struct {
+	backendDownPayload atomic.Pointer[[]byte]
+
+	// How many clients have been sent the payload, and how many of those didn't
+	// take all of it
+	downPayloadServed atomic.Uint64
+	downPayloadFailed atomic.Uint64
+}
+
+// How long a client gets to take the payload
+const backendDownPayloadTimeout = 2 * time.Second
+
+// setupDownPayload reads -backend-down-payload
+func (p *Proxy) setupDownPayload() error {
+	if p.backendDownPayloadFile == "" {
+		return nil
+	}
+	if p.socksServer {
+		return errors.New("-backend-down-payload can't be used with -socks5-server, whose clients are told why their dial failed")
+	}
+	if err := p.loadDownPayload(); err != nil {
+		return err
+	}
+	p.onReload = append(p.onReload, func() {
+		if err := p.loadDownPayload(); err != nil {
+			p.logger.Error("backend down payload reload failed, keeping the previous payload", "file", p.backendDownPayloadFile, "error", err.Error())
+		}
+	})
+	return nil
+}
+
+func (p *Proxy) loadDownPayload() error {
+	buf, err := os.ReadFile(p.backendDownPayloadFile)
+	if err != nil {
+		return err
+	}
+	p.backendDownPayload.Store(&buf)
+	return nil
+}
+
+// serveDownPayload sends c the payload, if there is one, after its session
+// failed to get a backend
+func (c *client) serveDownPayload() {
+	p := c.p.backendDownPayload.Load()
+	if p == nil {
+		return
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(backendDownPayloadTimeout))
+	_, err := c.conn.Write(*p)
+	c.conn.SetWriteDeadline(time.Time{})
+	c.servedMaintenance = true
+	c.p.downPayloadServed.Add(1)
+	if err != nil {
+		c.p.downPayloadFailed.Add(1)
+		c.trace("down_payload_failed", "error", err.Error())
+		return
+	}
+	c.trace("down_payload_sent", "bytes", len(*p))
+}
+
+// statsDownPayload adds the sessions sent the payload to the stats summary
+func (p *Proxy) statsDownPayload(w io.Writer) {
+	if p.backendDownPayloadFile != "" {
+		fmt.Fprintf(w, "backend_down_payload: served=%d failed=%d\n", p.downPayloadServed.Load(), p.downPayloadFailed.Load())
+	}
+}
@@ -0,0 +1,146 @@
+package clproxy
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+type drainSettings struct {
+	// A backend dropped from a route, whether by a config reload, the backends
+	// file, re-resolution, or set backend, drains: it gets no new sessions, its
+	// sessions run to completion, and it stays in the backends stats output as
+	// mode=draining until the last of them ends. With -backend-drain-timeout the
+	// sessions still on it that long after it was dropped are closed.
+	backendDrainTimeout time.Duration
+}
+
+// drainState is a backend's progress in draining. The zero value is a
+// backend which isn't draining.
+type drainState struct {
+	sync.Mutex
+	draining bool
+	since    time.Time
+	timer    *time.Timer
+	evict    chan struct{} // closed when the drain times out
+}
+
+// startDrain puts b into draining, if it has sessions left to drain, and
+// reports whether it did
+func (b *backend) startDrain() bool {
+	b.drain.Lock()
+	defer b.drain.Unlock()
+	if b.active.Load() == 0 || b.drain.draining {
+		return false
+	}
+	b.drain.draining = true
+	b.drain.since = time.Now()
+	b.p.logger.Info("backend draining", "backend", b.addr, "sessions", b.active.Load())
+	if b.p.backendDrainTimeout > 0 {
+		b.drain.timer = time.AfterFunc(b.p.backendDrainTimeout, b.drainTimedOut)
+	}
+	return true
+}
+
+// drainTimedOut closes the sessions still on b at the -backend-drain-timeout
+func (b *backend) drainTimedOut() {
+	b.drain.Lock()
+	defer b.drain.Unlock()
+	if !b.drain.draining {
+		return
+	}
+	b.p.logger.Warn("backend drain timed out, closing its sessions", "backend", b.addr, "sessions", b.active.Load())
+	close(b.evicted())
+}
+
+// evicted returns the channel closed when b's drain times out. The caller
+// holds b.drain.
+func (b *backend) evicted() chan struct{} {
+	if b.drain.evict == nil {
+		b.drain.evict = make(chan struct{})
+	}
+	return b.drain.evict
+}
+
+// checkDrained ends b's drain once its last session has gone
+func (b *backend) checkDrained() {
+	if b.active.Load() > 0 {
+		return
+	}
+	b.drain.Lock()
+	defer b.drain.Unlock()
+	if !b.drain.draining || b.active.Load() > 0 {
+		return
+	}
+	b.drain.draining = false
+	if b.drain.timer != nil {
+		b.drain.timer.Stop()
+	}
+	b.p.logger.Info("backend drained", "backend", b.addr, "took", time.Since(b.drain.since).Seconds())
+}
+
+func (b *backend) draining() bool {
+	b.drain.Lock()
+	defer b.drain.Unlock()
+	return b.drain.draining
+}
+
+// watchDrain closes c's session if its backend's drain times out, until the
+// function it returns is called
+func (c *client) watchDrain() func() {
+	if c.p.backendDrainTimeout <= 0 {
+		return func() {}
+	}
+	b := c.backend
+	b.drain.Lock()
+	evict := b.evicted()
+	b.drain.Unlock()
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-evict:
+			c.endOnce.Do(func() {
+				c.closedBy, c.reason = "proxy", "drain_timeout"
+			})
+			c.conn.Close()
+			c.server.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// drainingList returns the backends s is still draining, forgetting any which
+// have finished
+func (s *backendSet) drainingList() []*backend {
+	s.Lock()
+	defer s.Unlock()
+	kept := s.draining[:0]
+	for _, b := range s.draining {
+		b.checkDrained()
+		if b.draining() {
+			kept = append(kept, b)
+		}
+	}
+	s.draining = kept
+	return append([]*backend(nil), kept...)
+}
+
+// statsDraining adds the backends being drained to the stats summary
+func (p *Proxy) statsDraining(w io.Writer) {
+	for _, rt := range p.allRoutes() {
+		bs := rt.backends.drainingList()
+		if len(bs) == 0 {
+			continue
+		}
+		var sessions int64
+		for _, b := range bs {
+			sessions += b.active.Load()
+		}
+		if rt.name != "" {
+			fmt.Fprintf(w, "route=%s ", rt.name)
+		}
+		fmt.Fprintf(w, "draining: backends=%d sessions=%d\n", len(bs), sessions)
+	}
+}
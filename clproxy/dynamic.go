@@ -0,0 +1,131 @@
+package clproxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type dynamicSettings struct {
+	// With -dynamic-dest each client names where it wants to go in a first line
+	// of "CONNECT host:port", which we consume, and is then proxied there instead
+	// of to -p. dynamicDestAllow must list the CIDRs and ports which may be
+	// asked for, in the same form as -original-dst-allow, so we can't be used as
+	// an open relay. A request which is malformed or not allowed is answered
+	// with a one line error before the connection is closed.
+	dynamicDest        bool
+	dynamicDestAllow   string
+	dynamicDestTimeout time.Duration
+}
+
+type dynamicState struct {
+	dynamicRules []dstRule
+
+	// Where clients have asked to go, each with a backend set of its own
+	dynamicRoutes destinations
+}
+
+// The longest CONNECT line we will read
+const maxConnectLine = 1024
+
+var errDynamicNotAllowed = errors.New("destination is not allowed")
+
+// setupDynamicDest parses -dynamic-dest-allow, which mustn't be empty
+func (p *Proxy) setupDynamicDest() error {
+	if strings.TrimSpace(p.dynamicDestAllow) == "" {
+		return errors.New("-dynamic-dest needs -dynamic-dest-allow")
+	}
+	var err error
+	p.dynamicRules, err = parseDstRules(p.dynamicDestAllow)
+	return err
+}
+
+// readConnect reads the CONNECT line from conn, returning the host:port asked
+// for along with anything the client sent after it, which belongs to the
+// backend
+func readConnect(conn net.Conn, timeout time.Duration) (string, []byte, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	br := bufio.NewReaderSize(conn, maxConnectLine)
+	line, err := br.ReadSlice('\n')
+	switch {
+	case errors.Is(err, bufio.ErrBufferFull):
+		return "", nil, errors.New("request line too long")
+	case err != nil:
+		return "", nil, err
+	}
+	verb, target, ok := strings.Cut(strings.TrimRight(string(line), "\r\n"), " ")
+	if !ok || verb != "CONNECT" || target == "" || strings.ContainsAny(target, " \t") {
+		return "", nil, errors.New("malformed request, want CONNECT host:port")
+	}
+	rest, _ := br.Peek(br.Buffered())
+	return target, rest, nil
+}
+
+// resolveAllowed resolves target and returns the first of its addresses
+// which rules allow. The address is what gets dialed, so a name can't be
+// made to point somewhere else between the check and the dial.
+func (p *Proxy) resolveAllowed(target string, rules []dstRule, timeout time.Duration) (netip.AddrPort, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return netip.AddrPort{}, fmt.Errorf("bad port in %q", target)
+	}
+	addrs := []netip.Addr{}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		addrs = append(addrs, ip)
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if addrs, err = p.resolver.LookupNetIP(ctx, "ip", host); err != nil {
+			return netip.AddrPort{}, err
+		}
+	}
+	for _, ip := range addrs {
+		dst := netip.AddrPortFrom(ip.Unmap(), uint16(port))
+		if matchDst(rules, dst) {
+			return dst, nil
+		}
+	}
+	return netip.AddrPort{}, fmt.Errorf("%w: %s", errDynamicNotAllowed, target)
+}
+
+// routeDynamic reads c's CONNECT line and points c at the destination it
+// names. If that fails the client is told why and false returned.
+func (c *client) routeDynamic() bool {
+	timeout := c.p.dynamicDestTimeout
+	target, rest, err := readConnect(c.conn, timeout)
+	var dst netip.AddrPort
+	if err == nil {
+		dst, err = c.p.resolveAllowed(target, c.p.dynamicRules, timeout)
+	}
+	if err != nil {
+		if !c.p.logRejection(c.name, c.conn, "dynamic_dest", "target", target, "error", err.Error()) {
+			c.p.logger.Warn("dynamic destination rejected", "client", c.name, "target", target, "error", err.Error())
+		}
+		c.conn.SetWriteDeadline(time.Now().Add(timeout))
+		fmt.Fprintf(c.conn, "error: %s\n", err)
+		return false
+	}
+	c.trace("dynamic_dest", "target", target, "backend", dst.String())
+	c.conn = replay(c.conn, rest)
+	c.route = c.p.dynamicRoutes.get(dst)
+	return true
+}
+
+// statsDynamic adds the destinations asked for to the backends stats
+func (p *Proxy) statsDynamic(w io.Writer) {
+	for _, b := range p.dynamicRoutes.backends() {
+		fmt.Fprintf(w, "dynamic_dest %s\n", b)
+	}
+}
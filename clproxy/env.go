@@ -0,0 +1,111 @@
+package clproxy
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Every flag can also be given as an environment variable: CLPROXY_ followed
+// by the flag's name in upper case with dashes as underscores, e.g.
+// CLPROXY_HEALTH_INTERVAL=5s. The single letter flags have proper names
+// instead. A flag on the command line beats the environment, which beats the
+// default.
+const envPrefix = "CLPROXY_"
+
+var envNames = map[string]string{
+	"l":        "CLPROXY_LISTEN",
+	"p":        "CLPROXY_BACKEND",
+	"p-backup": "CLPROXY_BACKUP",
+	"s":        "CLPROXY_STATS",
+	"c":        "CLPROXY_CONCURRENCY",
+}
+
+type envState struct {
+	// The flags which were set from the environment, by flag name
+	fromEnv map[string]string
+}
+
+// Flags whose values are not to be printed
+var secretFlags = map[string]bool{"socks5-pass": true, "socks5-server-pass": true, "stats-token": true}
+
+func envName(flagName string) string {
+	if name, ok := envNames[flagName]; ok {
+		return name
+	}
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// ApplyEnv sets every flag on the FlagSet given to RegisterFlags which wasn't
+// given on the command line but has an environment variable
+func (o *Options) ApplyEnv() error {
+	given := map[string]bool{}
+	o.flags.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	var err error
+	o.flags.VisitAll(func(f *flag.Flag) {
+		name := envName(f.Name)
+		v, ok := os.LookupEnv(name)
+		if !ok || given[f.Name] || err != nil {
+			return
+		}
+		if e := o.flags.Set(f.Name, v); e != nil {
+			err = fmt.Errorf("invalid value %q for %s (-%s): %v", v, name, f.Name, e)
+			return
+		}
+		o.fromEnv[f.Name] = name
+	})
+	return err
+}
+
+// flagGiven reports whether a flag was set on the command line or from the
+// environment
+func (p *Proxy) flagGiven(name string) bool {
+	given := false
+	p.flags.Visit(func(f *flag.Flag) { given = given || f.Name == name })
+	return given
+}
+
+// flagSource describes where a set flag came from, for messages
+func (p *Proxy) flagSource(name string) string {
+	if env, ok := p.fromEnv[name]; ok {
+		return env
+	}
+	return "-" + name
+}
+
+// printEffectiveConfig writes every flag's value to w, and where it came
+// from, followed by the routes we would serve
+func (p *Proxy) printEffectiveConfig(w io.Writer) {
+	given := map[string]bool{}
+	p.flags.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	p.flags.VisitAll(func(f *flag.Flag) {
+		if f.Name == "print-config" {
+			return
+		}
+		v := f.Value.String()
+		switch {
+		case secretFlags[f.Name] && v != "":
+			v = "xxxxx"
+		case f.Name == "http-proxy" && v != "":
+			if u, err := url.Parse(v); err == nil {
+				v = u.Redacted()
+			}
+		}
+		source := "default"
+		if env, ok := p.fromEnv[f.Name]; ok {
+			source = "env " + env
+		} else if given[f.Name] {
+			source = "flag"
+		}
+		fmt.Fprintf(w, "-%s=%q (%s)\n", f.Name, v, source)
+	})
+	for _, rt := range p.allRoutes() {
+		o := rt.opts()
+		fmt.Fprintf(w, "route=%q listen=%q backend=%q backup=%q concurrency=%d balance=%s happy_eyeballs_delay=%s tls_handshake_timeout=%s accept_proxy_timeout=%s sni_timeout=%s\n",
+			rt.name, strings.Join(o.listen, ","), strings.Join(rt.backends.primarySpecs, ","), strings.Join(rt.backends.backupSpecs, ","),
+			o.concurrency, rt.backends.balance, o.happyEyeballsDelay, o.tlsHandshakeTimeout, o.acceptProxyTimeout, o.sniTimeout)
+	}
+}
@@ -0,0 +1,130 @@
+package clproxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/netip"
+	"slices"
+	"strconv"
+)
+
+// Points on the ring per unit of backend weight. More points spread clients
+// more evenly.
+const ringReplicas = 160
+
+type ringPoint struct {
+	hash    uint64
+	backend *backend
+}
+
+// hashRing is a consistent hashing ring over a set of backends, so that
+// adding or removing one backend only moves about 1/N of the clients.
+type hashRing []ringPoint
+
+func hash64(s string) uint64 {
+	h := fnv.New64a()
+	io.WriteString(h, s)
+	// FNV on its own clusters badly for similar short strings such as
+	// addr#1, addr#2, so mix the result (the splitmix64 finalizer).
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func newHashRing(bs []*backend) hashRing {
+	ring := make(hashRing, 0, len(bs)*ringReplicas)
+	for _, b := range bs {
+		for i := 0; i < ringReplicas*int(b.weight.Load()); i++ {
+			ring = append(ring, ringPoint{hash: hash64(b.addr + "#" + strconv.Itoa(i)), backend: b})
+		}
+	}
+	slices.SortFunc(ring, func(a, b ringPoint) int {
+		switch {
+		case a.hash < b.hash:
+			return -1
+		case a.hash > b.hash:
+			return 1
+		}
+		return 0
+	})
+	return ring
+}
+
+// get walks the ring clockwise from key's position and returns the first
+// backend which is one of the candidates
+func (r hashRing) get(key string, candidates []*backend) *backend {
+	if len(r) == 0 {
+		return nil
+	}
+	h := hash64(key)
+	start, _ := slices.BinarySearchFunc(r, h, func(p ringPoint, h uint64) int {
+		switch {
+		case p.hash < h:
+			return -1
+		case p.hash > h:
+			return 1
+		}
+		return 0
+	})
+	for i := 0; i < len(r); i++ {
+		b := r[(start+i)%len(r)].backend
+		if slices.Contains(candidates, b) {
+			return b
+		}
+	}
+	return nil
+}
+
+// hashKey is what source-hash balancing hashes for a client: its IP
+// address, or its whole address if it doesn't have one
+func (info ConnInfo) hashKey() string {
+	if ip, ok := addrIP(info.Remote); ok {
+		return ip.String()
+	}
+	return info.Client
+}
+
+func pickSourceHash(s *backendSet, candidates []*backend, info ConnInfo) *backend {
+	if b := s.hashRing().get(info.hashKey(), candidates); b != nil {
+		return b
+	}
+	return candidates[0]
+}
+
+// statsLookup answers "lookup <ip> [route]" on the stats port with the
+// backend that source-hash balancing would currently choose for ip. The route
+// may be left out when there is only one.
+func (p *Proxy) statsLookup(w io.Writer, args []string) {
+	if len(args) != 1 && len(args) != 2 {
+		fmt.Fprintln(w, "error: usage: lookup <ip> [route]")
+		return
+	}
+	rts := p.allRoutes()
+	rt := rts[0]
+	if len(args) == 2 {
+		var ok bool
+		if rt, ok = p.findRoute(args[1]); !ok {
+			fmt.Fprintf(w, "error: unknown route %q\n", args[1])
+			return
+		}
+	} else if len(rts) > 1 {
+		fmt.Fprintln(w, "error: usage: lookup <ip> [route]")
+		return
+	}
+	ip, err := netip.ParseAddr(args[0])
+	if err != nil {
+		fmt.Fprintf(w, "error: invalid address %q\n", args[0])
+		return
+	}
+	b := rt.backends.hashRing().get(ip.Unmap().String(), rt.backends.candidates(false))
+	if b == nil {
+		fmt.Fprintln(w, "error: no backends available")
+		return
+	}
+	fmt.Fprintln(w, b.addr)
+}
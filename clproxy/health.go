@@ -0,0 +1,227 @@
+package clproxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type healthSettings struct {
+	// Active health checking. Every healthInterval each backend gets a TCP
+	// connect, closed straight away. healthFall consecutive failures mark it
+	// down and healthRise consecutive successes mark it up again. A zero
+	// interval disables checking and every backend is always up.
+	healthInterval time.Duration
+	healthTimeout  time.Duration
+	healthFall     int
+	healthRise     int
+
+	// With -health-send and/or -health-expect a check also sends some bytes and
+	// requires the response to start with the expected ones. Both are given with
+	// Go string escapes, e.g. "PING\r\n" or "\x00\x01".
+	healthSend        string
+	healthExpect      string
+	healthReadTimeout time.Duration
+}
+
+type healthState struct {
+	// The unescaped -health-send and -health-expect
+	healthSendBytes   []byte
+	healthExpectBytes []byte
+}
+
+// How much of an unexpected response to log
+const healthLogBytes = 64
+
+// setupHealthProbe unescapes -health-send and -health-expect
+func (p *Proxy) setupHealthProbe() error {
+	var err error
+	if p.healthSendBytes, err = unescape(p.healthSend); err != nil {
+		return fmt.Errorf("-health-send: %w", err)
+	}
+	if p.healthExpectBytes, err = unescape(p.healthExpect); err != nil {
+		return fmt.Errorf("-health-expect: %w", err)
+	}
+	return nil
+}
+
+// unescape interprets the escapes in s the way a Go string literal would
+func unescape(s string) ([]byte, error) {
+	u, err := strconv.Unquote(`"` + strings.ReplaceAll(s, `"`, `\"`) + `"`)
+	if err != nil {
+		return nil, fmt.Errorf("invalid escape in %q", s)
+	}
+	return []byte(u), nil
+}
+
+// Manual overrides set through the stats port
+const (
+	overrideNone int32 = iota
+	overrideUp
+	overrideDown
+)
+
+// available reports whether b may be given new sessions
+func (b *backend) available() bool {
+	if b.maint.Load() {
+		return false
+	}
+	switch b.override.Load() {
+	case overrideUp:
+		return true
+	case overrideDown:
+		return false
+	}
+	return !b.down.Load() && b.circuit.allow(b.addr)
+}
+
+// check connects to b once, probes it if so configured, and updates its
+// health accordingly. Only the health checker calls this, so the streak
+// counters need no locking.
+func (b *backend) check() {
+	var conn net.Conn
+	var err error
+	if b.network == "ws" || b.p.dialFunc != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), b.p.healthTimeout)
+		if b.network == "ws" {
+			conn, err = b.p.wsDial(ctx, &net.Dialer{Resolver: b.p.resolver.dialer}, b.path)
+		} else {
+			conn, err = b.p.dialFunc(ctx, b.addr)
+		}
+		cancel()
+	} else {
+		d := &net.Dialer{Timeout: b.p.healthTimeout, Resolver: b.p.resolver.dialer}
+		conn, err = d.Dial(b.network, b.path)
+	}
+	if err == nil {
+		err = b.probe(conn)
+		conn.Close()
+	}
+	b.checked(err)
+}
+
+// probe sends -health-send and reads the response, failing unless it starts
+// with -health-expect. We then close our side and read whatever is left, so
+// that the connection ends with an orderly close rather than a reset.
+func (b *backend) probe(conn net.Conn) error {
+	if len(b.p.healthSendBytes) == 0 && len(b.p.healthExpectBytes) == 0 {
+		return nil
+	}
+	if len(b.p.healthSendBytes) > 0 {
+		conn.SetWriteDeadline(time.Now().Add(b.p.healthTimeout))
+		if _, err := conn.Write(b.p.healthSendBytes); err != nil {
+			return err
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(b.p.healthReadTimeout))
+	// Read at least enough to compare, and as much as we would log
+	got := make([]byte, max(len(b.p.healthExpectBytes), healthLogBytes))
+	n, err := io.ReadAtLeast(conn, got, len(b.p.healthExpectBytes))
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		io.Copy(io.Discard, conn)
+	}
+	if !bytes.HasPrefix(got[:n], b.p.healthExpectBytes) {
+		// The log handler quotes and escapes the response for us
+		args := []any{"backend", b.addr, "response", string(got[:min(n, healthLogBytes)])}
+		if err != nil {
+			args = append(args, "error", err.Error())
+		}
+		b.p.logger.Warn("health check response mismatch", args...)
+		return fmt.Errorf("unexpected response %q", got[:min(n, healthLogBytes)])
+	}
+	return nil
+}
+
+// checked counts the result of a health check and changes state once
+// enough results in a row agree
+func (b *backend) checked(err error) {
+	if err != nil {
+		b.rise = 0
+		b.fall++
+		if !b.down.Load() && b.fall >= b.p.healthFall {
+			b.down.Store(true)
+			b.p.logger.Warn("backend down", "backend", b.addr, "checks_failed", b.fall, "error", err.Error())
+		}
+		return
+	}
+	b.fall = 0
+	b.rise++
+	if b.down.Load() && b.rise >= b.p.healthRise {
+		b.down.Store(false)
+		b.p.logger.Info("backend up", "backend", b.addr, "checks_passed", b.rise)
+	}
+}
+
+func (b *backend) healthString() string {
+	health := "up"
+	if b.down.Load() {
+		health = "down"
+	}
+	override := "none"
+	switch b.override.Load() {
+	case overrideUp:
+		override = "up"
+	case overrideDown:
+		override = "down"
+	}
+	return "health=" + health + " override=" + override
+}
+
+// healthCheck checks every backend each interval, all at once so that one
+// slow backend doesn't delay the others
+func (p *Proxy) healthCheck() {
+	for range p.ticks(p.healthInterval) {
+		var wg sync.WaitGroup
+		for _, b := range p.allBackends() {
+			wg.Add(1)
+			go func(b *backend) {
+				defer wg.Done()
+				b.check()
+			}(b)
+		}
+		wg.Wait()
+	}
+}
+
+// statsHealth answers "health <backend> up|down|auto" on the stats port,
+// forcing a backend's state or handing it back to the health checks. A
+// backend shared by several routes is overridden in all of them.
+func (p *Proxy) statsHealth(w io.Writer, args []string) {
+	if len(args) != 2 {
+		fmt.Fprintln(w, "error: usage: health <backend> up|down|auto")
+		return
+	}
+	var override int32
+	switch args[1] {
+	case "up":
+		override = overrideUp
+	case "down":
+		override = overrideDown
+	case "auto":
+		override = overrideNone
+	default:
+		fmt.Fprintln(w, "error: usage: health <backend> up|down|auto")
+		return
+	}
+	found := false
+	for _, rt := range p.allRoutes() {
+		b, ok := rt.backends.lookup(args[0])
+		if !ok {
+			continue
+		}
+		found = true
+		b.override.Store(override)
+		p.logger.Info("backend health override", "backend", b.addr, "override", args[1])
+		fmt.Fprintln(w, b)
+	}
+	if !found {
+		fmt.Fprintf(w, "error: unknown backend %q\n", args[0])
+	}
+}
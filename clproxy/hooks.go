@@ -0,0 +1,185 @@
+package clproxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"runtime/debug"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// connHooks are the hooks from Options, which see them for when each is
+// called. Every one is optional.
+type connHooks struct {
+	onAccept func(conn net.Conn) error
+	onAdmit  func(info ConnInfo)
+	onDialed func(info ConnInfo)
+	onClose  func(s Summary)
+}
+
+type hooksState struct {
+	hooks connHooks
+
+	// Hook calls which panicked
+	hookPanics atomic.Uint64
+}
+
+// ConnInfo is what hooks and balancers are told about a session as it goes
+// along
+type ConnInfo struct {
+	UID      string
+	Client   string   // the client's address
+	Remote   net.Addr // likewise, unformatted
+	Listener string   // with several -l addresses
+	Route    string   // with -route or -config
+	Identity string   // with -c-per-identity
+	Backend  string   // once dialed
+	Wait     time.Duration
+	Dial     time.Duration
+
+	// The backends being picked from, for the built in policies
+	set *backendSet
+}
+
+// Summary is what OnClose is told about a session as it ends, as it is
+// logged
+type Summary struct {
+	// ID counts connections since startup; UID is unique across restarts and
+	// instances
+	ID         uint64
+	UID        string
+	Client     string // the client's address
+	ClientName string // from -client-names
+	Backend    string
+	Start      time.Time
+
+	// How long the session took in all, waited for a slot under -c, took to
+	// connect to its backend, and was copying for
+	Took time.Duration
+	Wait time.Duration
+	Dial time.Duration
+	Copy time.Duration
+
+	// Bytes from the client and from the backend
+	BytesIn  int64
+	BytesOut int64
+
+	// success or error; for a success, which side closed first and why, and
+	// for an error, what it was
+	Status   string
+	ClosedBy string
+	Reason   string
+	Message  string
+
+	JA3 string // with -log-ja3
+}
+
+// export makes s a Summary for OnClose
+func (s summary) export() Summary {
+	return Summary{
+		ID:         s.ID,
+		UID:        s.UID,
+		Client:     s.name,
+		ClientName: s.label,
+		Backend:    s.backend,
+		Start:      s.start,
+		Took:       seconds(s.took),
+		Wait:       seconds(s.wait),
+		Dial:       seconds(s.dial),
+		Copy:       seconds(s.copy),
+		BytesIn:    s.bytesIn,
+		BytesOut:   s.bytesOut,
+		Status:     s.status,
+		ClosedBy:   s.closedBy,
+		Reason:     s.reason,
+		Message:    s.message,
+		JA3:        s.ja3,
+	}
+}
+
+func seconds(f float64) time.Duration {
+	return time.Duration(f * float64(time.Second))
+}
+
+// info returns c's ConnInfo as it stands
+func (c *client) info() ConnInfo {
+	info := ConnInfo{
+		UID:      c.UID,
+		Client:   c.name,
+		Remote:   c.conn.RemoteAddr(),
+		Listener: c.listener,
+		Route:    c.rt.logName(),
+		Identity: c.identity,
+		Backend:  c.backendAddr(),
+		Wait:     c.waited.Sub(c.start),
+	}
+	if !c.dialed.IsZero() {
+		info.Dial = c.dialed.Sub(c.waited)
+	}
+	return info
+}
+
+// callHook runs one hook, recovering from any panic in it
+func (p *Proxy) callHook(point, id string, fn func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			p.hookPanics.Add(1)
+			p.logger.Error("hook panicked", "hook", point, "id", id, "panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+		}
+	}()
+	fn()
+}
+
+// acceptHooks runs the OnAccept hook for conn
+func (p *Proxy) acceptHooks(conn net.Conn) error {
+	if p.hooks.onAccept == nil {
+		return nil
+	}
+	var err error
+	p.callHook("accept", p.remoteName(conn), func() { err = p.hooks.onAccept(conn) })
+	return err
+}
+
+func (c *client) admitHooks() {
+	if fn := c.p.hooks.onAdmit; fn != nil {
+		info := c.info()
+		c.p.callHook("admit", c.UID, func() { fn(info) })
+	}
+}
+
+func (c *client) dialedHooks() {
+	if fn := c.p.hooks.onDialed; fn != nil {
+		info := c.info()
+		c.p.callHook("dialed", c.UID, func() { fn(info) })
+	}
+}
+
+func (p *Proxy) closeHooks(s summary) {
+	if fn := p.hooks.onClose; fn != nil {
+		p.callHook("close", s.UID, func() { fn(s.export()) })
+	}
+}
+
+// statsHooks adds the hooks to the stats summary, if there are any
+func (p *Proxy) statsHooks(w io.Writer) {
+	var points []string
+	for _, h := range []struct {
+		point string
+		set   bool
+	}{
+		{"accept", p.hooks.onAccept != nil},
+		{"admit", p.hooks.onAdmit != nil},
+		{"dialed", p.hooks.onDialed != nil},
+		{"close", p.hooks.onClose != nil},
+	} {
+		if h.set {
+			points = append(points, h.point)
+		}
+	}
+	if len(points) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "hooks: %s panics=%d\n", strings.Join(points, ","), p.hookPanics.Load())
+}
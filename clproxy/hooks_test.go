@@ -0,0 +1,77 @@
+package clproxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHooks(t *testing.T) {
+	var mu sync.Mutex
+	var admitted, dialed []ConnInfo
+	var closed []Summary
+	p, addr := startProxy(t, Options{
+		Backends: []string{greeter(t, "hi")},
+		OnAdmit: func(info ConnInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			admitted = append(admitted, info)
+		},
+		OnDialed: func(info ConnInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			dialed = append(dialed, info)
+			panic("in a hook")
+		},
+		OnClose: func(s Summary) {
+			mu.Lock()
+			defer mu.Unlock()
+			closed = append(closed, s)
+		},
+	})
+	conn := greeting(t, addr, "hi")
+	conn.Write([]byte("q"))
+	conn.Close()
+	waitFor(t, "the session to close", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(closed) == 1
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if len(admitted) != 1 || admitted[0].Client != conn.LocalAddr().String() || admitted[0].Backend != "" {
+		t.Errorf("OnAdmit got %+v", admitted)
+	}
+	if len(dialed) != 1 || dialed[0].UID != admitted[0].UID || dialed[0].Backend == "" {
+		t.Errorf("OnDialed got %+v", dialed)
+	}
+	if s := closed[0]; s.UID != admitted[0].UID || s.Status != "success" || s.BytesIn != 1 || s.BytesOut != 2 {
+		t.Errorf("OnClose got %+v", s)
+	}
+	if n := p.hookPanics.Load(); n != 1 {
+		t.Errorf("%d hook panics counted, want 1", n)
+	}
+}
+
+// An error from OnAccept turns the client away before a backend is dialed
+func TestAcceptHook(t *testing.T) {
+	p, addr := startProxy(t, Options{
+		Backends: []string{greeter(t, "hi")},
+		OnAccept: func(conn net.Conn) error { return errors.New("go away") },
+	})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 2)); err != io.EOF {
+		t.Errorf("read %d bytes, %v, want io.EOF", n, err)
+	}
+	if s := p.Stats(); s.Routes[0].Sessions != 0 {
+		t.Errorf("stats after a rejected client: %+v", s)
+	}
+}
@@ -0,0 +1,110 @@
+package clproxy
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"slices"
+)
+
+type identitySettings struct {
+	// With -c-per-identity no one client may have more than that many active
+	// sessions on a route, however many of the route's -c slots are free; the
+	// rest wait their turn like any other client over the limit. Clients are
+	// told apart by the identity of their verified TLS client certificate, so
+	// that several clients behind one NAT each get their share, and clients
+	// without a certificate by their address.
+	concurrencyPerIdentity int
+}
+
+// identityCount is an identity's sessions on a route
+type identityCount struct {
+	active  int
+	waiting int
+}
+
+// identityKey is who c counts as for -c-per-identity
+func (c *client) identityKey() string {
+	if c.cert != "" {
+		return "cert:" + c.cert
+	}
+	if ip, ok := addrIP(c.conn.RemoteAddr()); ok {
+		return "ip:" + ip.String()
+	}
+	return c.name
+}
+
+// identityWaiting counts c as waiting. The caller holds rt.cond.L.
+func (rt *route) identityWaiting(c *client) {
+	if rt.p.concurrencyPerIdentity <= 0 {
+		return
+	}
+	c.identity = c.identityKey()
+	if rt.identities == nil {
+		rt.identities = map[string]*identityCount{}
+	}
+	n := rt.identities[c.identity]
+	if n == nil {
+		n = &identityCount{}
+		rt.identities[c.identity] = n
+	}
+	n.waiting++
+}
+
+// identityFull reports whether c's identity has all the sessions it may.
+// The caller holds rt.cond.L.
+func (rt *route) identityFull(c *client) bool {
+	return c.identity != "" && rt.identities[c.identity].active >= rt.p.concurrencyPerIdentity
+}
+
+// identityAdmitted moves c from waiting to active. The caller holds
+// rt.cond.L.
+func (rt *route) identityAdmitted(c *client) {
+	if n := rt.identities[c.identity]; n != nil {
+		n.waiting--
+		n.active++
+	}
+}
+
+// identityDone forgets c's session, and its identity once it has none. The
+// caller holds rt.cond.L.
+func (rt *route) identityDone(c *client) {
+	n := rt.identities[c.identity]
+	if n == nil {
+		return
+	}
+	n.active--
+	if n.active == 0 && n.waiting == 0 {
+		delete(rt.identities, c.identity)
+	}
+}
+
+// statsIdentities answers "identities" on the stats port with each
+// identity's active and waiting sessions
+func (p *Proxy) statsIdentities(w io.Writer, args []string) {
+	if p.concurrencyPerIdentity <= 0 {
+		fmt.Fprintln(w, "error: there is no -c-per-identity")
+		return
+	}
+	type line struct {
+		route, identity string
+		identityCount
+	}
+	var lines []line
+	for _, rt := range p.allRoutes() {
+		rt.cond.L.Lock()
+		for id, n := range rt.identities {
+			lines = append(lines, line{rt.logName(), id, *n})
+		}
+		rt.cond.L.Unlock()
+	}
+	slices.SortFunc(lines, func(a, b line) int {
+		return cmp.Or(cmp.Compare(a.route, b.route), cmp.Compare(b.active, a.active), cmp.Compare(a.identity, b.identity))
+	})
+	for _, l := range lines {
+		if l.route != "" {
+			fmt.Fprintf(w, "route=%s ", l.route)
+		}
+		fmt.Fprintf(w, "identity=%s active=%d waiting=%d limit=%d\n", l.identity, l.active, l.waiting, p.concurrencyPerIdentity)
+	}
+}
@@ -0,0 +1,25 @@
+package clproxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+)
+
+// bootID is chosen at random when the process starts. Combined with the
+// connection counter it gives every connection an ID which is unique across
+// restarts and across instances, for correlating logs between systems.
+var bootID = newBootID()
+
+func newBootID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		panic("unable to generate boot ID: " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}
+
+// connID returns the globally unique ID for the connection numbered num
+func connID(num uint64) string {
+	return fmt.Sprintf("%s-%d", bootID, num)
+}
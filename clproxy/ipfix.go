@@ -0,0 +1,278 @@
+package clproxy
+
+import (
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+type ipfixSettings struct {
+	// Where to send IPFIX flow records for completed sessions. Empty disables
+	// flow export entirely.
+	flowCollector string
+
+	// The Observation Domain ID placed in every IPFIX message header
+	flowDomain uint
+}
+
+type ipfixState struct {
+	flows *flowExporter
+}
+
+// RFC 7011 section 8.4 requires templates sent over UDP to be resent
+// periodically so that a collector which restarts can decode our data again.
+var flowTemplateRefresh = 10 * time.Minute
+
+const (
+	ipfixVersion = 10
+	// Keep messages comfortably under a typical path MTU
+	ipfixMaxRecords = 10
+	// Enterprise number for RFC 5103 reverse direction information elements
+	ipfixReversePEN = 29305
+)
+
+// ipfixField is a field specifier in a template record
+type ipfixField struct {
+	id         uint16
+	length     uint16
+	enterprise uint32
+}
+
+// Template IDs are 256 plus a bit each for the client and backend legs being
+// IPv6, since IPFIX needs a different information element for each family.
+func ipfixTemplateID(clientV6, backendV6 bool) uint16 {
+	id := uint16(256)
+	if clientV6 {
+		id += 1
+	}
+	if backendV6 {
+		id += 2
+	}
+	return id
+}
+
+// ipfixTemplate describes a session as a biflow. The client leg uses the
+// ordinary source/destination elements and the backend leg the post NAT/NAPT
+// elements, as the proxy behaves much like a NAT from a collector's point of
+// view. Reverse octets come from RFC 5103.
+func ipfixTemplate(clientV6, backendV6 bool) []ipfixField {
+	srcAddr, dstAddr, addrLen := uint16(8), uint16(12), uint16(4)
+	if clientV6 {
+		srcAddr, dstAddr, addrLen = 27, 28, 16
+	}
+	natSrc, natDst, natLen := uint16(225), uint16(226), uint16(4)
+	if backendV6 {
+		natSrc, natDst, natLen = 281, 282, 16
+	}
+	return []ipfixField{
+		{id: srcAddr, length: addrLen},
+		{id: dstAddr, length: addrLen},
+		{id: 7, length: 2},  // sourceTransportPort
+		{id: 11, length: 2}, // destinationTransportPort
+		{id: 4, length: 1},  // protocolIdentifier
+		{id: natSrc, length: natLen},
+		{id: natDst, length: natLen},
+		{id: 227, length: 2}, // postNAPTSourceTransportPort
+		{id: 228, length: 2}, // postNAPTDestinationTransportPort
+		{id: 1, length: 8},   // octetDeltaCount
+		{id: 1, length: 8, enterprise: ipfixReversePEN},
+		{id: 152, length: 8}, // flowStartMilliseconds
+		{id: 153, length: 8}, // flowEndMilliseconds
+	}
+}
+
+// flowRecord is one completed session
+type flowRecord struct {
+	client   *net.TCPAddr // the client's end of the accepted connection
+	listener *net.TCPAddr // our end of the accepted connection
+	local    *net.TCPAddr // our end of the backend connection
+	backend  *net.TCPAddr // the backend's end of the backend connection
+	bytesIn  int64
+	bytesOut int64
+	start    time.Time
+	end      time.Time
+}
+
+func (r *flowRecord) template() uint16 {
+	return ipfixTemplateID(r.client.IP.To4() == nil, r.backend.IP.To4() == nil)
+}
+
+func ipfixAddr(b []byte, ip net.IP, v6 bool) []byte {
+	if v6 {
+		return append(b, ip.To16()...)
+	}
+	return append(b, ip.To4()...)
+}
+
+func (r *flowRecord) encode(b []byte) []byte {
+	clientV6 := r.client.IP.To4() == nil
+	backendV6 := r.backend.IP.To4() == nil
+	b = ipfixAddr(b, r.client.IP, clientV6)
+	b = ipfixAddr(b, r.listener.IP, clientV6)
+	b = binary.BigEndian.AppendUint16(b, uint16(r.client.Port))
+	b = binary.BigEndian.AppendUint16(b, uint16(r.listener.Port))
+	b = append(b, 6) // TCP
+	b = ipfixAddr(b, r.local.IP, backendV6)
+	b = ipfixAddr(b, r.backend.IP, backendV6)
+	b = binary.BigEndian.AppendUint16(b, uint16(r.local.Port))
+	b = binary.BigEndian.AppendUint16(b, uint16(r.backend.Port))
+	b = binary.BigEndian.AppendUint64(b, uint64(r.bytesIn))
+	b = binary.BigEndian.AppendUint64(b, uint64(r.bytesOut))
+	b = binary.BigEndian.AppendUint64(b, uint64(r.start.UnixMilli()))
+	b = binary.BigEndian.AppendUint64(b, uint64(r.end.UnixMilli()))
+	return b
+}
+
+// flowExporter batches flow records and sends them to a collector over UDP.
+// Everything happens on its own goroutine; connections only ever do a
+// non-blocking channel send, so a slow or missing collector can never hold
+// up proxying.
+type flowExporter struct {
+	p       *Proxy
+	conn    net.Conn
+	records chan flowRecord
+
+	seq           uint32
+	lastTemplates time.Time
+	failing       bool
+
+	dropped atomic.Uint64
+}
+
+func (p *Proxy) newFlowExporter(addr string) (*flowExporter, error) {
+	d := &net.Dialer{Resolver: p.resolver.dialer}
+	conn, err := d.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	e := &flowExporter{
+		p:       p,
+		conn:    conn,
+		records: make(chan flowRecord, 4096),
+	}
+	go e.run()
+	return e, nil
+}
+
+// add queues a record for export, dropping it if the queue is full
+func (e *flowExporter) add(r flowRecord) {
+	select {
+	case e.records <- r:
+	default:
+		e.dropped.Add(1)
+	}
+}
+
+func (e *flowExporter) run() {
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	var pending []flowRecord
+	for {
+		select {
+		case r := <-e.records:
+			pending = append(pending, r)
+			if len(pending) < ipfixMaxRecords {
+				continue
+			}
+		case <-tick.C:
+			if len(pending) == 0 {
+				continue
+			}
+		case <-e.p.done:
+			if len(pending) > 0 {
+				e.send(pending)
+			}
+			return
+		}
+		e.send(pending)
+		pending = pending[:0]
+	}
+}
+
+// send writes a single IPFIX message holding recs, preceded by a template set
+// when it is time to refresh the collector's view of our templates.
+func (e *flowExporter) send(recs []flowRecord) {
+	now := time.Now()
+	msg := make([]byte, 16, 1400)
+	if now.Sub(e.lastTemplates) >= flowTemplateRefresh {
+		msg = appendTemplateSet(msg)
+		e.lastTemplates = now
+	}
+	for _, v6 := range [][2]bool{{false, false}, {true, false}, {false, true}, {true, true}} {
+		id := ipfixTemplateID(v6[0], v6[1])
+		start := len(msg)
+		for i := range recs {
+			if recs[i].template() != id {
+				continue
+			}
+			if len(msg) == start {
+				msg = binary.BigEndian.AppendUint16(msg, id)
+				msg = append(msg, 0, 0)
+			}
+			msg = recs[i].encode(msg)
+		}
+		if len(msg) > start {
+			binary.BigEndian.PutUint16(msg[start+2:], uint16(len(msg)-start))
+		}
+	}
+	binary.BigEndian.PutUint16(msg[0:], ipfixVersion)
+	binary.BigEndian.PutUint16(msg[2:], uint16(len(msg)))
+	binary.BigEndian.PutUint32(msg[4:], uint32(now.Unix()))
+	binary.BigEndian.PutUint32(msg[8:], e.seq)
+	binary.BigEndian.PutUint32(msg[12:], uint32(e.p.flowDomain))
+	e.seq += uint32(len(recs))
+
+	// Only log transitions so an absent collector doesn't flood the log
+	if _, err := e.conn.Write(msg); err != nil {
+		if !e.failing {
+			e.p.logger.Warn("flow export failing", "collector", e.p.flowCollector, "error", err.Error())
+			e.failing = true
+		}
+		// Make sure the collector gets templates once it comes back
+		e.lastTemplates = time.Time{}
+	} else if e.failing {
+		e.p.logger.Info("flow export recovered", "collector", e.p.flowCollector)
+		e.failing = false
+	}
+}
+
+func appendTemplateSet(msg []byte) []byte {
+	start := len(msg)
+	msg = append(msg, 0, 2, 0, 0) // set ID 2 is a template set
+	for _, v6 := range [][2]bool{{false, false}, {true, false}, {false, true}, {true, true}} {
+		fields := ipfixTemplate(v6[0], v6[1])
+		msg = binary.BigEndian.AppendUint16(msg, ipfixTemplateID(v6[0], v6[1]))
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(fields)))
+		for _, f := range fields {
+			if f.enterprise != 0 {
+				msg = binary.BigEndian.AppendUint16(msg, f.id|0x8000)
+				msg = binary.BigEndian.AppendUint16(msg, f.length)
+				msg = binary.BigEndian.AppendUint32(msg, f.enterprise)
+				continue
+			}
+			msg = binary.BigEndian.AppendUint16(msg, f.id)
+			msg = binary.BigEndian.AppendUint16(msg, f.length)
+		}
+	}
+	binary.BigEndian.PutUint16(msg[start+2:], uint16(len(msg)-start))
+	return msg
+}
+
+// exportFlow queues a flow record for c if flow export is enabled and all of
+// the addresses involved are TCP addresses.
+func (c *client) exportFlow() {
+	if c.p.flows == nil {
+		return
+	}
+	r := flowRecord{bytesIn: c.bytesIn, bytesOut: c.bytesOut, start: c.start, end: c.done}
+	var ok [4]bool
+	r.client, ok[0] = c.conn.RemoteAddr().(*net.TCPAddr)
+	r.listener, ok[1] = c.conn.LocalAddr().(*net.TCPAddr)
+	r.local, ok[2] = c.server.LocalAddr().(*net.TCPAddr)
+	r.backend, ok[3] = c.server.RemoteAddr().(*net.TCPAddr)
+	if ok != [4]bool{true, true, true, true} {
+		return
+	}
+	c.p.flows.add(r)
+}
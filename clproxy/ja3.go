@@ -0,0 +1,98 @@
+package clproxy
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+type ja3Settings struct {
+	// With -log-ja3 the JA3 fingerprint of each client's ClientHello, which
+	// tells TLS stacks apart whatever name or address they come from, is added
+	// to its log line as tls_ja3 and to the recent stats command. The hello is
+	// the one read to terminate TLS with -tls-cert, to route with -sni-route,
+	// or otherwise sniffed as it is forwarded, as with -log-tls-info. Clients
+	// which don't send a well formed ClientHello get no fingerprint.
+	logJA3 bool
+}
+
+// ja3Fields are the parts of a ClientHello which make up its JA3 string
+type ja3Fields struct {
+	version    uint16 // the legacy version, not supported_versions
+	ciphers    []uint16
+	extensions []uint16
+	curves     []uint16
+	points     []uint8
+}
+
+// isGREASE reports whether v is one of the reserved values clients sprinkle
+// through their hellos to keep servers tolerant (RFC 8701), which JA3 leaves
+// out since they change from one connection to the next
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// collect takes the curves and point formats from a hello's extensions,
+// as far as they parse
+func (f *ja3Fields) collect(typ uint16, data []byte) {
+	e := helloReader{b: data}
+	switch typ {
+	case 10: // supported_groups
+		list := helloReader{b: e.bytes(int(e.u16()))}
+		for len(list.b) >= 2 {
+			f.curves = append(f.curves, list.u16())
+		}
+	case 11: // ec_point_formats
+		list := helloReader{b: e.bytes(int(e.u8()))}
+		for len(list.b) >= 1 {
+			f.points = append(f.points, list.u8())
+		}
+	}
+}
+
+// hash returns the JA3 fingerprint, the MD5 of the JA3 string
+func (f *ja3Fields) hash() string {
+	sum := md5.Sum([]byte(f.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// String returns the JA3 string, e.g. 771,4865-4866,0-23-65281,29-23,0
+func (f *ja3Fields) String() string {
+	var b strings.Builder
+	b.WriteString(strconv.Itoa(int(f.version)))
+	for _, list := range [][]uint16{f.ciphers, f.extensions, f.curves} {
+		b.WriteByte(',')
+		writeJA3List(&b, list)
+	}
+	b.WriteByte(',')
+	for i, p := range f.points {
+		if i > 0 {
+			b.WriteByte('-')
+		}
+		b.WriteString(strconv.Itoa(int(p)))
+	}
+	return b.String()
+}
+
+func writeJA3List(b *strings.Builder, list []uint16) {
+	first := true
+	for _, v := range list {
+		if isGREASE(v) {
+			continue
+		}
+		if !first {
+			b.WriteByte('-')
+		}
+		b.WriteString(strconv.Itoa(int(v)))
+		first = false
+	}
+}
+
+// ja3 returns c's fingerprint for the recent stats command, if it has one
+func (c *client) ja3() string {
+	if c.hello == nil {
+		return ""
+	}
+	return c.hello.ja3
+}
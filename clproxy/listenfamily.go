@@ -0,0 +1,59 @@
+package clproxy
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+type listenFamilySettings struct {
+	// -listen-family says which IP versions the -l listeners take connections
+	// over: v4 or v6 alone, or dual for both on one IPv6 socket (with IPv4
+	// clients seen at their plain IPv4 address). Left empty, Go's default
+	// applies, which is dual for an address with no host. dual needs such an
+	// address, as a specific one is only ever one family.
+	listenFamily string
+}
+
+func (p *Proxy) checkListenFamily() error {
+	switch p.listenFamily {
+	case "", "v4", "v6", "dual":
+		return nil
+	}
+	return fmt.Errorf("unknown -listen-family %q (want v4, v6, or dual)", p.listenFamily)
+}
+
+// familyNetwork returns the network to listen on address with for
+// -listen-family
+func (p *Proxy) familyNetwork(address string) (string, error) {
+	switch p.listenFamily {
+	case "v4":
+		return "tcp4", nil
+	case "v6":
+		return "tcp6", nil
+	case "dual":
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return "", err
+		}
+		if ip, err := netip.ParseAddr(host); host != "" && (err != nil || !ip.IsUnspecified()) {
+			return "", fmt.Errorf("-listen-family dual needs an address with no host or ::, e.g. :8301")
+		}
+		return "tcp", nil
+	}
+	return "tcp", nil
+}
+
+// listenFamilies describes which IP versions ln, bound with network, takes
+// connections over. Go makes a wildcard "tcp" listener dual stack whenever
+// the host has IPv6, and a "tcp6" one IPv6 only.
+func listenFamilies(network string, ln net.Listener) string {
+	ip, _ := addrIP(ln.Addr())
+	switch {
+	case ip.Is4():
+		return "v4"
+	case network == "tcp" && ip.IsUnspecified():
+		return "v4,v6"
+	}
+	return "v6"
+}
@@ -0,0 +1,24 @@
+package clproxy
+
+import "syscall"
+
+// v6onlyControl sets IPV6_V6ONLY on an IPv6 listening socket to match
+// -listen-family, rather than leaving it to the defaults. IPv4 sockets are
+// left alone.
+func (p *Proxy) v6onlyControl(network, address string, raw syscall.RawConn) error {
+	if network != "tcp6" {
+		return nil
+	}
+	only := 0
+	if p.listenFamily == "v6" {
+		only = 1
+	}
+	var err error
+	cerr := raw.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, only)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
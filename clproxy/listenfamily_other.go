@@ -0,0 +1,9 @@
+//go:build !linux
+
+package clproxy
+
+import "syscall"
+
+// Elsewhere the network we listen with sets IPV6_V6ONLY as -listen-family
+// wants
+func (p *Proxy) v6onlyControl(network, address string, raw syscall.RawConn) error { return nil }
@@ -0,0 +1,114 @@
+package clproxy
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+type logFileSettings struct {
+	// Log to this file rather than stderr. Empty means stderr.
+	logFileName string
+
+	// Rotate the log file once it would grow past logMaxSize bytes, keeping
+	// logMaxFiles old files (name.1 being the newest). Zero disables rotation.
+	logMaxSize  ByteSize
+	logMaxFiles int
+}
+
+// reopenableFile is an io.Writer for a log file which can be closed and opened
+// again, so that logrotate can move it aside and send us a SIGHUP. It can also
+// rotate itself when logMaxSize is set. Writes are serialized with reopening
+// and rotation so no line is lost or split across two files. If the file
+// can't be opened we write to stderr instead.
+type reopenableFile struct {
+	mu   sync.Mutex
+	p    *Proxy
+	path string
+	f    *os.File
+	size int64
+}
+
+func (p *Proxy) openLogFile(path string) (*reopenableFile, error) {
+	r := &reopenableFile{p: p, path: path}
+	f, size, err := r.open()
+	if err != nil {
+		return nil, err
+	}
+	r.f, r.size = f, size
+	return r, nil
+}
+
+// open opens the path, returning the file and how big it already is. It
+// leaves r alone, so that the caller can swap the file in under r.mu.
+func (r *reopenableFile) open() (*os.File, int64, error) {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, 0, err
+	}
+	var size int64
+	if fi, err := f.Stat(); err == nil {
+		size = fi.Size()
+	}
+	return f, size, nil
+}
+
+func (r *reopenableFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return os.Stderr.Write(p)
+	}
+	if r.p.logMaxSize > 0 && r.size > 0 && r.size+int64(len(p)) > int64(r.p.logMaxSize) {
+		r.rotate()
+		if r.f == nil {
+			return os.Stderr.Write(p)
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate shifts name.N to name.N+1, dropping anything past logMaxFiles, moves
+// the current file to name.1, and starts a new one. It must be called with
+// r.mu held.
+func (r *reopenableFile) rotate() {
+	r.f.Close()
+	r.f = nil
+	os.Remove(fmt.Sprintf("%s.%d", r.path, r.p.logMaxFiles))
+	for i := r.p.logMaxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	if r.p.logMaxFiles > 0 {
+		os.Rename(r.path, r.path+".1")
+	} else {
+		os.Remove(r.path)
+	}
+	f, size, err := r.open()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to open log file %s after rotation, logging to stderr: %s\n", r.path, err.Error())
+		return
+	}
+	r.f, r.size = f, size
+	// We are inside a log write, so the rotation has to be logged once it
+	// has finished rather than from here.
+	go r.p.logger.Info("log rotated", "file", r.path, "keep", r.p.logMaxFiles)
+}
+
+// reopen closes the current file and opens the path again
+func (r *reopenableFile) reopen() error {
+	f, size, err := r.open()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f != nil {
+		r.f.Close()
+	}
+	r.f, r.size = f, size
+	if err != nil {
+		r.f = nil
+		fmt.Fprintf(os.Stderr, "unable to reopen log file %s, logging to stderr: %s\n", r.path, err.Error())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package clproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type loggingSettings struct {
+	// One of text, logfmt, or json
+	logFormat string
+
+	// One of debug, info, warn, or error
+	logLevelName string
+
+	// Write one JSON line per connection to this file rather than mixing them in
+	// with the operational log. Empty disables the access log.
+	accessLogName string
+
+	// Log a line when a connection is accepted and another when its backend
+	// connection is made, in addition to the one when it completes
+	logConnect      bool
+	logConnectLevel string
+}
+
+type loggingState struct {
+	logLevel  *slog.LevelVar
+	accessLog *slog.Logger
+
+	// Everything the proxy logs goes through this logger so that fields are named
+	// and formatted the same way no matter where they come from.
+	logger *slog.Logger
+
+	connectLevel slog.Level
+}
+
+// setupLogging replaces the default logger with one for the configured format
+func (p *Proxy) setupLogging(w io.Writer) error {
+	if err := p.logLevel.UnmarshalText([]byte(p.logLevelName)); err != nil {
+		return fmt.Errorf("unknown log level %q (want debug, info, warn, or error)", p.logLevelName)
+	}
+	opts := &slog.HandlerOptions{Level: p.logLevel, ReplaceAttr: dropEmptyMessage}
+	var h slog.Handler
+	switch p.logFormat {
+	case "text":
+		h = newTextHandler(w, p.logLevel)
+	case "logfmt":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("unknown log format %q (want text, logfmt, or json)", p.logFormat)
+	}
+	p.logger = slog.New(h)
+	return nil
+}
+
+// setupAccessLog opens the access log, which is always JSON and always written
+// regardless of -log-level
+func (p *Proxy) setupAccessLog() (*reopenableFile, error) {
+	f, err := p.openLogFile(p.accessLogName)
+	if err != nil {
+		return nil, err
+	}
+	p.accessLog = slog.New(slog.NewJSONHandler(f, &slog.HandlerOptions{
+		Level:       slog.LevelDebug,
+		ReplaceAttr: dropEmptyMessage,
+	}))
+	return f, nil
+}
+
+// logConnection writes the record for a completed or failed connection, to
+// the access log if there is one and the operational log otherwise
+func (p *Proxy) logConnection(level slog.Level, args ...any) {
+	if p.accessLog != nil {
+		p.accessLog.Log(context.Background(), level, "", args...)
+		return
+	}
+	p.logger.Log(context.Background(), level, "", args...)
+}
+
+// logRejection writes the access log's record of conn, from client and
+// turned away for reason before it got a session, reporting false if there
+// is no access log and the operational log is to say so instead
+func (p *Proxy) logRejection(client string, conn net.Conn, reason string, args ...any) bool {
+	if p.accessLog == nil {
+		return false
+	}
+	p.logConnection(slog.LevelWarn, append([]any{
+		"client", client,
+		"local", conn.LocalAddr().String(),
+		"status", "rejected",
+		"reason", reason,
+	}, args...)...)
+	return true
+}
+
+// logStart writes one of the -log-connect lines for c
+func (c *client) logStart(msg string, args ...any) {
+	if !c.p.logConnect {
+		return
+	}
+	base := []any{"id", c.UID, "client", c.name}
+	if name := c.rt.logName(); name != "" {
+		base = append(base, "route", name)
+	}
+	c.p.logger.Log(context.Background(), c.p.connectLevel, msg, append(base, args...)...)
+}
+
+// Connection records carry everything in their fields and have no message, so
+// leave the empty msg out of structured output rather than printing msg="".
+func dropEmptyMessage(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) == 0 && a.Key == slog.MessageKey && a.Value.String() == "" {
+		return slog.Attr{}
+	}
+	return a
+}
+
+// textHandler writes the traditional human oriented format: the standard log
+// package timestamp followed by the message, if any, and key=value pairs.
+// Strings are only quoted when they need to be. Levels are used for filtering
+// but, as before, not printed.
+type textHandler struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	level  slog.Leveler
+	attrs  []slog.Attr
+	prefix string
+}
+
+func newTextHandler(w io.Writer, level slog.Leveler) *textHandler {
+	return &textHandler{mu: &sync.Mutex{}, w: w, level: level}
+}
+
+func (h *textHandler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= h.level.Level()
+}
+
+func (h *textHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	n := *h
+	n.attrs = append(n.attrs[:len(n.attrs):len(n.attrs)], h.qualify(attrs)...)
+	return &n
+}
+
+func (h *textHandler) WithGroup(name string) slog.Handler {
+	n := *h
+	n.prefix = h.prefix + name + "."
+	return &n
+}
+
+func (h *textHandler) qualify(attrs []slog.Attr) []slog.Attr {
+	if h.prefix == "" {
+		return attrs
+	}
+	out := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		out[i] = slog.Attr{Key: h.prefix + a.Key, Value: a.Value}
+	}
+	return out
+}
+
+func (h *textHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	b.WriteString(r.Time.Format("2006/01/02 15:04:05"))
+	if r.Message != "" {
+		b.WriteByte(' ')
+		b.WriteString(r.Message)
+	}
+	for _, a := range h.attrs {
+		appendTextAttr(&b, "", a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		appendTextAttr(&b, h.prefix, a)
+		return true
+	})
+	b.WriteByte('\n')
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, b.String())
+	return err
+}
+
+func appendTextAttr(b *strings.Builder, prefix string, a slog.Attr) {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		for _, ga := range v.Group() {
+			appendTextAttr(b, prefix+a.Key+".", ga)
+		}
+		return
+	}
+	if a.Key == "" {
+		return
+	}
+	b.WriteByte(' ')
+	b.WriteString(prefix)
+	b.WriteString(a.Key)
+	b.WriteByte('=')
+	b.WriteString(textValue(v))
+}
+
+func textValue(v slog.Value) string {
+	switch v.Kind() {
+	case slog.KindFloat64:
+		return strconv.FormatFloat(v.Float64(), 'f', 6, 64)
+	case slog.KindDuration:
+		return strconv.FormatFloat(v.Duration().Seconds(), 'f', 6, 64)
+	case slog.KindTime:
+		return v.Time().Format(time.RFC3339Nano)
+	case slog.KindString:
+		s := v.String()
+		if s == "" || strings.ContainsAny(s, " \t\r\n\"=") {
+			return strconv.Quote(s)
+		}
+		return s
+	}
+	return v.String()
+}
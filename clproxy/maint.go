@@ -0,0 +1,74 @@
+package clproxy
+
+import (
+	"fmt"
+	"io"
+)
+
+// Maintenance mode. A backend disabled through the stats port gets no new
+// sessions whatever its health, while the ones it has carry on. The flag lives
+// on the backend, so it lasts through re-resolution and config reloads for as
+// long as the backend is still configured.
+
+// statsDisable answers "disable <backend> [route]" on the stats port
+func (p *Proxy) statsDisable(w io.Writer, args []string) {
+	p.setMaint(w, args, "disable", true)
+}
+
+// statsEnable answers "enable <backend> [route]" on the stats port
+func (p *Proxy) statsEnable(w io.Writer, args []string) {
+	p.setMaint(w, args, "enable", false)
+}
+
+func (p *Proxy) setMaint(w io.Writer, args []string, cmd string, maint bool) {
+	if len(args) != 1 && len(args) != 2 {
+		fmt.Fprintf(w, "error: usage: %s <backend> [route]\n", cmd)
+		return
+	}
+	rts := p.allRoutes()
+	if len(args) == 2 {
+		rt, ok := p.findRoute(args[1])
+		if !ok {
+			fmt.Fprintf(w, "error: unknown route %q\n", args[1])
+			return
+		}
+		rts = []*route{rt}
+	}
+	found := false
+	for _, rt := range rts {
+		b, ok := rt.backends.lookup(args[0])
+		if !ok {
+			continue
+		}
+		found = true
+		logArgs := []any{"backend", b.addr}
+		if rt.name != "" {
+			logArgs = append(logArgs, "route", rt.name)
+		}
+		if b.maint.Swap(maint) != maint {
+			if maint {
+				p.logger.Info("backend disabled", logArgs...)
+			} else {
+				p.logger.Info("backend enabled", logArgs...)
+			}
+		}
+		fmt.Fprintln(w, b)
+		if maint && len(rt.backends.candidates(false)) == 0 && len(rt.backends.candidates(true)) == 0 {
+			p.logger.Error("disabled the last available backend, new connections will fail until one is enabled", logArgs...)
+			fmt.Fprintln(w, "warning: that was the last available backend, new connections will fail until one is enabled")
+		}
+	}
+	if !found {
+		fmt.Fprintf(w, "error: unknown backend %q\n", args[0])
+	}
+}
+
+func (b *backend) maintString() string {
+	if b.draining() {
+		return "mode=draining"
+	}
+	if b.maint.Load() {
+		return "mode=maint"
+	}
+	return "mode=normal"
+}
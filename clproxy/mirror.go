@@ -0,0 +1,109 @@
+package clproxy
+
+import (
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type mirrorSettings struct {
+	// With -mirror a copy of what each client sends is also written to a shadow
+	// backend, whose replies are thrown away. Mirroring never holds up the real
+	// session: bytes the mirror can't take in time are dropped and counted.
+	// -mirror-sample mirrors only that fraction of sessions.
+	mirrorAddr   string
+	mirrorSample float64
+}
+
+type mirrorState struct {
+	mirroredSessions atomic.Uint64
+	mirrorFailures   atomic.Uint64
+	mirrorDropped    atomic.Int64
+}
+
+// Chunks of client data queued for the mirror before we start dropping, and
+// how long the mirror gets to take each one
+const mirrorQueue = 64
+const mirrorTimeout = 5 * time.Second
+
+// A mirror is one session's connection to the shadow backend. It is the
+// io.Writer the client's data is teed into.
+type mirror struct {
+	p       *Proxy
+	queue   chan []byte
+	dropped atomic.Int64
+	once    sync.Once
+}
+
+// startMirror begins mirroring a session if it is picked by -mirror-sample.
+// The mirror is dialed in the background; data queues up meanwhile.
+func (p *Proxy) startMirror() *mirror {
+	if p.mirrorAddr == "" || (p.mirrorSample < 1 && rand.Float64() >= p.mirrorSample) {
+		return nil
+	}
+	p.mirroredSessions.Add(1)
+	m := &mirror{p: p, queue: make(chan []byte, mirrorQueue)}
+	go m.run()
+	return m
+}
+
+// Write queues a copy of p for the mirror, or drops it if the queue is full
+func (m *mirror) Write(p []byte) (int, error) {
+	select {
+	case m.queue <- append([]byte(nil), p...):
+	default:
+		m.drop(len(p))
+	}
+	return len(p), nil
+}
+
+func (m *mirror) drop(n int) {
+	m.dropped.Add(int64(n))
+	m.p.mirrorDropped.Add(int64(n))
+}
+
+// close ends the session's mirroring once whatever is queued has been sent
+func (m *mirror) close() {
+	m.once.Do(func() { close(m.queue) })
+}
+
+func (m *mirror) run() {
+	network, address := DialAddr(m.p.mirrorAddr)
+	d := &net.Dialer{Timeout: mirrorTimeout, Resolver: m.p.resolver.dialer}
+	conn, err := d.Dial(network, address)
+	if err != nil {
+		m.fail(err)
+		return
+	}
+	defer conn.Close()
+	go io.Copy(io.Discard, conn)
+	for buf := range m.queue {
+		conn.SetWriteDeadline(time.Now().Add(mirrorTimeout))
+		if _, err := conn.Write(buf); err != nil {
+			m.drop(len(buf))
+			m.fail(err)
+			return
+		}
+	}
+}
+
+// fail gives up on the mirror for this session, dropping everything still
+// to come
+func (m *mirror) fail(err error) {
+	m.p.mirrorFailures.Add(1)
+	m.p.logger.Debug("mirror failed", "mirror", m.p.mirrorAddr, "error", err.Error())
+	for buf := range m.queue {
+		m.drop(len(buf))
+	}
+}
+
+// statsMirror adds the mirror counters to the stats summary when mirroring
+func (p *Proxy) statsMirror(w io.Writer) {
+	if p.mirrorAddr != "" {
+		fmt.Fprintf(w, "mirror: sessions=%d failed=%d dropped_bytes=%d\n", p.mirroredSessions.Load(), p.mirrorFailures.Load(), p.mirrorDropped.Load())
+	}
+}
@@ -0,0 +1,73 @@
+package clproxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+type mptcpSettings struct {
+	// With -mptcp our listeners and backend dials offer Multipath TCP, so that a
+	// session can survive the failure of one of several paths. Whether it's
+	// used is up to the other end; when either end, the kernel, or the platform
+	// doesn't support it the connection is plain TCP, as it would have been.
+	multipathTCP bool
+}
+
+type mptcpState struct {
+	// How many client and backend connections did and didn't end up using MPTCP
+	mptcpCounts struct {
+		clientMPTCP, clientPlain   atomic.Uint64
+		backendMPTCP, backendPlain atomic.Uint64
+	}
+}
+
+// transport names what conn is carried over: mptcp, tcp, or "" when it isn't
+// a TCP connection at all. A TLS connection is looked through.
+func transport(conn net.Conn) string {
+	if nc, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		conn = nc.NetConn()
+	}
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return ""
+	}
+	if used, err := tc.MultipathTCP(); err == nil && used {
+		return "mptcp"
+	}
+	return "tcp"
+}
+
+// noteMPTCP counts and logs whether c's connections negotiated MPTCP
+func (c *client) noteMPTCP() {
+	if !c.p.multipathTCP {
+		return
+	}
+	backend := transport(c.server)
+	for _, side := range []struct {
+		transport    string
+		mptcp, plain *atomic.Uint64
+	}{
+		{c.clientTransport, &c.p.mptcpCounts.clientMPTCP, &c.p.mptcpCounts.clientPlain},
+		{backend, &c.p.mptcpCounts.backendMPTCP, &c.p.mptcpCounts.backendPlain},
+	} {
+		switch side.transport {
+		case "mptcp":
+			side.mptcp.Add(1)
+		case "tcp":
+			side.plain.Add(1)
+		}
+	}
+	c.p.logger.Debug("mptcp", "id", c.UID, "client", c.clientTransport, "backend", backend)
+}
+
+// statsMPTCP adds the MPTCP counts to the stats summary when -mptcp is on
+func (p *Proxy) statsMPTCP(w io.Writer) {
+	if !p.multipathTCP {
+		return
+	}
+	fmt.Fprintf(w, "mptcp: client_mptcp=%d client_plain=%d backend_mptcp=%d backend_plain=%d\n",
+		p.mptcpCounts.clientMPTCP.Load(), p.mptcpCounts.clientPlain.Load(),
+		p.mptcpCounts.backendMPTCP.Load(), p.mptcpCounts.backendPlain.Load())
+}
@@ -0,0 +1,189 @@
+package clproxy
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The defaults of -s and -c, which the stats and selftest subcommands go by
+// too
+const (
+	DefaultStatsAddr   = "127.0.0.1:8299"
+	DefaultConcurrency = 1
+)
+
+// Options are what a Proxy is made from. The fields are the settings a
+// program embedding the proxy is most likely to want; every other setting is
+// one of the command's flags, which RegisterFlags defines. A field left at
+// its zero value takes its setting from those flags if RegisterFlags was
+// called, or else from the flag's default, and one which isn't overrides the
+// flag.
+type Options struct {
+	// Addresses to listen on, as -l takes them
+	Listen []string
+
+	// Listeners already bound, by a test for instance, to serve as if they
+	// were among Listen. Unless Listen or -l is given as well, they are all
+	// that is listened on. They can't be used with -config.
+	Listeners []net.Listener
+
+	// Backends to proxy to, as -p takes them
+	Backends []string
+
+	// Sessions allowed at once, as -c
+	Concurrency int
+
+	// The stats port's address, as -s
+	StatsAddr string
+
+	// How long connecting to a backend may take, as -dial-timeout
+	DialTimeout time.Duration
+
+	// How to choose between the backends, as -balance: one of the built in
+	// policies or of Balancers
+	Balance string
+
+	// Balancers of the program's own, by the name Balance, -balance, or a
+	// -config route's balance gives them
+	Balancers map[string]Balancer
+
+	// If set, makes every connection to a backend, and every health check,
+	// in place of the proxy's own dialing. -socks5, -http-proxy, and the
+	// -bind-* flags don't apply to it, and ws:// and wss:// backends are
+	// still dialed as WebSockets; -backend-tls and -backend-prelude-file are
+	// still done on the connection it returns.
+	DialFunc DialFunc
+
+	// Where to log, in place of the logger -log-format, -log-level, and
+	// -log-file would make. The stats port's loglevel command has no effect
+	// on it.
+	Logger *slog.Logger
+
+	// Hooks following sessions through their life, for custom ACLs, metrics,
+	// or tagging, each optional. OnAccept is called with each client's
+	// connection once it has passed the ACL, bans, and any TLS handshake, and
+	// an error from it turns the client away as the ACL would. OnAdmit is
+	// called once a session has a slot under -c, OnDialed once its backend is
+	// connected, and OnClose as the session is logged, whether it succeeded
+	// or not.
+	//
+	// They are called synchronously on the connection's goroutine, for many
+	// connections at once, so they hold the connection up while they run and
+	// must be quick; anything slow belongs on a goroutine of its own. One
+	// which panics is logged with where it was called and the connection, and
+	// counted in the stats summary, and the connection carries on as if it
+	// hadn't been there.
+	OnAccept func(conn net.Conn) error
+	OnAdmit  func(info ConnInfo)
+	OnDialed func(info ConnInfo)
+	OnClose  func(s Summary)
+
+	// The flags the settings are bound to, and the settings
+	flags    *flag.FlagSet
+	settings *settings
+
+	// The flags which were set from the environment, by flag name
+	fromEnv map[string]string
+}
+
+// RegisterFlags defines the command's flags on fs, for a Proxy made from o
+// to take its settings from once fs is parsed
+func (o *Options) RegisterFlags(fs *flag.FlagSet) {
+	o.flags, o.settings, o.fromEnv = fs, new(settings), map[string]string{}
+	o.settings.register(fs)
+}
+
+// apply sets the flags of the fields which are given, so that they count as
+// given wherever that matters, as -p does against -backends-file
+func (o *Options) apply() error {
+	if o.settings == nil {
+		o.RegisterFlags(flag.NewFlagSet("clproxy", flag.ContinueOnError))
+	}
+	given := map[string]bool{}
+	o.flags.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	if len(o.Listen) > 0 || len(o.Listeners) > 0 && !given["l"] {
+		o.settings.listenOn = ""
+	}
+	set := func(name, value string) error {
+		if err := o.flags.Set(name, value); err != nil {
+			return fmt.Errorf("invalid value %q for -%s: %v", value, name, err)
+		}
+		return nil
+	}
+	var errs []error
+	for _, addr := range o.Listen {
+		errs = append(errs, set("l", addr))
+	}
+	if len(o.Backends) > 0 {
+		errs = append(errs, set("p", strings.Join(o.Backends, ",")))
+	}
+	if o.Concurrency != 0 {
+		errs = append(errs, set("c", strconv.Itoa(o.Concurrency)))
+	}
+	if o.StatsAddr != "" {
+		errs = append(errs, set("s", o.StatsAddr))
+	}
+	if o.DialTimeout != 0 {
+		errs = append(errs, set("dial-timeout", o.DialTimeout.String()))
+	}
+	if o.Balance != "" {
+		errs = append(errs, set("balance", o.Balance))
+	}
+	return errors.Join(errs...)
+}
+
+// An Error is why New or Start failed. Status is what the command exits
+// with: 2 when it was misused, with flags or options which make no sense,
+// and 1 when something it was asked to do couldn't be done, in which case
+// the failure has been logged already.
+type Error struct {
+	Status int
+	Err    error
+}
+
+func (e *Error) Error() string { return e.Err.Error() }
+func (e *Error) Unwrap() error { return e.Err }
+
+// usage makes err an Error for flags or options which make no sense
+func usage(err error) error {
+	return &Error{Status: 2, Err: err}
+}
+
+// fail logs a failure which stops the proxy starting, and returns it as an
+// Error for New or Start to give back
+func (p *Proxy) fail(msg string, args ...any) error {
+	p.logger.Error(msg, args...)
+	var b strings.Builder
+	b.WriteString(msg)
+	for i := 0; i+1 < len(args); i += 2 {
+		fmt.Fprintf(&b, " %v=%v", args[i], args[i+1])
+	}
+	return &Error{Status: 1, Err: errors.New(b.String())}
+}
+
+// abort logs a failure which leaves the proxy unable to carry on, such as a
+// listener failing, and passes it on to whoever is watching Failed
+func (p *Proxy) abort(msg string, args ...any) {
+	err := p.fail(msg, args...)
+	select {
+	case p.failed <- err:
+	default:
+	}
+}
+
+// Failed delivers the error if the proxy stops serving of its own accord, as
+// when a listener fails. It is logged already.
+func (p *Proxy) Failed() <-chan error {
+	return p.failed
+}
+
+// Logger returns the logger the proxy logs everything through
+func (p *Proxy) Logger() *slog.Logger {
+	return p.logger
+}
@@ -0,0 +1,164 @@
+package clproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type origDstSettings struct {
+	// With -original-dst (Linux only) each connection goes to wherever it was
+	// headed before an iptables REDIRECT rule sent it to us, instead of to -p.
+	// originalDstAllow limits where that may be, so we can't be used as an open
+	// relay.
+	originalDst      bool
+	originalDstAllow string
+}
+
+type origDstState struct {
+	dstRules  []dstRule
+	dstRoutes destinations
+}
+type dstRule struct {
+	prefix netip.Prefix // invalid means any address
+	port   uint16       // 0 means any port
+}
+
+// destinations holds the destinations seen so far, each with a backend set
+// of its own so that they get counters and a line in the backends stats
+type destinations struct {
+	sync.Mutex
+	p *Proxy
+	m map[netip.AddrPort]*backendSet
+}
+
+// get returns the backend set for dst, making one if it's new
+func (d *destinations) get(dst netip.AddrPort) *backendSet {
+	d.Lock()
+	defer d.Unlock()
+	s, ok := d.m[dst]
+	if !ok {
+		s = d.p.newBackendSet()
+		s.set([]string{dst.String()}, nil, nil, nil)
+		d.m[dst] = s
+	}
+	return s
+}
+
+// backends lists the backend of every destination seen
+func (d *destinations) backends() []*backend {
+	d.Lock()
+	sets := make([]*backendSet, 0, len(d.m))
+	for _, s := range d.m {
+		sets = append(sets, s)
+	}
+	d.Unlock()
+	var out []*backend
+	for _, s := range sets {
+		out = append(out, s.list()...)
+	}
+	return out
+}
+
+var errDstNotAllowed = errors.New("original destination is not allowed")
+var errNotRedirected = errors.New("connection was not redirected")
+
+// setupOriginalDst parses -original-dst-allow: a comma separated list of
+// CIDRs, each optionally followed by :port (with IPv6 ones in brackets, e.g.
+// [2001:db8::/32]:443), or :port alone for any address
+func (p *Proxy) setupOriginalDst() error {
+	if err := checkOriginalDst(); err != nil {
+		return err
+	}
+	var err error
+	p.dstRules, err = parseDstRules(p.originalDstAllow)
+	return err
+}
+
+// parseDstRules parses a comma separated list of destination rules
+func parseDstRules(list string) ([]dstRule, error) {
+	var rules []dstRule
+	for _, s := range splitList(list) {
+		r, err := parseDstRule(s)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func parseDstRule(s string) (dstRule, error) {
+	var r dstRule
+	prefix, port := s, ""
+	switch {
+	case strings.HasPrefix(s, "["):
+		var ok bool
+		prefix, port, ok = strings.Cut(s[1:], "]:")
+		if !ok {
+			return r, fmt.Errorf("bad destination %q", s)
+		}
+	case strings.Count(s, ":") == 1:
+		prefix, port, _ = strings.Cut(s, ":")
+	}
+	if port != "" {
+		n, err := strconv.ParseUint(port, 10, 16)
+		if err != nil || n == 0 {
+			return r, fmt.Errorf("bad port in %q", s)
+		}
+		r.port = uint16(n)
+	}
+	if prefix != "" {
+		p, err := parsePrefix(prefix)
+		if err != nil {
+			return r, err
+		}
+		r.prefix = p
+	}
+	return r, nil
+}
+
+// dstAllowed reports whether dst matches -original-dst-allow. An empty list
+// allows everything.
+func (p *Proxy) dstAllowed(dst netip.AddrPort) bool {
+	return len(p.dstRules) == 0 || matchDst(p.dstRules, dst)
+}
+
+// matchDst reports whether dst matches any of rules
+func matchDst(rules []dstRule, dst netip.AddrPort) bool {
+	for _, r := range rules {
+		if (!r.prefix.IsValid() || r.prefix.Contains(dst.Addr())) && (r.port == 0 || r.port == dst.Port()) {
+			return true
+		}
+	}
+	return false
+}
+
+// routeOriginalDst finds where conn was originally headed and returns the
+// backend set for it
+func (p *Proxy) routeOriginalDst(conn net.Conn) (*backendSet, error) {
+	dst, err := getOriginalDst(conn)
+	if err != nil {
+		return nil, err
+	}
+	dst = netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port())
+	if local, ok := addrPort(conn.LocalAddr()); ok && local == dst {
+		return nil, errNotRedirected
+	}
+	if !p.dstAllowed(dst) {
+		return nil, fmt.Errorf("%w: %s", errDstNotAllowed, dst)
+	}
+	return p.dstRoutes.get(dst), nil
+}
+
+// statsOriginalDst adds the destinations seen to the backends stats
+func (p *Proxy) statsOriginalDst(w io.Writer) {
+	for _, b := range p.dstRoutes.backends() {
+		fmt.Fprintf(w, "original_dst %s\n", b)
+	}
+}
@@ -0,0 +1,64 @@
+package clproxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"syscall"
+	"unsafe"
+)
+
+// From linux/netfilter_ipv4.h and linux/netfilter_ipv6/ip6_tables.h
+const soOriginalDst = 80
+
+// getOriginalDst asks netfilter where conn was headed before it was
+// redirected to us
+func getOriginalDst(conn net.Conn) (netip.AddrPort, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return netip.AddrPort{}, errors.New("not a TCP connection")
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	var dst netip.AddrPort
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		// sockaddr_in6 is the larger of the two
+		var sa syscall.RawSockaddrInet6
+		size := uint32(unsafe.Sizeof(sa))
+		level := syscall.SOL_IP
+		if ap, _ := addrPort(conn.LocalAddr()); ap.Addr().Is6() {
+			level = syscall.SOL_IPV6
+		}
+		_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, uintptr(level), soOriginalDst,
+			uintptr(unsafe.Pointer(&sa)), uintptr(unsafe.Pointer(&size)), 0)
+		if errno == syscall.ENOENT {
+			// No NAT entry, so the client connected to us directly
+			serr = errNotRedirected
+			return
+		} else if errno != 0 {
+			serr = errno
+			return
+		}
+		// The port is in network byte order in both layouts
+		port := binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(&sa.Port))[:])
+		switch sa.Family {
+		case syscall.AF_INET:
+			sa4 := (*syscall.RawSockaddrInet4)(unsafe.Pointer(&sa))
+			dst = netip.AddrPortFrom(netip.AddrFrom4(sa4.Addr), port)
+		case syscall.AF_INET6:
+			dst = netip.AddrPortFrom(netip.AddrFrom16(sa.Addr), port)
+		default:
+			serr = errors.New("unexpected address family")
+		}
+	})
+	if err == nil {
+		err = serr
+	}
+	return dst, err
+}
+
+func checkOriginalDst() error { return nil }
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package clproxy
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+)
+
+func getOriginalDst(conn net.Conn) (netip.AddrPort, error) {
+	return netip.AddrPort{}, checkOriginalDst()
+}
+
+func checkOriginalDst() error {
+	return errors.New("-original-dst is only supported on Linux")
+}
@@ -0,0 +1,28 @@
+package clproxy
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// peerCred describes the process at the other end of a Unix socket using
+// SO_PEERCRED
+func peerCred(conn *net.UnixConn) (string, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err == nil {
+		err = credErr
+	}
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("unix:pid=%d,uid=%d,gid=%d", cred.Pid, cred.Uid, cred.Gid), nil
+}
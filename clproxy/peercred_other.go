@@ -0,0 +1,12 @@
+//go:build !linux
+
+package clproxy
+
+import (
+	"net"
+	"syscall"
+)
+
+func peerCred(conn *net.UnixConn) (string, error) {
+	return "", syscall.ENOTSUP
+}
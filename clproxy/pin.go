@@ -0,0 +1,154 @@
+package clproxy
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+type pinSettings struct {
+	// With -backend-tls-pin a backend's certificate chain must also contain a
+	// public key we know, given as sha256//<base64 SHA-256 of the
+	// SubjectPublicKeyInfo> as in HPKP. Any certificate of the verified chain
+	// may match, so a pin can be the backend's own key or that of the CA which
+	// issues it; with -backend-tls-insecure nothing is verified and only the
+	// backend's own certificate counts. Pins may also be listed in
+	// -backend-tls-pin-file, one per line, which is reloaded on SIGHUP.
+	backendTLSPin     string
+	backendTLSPinFile string
+}
+
+type pinState struct {
+	// The pins in force, by raw digest. Nil when pinning is off.
+	backendPins atomic.Pointer[map[string]bool]
+
+	backendPinMismatches atomic.Uint64
+}
+
+const pinPrefix = "sha256//"
+
+// backendPinError marks a backend whose certificate chain matched none of
+// the pins
+type backendPinError struct {
+	spki string
+}
+
+func (e *backendPinError) Error() string {
+	return "backend tls pin mismatch: certificate key is " + e.spki
+}
+
+// setupBackendPins loads the pins, if any are configured
+func (p *Proxy) setupBackendPins() error {
+	if p.backendTLSPin == "" && p.backendTLSPinFile == "" {
+		return nil
+	}
+	if !p.backendTLS {
+		return errors.New("-backend-tls-pin needs -backend-tls")
+	}
+	if err := p.reloadPins(); err != nil {
+		return err
+	}
+	if p.backendTLSPinFile != "" {
+		p.onReload = append(p.onReload, func() { p.reloadPins() })
+	}
+	return nil
+}
+
+// reloadPins reads the pins from -backend-tls-pin and -backend-tls-pin-file.
+// If they don't all parse the pins in force are kept.
+func (p *Proxy) reloadPins() error {
+	fail := func(err error) error {
+		p.logger.Error("backend tls pins not loaded", "file", p.backendTLSPinFile, "error", err.Error())
+		return err
+	}
+	specs := splitList(p.backendTLSPin)
+	if p.backendTLSPinFile != "" {
+		lines, err := readPinFile(p.backendTLSPinFile)
+		if err != nil {
+			return fail(err)
+		}
+		specs = append(specs, lines...)
+	}
+	pins := map[string]bool{}
+	for _, spec := range specs {
+		digest, err := parsePin(spec)
+		if err != nil {
+			return fail(err)
+		}
+		pins[digest] = true
+	}
+	if len(pins) == 0 {
+		return fail(errors.New("no pins given"))
+	}
+	p.backendPins.Store(&pins)
+	p.logger.Info("backend tls pins loaded", "file", p.backendTLSPinFile, "pins", len(pins))
+	return nil
+}
+
+// readPinFile reads a pin file. Blank lines and lines starting with # are
+// ignored.
+func readPinFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var pins []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pins = append(pins, line)
+	}
+	return pins, sc.Err()
+}
+
+// parsePin checks a sha256//base64 pin and returns the digest it holds
+func parsePin(spec string) (string, error) {
+	b64, ok := strings.CutPrefix(spec, pinPrefix)
+	if !ok {
+		return "", fmt.Errorf("bad pin %q, want sha256//base64", spec)
+	}
+	digest, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil || len(digest) != sha256.Size {
+		return "", fmt.Errorf("bad pin %q, want the base64 of a SHA-256 digest", spec)
+	}
+	return string(digest), nil
+}
+
+// spkiDigest is the SHA-256 of cert's SubjectPublicKeyInfo
+func spkiDigest(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return string(sum[:])
+}
+
+// checkPins fails a finished backend handshake whose certificate chain holds
+// none of the pinned keys
+func (p *Proxy) checkPins(cs tls.ConnectionState) error {
+	pins := p.backendPins.Load()
+	if pins == nil || len(cs.PeerCertificates) == 0 {
+		return nil
+	}
+	chains := cs.VerifiedChains
+	if len(chains) == 0 {
+		chains = [][]*x509.Certificate{cs.PeerCertificates[:1]}
+	}
+	for _, chain := range chains {
+		for _, cert := range chain {
+			if (*pins)[spkiDigest(cert)] {
+				return nil
+			}
+		}
+	}
+	p.backendPinMismatches.Add(1)
+	return &backendPinError{spki: pinPrefix + base64.StdEncoding.EncodeToString([]byte(spkiDigest(cs.PeerCertificates[0])))}
+}
@@ -0,0 +1,185 @@
+package clproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+type poolSettings struct {
+	// With -pool-size each primary backend has up to that many connections
+	// dialed (and TLS handshaken) ahead of time, and a newly admitted client is
+	// handed one of those instead of waiting on a dial. Pooled connections which
+	// go unused for -pool-idle-timeout are closed and replaced.
+	poolSize        int
+	poolIdleTimeout time.Duration
+}
+
+type poolState struct {
+	poolWakeup chan struct{}
+}
+
+// How long the liveness check before handing over a pooled connection waits
+// for the backend to say it has gone away
+const poolCheckWait = time.Millisecond
+
+type pooledConn struct {
+	conn  net.Conn
+	since time.Time
+}
+
+// connPool is a backend's ready connections, newest last. The zero value is
+// an empty pool.
+type connPool struct {
+	sync.Mutex
+	conns   []pooledConn
+	filling int  // dials in progress
+	drained bool // the backend is gone; take nothing more in
+}
+
+// take returns a pooled connection which still looks alive, if there is one
+// which has been idle for less than idle
+func (p *connPool) take(idle time.Duration) (net.Conn, bool) {
+	for {
+		p.Lock()
+		if len(p.conns) == 0 {
+			p.Unlock()
+			return nil, false
+		}
+		pc := p.conns[len(p.conns)-1]
+		p.conns = p.conns[:len(p.conns)-1]
+		p.Unlock()
+		if time.Since(pc.since) >= idle {
+			pc.conn.Close()
+			continue
+		}
+		if conn, ok := alive(pc.conn); ok {
+			return conn, true
+		}
+		pc.conn.Close()
+	}
+}
+
+// alive checks that a pooled connection hasn't been closed by the backend
+// while it sat idle, by reading with a deadline which has all but passed. A
+// backend which speaks first will have sent something already; that is kept
+// for the client.
+func alive(conn net.Conn) (net.Conn, bool) {
+	conn.SetReadDeadline(time.Now().Add(poolCheckWait))
+	defer conn.SetReadDeadline(time.Time{})
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if n > 0 {
+		return replay(conn, buf[:n]), true
+	}
+	return conn, errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// put adds a freshly dialed connection to the pool, or closes it if the pool
+// has been drained in the meantime
+func (p *connPool) put(conn net.Conn) {
+	p.Lock()
+	defer p.Unlock()
+	p.filling--
+	if p.drained {
+		conn.Close()
+		return
+	}
+	p.conns = append(p.conns, pooledConn{conn: conn, since: time.Now()})
+}
+
+// expire closes the connections which have been idle for idle or longer and
+// returns how many more dials it would take to fill the pool to size. Those
+// dials are counted as in progress.
+func (p *connPool) expire(size int, idle time.Duration) int {
+	p.Lock()
+	defer p.Unlock()
+	keep := p.conns[:0]
+	for _, pc := range p.conns {
+		if time.Since(pc.since) >= idle {
+			pc.conn.Close()
+			continue
+		}
+		keep = append(keep, pc)
+	}
+	clear(p.conns[len(keep):])
+	p.conns = keep
+	need := size - len(p.conns) - p.filling
+	if need < 0 || p.drained {
+		return 0
+	}
+	p.filling += need
+	return need
+}
+
+// drain closes every pooled connection of a backend which has been removed
+func (p *connPool) drain() {
+	p.Lock()
+	defer p.Unlock()
+	for _, pc := range p.conns {
+		pc.conn.Close()
+	}
+	p.conns, p.drained = nil, true
+}
+
+func (p *connPool) len() int {
+	p.Lock()
+	defer p.Unlock()
+	return len(p.conns)
+}
+
+// fill dials n connections to b for its pool
+func (b *backend) fill(n int) {
+	for range n {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), b.p.poolIdleTimeout)
+			defer cancel()
+			r := b.p.connect(ctx, b.p.newDialer(), b, b.p.tlsHandshakeTimeout)
+			if r.err != nil {
+				b.pool.Lock()
+				b.pool.filling--
+				b.pool.Unlock()
+				b.p.logger.Debug("pool dial failed", "backend", b.addr, "error", r.err.Error())
+				return
+			}
+			b.pool.put(r.conn)
+		}()
+	}
+}
+
+// wakePool asks for the pools to be topped up now rather than at the next tick
+func (p *Proxy) wakePool() {
+	if p.poolSize == 0 {
+		return
+	}
+	select {
+	case p.poolWakeup <- struct{}{}:
+	default:
+	}
+}
+
+// maintainPools keeps every available primary backend's pool full and
+// closes connections which have been idle too long
+func (p *Proxy) maintainPools() {
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		for _, b := range p.allBackends() {
+			if b.backup.Load() || !b.available() {
+				continue
+			}
+			if n := b.pool.expire(p.poolSize, p.poolIdleTimeout); n > 0 {
+				b.fill(n)
+			}
+		}
+		select {
+		case <-tick.C:
+		case <-p.poolWakeup:
+		case <-p.done:
+			return
+		}
+	}
+}
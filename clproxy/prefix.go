@@ -0,0 +1,117 @@
+package clproxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+type prefixSettings struct {
+	// With -require-prefix a client's first bytes must match one of the given
+	// patterns, e.g. a database's startup message, before a backend is dialed
+	// for it, so that scanners speaking some other protocol don't each take up
+	// a backend connection. The bytes are held back until a pattern matches, and
+	// then passed on to the backend as usual. A client which sends something
+	// else, or not enough within -require-prefix-timeout, is closed and logged
+	// with reason=protocol_mismatch. Only for protocols in which the client
+	// speaks first: clients waiting for the server to greet them will just time
+	// out.
+	requirePrefix        string
+	requirePrefixTimeout time.Duration
+}
+
+type prefixState struct {
+	requiredPrefixes [][]byte
+
+	// Clients closed for not sending a -require-prefix
+	protocolMismatches atomic.Uint64
+}
+
+var errProtocolMismatch = errors.New("first bytes match no -require-prefix")
+
+func (p *Proxy) setupRequirePrefix() error {
+	for _, s := range splitList(p.requirePrefix) {
+		prefix, err := unescape(s)
+		if err != nil {
+			return fmt.Errorf("-require-prefix: %w", err)
+		}
+		if len(prefix) == 0 {
+			return errors.New("-require-prefix can't be empty")
+		}
+		p.requiredPrefixes = append(p.requiredPrefixes, prefix)
+	}
+	return nil
+}
+
+// matchPrefix reports whether buf starts with one of the required prefixes,
+// and whether more bytes could still make it do so
+func (p *Proxy) matchPrefix(buf []byte) (matched, possible bool) {
+	for _, prefix := range p.requiredPrefixes {
+		n := min(len(prefix), len(buf))
+		if !bytes.Equal(buf[:n], prefix[:n]) {
+			continue
+		}
+		if n == len(prefix) {
+			return true, true
+		}
+		possible = true
+	}
+	return false, possible
+}
+
+// checkPrefix reads c's first bytes and checks them against -require-prefix,
+// putting them back to be sent on to the backend. It reports false if c
+// should be dropped instead.
+func (c *client) checkPrefix() bool {
+	longest := 0
+	for _, p := range c.p.requiredPrefixes {
+		longest = max(longest, len(p))
+	}
+	c.conn.SetReadDeadline(time.Now().Add(c.p.requirePrefixTimeout))
+	buf := make([]byte, 0, longest)
+	var err error
+	for {
+		matched, possible := c.p.matchPrefix(buf)
+		if matched {
+			break
+		}
+		if !possible {
+			err = errProtocolMismatch
+			break
+		}
+		var n int
+		n, err = c.conn.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if err != nil {
+			if matched, _ = c.p.matchPrefix(buf); matched {
+				err = nil
+			}
+			break
+		}
+	}
+	c.conn.SetReadDeadline(time.Time{})
+	c.conn = replay(c.conn, buf)
+	if err == nil {
+		c.trace("prefix_matched", "bytes", len(buf))
+		return true
+	}
+	c.p.protocolMismatches.Add(1)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if !c.p.logRejection(c.name, c.conn, "protocol_mismatch", "first_bytes", string(buf), "error", err.Error()) {
+		c.p.logger.Warn("protocol mismatch", "client", c.name, "local", c.conn.LocalAddr().String(), "reason", "protocol_mismatch", "first_bytes", string(buf), "error", err.Error())
+	}
+	return false
+}
+
+// statsRequirePrefix adds the clients closed for not sending a
+// -require-prefix to the stats summary
+func (p *Proxy) statsRequirePrefix(w io.Writer) {
+	if p.requiredPrefixes != nil {
+		fmt.Fprintf(w, "protocol_mismatches: %d\n", p.protocolMismatches.Load())
+	}
+}
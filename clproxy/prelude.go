@@ -0,0 +1,115 @@
+package clproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+type preludeSettings struct {
+	// With -backend-prelude-file the file's bytes are written to each backend
+	// connection as soon as it is made, ahead of anything from the client, e.g.
+	// to log in and choose a database on the client's behalf. With
+	// -backend-prelude-expect the backend must then answer with exactly those
+	// bytes, which are read and not passed on. A prelude which can't be written
+	// or isn't answered as expected fails the dial, so it counts against the
+	// backend and the session moves on to another. The prelude's bytes aren't
+	// counted in the session's in and out. The file is read again on SIGHUP.
+	backendPreludeFile    string
+	backendPreludeExpect  string
+	backendPreludeTimeout time.Duration
+}
+
+type preludeState struct {
+	// The prelude as last read, and the unescaped -backend-prelude-expect
+	backendPrelude            atomic.Pointer[[]byte]
+	backendPreludeExpectBytes []byte
+}
+
+// preludeError is a backend failing its prelude
+type preludeError struct {
+	err error
+}
+
+func (e *preludeError) Error() string { return "backend prelude: " + e.err.Error() }
+func (e *preludeError) Unwrap() error { return e.err }
+
+// setupPrelude reads -backend-prelude-file and checks the flags that go with
+// it
+func (p *Proxy) setupPrelude() error {
+	if p.backendPreludeFile == "" {
+		if p.backendPreludeExpect != "" {
+			return errors.New("-backend-prelude-expect needs -backend-prelude-file")
+		}
+		return nil
+	}
+	if p.sendProxy != "" {
+		return errors.New("-backend-prelude-file can't be used with -send-proxy, whose header must come first")
+	}
+	if p.tunnelClient != "" {
+		return errors.New("-backend-prelude-file can't be used with -tunnel-client; give it to the far end instead")
+	}
+	var err error
+	if p.backendPreludeExpectBytes, err = unescape(p.backendPreludeExpect); err != nil {
+		return fmt.Errorf("-backend-prelude-expect: %w", err)
+	}
+	if err := p.loadPrelude(); err != nil {
+		return err
+	}
+	p.onReload = append(p.onReload, func() {
+		if err := p.loadPrelude(); err != nil {
+			p.logger.Error("backend prelude reload failed, keeping the previous prelude", "file", p.backendPreludeFile, "error", err.Error())
+		}
+	})
+	return nil
+}
+
+func (p *Proxy) loadPrelude() error {
+	buf, err := os.ReadFile(p.backendPreludeFile)
+	if err != nil {
+		return err
+	}
+	if len(buf) == 0 {
+		return fmt.Errorf("%s is empty", p.backendPreludeFile)
+	}
+	p.backendPrelude.Store(&buf)
+	return nil
+}
+
+// sendPrelude writes the prelude to conn and reads the expected answer,
+// within -backend-prelude-timeout and ctx
+func (p *Proxy) sendPrelude(ctx context.Context, conn net.Conn) error {
+	prelude := p.backendPrelude.Load()
+	if prelude == nil {
+		return nil
+	}
+	deadline := time.Now().Add(p.backendPreludeTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	defer conn.SetDeadline(time.Time{})
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+	if _, err := conn.Write(*prelude); err != nil {
+		return &preludeError{err}
+	}
+	if len(p.backendPreludeExpectBytes) == 0 {
+		return nil
+	}
+	got := make([]byte, len(p.backendPreludeExpectBytes))
+	n, err := io.ReadFull(conn, got)
+	if err != nil {
+		return &preludeError{fmt.Errorf("reading the answer after %d bytes: %w", n, err)}
+	}
+	if !bytes.Equal(got, p.backendPreludeExpectBytes) {
+		return &preludeError{fmt.Errorf("unexpected answer %q", got)}
+	}
+	return nil
+}
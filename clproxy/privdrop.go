@@ -0,0 +1,160 @@
+package clproxy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+)
+
+type privDropSettings struct {
+	// With -user, and optionally -group, we start as root to bind privileged
+	// ports and then switch to that user and group once every listener is bound,
+	// before serving anyone. Without -group we take the user's primary group and
+	// its supplementary groups. A failed switch is fatal. Files which are opened
+	// again later, log files on SIGHUP or rotation, the state file, and the ACME
+	// cache, must be writable by the user, which is checked at startup. So must
+	// files read on reload be readable, though that isn't checked. Listeners a
+	// -config reload adds are bound as the user, so can't use privileged ports.
+	runAsUser  string
+	runAsGroup string
+}
+
+type privDropState struct {
+	dropTo *privTarget
+}
+
+// privTarget is who we switch to
+type privTarget struct {
+	name   string
+	uid    int
+	gid    int
+	groups []int
+}
+
+// setupPrivDrop looks up -user and -group and checks that we can run as them
+func (p *Proxy) setupPrivDrop() error {
+	if p.runAsUser == "" {
+		if p.runAsGroup != "" {
+			return errors.New("-group needs -user")
+		}
+		return nil
+	}
+	if err := checkPrivDrop(); err != nil {
+		return err
+	}
+	if p.transparent || p.bindDevice != "" {
+		return errors.New("-transparent and -bind-device need privileges which -user gives up")
+	}
+	t, err := lookupPrivTarget(p.runAsUser, p.runAsGroup)
+	if err != nil {
+		return err
+	}
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("-user %s needs us to be started as root", p.runAsUser)
+	}
+	var errs []error
+	check := func(flagName, path string, dir bool) {
+		if err := checkWritable(t, path, dir); err != nil {
+			errs = append(errs, fmt.Errorf("-%s %s: %w; change its owner or permissions, or use another path", flagName, path, err))
+		}
+	}
+	for _, log := range [][2]string{{"log-file", p.logFileName}, {"access-log", p.accessLogName}, {"stats-audit-log", p.statsAuditLogName}} {
+		if log[1] == "" {
+			continue
+		}
+		check(log[0], log[1], false)
+		if p.logMaxSize > 0 {
+			// Rotation renames files in the directory
+			check(log[0], filepath.Dir(log[1]), true)
+		}
+	}
+	if p.stateFile != "" {
+		// Saved to a temporary file which replaces the old one
+		check("state-file", filepath.Dir(p.stateFile), true)
+	}
+	if p.acmeCache != "" {
+		check("acme-cache", p.acmeCache, true)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	p.dropTo = t
+	return nil
+}
+
+// lookupPrivTarget finds the ids of a user and group, each a name or a
+// number
+func lookupPrivTarget(userName, groupName string) (*privTarget, error) {
+	t := &privTarget{name: userName}
+	u, err := user.Lookup(userName)
+	if err != nil {
+		if _, numErr := strconv.Atoi(userName); numErr != nil {
+			return nil, fmt.Errorf("-user: %w", err)
+		}
+		if u, err = user.LookupId(userName); err != nil {
+			return nil, fmt.Errorf("-user: %w", err)
+		}
+	}
+	if t.uid, err = strconv.Atoi(u.Uid); err != nil {
+		return nil, fmt.Errorf("-user %s has uid %q, which isn't a number", userName, u.Uid)
+	}
+	if groupName != "" {
+		if t.gid, err = lookupGroup(groupName); err != nil {
+			return nil, fmt.Errorf("-group: %w", err)
+		}
+		t.groups = []int{t.gid}
+		return t, nil
+	}
+	if t.gid, err = strconv.Atoi(u.Gid); err != nil {
+		return nil, fmt.Errorf("-user %s has gid %q, which isn't a number", userName, u.Gid)
+	}
+	t.groups = []int{t.gid}
+	ids, _ := u.GroupIds()
+	for _, id := range ids {
+		if gid, err := strconv.Atoi(id); err == nil && gid != t.gid {
+			t.groups = append(t.groups, gid)
+		}
+	}
+	return t, nil
+}
+
+// checkWritable checks that t will be able to write path, or create it if it
+// doesn't exist yet
+func checkWritable(t *privTarget, path string, dir bool) error {
+	fi, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		parent := filepath.Dir(path)
+		if pfi, err := os.Stat(parent); err != nil || !writableBy(pfi, t) {
+			return fmt.Errorf("doesn't exist, and user %s can't create it in %s", t.name, parent)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if dir != fi.IsDir() {
+		if dir {
+			return errors.New("isn't a directory")
+		}
+		return errors.New("is a directory")
+	}
+	if !writableBy(fi, t) {
+		return fmt.Errorf("isn't writable by user %s", t.name)
+	}
+	return nil
+}
+
+// dropPrivileges switches to -user and -group, if given
+func (p *Proxy) dropPrivileges() error {
+	if p.dropTo == nil {
+		return nil
+	}
+	if err := setIDs(p.dropTo); err != nil {
+		return p.fail("can't switch user", "user", p.dropTo.name, "uid", p.dropTo.uid, "gid", p.dropTo.gid, "error", err.Error())
+	}
+	p.logger.Info("switched user", "user", p.dropTo.name, "uid", p.dropTo.uid, "gid", p.dropTo.gid)
+	return nil
+}
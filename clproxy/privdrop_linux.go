@@ -0,0 +1,55 @@
+package clproxy
+
+import (
+	"errors"
+	"os"
+	"slices"
+	"syscall"
+)
+
+func checkPrivDrop() error {
+	return nil
+}
+
+// writableBy reports whether t could write to fi, or create files in it if
+// it is a directory, going by its permission bits
+func writableBy(fi os.FileInfo, t *privTarget) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	want := os.FileMode(0o2)
+	if fi.IsDir() {
+		want |= 0o1
+	}
+	perm := fi.Mode().Perm()
+	switch {
+	case int(st.Uid) == t.uid:
+		perm >>= 6
+	case slices.Contains(t.groups, int(st.Gid)):
+		perm >>= 3
+	}
+	return perm&want == want
+}
+
+// setIDs switches every thread to t's ids. Go applies each of these to all
+// threads on Linux.
+func setIDs(t *privTarget) error {
+	if err := syscall.Setgroups(t.groups); err != nil {
+		return err
+	}
+	if err := syscall.Setgid(t.gid); err != nil {
+		return err
+	}
+	if err := syscall.Setuid(t.uid); err != nil {
+		return err
+	}
+	if os.Getuid() != t.uid || os.Geteuid() != t.uid || os.Getgid() != t.gid || os.Getegid() != t.gid {
+		return errors.New("ids unchanged after switching")
+	}
+	// Root must be out of reach now
+	if t.uid != 0 && syscall.Setuid(0) == nil {
+		return errors.New("could switch back to root")
+	}
+	return nil
+}
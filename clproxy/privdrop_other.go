@@ -0,0 +1,20 @@
+//go:build !linux
+
+package clproxy
+
+import (
+	"errors"
+	"os"
+)
+
+func checkPrivDrop() error {
+	return errors.New("-user is only supported on Linux")
+}
+
+func writableBy(fi os.FileInfo, t *privTarget) bool {
+	return false
+}
+
+func setIDs(t *privTarget) error {
+	return checkPrivDrop()
+}
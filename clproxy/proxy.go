@@ -0,0 +1,456 @@
+package clproxy
+
+import (
+	"context"
+	"flag"
+	"io"
+	"iter"
+	"log/slog"
+	"maps"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A Proxy is a set of routes, the listeners feeding them, and the sessions
+// they have admitted, so that everything a connection touches on its way
+// through is reached from it rather than from package state. It is made by
+// New, serves from Start, and stops with Shutdown; any number may run in one
+// program, so long as they don't listen on the same addresses.
+type Proxy struct {
+	settings
+
+	// The flags the settings were parsed from
+	flags *flag.FlagSet
+
+	acceptProxyState
+	acceptRateState
+	acmeCertState
+	adminState
+	autobanState
+	balanceState
+	bandwidthState
+	bindSourceState
+	bwClassState
+	canaryRolloutState
+	captureState
+	chaosState
+	clientACLState
+	clientCertState
+	clientNamesState
+	downPayloadState
+	dialState
+	dynamicState
+	envState
+	healthState
+	hooksState
+	httpProxyState
+	ipfixState
+	loggingState
+	mirrorState
+	mptcpState
+	origDstState
+	persistenceState
+	pinState
+	poolState
+	prefixState
+	preludeState
+	privDropState
+	resolveState
+	samplingState
+	sniState
+	socksServerState
+	sourceRouteState
+	tarpitState
+	tlsState
+	traceState
+	tunnelState
+
+	// The routes being served, in configured order
+	routes     []*route
+	routesLock sync.RWMutex
+
+	// The bound listeners by address, and the lock serializing changes to
+	// them and to the routes
+	listeners  map[string]*listener
+	configLock sync.Mutex
+
+	// How many times the routes have been loaded, counting startup
+	configGeneration atomic.Uint64
+
+	// Connections accepted since startup, across all routes
+	count atomic.Uint64
+
+	// The sessions copying data, by id, so that the stats port can list them
+	// and find them to capture or throttle
+	live     map[string]*client
+	liveLock sync.Mutex
+
+	// The most recently completed connections, kept around so that they can
+	// be inspected through the stats port after the logs have rotated away.
+	recent *ring
+
+	// Functions for Reload to call, in order, as it does on SIGHUP
+	onReload []func()
+
+	// Functions for Shutdown to call, in order, as it does on SIGINT or
+	// SIGTERM
+	onShutdown []func()
+
+	// Functions Start runs on goroutines of their own, which keep going until
+	// Shutdown closes done
+	background []func()
+	done       chan struct{}
+	stopOnce   sync.Once
+
+	// The Listeners given in Options, by address
+	given map[string]net.Listener
+
+	// The stats port and -tunnel-server listeners, once bound
+	statsLn  net.Listener
+	tunnelLn net.Listener
+
+	// Every client connection being handled, until it is closed, so that
+	// Shutdown can wait for them or close them
+	conns     map[net.Conn]bool
+	connsLock sync.Mutex
+
+	// Where abort sends what stopped the proxy, for Failed
+	failed chan error
+
+	// statsCommands maps the first word of a line sent to the stats port to
+	// the function which answers it
+	statsCommands map[string]func(w io.Writer, args []string)
+}
+
+// settings are what the flags set, as the proxy was started with them
+type settings struct {
+	acceptProxySettings
+	acceptRateSettings
+	acmeCertSettings
+	adminSettings
+	autobanSettings
+	backendsFileSettings
+	balanceSettings
+	bandwidthSettings
+	bindSourceSettings
+	bwClassSettings
+	canaryRolloutSettings
+	captureSettings
+	chaosSettings
+	checksumSettings
+	circuitSettings
+	clientACLSettings
+	clientCertSettings
+	clientNamesSettings
+	configSettings
+	dialSettings
+	dnsResolverSettings
+	downPayloadSettings
+	drainSettings
+	dynamicSettings
+	healthSettings
+	httpProxySettings
+	identitySettings
+	ipfixSettings
+	ja3Settings
+	listenFamilySettings
+	logFileSettings
+	loggingSettings
+	mirrorSettings
+	mptcpSettings
+	origDstSettings
+	persistenceSettings
+	pinSettings
+	poolSettings
+	prefixSettings
+	preludeSettings
+	privDropSettings
+	proxyProtoSettings
+	proxySettings
+	recentSettings
+	resolveSettings
+	reusePortSettings
+	samplingSettings
+	sniSettings
+	sniffSettings
+	socksServerSettings
+	socksSettings
+	sourceRouteSettings
+	tarpitSettings
+	tfoSettings
+	tlsInfoSettings
+	tlsSettings
+	traceSettings
+	tunnelSettings
+	unixSockSettings
+	websocketSettings
+}
+
+// newProxy makes a proxy with o's settings, or the defaults if o has none,
+// before they are checked
+func newProxy(o *Options) *Proxy {
+	if o.settings == nil {
+		o.RegisterFlags(flag.NewFlagSet("clproxy", flag.ContinueOnError))
+	}
+	p := &Proxy{
+		settings:  *o.settings,
+		flags:     o.flags,
+		listeners: map[string]*listener{},
+		live:      map[string]*client{},
+		done:      make(chan struct{}),
+		given:     map[string]net.Listener{},
+		conns:     map[net.Conn]bool{},
+		failed:    make(chan error, 1),
+	}
+	p.logLevel = new(slog.LevelVar)
+	p.logger = slog.New(newTextHandler(os.Stderr, p.logLevel))
+	p.capturedIPs = map[netip.Addr]int64{}
+	p.chaosFailures = map[string]*atomic.Uint64{"dial_error": {}, "mid_stream_reset": {}, "stall": {}}
+	p.fromEnv = o.fromEnv
+	p.hooks = connHooks{o.OnAccept, o.OnAdmit, o.OnDialed, o.OnClose}
+	p.balancers = maps.Clone(policies)
+	maps.Copy(p.balancers, o.Balancers)
+	p.dialFunc = o.DialFunc
+	p.poolWakeup = make(chan struct{}, 1)
+	p.rateLimits = map[string]*directionLimits{
+		"client":  {name: "up"},
+		"backend": {name: "down"},
+	}
+	p.resolveTimeout = 5 * time.Second
+	p.traced = map[string]bool{}
+	p.acmeState.expires, p.acmeState.errs = map[string]time.Time{}, map[string]string{}
+	p.autoban.m = map[netip.Addr]*strikes{}
+	p.picked.m = map[string]*backendSet{}
+	p.dstRoutes = destinations{p: p, m: map[netip.AddrPort]*backendSet{}}
+	p.dynamicRoutes = destinations{p: p, m: map[netip.AddrPort]*backendSet{}}
+	p.socksRoutes = destinations{p: p, m: map[netip.AddrPort]*backendSet{}}
+	p.resolver = &dnsResolver{p: p, addrs: []string{"system"}, resolvers: []*net.Resolver{net.DefaultResolver}}
+	p.unlogged = &aggregate{p: p}
+	p.statsCommands = map[string]func(w io.Writer, args []string){
+		"stats":      p.statsSummary,
+		"recent":     p.statsRecent,
+		"backends":   p.statsBackends,
+		"trace":      p.statsTrace,
+		"untrace":    p.statsUntrace,
+		"loglevel":   p.statsLogLevel,
+		"quiet":      p.statsQuiet,
+		"lookup":     p.statsLookup,
+		"health":     p.statsHealth,
+		"disable":    p.statsDisable,
+		"enable":     p.statsEnable,
+		"resolved":   p.statsResolved,
+		"set":        p.statsSet,
+		"canary":     p.statsCanaryCommand,
+		"acl":        p.statsACL,
+		"bans":       p.statsBans,
+		"unban":      p.statsUnban,
+		"identities": p.statsIdentities,
+		"chaos":      p.statsChaos,
+		"capture":    p.statsCapture,
+		"uncapture":  p.statsUncapture,
+		"conns":      p.statsLive,
+		"throttle":   p.statsThrottle,
+		"unthrottle": p.statsUnthrottle,
+	}
+	return p
+}
+
+// Start binds the stats port and every listener, gives up root if -user is
+// set, and starts serving and everything done in the background, such as
+// health checks, returning once it has. The proxy serves until Shutdown, or
+// until ctx is done, which shuts it down at once. An error is an *Error.
+func (p *Proxy) Start(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	p.resolveBackends()
+	// A reload may bring in hostnames, so keep resolving with -config
+	if (p.anyHostnames() || p.configFile != "") && p.resolveInterval > 0 {
+		p.background = append(p.background, p.refreshBackends)
+	}
+	if p.poolSize > 0 {
+		p.background = append(p.background, p.maintainPools)
+	}
+	if p.backendsFile != "" || p.configFile != "" {
+		p.background = append(p.background, p.watchBackendsFiles)
+	}
+	p.background = append(p.background, p.logAggregates)
+	if p.healthInterval > 0 {
+		p.background = append(p.background, p.healthCheck)
+	}
+	if p.stateFile != "" {
+		p.loadState()
+		p.background = append(p.background, p.persistState)
+		p.onShutdown = append(p.onShutdown, func() {
+			if err := p.saveState(); err != nil {
+				p.logger.Error("state save failed", "file", p.stateFile, "error", err.Error())
+			}
+		})
+	}
+	if p.flowCollector != "" {
+		var err error
+		if p.flows, err = p.newFlowExporter(p.flowCollector); err != nil {
+			return p.fail("flow collector error", "address", p.flowCollector, "error", err.Error())
+		}
+	}
+	if err := p.stats(); err != nil {
+		return err
+	}
+	if err := p.server(); err != nil {
+		p.statsLn.Close()
+		return err
+	}
+	for _, fn := range p.background {
+		go fn()
+	}
+	context.AfterFunc(ctx, func() { p.Shutdown(ctx) })
+	return nil
+}
+
+// Reload re-reads the -config file, reopens the log files, and reloads
+// whatever else is read from files, as SIGHUP does
+func (p *Proxy) Reload() {
+	select {
+	case <-p.done:
+		return
+	default:
+	}
+	for _, fn := range p.onReload {
+		fn()
+	}
+}
+
+// Shutdown stops the proxy listening and doing anything in the background,
+// does what is to be done on the way out, such as saving the -state-file,
+// and waits for the sessions to finish. If ctx is done first, the sessions
+// left are closed and its error returned. It may be called more than once,
+// each call waiting as the first did.
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	p.stopOnce.Do(func() {
+		close(p.done)
+		p.configLock.Lock()
+		for addr, l := range p.listeners {
+			l.Close()
+			delete(p.listeners, addr)
+		}
+		p.configLock.Unlock()
+		for _, ln := range []net.Listener{p.statsLn, p.tunnelLn} {
+			if ln != nil {
+				ln.Close()
+			}
+		}
+		for _, fn := range p.onShutdown {
+			fn()
+		}
+	})
+	tick := time.NewTicker(10 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		p.connsLock.Lock()
+		handling := len(p.conns)
+		p.connsLock.Unlock()
+		if handling == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			p.closeConns()
+			return ctx.Err()
+		case <-tick.C:
+		}
+	}
+}
+
+// closeConns closes every client connection, and the backend connection of
+// every session copying, which is logged as closed by the proxy
+func (p *Proxy) closeConns() {
+	p.liveLock.Lock()
+	for _, c := range p.live {
+		c.endOnce.Do(func() {
+			c.closedBy, c.reason = "proxy", "shutdown"
+		})
+		c.server.Close()
+	}
+	p.liveLock.Unlock()
+	p.connsLock.Lock()
+	defer p.connsLock.Unlock()
+	for conn := range p.conns {
+		conn.Close()
+	}
+}
+
+// ticks yields every d until Shutdown, for the loops Start runs in the
+// background
+func (p *Proxy) ticks(d time.Duration) iter.Seq[time.Time] {
+	return func(yield func(time.Time) bool) {
+		t := time.NewTicker(d)
+		defer t.Stop()
+		for {
+			select {
+			case <-p.done:
+				return
+			case now := <-t.C:
+				if !yield(now) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// sleep waits for d, reporting false if Shutdown came first
+func (p *Proxy) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-p.done:
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// Stats are counts of a proxy's sessions, as the stats port's summary gives
+// them
+type Stats struct {
+	Active  int
+	Waiting int
+
+	// Connections which have reached a route's limiter
+	Connections uint64
+
+	// By route, the one made from the flags being unnamed
+	Routes []RouteStats
+}
+
+// RouteStats are the counts of one route's sessions
+type RouteStats struct {
+	Name    string
+	Active  int
+	Waiting int
+	Limit   int
+
+	// Sessions admitted
+	Sessions uint64
+}
+
+// Stats counts the proxy's sessions
+func (p *Proxy) Stats() Stats {
+	s := Stats{Connections: p.count.Load()}
+	for _, rt := range p.allRoutes() {
+		active, waiting := rt.counts()
+		s.Active, s.Waiting = s.Active+active, s.Waiting+waiting
+		s.Routes = append(s.Routes, RouteStats{
+			Name:     rt.name,
+			Active:   active,
+			Waiting:  waiting,
+			Limit:    rt.opts().concurrency,
+			Sessions: rt.sessions.Load(),
+		})
+	}
+	return s
+}
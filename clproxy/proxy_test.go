@@ -0,0 +1,196 @@
+package clproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+)
+
+// freeAddr returns a local address with a port nothing is listening on
+func freeAddr() string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "127.0.0.1:0"
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// greeter is a backend which sends hello to each connection and then echoes
+// it, closing when it is sent a q. A session ends once both sides have
+// closed.
+func greeter(t *testing.T, hello string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.WriteString(conn, hello)
+				buf := make([]byte, 64)
+				for {
+					n, err := conn.Read(buf)
+					if err != nil || bytes.IndexByte(buf[:n], 'q') >= 0 {
+						return
+					}
+					conn.Write(buf[:n])
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// startProxy starts a proxy from o on a listener of its own and returns it
+// with the address to connect to, shutting it down when the test ends
+func startProxy(t *testing.T, o Options) (*Proxy, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.Listeners = []net.Listener{ln}
+	o.StatsAddr = "127.0.0.1:0"
+	o.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	p, err := New(o)
+	if err != nil {
+		ln.Close()
+		t.Fatal(err)
+	}
+	if err := p.Start(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		p.Shutdown(ctx)
+	})
+	return p, ln.Addr().String()
+}
+
+// greeting connects to addr and reads the backend's greeting of len(want)
+func greeting(t *testing.T, addr, want string) net.Conn {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Fatalf("got %q from the backend, want %q", got, want)
+	}
+	return conn
+}
+
+// waitFor fails the test unless cond comes true soon
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestProxySession(t *testing.T) {
+	p, addr := startProxy(t, Options{Backends: []string{greeter(t, "hi")}})
+	conn := greeting(t, addr, "hi")
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "ping" {
+		t.Fatalf("echoed %q, %v", got, err)
+	}
+	if s := p.Stats(); s.Active != 1 || s.Connections != 1 || len(s.Routes) != 1 || s.Routes[0].Sessions != 1 {
+		t.Errorf("stats during the session: %+v", s)
+	}
+	conn.Write([]byte("q"))
+	conn.Close()
+	waitFor(t, "the session to end", func() bool { return p.Stats().Active == 0 })
+}
+
+// Proxies share nothing, so each keeps to its own backends and counts
+func TestTwoProxies(t *testing.T) {
+	p1, addr1 := startProxy(t, Options{Backends: []string{greeter(t, "one")}})
+	p2, addr2 := startProxy(t, Options{Backends: []string{greeter(t, "two")}, Concurrency: 5})
+	greeting(t, addr1, "one")
+	greeting(t, addr2, "two")
+	greeting(t, addr2, "two")
+	waitFor(t, "the sessions to be admitted", func() bool {
+		return p1.Stats().Active == 1 && p2.Stats().Active == 2
+	})
+	if l1, l2 := p1.Stats().Routes[0].Limit, p2.Stats().Routes[0].Limit; l1 != DefaultConcurrency || l2 != 5 {
+		t.Errorf("limits %d and %d, want %d and 5", l1, l2, DefaultConcurrency)
+	}
+}
+
+// With -c 1 a second client waits for the first to finish
+func TestConcurrencyLimit(t *testing.T) {
+	p, addr := startProxy(t, Options{Backends: []string{greeter(t, "hi")}, Concurrency: 1})
+	first := greeting(t, addr, "hi")
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	waitFor(t, "the second client to queue", func() bool {
+		s := p.Stats()
+		return s.Active == 1 && s.Waiting == 1
+	})
+	first.Write([]byte("q"))
+	first.Close()
+	second.SetDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, 2)
+	if _, err := io.ReadFull(second, got); err != nil || string(got) != "hi" {
+		t.Fatalf("second client got %q, %v", got, err)
+	}
+}
+
+// Shutdown stops listening, and closes the sessions left when its context
+// ends
+func TestShutdown(t *testing.T) {
+	p, addr := startProxy(t, Options{Backends: []string{greeter(t, "hi")}})
+	conn := greeting(t, addr, "hi")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := p.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown with a session open: %v", err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("session still open after Shutdown")
+	}
+	if c, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		c.Close()
+		t.Error("still listening after Shutdown")
+	}
+	if err := p.Shutdown(context.Background()); err != nil {
+		t.Errorf("second Shutdown: %v", err)
+	}
+}
+
+func TestNewUsageError(t *testing.T) {
+	_, err := New(Options{Backends: []string{"127.0.0.1:8300=heavy"}})
+	var e *Error
+	if !errors.As(err, &e) || e.Status != 2 {
+		t.Errorf("New with a bad weight: %v, want an *Error with status 2", err)
+	}
+}
@@ -0,0 +1,91 @@
+package clproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+type proxyProtoSettings struct {
+	// With -send-proxy we start every backend connection with a PROXY protocol
+	// header (v1 text or v2 binary) carrying the client's real address, so the
+	// backend doesn't only ever see ours
+	sendProxy string
+}
+
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// addrPort is the IP and port of a TCP address
+func addrPort(a net.Addr) (netip.AddrPort, bool) {
+	ta, ok := a.(*net.TCPAddr)
+	if !ok {
+		return netip.AddrPort{}, false
+	}
+	ap := ta.AddrPort()
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()), true
+}
+
+// proxyHeader builds the PROXY protocol header describing a connection from
+// src to dst. Anything other than TCP is sent as UNKNOWN (or, in v2, as a
+// Unix socket where both ends are one).
+func proxyHeader(version string, src, dst net.Addr) []byte {
+	s, sok := addrPort(src)
+	d, dok := addrPort(dst)
+	if version == "v1" {
+		switch {
+		case !sok || !dok:
+			return []byte("PROXY UNKNOWN\r\n")
+		case s.Addr().Is4() && d.Addr().Is4():
+			return fmt.Appendf(nil, "PROXY TCP4 %s %s %d %d\r\n", s.Addr(), d.Addr(), s.Port(), d.Port())
+		}
+		return fmt.Appendf(nil, "PROXY TCP6 %s %s %d %d\r\n", as16(s.Addr()), as16(d.Addr()), s.Port(), d.Port())
+	}
+
+	var body bytes.Buffer
+	fam := byte(0x00) // AF_UNSPEC
+	switch {
+	case sok && dok && s.Addr().Is4() && d.Addr().Is4():
+		fam = 0x11 // TCP over IPv4
+		body.Write(s.Addr().AsSlice())
+		body.Write(d.Addr().AsSlice())
+		binary.Write(&body, binary.BigEndian, [2]uint16{s.Port(), d.Port()})
+	case sok && dok:
+		fam = 0x21 // TCP over IPv6
+		a, b := as16(s.Addr()).As16(), as16(d.Addr()).As16()
+		body.Write(a[:])
+		body.Write(b[:])
+		binary.Write(&body, binary.BigEndian, [2]uint16{s.Port(), d.Port()})
+	default:
+		su, suok := src.(*net.UnixAddr)
+		du, duok := dst.(*net.UnixAddr)
+		if suok && duok {
+			fam = 0x31 // Unix stream
+			var a, b [108]byte
+			copy(a[:], su.Name)
+			copy(b[:], du.Name)
+			body.Write(a[:])
+			body.Write(b[:])
+		}
+	}
+	hdr := append([]byte(nil), proxyV2Sig...)
+	hdr = append(hdr, 0x21, fam) // version 2, PROXY command
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(body.Len()))
+	return append(hdr, body.Bytes()...)
+}
+
+// as16 gives an IPv4 address in its IPv4-mapped IPv6 form, for headers where
+// the two ends are of different families
+func as16(ip netip.Addr) netip.Addr {
+	if ip.Is4() {
+		return netip.AddrFrom16(ip.As16())
+	}
+	return ip
+}
+
+// sendProxyHeader writes the PROXY header for c to its backend connection
+func (c *client) sendProxyHeader() error {
+	_, err := c.server.Write(proxyHeader(c.p.sendProxy, c.conn.RemoteAddr(), c.conn.LocalAddr()))
+	return err
+}
@@ -0,0 +1,135 @@
+package clproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func tcpAddr(s string) *net.TCPAddr {
+	return net.TCPAddrFromAddrPort(netip.MustParseAddrPort(s))
+}
+
+func TestProxyHeaderV1(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		src, dst net.Addr
+		want     string
+	}{
+		{"tcp4", tcpAddr("192.0.2.1:5000"), tcpAddr("198.51.100.2:8300"), "PROXY TCP4 192.0.2.1 198.51.100.2 5000 8300\r\n"},
+		{"tcp6", tcpAddr("[2001:db8::1]:5000"), tcpAddr("[2001:db8::2]:8300"), "PROXY TCP6 2001:db8::1 2001:db8::2 5000 8300\r\n"},
+		{"mixed", tcpAddr("192.0.2.1:5000"), tcpAddr("[2001:db8::2]:8300"), "PROXY TCP6 ::ffff:192.0.2.1 2001:db8::2 5000 8300\r\n"},
+		// A dual stack listener sees IPv4 clients as IPv4-mapped
+		{"mapped", tcpAddr("[::ffff:192.0.2.1]:5000"), tcpAddr("[::ffff:198.51.100.2]:8300"), "PROXY TCP4 192.0.2.1 198.51.100.2 5000 8300\r\n"},
+		{"unix", &net.UnixAddr{Name: "/run/a.sock", Net: "unix"}, &net.UnixAddr{Name: "/run/b.sock", Net: "unix"}, "PROXY UNKNOWN\r\n"},
+		{"one unix", tcpAddr("192.0.2.1:5000"), &net.UnixAddr{Name: "/run/b.sock", Net: "unix"}, "PROXY UNKNOWN\r\n"},
+	} {
+		if got := string(proxyHeader("v1", tc.src, tc.dst)); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestProxyHeaderV2(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		src, dst net.Addr
+		fam      byte
+		body     []byte
+	}{
+		{"tcp4", tcpAddr("192.0.2.1:5000"), tcpAddr("198.51.100.2:8300"), 0x11,
+			[]byte{192, 0, 2, 1, 198, 51, 100, 2, 0x13, 0x88, 0x20, 0x6c}},
+		{"tcp6", tcpAddr("[2001:db8::1]:5000"), tcpAddr("[2001:db8::2]:8300"), 0x21,
+			v2Body(netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("2001:db8::2"), 5000, 8300)},
+		{"mixed", tcpAddr("192.0.2.1:5000"), tcpAddr("[2001:db8::2]:8300"), 0x21,
+			v2Body(netip.MustParseAddr("::ffff:192.0.2.1"), netip.MustParseAddr("2001:db8::2"), 5000, 8300)},
+		{"unspec", tcpAddr("192.0.2.1:5000"), &net.UnixAddr{Name: "/run/b.sock", Net: "unix"}, 0x00, nil},
+		{"unix", &net.UnixAddr{Name: "/run/a.sock", Net: "unix"}, &net.UnixAddr{Name: "/run/b.sock", Net: "unix"}, 0x31,
+			v2UnixBody("/run/a.sock", "/run/b.sock")},
+	} {
+		hdr := proxyHeader("v2", tc.src, tc.dst)
+		want := append([]byte(nil), proxyV2Sig...)
+		want = append(want, 0x21, tc.fam)
+		want = binary.BigEndian.AppendUint16(want, uint16(len(tc.body)))
+		want = append(want, tc.body...)
+		if !bytes.Equal(hdr, want) {
+			t.Errorf("%s: got % x, want % x", tc.name, hdr, want)
+		}
+	}
+}
+
+func v2Body(s, d netip.Addr, sp, dp uint16) []byte {
+	a, b := s.As16(), d.As16()
+	body := append(a[:], b[:]...)
+	body = binary.BigEndian.AppendUint16(body, sp)
+	return binary.BigEndian.AppendUint16(body, dp)
+}
+
+func v2UnixBody(s, d string) []byte {
+	var a, b [108]byte
+	copy(a[:], s)
+	copy(b[:], d)
+	return append(a[:], b[:]...)
+}
+
+// What we send, a listener with -accept-proxy should read back the same
+func TestProxyHeaderRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		src, dst net.Addr
+		want     bool // whether the addresses come through
+	}{
+		{"tcp4", tcpAddr("192.0.2.1:5000"), tcpAddr("198.51.100.2:8300"), true},
+		{"tcp6", tcpAddr("[2001:db8::1]:5000"), tcpAddr("[2001:db8::2]:8300"), true},
+		{"mixed", tcpAddr("192.0.2.1:5000"), tcpAddr("[2001:db8::2]:8300"), true},
+		{"unix", &net.UnixAddr{Name: "/run/a.sock", Net: "unix"}, &net.UnixAddr{Name: "/run/b.sock", Net: "unix"}, false},
+	} {
+		for _, version := range []string{"v1", "v2"} {
+			// The session's own bytes follow the header and must be left unread
+			br := bufio.NewReader(bytes.NewReader(append(proxyHeader(version, tc.src, tc.dst), "hello"...)))
+			src, dst, err := parseProxyHeader(br)
+			if err != nil {
+				t.Errorf("%s %s: %v", tc.name, version, err)
+				continue
+			}
+			if !tc.want {
+				if src != nil || dst != nil {
+					t.Errorf("%s %s: got %v %v, want no addresses", tc.name, version, src, dst)
+				}
+			} else if !sameAddrPort(src, tc.src) || !sameAddrPort(dst, tc.dst) {
+				t.Errorf("%s %s: got %v %v, want %v %v", tc.name, version, src, dst, tc.src, tc.dst)
+			}
+			if rest, _ := br.Peek(br.Buffered()); string(rest) != "hello" {
+				t.Errorf("%s %s: left %q after the header, want %q", tc.name, version, rest, "hello")
+			}
+		}
+	}
+}
+
+// sameAddrPort compares TCP addresses, taking an IPv4-mapped address to be
+// the IPv4 one
+func sameAddrPort(a, b net.Addr) bool {
+	ap, aok := addrPort(a)
+	bp, bok := addrPort(b)
+	return aok && bok && ap == bp
+}
+
+func TestParseProxyHeaderBad(t *testing.T) {
+	for _, in := range []string{
+		"GET / HTTP/1.1\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.2 5000\r\n",
+		"PROXY TCP4 2001:db8::1 198.51.100.2 5000 8300\r\n",
+		"PROXY TCP6 2001:db8::1 198.51.100.2 5000 8300\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.2 5000 70000\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.2 5000 8300\n",
+		string(proxyV2Sig) + "\x11\x11\x00\x00",
+		string(proxyV2Sig) + "\x21\x11\x00\x04\x01\x02\x03\x04",
+	} {
+		if _, _, err := parseProxyHeader(bufio.NewReader(bytes.NewReader([]byte(in)))); err == nil {
+			t.Errorf("%q: no error", in)
+		}
+	}
+}
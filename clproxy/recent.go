@@ -0,0 +1,126 @@
+package clproxy
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type recentSettings struct {
+	recentSize int
+}
+
+// summary is what we remember about a completed connection.
+type summary struct {
+	ID       uint64
+	UID      string
+	name     string
+	label    string // from -client-names
+	backend  string
+	start    time.Time
+	took     float64
+	wait     float64
+	dial     float64
+	copy     float64
+	bytesIn  int64
+	bytesOut int64
+	status   string
+	closedBy string
+	reason   string
+	message  string
+	ja3      string
+}
+
+func (s summary) String() string {
+	line := fmt.Sprintf(
+		"id=%s client=%s num=%d backend=%s start=%s status=%s took=%f wait=%f dial=%f copy=%f in=%d out=%d",
+		s.UID,
+		s.name,
+		s.ID,
+		s.backend,
+		s.start.Format(time.RFC3339Nano),
+		s.status,
+		s.took,
+		s.wait,
+		s.dial,
+		s.copy,
+		s.bytesIn,
+		s.bytesOut)
+	if s.label != "" {
+		line += " client_name=" + s.label
+	}
+	if s.ja3 != "" {
+		line += " tls_ja3=" + s.ja3
+	}
+	if s.status == "error" {
+		return line + fmt.Sprintf(" message=%q", s.message)
+	}
+	return line + fmt.Sprintf(" closed_by=%s reason=%s", s.closedBy, s.reason)
+}
+
+// ring is a fixed size buffer of summaries. Once full the oldest entry is
+// overwritten, so memory use never grows past its initial allocation.
+type ring struct {
+	sync.Mutex
+	entries []summary
+	next    int
+	full    bool
+}
+
+func newRing(size int) *ring {
+	if size < 1 {
+		size = 1
+	}
+	return &ring{entries: make([]summary, size)}
+}
+
+func (r *ring) add(s summary) {
+	r.Lock()
+	defer r.Unlock()
+	r.entries[r.next] = s
+	r.next++
+	if r.next == len(r.entries) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// newest returns up to n summaries, most recent first. A copy is returned so
+// callers can take their time with it without holding the lock.
+func (r *ring) newest(n int) []summary {
+	r.Lock()
+	defer r.Unlock()
+	have := r.next
+	if r.full {
+		have = len(r.entries)
+	}
+	if n <= 0 || n > have {
+		n = have
+	}
+	out := make([]summary, n)
+	for i := 0; i < n; i++ {
+		idx := r.next - 1 - i
+		if idx < 0 {
+			idx += len(r.entries)
+		}
+		out[i] = r.entries[idx]
+	}
+	return out
+}
+
+// statsRecent answers "recent [count]" on the stats port
+func (p *Proxy) statsRecent(w io.Writer, args []string) {
+	n := 0
+	if len(args) > 0 {
+		var err error
+		if n, err = strconv.Atoi(args[0]); err != nil || n < 0 {
+			fmt.Fprintf(w, "error: invalid count %q\n", args[0])
+			return
+		}
+	}
+	for _, s := range p.recent.newest(n) {
+		fmt.Fprintln(w, s)
+	}
+}
@@ -0,0 +1,153 @@
+package clproxy
+
+import (
+	"context"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type resolveSettings struct {
+	// Backends given by hostname are resolved to every address the name has,
+	// each of which becomes a backend of its own. Names are resolved again this
+	// often, adding and removing backends as the records change.
+	resolveInterval time.Duration
+}
+
+type resolveState struct {
+	// How long a lookup may take, across every -resolver
+	resolveTimeout time.Duration
+
+	resolver *dnsResolver
+
+	// Held while resolving, or changing what is to be resolved, so that the
+	// resolver goroutine and a config reload don't trip over each other
+	resolveLock sync.Mutex
+}
+
+// expand turns backend specs into addresses, recording in from the spec each
+// resolved address came from and in weights the weight given with it. Specs
+// which are already IP addresses or Unix sockets pass straight through. If a
+// name can't be resolved we keep using what it last resolved to, or failing
+// that the name itself, leaving the dialer to try again.
+func (s *backendSet) expand(specs []string, from map[string]string, weights map[string]int) []string {
+	var out []string
+	for _, spec := range specs {
+		spec, weight, _ := splitWeight(spec)
+		if name, ok := strings.CutPrefix(spec, srvPrefix); ok {
+			out = append(out, s.expandSRV(spec, name, from, weights)...)
+			continue
+		}
+		host, port, err := net.SplitHostPort(spec)
+		if strings.HasPrefix(spec, unixPrefix) || err != nil || net.ParseIP(host) != nil {
+			weights[spec] = weight
+			out = append(out, spec)
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), s.p.resolveTimeout)
+		ips, err := s.p.resolver.LookupIPAddr(ctx, host)
+		cancel()
+		if err != nil || len(ips) == 0 {
+			prev, ok := s.lastResolved[spec]
+			if !ok {
+				prev = []string{spec}
+			}
+			s.p.logger.Warn("backend resolution failed, keeping previous addresses", "backend", spec, "error", errString(err), "addresses", prev)
+			for _, addr := range prev {
+				weights[addr] = weight
+			}
+			out = append(out, prev...)
+			continue
+		}
+		addrs := make([]string, 0, len(ips))
+		for _, ip := range ips {
+			addrs = append(addrs, net.JoinHostPort(ip.IP.String(), port))
+		}
+		slices.Sort(addrs)
+		if s.lastResolved == nil {
+			s.lastResolved = map[string][]string{}
+		}
+		s.lastResolved[spec] = addrs
+		for _, addr := range addrs {
+			from[addr] = spec
+			weights[addr] = weight
+		}
+		out = append(out, addrs...)
+	}
+	return out
+}
+
+// resolve resolves the configured backends and applies the result if it
+// differs from the current set
+func (s *backendSet) resolve(route string) {
+	s.p.resolveLock.Lock()
+	defer s.p.resolveLock.Unlock()
+	from, weights := map[string]string{}, map[string]int{}
+	primary, backup := s.expand(s.primarySpecs, from, weights), s.expand(s.backupSpecs, from, weights)
+	var curPrimary, curBackup []string
+	reweighted := false
+	for _, b := range s.list() {
+		if b.backup.Load() {
+			curBackup = append(curBackup, b.addr)
+		} else {
+			curPrimary = append(curPrimary, b.addr)
+		}
+		if w, ok := weights[b.addr]; ok && int64(w) != b.weight.Load() {
+			reweighted = true
+		}
+	}
+	if slices.Equal(primary, curPrimary) && slices.Equal(backup, curBackup) && !reweighted {
+		return
+	}
+	s.set(primary, backup, from, weights)
+	args := []any{"primary", primary, "backup", backup}
+	if slices.ContainsFunc(s.list(), func(b *backend) bool { return b.weight.Load() != 1 }) {
+		args = append(args, "weights", s.weights())
+	}
+	if route != "" {
+		args = append(args, "route", route)
+	}
+	s.p.logger.Info("backends changed", args...)
+}
+
+// resolveBackends resolves the backends of every route
+func (p *Proxy) resolveBackends() {
+	for _, rt := range p.allRoutes() {
+		rt.backends.resolve(rt.name)
+	}
+}
+
+// hasHostnames reports whether any backend spec needs resolving
+func (s *backendSet) hasHostnames() bool {
+	for _, spec := range append(append([]string(nil), s.primarySpecs...), s.backupSpecs...) {
+		spec, _, _ = splitWeight(spec)
+		if strings.HasPrefix(spec, srvPrefix) {
+			return true
+		}
+		if strings.HasPrefix(spec, unixPrefix) {
+			continue
+		}
+		if host, _, err := net.SplitHostPort(spec); err == nil && net.ParseIP(host) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// anyHostnames reports whether any route has backends to resolve
+func (p *Proxy) anyHostnames() bool {
+	for _, rt := range p.allRoutes() {
+		if rt.backends.hasHostnames() {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Proxy) refreshBackends() {
+	for range p.ticks(p.resolveInterval) {
+		p.resolveBackends()
+	}
+}
@@ -0,0 +1,94 @@
+package clproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+)
+
+type reusePortSettings struct {
+	// With -reuseport N each TCP listen address is bound N times with
+	// SO_REUSEPORT, each socket with its own accept loop feeding the route's
+	// limiter, and the kernel spreads new connections across them. This helps
+	// when a single accept loop can't keep up. Linux only, as elsewhere the
+	// kernel doesn't share the connections out.
+	reusePort int
+}
+
+// bindSockets binds addr, once or -reuseport times, for -l. TCP and
+// WebSocket addresses are bound for -listen-family.
+func (p *Proxy) bindSockets(addr string) ([]net.Listener, error) {
+	network, path := DialAddr(addr)
+	if network == "unix" {
+		ln, err := p.listen(addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{ln}, nil
+	}
+	ws := network == "ws"
+	if ws {
+		u, err := url.Parse(path)
+		if err != nil {
+			return nil, err
+		}
+		path = u.Host
+	}
+	network, err := p.familyNetwork(path)
+	if err != nil {
+		return nil, err
+	}
+	lc := p.listenConfig()
+	if p.listenFamily == "v6" || p.listenFamily == "dual" {
+		lc.Control = withControl(lc.Control, p.v6onlyControl)
+	}
+	if p.reusePort > 1 {
+		lc.Control = withControl(lc.Control, reusePortControl)
+	}
+	socks := make([]net.Listener, 0, max(p.reusePort, 1))
+	for range max(p.reusePort, 1) {
+		ln, err := lc.Listen(context.Background(), network, path)
+		if err == nil && ws {
+			var wl *wsListener
+			if wl, err = p.listenWebSocket(ln, addr); err != nil {
+				ln.Close()
+			} else {
+				ln = wl
+			}
+		}
+		if err != nil {
+			for _, s := range socks {
+				s.Close()
+			}
+			return nil, err
+		}
+		socks = append(socks, ln)
+	}
+	if p.listenFamily != "" {
+		p.logger.Info("listen families", "address", addr, "bound", socks[0].Addr().String(), "families", listenFamilies(network, socks[0]))
+	}
+	return socks, nil
+}
+
+// statsReusePort adds how many connections each socket of each address has
+// accepted to the stats summary, to show how evenly they are spread
+func (p *Proxy) statsReusePort(w io.Writer) {
+	if p.reusePort <= 1 {
+		return
+	}
+	p.configLock.Lock()
+	defer p.configLock.Unlock()
+	for addr, l := range p.listeners {
+		if len(l.socks) <= 1 {
+			continue
+		}
+		counts := make([]string, len(l.socks))
+		for i := range l.socks {
+			counts[i] = fmt.Sprint(l.accepted[i].Load())
+		}
+		fmt.Fprintf(w, "reuseport: address=%s accepted=%s\n", addr, strings.Join(counts, ","))
+	}
+}
@@ -0,0 +1,21 @@
+package clproxy
+
+import "syscall"
+
+// Not in package syscall
+const soReusePort = 15
+
+// reusePortControl sets SO_REUSEPORT on a listening socket before it is
+// bound
+func reusePortControl(network, address string, raw syscall.RawConn) error {
+	var err error
+	cerr := raw.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+func checkReusePort() error { return nil }
@@ -0,0 +1,103 @@
+package clproxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// With -reuseport the kernel should share the connections out between the
+// sockets, so that more than one accept loop serves them
+func TestReusePortSpreads(t *testing.T) {
+	p := newProxy(&Options{})
+	p.reusePort = 4
+	p.recent = newRing(p.recentSize)
+
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.CopyN(conn, conn, 1)
+			}()
+		}
+	}()
+
+	addr := freeAddr()
+	rt := p.newRoute("")
+	opts := *rt.opts()
+	opts.listen, opts.concurrency = []string{addr}, 64
+	rt.settings.Store(&opts)
+	rt.backends.set([]string{backend.Addr().String()}, nil, nil, nil)
+	p.configLock.Lock()
+	bound, err := p.bindListeners([]*route{rt})
+	if err == nil {
+		p.serve([]*route{rt}, bound)
+	}
+	p.configLock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		p.configLock.Lock()
+		p.serve(nil, nil)
+		p.configLock.Unlock()
+	}()
+	l := p.listeners[addr]
+	if len(l.socks) != p.reusePort {
+		t.Fatalf("bound %d sockets, want %d", len(l.socks), p.reusePort)
+	}
+
+	// Each from its own port, which the kernel hashes on
+	const sessions = 64
+	for range sessions {
+		conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Write([]byte{'x'})
+		if err == nil {
+			_, err = io.ReadFull(conn, make([]byte, 1))
+		}
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Let the sessions finish before the listeners close under them
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if active, _ := rt.counts(); active == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("sessions still active")
+		}
+	}
+
+	var total uint64
+	served := 0
+	for i := range l.accepted {
+		n := l.accepted[i].Load()
+		total += n
+		if n > 0 {
+			served++
+		}
+	}
+	if total != sessions {
+		t.Errorf("accepted %d connections, want %d", total, sessions)
+	}
+	if served < 2 {
+		t.Errorf("only %d of %d accept loops served connections", served, p.reusePort)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package clproxy
+
+import (
+	"errors"
+	"syscall"
+)
+
+func reusePortControl(network, address string, raw syscall.RawConn) error {
+	return checkReusePort()
+}
+
+func checkReusePort() error {
+	return errors.New("-reuseport is only supported on Linux")
+}
@@ -0,0 +1,373 @@
+package clproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A route is a set of listen addresses proxied to a set of backends under a
+// concurrency limit of its own. Without -config there is a single unnamed
+// route made from the command line flags.
+type route struct {
+	p        *Proxy
+	name     string
+	backends *backendSet
+
+	// The settings a config reload may change, replaced as a whole
+	settings atomic.Pointer[routeOptions]
+
+	// The limiter. waiting, active, and identities are guarded by cond.L.
+	cond    *sync.Cond
+	waiting int
+	active  int
+
+	// Sessions by client identity, with -c-per-identity
+	identities map[string]*identityCount
+
+	// Sessions admitted so far
+	sessions atomic.Uint64
+}
+
+type routeOptions struct {
+	listen      []string
+	concurrency int
+
+	// Per route overrides of the global timeouts
+	happyEyeballsDelay  time.Duration
+	tlsHandshakeTimeout time.Duration
+	acceptProxyTimeout  time.Duration
+	sniTimeout          time.Duration
+}
+
+func (p *Proxy) newRoute(name string) *route {
+	rt := &route{
+		p:        p,
+		name:     name,
+		backends: p.newBackendSet(),
+		cond:     &sync.Cond{L: &sync.Mutex{}},
+	}
+	rt.settings.Store(&routeOptions{
+		concurrency:         p.concurrency,
+		happyEyeballsDelay:  p.happyEyeballsDelay,
+		tlsHandshakeTimeout: p.tlsHandshakeTimeout,
+		acceptProxyTimeout:  p.acceptProxyTimeout,
+		sniTimeout:          p.sniTimeout,
+	})
+	return rt
+}
+
+// opts returns the route's current settings
+func (rt *route) opts() *routeOptions {
+	return rt.settings.Load()
+}
+
+// allRoutes returns the routes being served
+func (p *Proxy) allRoutes() []*route {
+	p.routesLock.RLock()
+	defer p.routesLock.RUnlock()
+	return p.routes
+}
+
+// findRoute returns the route called name
+func (p *Proxy) findRoute(name string) (*route, bool) {
+	for _, rt := range p.allRoutes() {
+		if rt.name == name {
+			return rt, true
+		}
+	}
+	return nil, false
+}
+
+// allBackends returns every backend of every route
+func (p *Proxy) allBackends() []*backend {
+	var out []*backend
+	for _, rt := range p.allRoutes() {
+		out = append(out, rt.backends.list()...)
+	}
+	return out
+}
+
+// counts returns the route's active and waiting connections
+func (rt *route) counts() (active, waiting int) {
+	rt.cond.L.Lock()
+	defer rt.cond.L.Unlock()
+	return rt.active, rt.waiting
+}
+
+// acquire takes one of rt's active slots, waiting for one if need be. The
+// proxy's own sessions are admitted by setup, which also minds identities.
+func (rt *route) acquire() {
+	rt.cond.L.Lock()
+	defer rt.cond.L.Unlock()
+	rt.waiting++
+	for rt.active >= rt.opts().concurrency {
+		rt.cond.Wait()
+	}
+	rt.waiting--
+	rt.active++
+}
+
+// release gives back a slot taken by acquire
+func (rt *route) release() {
+	rt.cond.L.Lock()
+	rt.active--
+	rt.cond.L.Unlock()
+	rt.cond.Signal()
+}
+
+// A listener is one bound listen address, with one socket or, with
+// -reuseport, several. A reload may hand it over to another route, so the
+// route is looked up for each connection.
+type listener struct {
+	socks    []net.Listener
+	accepted []atomic.Uint64 // by socket
+	addr     string
+	rt       atomic.Pointer[route]
+}
+
+// Close stops the listener accepting on all of its sockets
+func (l *listener) Close() {
+	for _, s := range l.socks {
+		s.Close()
+	}
+}
+
+// bindListeners binds every address of rts which isn't bound already. If any
+// fails the ones bound here are closed again, leaving things as they were.
+// The caller holds configLock.
+func (p *Proxy) bindListeners(rts []*route) (map[string]*listener, error) {
+	bound := map[string]*listener{}
+	for _, rt := range rts {
+		for _, addr := range rt.opts().listen {
+			if _, ok := p.listeners[addr]; ok {
+				continue
+			}
+			if _, ok := bound[addr]; ok {
+				continue
+			}
+			var socks []net.Listener
+			var err error
+			if ln, ok := p.given[addr]; ok {
+				// Bound already, by whoever gave it in Options
+				socks = []net.Listener{ln}
+			} else if socks, err = p.bindSockets(addr); err != nil {
+				for _, l := range bound {
+					l.Close()
+				}
+				return nil, fmt.Errorf("%s: %w", addr, err)
+			}
+			bound[addr] = &listener{socks: socks, accepted: make([]atomic.Uint64, len(socks)), addr: addr}
+		}
+	}
+	return bound, nil
+}
+
+// serve points each listen address at its route, starting accept loops for
+// the new listeners and closing those no route uses any more. The caller
+// holds configLock.
+func (p *Proxy) serve(rts []*route, bound map[string]*listener) {
+	using := map[string]bool{}
+	for _, rt := range rts {
+		for _, addr := range rt.opts().listen {
+			using[addr] = true
+			if l, ok := bound[addr]; ok {
+				l.rt.Store(rt)
+				p.listeners[addr] = l
+				for i := range l.socks {
+					go p.accept(l, i)
+				}
+				continue
+			}
+			p.listeners[addr].rt.Store(rt)
+		}
+	}
+	for addr, l := range p.listeners {
+		if !using[addr] {
+			l.Close()
+			delete(p.listeners, addr)
+		}
+	}
+	p.routesLock.Lock()
+	p.routes = rts
+	p.routesLock.Unlock()
+	p.configGeneration.Add(1)
+}
+
+// reloadConfig re-reads the config file on SIGHUP. The new config is checked
+// and its new listen addresses bound before anything changes; if any of that
+// fails the old config stays in place. Routes keep their limiter and backend
+// counters across a reload, removed routes stop accepting but their sessions
+// carry on, and a raised concurrency admits waiting connections straight away.
+func (p *Proxy) reloadConfig() {
+	loaded, err := p.loadConfig(p.configFile)
+	if err == nil {
+		err = checkRoutes(loaded)
+	}
+	if err != nil {
+		p.logger.Error("config reload failed, keeping the old config", "file", p.configFile, "error", err.Error())
+		return
+	}
+	p.configLock.Lock()
+	defer p.configLock.Unlock()
+	bound, err := p.bindListeners(loaded)
+	if err != nil {
+		p.logger.Error("config reload failed, keeping the old config", "file", p.configFile, "error", err.Error())
+		return
+	}
+	cur := map[string]*route{}
+	for _, rt := range p.allRoutes() {
+		cur[rt.name] = rt
+	}
+	var next []*route
+	var added, changed int
+	for _, n := range loaded {
+		rt, ok := cur[n.name]
+		if !ok {
+			p.logger.Info("route added", "route", n.name, "address", strings.Join(n.opts().listen, ","), "backend", strings.Join(n.backends.primarySpecs, ","), "concurrency", n.opts().concurrency)
+			n.backends.resolve(n.name)
+			next = append(next, n)
+			added++
+			continue
+		}
+		delete(cur, n.name)
+		if rt.update(n) {
+			changed++
+		}
+		next = append(next, rt)
+	}
+	for _, rt := range cur {
+		p.logger.Info("route removed", "route", rt.name)
+	}
+	p.serve(next, bound)
+	p.logger.Info("config reloaded", "file", p.configFile, "generation", p.configGeneration.Load(), "added", added, "removed", len(cur), "changed", changed)
+}
+
+// update applies n's settings and backends to rt, logging each change, and
+// reports whether there were any
+func (rt *route) update(n *route) bool {
+	changed := false
+	diff := func(setting string, old, new any) {
+		if fmt.Sprint(old) != fmt.Sprint(new) {
+			rt.p.logger.Info("route changed", "route", rt.name, "setting", setting, "old", old, "new", new)
+			changed = true
+		}
+	}
+	o, no := rt.opts(), n.opts()
+	diff("listen", strings.Join(o.listen, ","), strings.Join(no.listen, ","))
+	diff("concurrency", o.concurrency, no.concurrency)
+	diff("happy_eyeballs_delay", o.happyEyeballsDelay, no.happyEyeballsDelay)
+	diff("tls_handshake_timeout", o.tlsHandshakeTimeout, no.tlsHandshakeTimeout)
+	diff("accept_proxy_timeout", o.acceptProxyTimeout, no.acceptProxyTimeout)
+	diff("sni_timeout", o.sniTimeout, no.sniTimeout)
+	rt.cond.L.Lock()
+	rt.settings.Store(no)
+	rt.cond.L.Unlock()
+	// A higher limit may let waiting connections in
+	rt.cond.Broadcast()
+
+	s := rt.backends
+	rt.p.pickLock.Lock()
+	diff("balance", s.balance, n.backends.balance)
+	s.balance = n.backends.balance
+	rt.p.pickLock.Unlock()
+	rt.p.resolveLock.Lock()
+	diff("backend", strings.Join(s.primarySpecs, ","), strings.Join(n.backends.primarySpecs, ","))
+	diff("backup", strings.Join(s.backupSpecs, ","), strings.Join(n.backends.backupSpecs, ","))
+	specsChanged := !slices.Equal(s.primarySpecs, n.backends.primarySpecs) || !slices.Equal(s.backupSpecs, n.backends.backupSpecs)
+	diff("backends_file", s.file, n.backends.file)
+	s.primarySpecs, s.backupSpecs = n.backends.primarySpecs, n.backends.backupSpecs
+	s.file, s.fileInfo, s.fileErr = n.backends.file, n.backends.fileInfo, ""
+	rt.p.resolveLock.Unlock()
+	if specsChanged {
+		s.resolve(rt.name)
+	}
+	return changed
+}
+
+// checkRoutes rejects routes which would fight over a listen address
+func checkRoutes(rts []*route) error {
+	owner := map[string]string{}
+	for _, rt := range rts {
+		for _, addr := range rt.opts().listen {
+			if other, ok := owner[addr]; ok {
+				if other == rt.name {
+					return fmt.Errorf("route %q listens on %s twice", rt.name, addr)
+				}
+				return fmt.Errorf("routes %q and %q both listen on %s", other, rt.name, addr)
+			}
+			owner[addr] = rt.name
+		}
+	}
+	return nil
+}
+
+// accept runs the accept loop for socket i of a listener until it is closed
+// by a reload or Shutdown. Connections are tagged with the listener they arrived on when
+// their route has more than one.
+func (p *Proxy) accept(l *listener, i int) {
+	for {
+		p.acceptWait()
+		conn, err := l.socks[i].Accept()
+		if errors.Is(err, net.ErrClosed) {
+			if i == 0 {
+				p.logger.Info("stopped listening", "address", l.addr)
+			}
+			return
+		}
+		if err != nil {
+			// I'm not exactly sure what could go wrong here but whatever it is
+			// is probably bad...
+			p.abort("net.Listener.Accept error", "address", l.addr, "error", err.Error())
+			return
+		}
+		l.accepted[i].Add(1)
+		if !p.acceptAllowed(conn) {
+			continue
+		}
+		rt := l.rt.Load()
+		label := ""
+		if len(rt.opts().listen) > 1 {
+			label = l.addr
+		}
+		// Send our connection to be proxied in a new goroutine.
+		p.track(conn, true)
+		go func() {
+			defer p.track(conn, false)
+			p.handleClient(conn, label, rt)
+		}()
+	}
+}
+
+// track adds conn to the connections being handled, or removes it
+func (p *Proxy) track(conn net.Conn, handling bool) {
+	p.connsLock.Lock()
+	defer p.connsLock.Unlock()
+	if handling {
+		p.conns[conn] = true
+	} else {
+		delete(p.conns, conn)
+	}
+}
+
+// statsRoutes breaks the stats summary down by route when there is more than
+// the one unnamed route
+func (p *Proxy) statsRoutes(w io.Writer) {
+	if p.configFile != "" {
+		fmt.Fprintf(w, "config_generation: %d\n", p.configGeneration.Load())
+	}
+	for _, rt := range p.allRoutes() {
+		name := rt.logName()
+		if name == "" {
+			continue
+		}
+		active, waiting := rt.counts()
+		fmt.Fprintf(w, "route=%s active=%d waiting=%d limit=%d sessions=%d\n", name, active, waiting, rt.opts().concurrency, rt.sessions.Load())
+	}
+}
@@ -0,0 +1,245 @@
+package clproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+type samplingSettings struct {
+	// The fraction of successful connections which get a log line of their own.
+	// Errors are always logged.
+	logSample float64
+
+	// Successful connections faster than this are summarized rather than logged,
+	// and slower ones are always logged. logSlowDimension picks which of the
+	// connection's timings is compared.
+	logSlowThreshold time.Duration
+	logSlowDimension string
+
+	// How often to log a summary of the connections that were not logged
+	logAggregateInterval time.Duration
+
+	// Whether to start in quiet mode
+	startQuiet bool
+}
+
+type samplingState struct {
+	// In quiet mode no successful connections are logged individually, and errors
+	// are rate limited per category. Can be changed through the stats port.
+	quiet atomic.Bool
+
+	unlogged *aggregate
+}
+
+// How many errors of each category quiet mode logs per interval
+var quietErrors = 10
+
+// How many timings to keep per interval for estimating percentiles
+const aggregateSamples = 1024
+
+// aggregate sums up successful connections which were not logged individually
+// so that totals can still be worked out from the log alone.
+type aggregate struct {
+	sync.Mutex
+	p *Proxy
+	totals
+}
+
+type totals struct {
+	count    uint64
+	took     float64
+	tookMax  float64
+	wait     float64
+	waitMax  float64
+	dial     float64
+	dialMax  float64
+	bytesIn  int64
+	bytesOut int64
+
+	// A uniform random sample of {took, wait, dial} for the interval
+	samples [][3]float64
+
+	errors         uint64
+	errorsUnlogged uint64
+	errorsLogged   map[string]int
+}
+
+// aggregating is true when some connections may go unlogged
+func (p *Proxy) aggregating() bool {
+	return p.logSample < 1 || p.logSlowThreshold > 0 || p.quiet.Load()
+}
+
+// isSlow reports whether s is past the slow threshold, if there is one
+func (p *Proxy) isSlow(s *summary) bool {
+	if p.logSlowThreshold <= 0 {
+		return false
+	}
+	v := s.took
+	switch p.logSlowDimension {
+	case "wait":
+		v = s.wait
+	case "dial":
+		v = s.dial
+	}
+	return v >= p.logSlowThreshold.Seconds()
+}
+
+func (a *aggregate) add(s *summary) {
+	a.Lock()
+	defer a.Unlock()
+	a.count++
+	a.took += s.took
+	a.tookMax = max(a.tookMax, s.took)
+	a.wait += s.wait
+	a.waitMax = max(a.waitMax, s.wait)
+	a.dial += s.dial
+	a.dialMax = max(a.dialMax, s.dial)
+	a.bytesIn += s.bytesIn
+	a.bytesOut += s.bytesOut
+	// Reservoir sampling keeps memory bounded however busy we are
+	sample := [3]float64{s.took, s.wait, s.dial}
+	if len(a.samples) < aggregateSamples {
+		a.samples = append(a.samples, sample)
+	} else if i := rand.Uint64N(a.count); i < aggregateSamples {
+		a.samples[i] = sample
+	}
+}
+
+// addError counts a failed connection and reports whether it should still be
+// logged individually
+func (a *aggregate) addError(category string) bool {
+	a.Lock()
+	defer a.Unlock()
+	a.errors++
+	if !a.p.quiet.Load() {
+		return true
+	}
+	if a.errorsLogged == nil {
+		a.errorsLogged = map[string]int{}
+	}
+	if a.errorsLogged[category] >= quietErrors {
+		a.errorsUnlogged++
+		return false
+	}
+	a.errorsLogged[category]++
+	return true
+}
+
+// flush logs and resets the aggregate, if anything has been added to it
+func (a *aggregate) flush() {
+	a.Lock()
+	n := a.totals
+	a.totals = totals{}
+	a.Unlock()
+	if n.count == 0 && n.errors == 0 {
+		return
+	}
+	c := float64(max(n.count, 1))
+	a.p.logger.Info("unlogged connections",
+		"count", n.count,
+		"took_avg", n.took/c,
+		"took_max", n.tookMax,
+		"took_p95", percentile(n.samples, 0, 0.95),
+		"wait_avg", n.wait/c,
+		"wait_max", n.waitMax,
+		"wait_p95", percentile(n.samples, 1, 0.95),
+		"dial_avg", n.dial/c,
+		"dial_max", n.dialMax,
+		"dial_p95", percentile(n.samples, 2, 0.95),
+		"in", n.bytesIn,
+		"out", n.bytesOut,
+		"errors", n.errors,
+		"errors_unlogged", n.errorsUnlogged)
+}
+
+// percentile estimates the p'th percentile of column col of samples
+func percentile(samples [][3]float64, col int, p float64) float64 {
+	if len(samples) == 0 {
+		return 0
+	}
+	vals := make([]float64, len(samples))
+	for i, s := range samples {
+		vals[i] = s[col]
+	}
+	slices.Sort(vals)
+	// Nearest rank
+	return vals[int(math.Ceil(p*float64(len(vals))))-1]
+}
+
+func (p *Proxy) logAggregates() {
+	for range p.ticks(p.logAggregateInterval) {
+		p.unlogged.flush()
+	}
+}
+
+// sampled decides whether a successful connection gets its own log line.
+// It is called before any formatting happens.
+func (p *Proxy) sampled() bool {
+	if p.quiet.Load() {
+		return false
+	}
+	return p.logSample >= 1 || rand.Float64() < p.logSample
+}
+
+// errorCategory buckets connection errors for quiet mode's rate limiting
+func errorCategory(err error) string {
+	var netErr net.Error
+	var tlsErr *backendTLSError
+	var pinErr *backendPinError
+	var socksErr *socksError
+	var httpErr *httpProxyError
+	var wsErr *wsError
+	var preludeErr *preludeError
+	var chaosErr *chaosError
+	switch {
+	case errors.As(err, &chaosErr):
+		return "chaos"
+	case errors.As(err, &tlsErr):
+		return "tls"
+	case errors.As(err, &pinErr):
+		return "pin"
+	case errors.As(err, &socksErr):
+		return "socks"
+	case errors.As(err, &httpErr):
+		return "http_proxy"
+	case errors.As(err, &wsErr):
+		return "websocket"
+	case errors.As(err, &preludeErr):
+		return "prelude"
+	case isDNSError(err):
+		return "dns"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "reset"
+	}
+	return "other"
+}
+
+// statsQuiet answers "quiet [on|off]" on the stats port
+func (p *Proxy) statsQuiet(w io.Writer, args []string) {
+	if len(args) > 0 {
+		switch args[0] {
+		case "on":
+			p.quiet.Store(true)
+		case "off":
+			p.quiet.Store(false)
+		default:
+			fmt.Fprintln(w, "error: usage: quiet [on|off]")
+			return
+		}
+		p.logger.Info("quiet mode changed", "quiet", p.quiet.Load())
+	}
+	fmt.Fprintf(w, "quiet: %t\n", p.quiet.Load())
+}
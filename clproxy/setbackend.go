@@ -0,0 +1,171 @@
+package clproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// For a failover without a restart, "set backend <address>" on the stats
+// port replaces a route's primary backends with one new address. New
+// sessions go to it straight away, while sessions on the old backends carry
+// on where they are; the old backends are remembered so that the stats
+// summary can show how many sessions they still have, and the operator knows
+// when it's safe to take them away. The next -config reload puts back the
+// configured backends.
+
+// statsSet answers "set backend <address> [route]" on the stats port
+func (p *Proxy) statsSet(w io.Writer, args []string) {
+	if len(args) < 1 || args[0] != "backend" || len(args) != 2 && len(args) != 3 {
+		fmt.Fprintln(w, "error: usage: set backend <address> [route]")
+		return
+	}
+	addr := args[1]
+	rts := p.allRoutes()
+	if len(args) == 3 {
+		rt, ok := p.findRoute(args[2])
+		if !ok {
+			fmt.Fprintf(w, "error: unknown route %q\n", args[2])
+			return
+		}
+		rts = []*route{rt}
+	} else if len(rts) > 1 {
+		fmt.Fprintln(w, "error: there are several routes, say which one")
+		return
+	}
+	rt := rts[0]
+	if err := p.checkBackendAddr(addr); err != nil {
+		fmt.Fprintf(w, "error: %s\n", err)
+		return
+	}
+
+	old, onOld, err := p.setPrimary(rt, addr)
+	if err != nil {
+		fmt.Fprintf(w, "error: %s\n", err)
+		return
+	}
+	logArgs := []any{"old", old, "new", addr, "sessions_on_old_backend", onOld}
+	if rt.name != "" {
+		logArgs = append(logArgs, "route", rt.name)
+	}
+	p.logger.Info("backend set", logArgs...)
+	for _, b := range rt.backends.list() {
+		if !b.backup.Load() {
+			fmt.Fprintln(w, b)
+		}
+	}
+	fmt.Fprintf(w, "sessions_on_old_backend: %d\n", onOld)
+}
+
+// setPrimary replaces rt's primary backends with addr, keeping track of the
+// ones replaced while they still have sessions, and returns the old backends
+// and how many sessions are left on them
+func (p *Proxy) setPrimary(rt *route, addr string) ([]string, int64, error) {
+	s := rt.backends
+	p.resolveLock.Lock()
+	if s.file != "" {
+		p.resolveLock.Unlock()
+		return nil, 0, errors.New("this route's backends come from -backends-file, change the file instead")
+	}
+	old := s.primarySpecs
+	s.primarySpecs = []string{addr}
+	// Whatever was replaced stays retired until its sessions are gone
+	var retired []*backend
+	for _, b := range append(s.retired, s.list()...) {
+		if !b.backup.Load() && b.active.Load() > 0 {
+			retired = append(retired, b)
+		}
+	}
+	s.retired = retired
+	s.setBackend = true
+	p.resolveLock.Unlock()
+	s.resolve(rt.name)
+	return old, s.sessionsOnOld(), nil
+}
+
+// checkBackendAddr rejects an address we couldn't dial, resolving hostnames
+// so that a typo doesn't take down every new session
+func (p *Proxy) checkBackendAddr(addr string) error {
+	if path, ok := strings.CutPrefix(addr, unixPrefix); ok {
+		if path == "" {
+			return errors.New("no path given for unix:// backend")
+		}
+		return nil
+	}
+	if strings.HasPrefix(addr, srvPrefix) {
+		return errors.New("srv:// backends can't be set, give an address")
+	}
+	hostport := addr
+	if isWebSocketURL(addr) {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return err
+		}
+		hostport = u.Host
+		if u.Port() == "" {
+			hostport = net.JoinHostPort(u.Hostname(), map[string]string{"ws": "80", "wss": "443"}[u.Scheme])
+		}
+	}
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return err
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	if host == "" {
+		return fmt.Errorf("no host given in %q", addr)
+	}
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.resolveTimeout)
+	defer cancel()
+	ips, err := p.resolver.LookupIPAddr(ctx, host)
+	if err == nil && len(ips) == 0 {
+		err = fmt.Errorf("no addresses for %s", host)
+	}
+	return err
+}
+
+// sessionsOnOld counts the sessions still on backends replaced by set
+// backend, forgetting the ones which have emptied or come back
+func (s *backendSet) sessionsOnOld() int64 {
+	s.p.resolveLock.Lock()
+	defer s.p.resolveLock.Unlock()
+	var n int64
+	var retired []*backend
+	for _, b := range s.retired {
+		if cur, ok := s.lookup(b.addr); ok && cur == b {
+			continue
+		}
+		if active := b.active.Load(); active > 0 {
+			n += active
+			retired = append(retired, b)
+		}
+	}
+	s.retired = retired
+	return n
+}
+
+// statsSetBackend adds the sessions left on replaced backends to the stats
+// summary, for routes which have had one replaced
+func (p *Proxy) statsSetBackend(w io.Writer) {
+	for _, rt := range p.allRoutes() {
+		p.resolveLock.Lock()
+		replaced := rt.backends.setBackend
+		p.resolveLock.Unlock()
+		if !replaced {
+			continue
+		}
+		if rt.name != "" {
+			fmt.Fprintf(w, "route=%s ", rt.name)
+		}
+		fmt.Fprintf(w, "sessions_on_old_backend: %d\n", rt.backends.sessionsOnOld())
+	}
+}
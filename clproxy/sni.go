@@ -0,0 +1,293 @@
+package clproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+	"time"
+)
+
+type sniSettings struct {
+	// SNI routing sends TLS connections to a backend chosen by the server name in
+	// their ClientHello, without terminating TLS, e.g.
+	//
+	//	-sni-route "db1.example.com=10.0.0.1:5432,*.web.example.com=10.0.0.2:443"
+	//
+	// Connections whose name has no route, or which send no ClientHello within
+	// sniTimeout, go to the -p backends unless sniRequire is set.
+	sniRoute   string
+	sniTimeout time.Duration
+	sniRequire bool
+}
+
+type sniState struct {
+	// Each route has a backend set of its own so it gets counters, a circuit
+	// breaker, and a line in the backends stats like any other backend.
+	sniRoutes map[string]*backendSet
+}
+
+// The most we will buffer looking for the end of a ClientHello
+const maxClientHello = 64 << 10
+
+var errNoClientHello = errors.New("not a TLS ClientHello")
+
+// setupSNIRoutes parses -sni-route
+func (p *Proxy) setupSNIRoutes() error {
+	p.sniRoutes = map[string]*backendSet{}
+	for _, route := range splitList(p.sniRoute) {
+		name, addr, ok := strings.Cut(route, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		addr = strings.TrimSpace(addr)
+		if !ok || name == "" || addr == "" {
+			return fmt.Errorf("bad route %q, want name=address", route)
+		}
+		s := p.newBackendSet()
+		s.set([]string{addr}, nil, nil, nil)
+		p.sniRoutes[name] = s
+	}
+	return nil
+}
+
+// routeFor returns the backend set for a server name: an exact route, else
+// the most specific wildcard route, else nil for the default backends
+func (p *Proxy) routeFor(name string) (*backendSet, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if s, ok := p.sniRoutes[name]; ok {
+		return s, true
+	}
+	for rest := name; ; {
+		_, after, ok := strings.Cut(rest, ".")
+		if !ok {
+			break
+		}
+		if s, ok := p.sniRoutes["*."+after]; ok {
+			return s, true
+		}
+		rest = after
+	}
+	return nil, false
+}
+
+// The parts of a ClientHello we care about
+type clientHello struct {
+	sni     string
+	alpn    []string
+	version uint16 // the highest version offered
+	ja3     string // with -log-ja3
+}
+
+// peekSNI reads the ClientHello from conn and returns it along with
+// everything read, which must be sent on to the backend before anything
+// else
+func (p *Proxy) peekSNI(conn net.Conn, timeout time.Duration) (*clientHello, []byte, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	var raw bytes.Buffer
+	hello, err := p.readHello(io.TeeReader(conn, &raw))
+	return hello, raw.Bytes(), err
+}
+
+// readHello reads a ClientHello from r, which may be split over several
+// records. A stream which ends before the ClientHello does gives
+// io.ErrUnexpectedEOF or io.EOF.
+func (p *Proxy) readHello(r io.Reader) (*clientHello, error) {
+	var raw, hello []byte
+	for {
+		var hdr [5]byte
+		got, err := io.ReadFull(r, hdr[:])
+		raw = append(raw, hdr[:got]...)
+		if err != nil {
+			return nil, err
+		}
+		// Only handshake records may come before the ClientHello is complete
+		if hdr[0] != 0x16 {
+			return nil, errNoClientHello
+		}
+		n := int(binary.BigEndian.Uint16(hdr[3:]))
+		body := make([]byte, n)
+		got, err = io.ReadFull(r, body)
+		raw = append(raw, body[:got]...)
+		if err != nil {
+			return nil, err
+		}
+		hello = append(hello, body...)
+		if len(hello) >= 4 {
+			if hello[0] != 1 {
+				return nil, errNoClientHello
+			}
+			want := 4 + (int(hello[1])<<16 | int(hello[2])<<8 | int(hello[3]))
+			if want > maxClientHello {
+				return nil, errNoClientHello
+			}
+			if len(hello) >= want {
+				return p.parseHello(hello[4:want])
+			}
+		}
+		if len(raw) > maxClientHello {
+			return nil, errNoClientHello
+		}
+	}
+}
+
+// parseHello picks the server name, ALPN protocols, and highest version out
+// of the body of a ClientHello, and with -log-ja3 its fingerprint. Only a
+// broken server_name extension fails it; we take what we can from the
+// others.
+func (p *Proxy) parseHello(b []byte) (*clientHello, error) {
+	r := helloReader{b: b}
+	h := &clientHello{version: r.u16()}
+	var ja3 ja3Fields
+	ja3.version = h.version
+	r.skip(32) // random
+	r.skip(int(r.u8()))
+	ciphers := helloReader{b: r.bytes(int(r.u16()))}
+	r.skip(int(r.u8()))
+	if r.err != nil {
+		return nil, r.err
+	}
+	if p.logJA3 {
+		for len(ciphers.b) >= 2 {
+			ja3.ciphers = append(ja3.ciphers, ciphers.u16())
+		}
+	}
+	if len(r.b) == 0 {
+		if p.logJA3 {
+			h.ja3 = ja3.hash()
+		}
+		return h, nil // no extensions
+	}
+	exts := helloReader{b: r.bytes(int(r.u16()))}
+	for r.err == nil && exts.err == nil && len(exts.b) > 0 {
+		typ, data := exts.u16(), exts.bytes(int(exts.u16()))
+		e := helloReader{b: data}
+		if p.logJA3 && exts.err == nil {
+			ja3.extensions = append(ja3.extensions, typ)
+			ja3.collect(typ, data)
+		}
+		switch typ {
+		case 0: // server_name
+			list := helloReader{b: e.bytes(int(e.u16()))}
+			for list.err == nil && len(list.b) > 0 {
+				kind, name := list.u8(), list.bytes(int(list.u16()))
+				if kind == 0 && list.err == nil && h.sni == "" {
+					h.sni = string(name)
+				}
+			}
+			e.err = errors.Join(e.err, list.err)
+		case 16: // application_layer_protocol_negotiation
+			list := helloReader{b: e.bytes(int(e.u16()))}
+			for list.err == nil && len(list.b) > 0 {
+				if proto := list.bytes(int(list.u8())); list.err == nil {
+					h.alpn = append(h.alpn, string(proto))
+				}
+			}
+		case 43: // supported_versions
+			list := helloReader{b: e.bytes(int(e.u8()))}
+			for list.err == nil && len(list.b) > 0 {
+				// Skip the GREASE values, which look like 0x?a?a
+				if v := list.u16(); v&0x0f0f != 0x0a0a && v > h.version {
+					h.version = v
+				}
+			}
+		}
+		if e.err != nil {
+			return nil, e.err
+		}
+	}
+	if err := errors.Join(r.err, exts.err); err != nil {
+		return nil, err
+	}
+	if p.logJA3 {
+		h.ja3 = ja3.hash()
+	}
+	return h, nil
+}
+
+// helloReader reads big-endian fields from a ClientHello, remembering the
+// first overrun instead of failing each read
+type helloReader struct {
+	b   []byte
+	err error
+}
+
+func (r *helloReader) bytes(n int) []byte {
+	if r.err != nil || n > len(r.b) {
+		r.err = errNoClientHello
+		return nil
+	}
+	out := r.b[:n]
+	r.b = r.b[n:]
+	return out
+}
+
+func (r *helloReader) skip(n int) { r.bytes(n) }
+
+func (r *helloReader) u8() uint8 {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *helloReader) u16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+// peekedConn replays bytes already read from a connection before reading
+// any more from it
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (p *peekedConn) Read(b []byte) (int, error) { return p.r.Read(b) }
+
+func replay(conn net.Conn, peeked []byte) net.Conn {
+	if len(peeked) == 0 {
+		return conn
+	}
+	return &peekedConn{Conn: conn, r: io.MultiReader(bytes.NewReader(peeked), conn)}
+}
+
+// routeSNI reads the ClientHello and picks the backends for c. It reports
+// false if the connection should be dropped instead.
+func (c *client) routeSNI() bool {
+	hello, peeked, err := c.p.peekSNI(c.conn, c.rt.opts().sniTimeout)
+	c.conn = replay(c.conn, peeked)
+	if err != nil {
+		c.trace("sni_failed", "error", err.Error())
+	} else {
+		c.sni, c.hello = hello.sni, hello
+	}
+	var routed bool
+	c.route, routed = c.p.routeFor(c.sni)
+	if !routed && c.p.sniRequire {
+		msg := "no route for server name"
+		if err != nil {
+			msg = "no ClientHello: " + err.Error()
+		}
+		if !c.p.logRejection(c.name, c.conn, "sni", "sni", c.sni, "error", msg) {
+			c.p.logger.Warn("sni rejected", "client", c.name, "sni", c.sni, "error", msg)
+		}
+		return false
+	}
+	return true
+}
+
+// statsSNI adds the route backends to the backends stats
+func (p *Proxy) statsSNI(w io.Writer) {
+	for _, name := range slices.Sorted(maps.Keys(p.sniRoutes)) {
+		for _, b := range p.sniRoutes[name].list() {
+			fmt.Fprintf(w, "sni=%s %s\n", name, b)
+		}
+	}
+}
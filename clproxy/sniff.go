@@ -0,0 +1,93 @@
+package clproxy
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+type sniffSettings struct {
+	// With -sniff N the first N bytes each side of a session sends are logged
+	// at debug level as a hex and ASCII dump, a line for every 16 bytes carrying
+	// the connection's id, for working out what protocol mystery clients and
+	// scanners speak. What is forwarded is untouched; the bytes are copied
+	// aside as they go past. Anything that isn't printable ASCII shows as a dot,
+	// so nothing a client sends can mess up the log.
+	sniffBytes int
+}
+
+// The most -sniff will dump, and how much goes on each line
+const sniffMax = 256
+const sniffRow = 16
+
+func (p *Proxy) setupSniff() error {
+	if p.sniffBytes < 0 || p.sniffBytes > sniffMax {
+		return fmt.Errorf("-sniff must be between 0 and %d", sniffMax)
+	}
+	return nil
+}
+
+// sniffReader keeps the first -sniff bytes read through it and logs them
+// once it has them all, or the reads end first. It is only put in the copy
+// path with -sniff.
+type sniffReader struct {
+	r    io.Reader
+	c    *client
+	from string
+	buf  []byte
+	done bool
+}
+
+func (s *sniffReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if s.done {
+		return n, err
+	}
+	s.buf = append(s.buf, p[:min(n, s.c.p.sniffBytes-len(s.buf))]...)
+	// A deadline from throttle doesn't end the reads
+	if len(s.buf) == s.c.p.sniffBytes || (err != nil && !errors.Is(err, os.ErrDeadlineExceeded) && len(s.buf) > 0) {
+		s.done = true
+		s.c.logSniff(s.from, s.buf)
+	}
+	return n, err
+}
+
+// logSniff logs the dump of b, what from sent first
+func (c *client) logSniff(from string, b []byte) {
+	if !c.p.logger.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	for off := 0; off < len(b); off += sniffRow {
+		row := b[off:min(off+sniffRow, len(b))]
+		c.p.logger.Debug("sniff", "id", c.UID, "client", c.name, "from", from, "offset", off, "hex", sniffHex(row), "ascii", sniffASCII(row))
+	}
+}
+
+// sniffHex returns b as space separated hex bytes
+func sniffHex(b []byte) string {
+	var sb strings.Builder
+	for i, v := range b {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+		sb.WriteString(hex.EncodeToString([]byte{v}))
+	}
+	return sb.String()
+}
+
+// sniffASCII returns b with everything but printable ASCII as dots
+func sniffASCII(b []byte) string {
+	out := make([]byte, len(b))
+	for i, v := range b {
+		if v < 0x20 || v > 0x7e {
+			v = '.'
+		}
+		out[i] = v
+	}
+	return string(out)
+}
@@ -0,0 +1,169 @@
+package clproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+type socksSettings struct {
+	// With -socks5 backend connections are made through a SOCKS5 proxy, e.g. one
+	// on a bastion host, rather than directly
+	socksProxy string
+	socksUser  string
+	socksPass  string
+}
+
+// socksError marks a failure talking to the SOCKS proxy itself, as opposed to
+// the proxy failing to reach the backend
+type socksError struct {
+	err error
+}
+
+func (e *socksError) Error() string { return "socks5 proxy: " + e.err.Error() }
+func (e *socksError) Unwrap() error { return e.err }
+
+// Reasons the SOCKS proxy gives for not reaching the backend, from RFC 1928.
+// Where there is a matching errno it is used so they are summarized like
+// direct dial failures.
+var socksReplies = map[byte]error{
+	1: errors.New("general SOCKS server failure"),
+	2: errors.New("connection not allowed by ruleset"),
+	3: syscall.ENETUNREACH,
+	4: syscall.EHOSTUNREACH,
+	5: syscall.ECONNREFUSED,
+	6: errors.New("TTL expired"),
+	7: errors.New("command not supported"),
+	8: errors.New("address type not supported"),
+}
+
+// socksDial connects to target through the SOCKS5 proxy
+func (p *Proxy) socksDial(ctx context.Context, d *net.Dialer, target string) (net.Conn, error) {
+	conn, err := p.dialFrom(ctx, d, "tcp", p.socksProxy)
+	if err != nil {
+		return nil, &socksError{err}
+	}
+	// The handshake is bounded by ctx like the dial
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+	if err := p.socksConnect(conn, target); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func (p *Proxy) socksConnect(conn net.Conn, target string) error {
+	// Greeting: offer no auth, and username/password if we have them
+	methods := []byte{0x00}
+	if p.socksUser != "" {
+		methods = []byte{0x02}
+	}
+	if _, err := conn.Write(append([]byte{5, byte(len(methods))}, methods...)); err != nil {
+		return &socksError{err}
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return &socksError{err}
+	}
+	switch {
+	case reply[0] != 5:
+		return &socksError{fmt.Errorf("not a SOCKS5 server (version %d)", reply[0])}
+	case reply[1] == 0x02 && p.socksUser != "":
+		if err := p.socksAuth(conn); err != nil {
+			return err
+		}
+	case reply[1] != 0x00:
+		return &socksError{errors.New("no acceptable authentication method")}
+	}
+
+	req := []byte{5, 1, 0} // CONNECT
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("bad port in %q", target)
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if ip.Is4() {
+			req = append(append(req, 1), ip.AsSlice()...)
+		} else {
+			req = append(append(req, 4), ip.AsSlice()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("hostname %q is too long for SOCKS5", host)
+		}
+		req = append(append(req, 3, byte(len(host))), host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return &socksError{err}
+	}
+
+	// Reply: version, status, reserved, then the bound address, which we
+	// don't need
+	var hdr [4]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return &socksError{err}
+	}
+	if hdr[1] != 0 {
+		reason, ok := socksReplies[hdr[1]]
+		if !ok {
+			reason = fmt.Errorf("reply code %d", hdr[1])
+		}
+		return &net.OpError{Op: "dial", Net: "tcp", Err: fmt.Errorf("%s via socks5 proxy %s: %w", target, p.socksProxy, reason)}
+	}
+	var skip int
+	switch hdr[3] {
+	case 1:
+		skip = 4
+	case 4:
+		skip = 16
+	case 3:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return &socksError{err}
+		}
+		skip = int(n[0])
+	default:
+		return &socksError{fmt.Errorf("bad address type %d in reply", hdr[3])}
+	}
+	if _, err := io.ReadFull(conn, make([]byte, skip+2)); err != nil {
+		return &socksError{err}
+	}
+	return nil
+}
+
+// socksAuth does RFC 1929 username/password authentication
+func (p *Proxy) socksAuth(conn net.Conn) error {
+	if len(p.socksUser) > 255 || len(p.socksPass) > 255 {
+		return &socksError{errors.New("username or password too long")}
+	}
+	req := append([]byte{1, byte(len(p.socksUser))}, p.socksUser...)
+	req = append(append(req, byte(len(p.socksPass))), p.socksPass...)
+	if _, err := conn.Write(req); err != nil {
+		return &socksError{err}
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return &socksError{err}
+	}
+	if reply[1] != 0 {
+		return &socksError{errors.New("authentication failed")}
+	}
+	return nil
+}
@@ -0,0 +1,282 @@
+package clproxy
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+type socksServerSettings struct {
+	// With -socks5-server clients speak SOCKS5 (RFC 1928) to us, so that any
+	// SOCKS client can use our queueing. Each CONNECT is checked against
+	// -socks5-server-allow, in the same form as -original-dst-allow, and the
+	// client is then queued, dialed, and logged like any other, its target
+	// logged as target=. The client is told the dial succeeded, or why it
+	// didn't, once it has been admitted and the dial is done. BIND and UDP
+	// ASSOCIATE are refused as unsupported. With -socks5-server-user clients
+	// must give that username and -socks5-server-pass (RFC 1929).
+	socksServer        bool
+	socksServerAllow   string
+	socksServerUser    string
+	socksServerPass    string
+	socksServerTimeout time.Duration
+}
+
+type socksServerState struct {
+	socksServerRules []dstRule
+
+	// Where clients have asked to go, each with a backend set of its own
+	socksRoutes destinations
+}
+
+// SOCKS5 reply codes we send
+const (
+	socksSucceeded       = 0
+	socksFailure         = 1
+	socksNotAllowed      = 2
+	socksNetUnreachable  = 3
+	socksHostUnreachable = 4
+	socksRefused         = 5
+	socksTTLExpired      = 6
+	socksBadCommand      = 7
+	socksBadAddressType  = 8
+)
+
+// socksRequestError is a SOCKS request we turn down, with the reply code to
+// give the client
+type socksRequestError struct {
+	code byte
+	err  error
+}
+
+func (e *socksRequestError) Error() string { return e.err.Error() }
+
+// setupSOCKSServer parses -socks5-server-allow, which mustn't be empty
+func (p *Proxy) setupSOCKSServer() error {
+	if p.socksServerAllow == "" {
+		return errors.New("-socks5-server needs -socks5-server-allow")
+	}
+	if (p.socksServerUser == "") != (p.socksServerPass == "") {
+		return errors.New("-socks5-server-user and -socks5-server-pass must be given together")
+	}
+	if len(p.socksServerUser) > 255 || len(p.socksServerPass) > 255 {
+		return errors.New("-socks5-server-user and -socks5-server-pass can be at most 255 bytes")
+	}
+	var err error
+	p.socksServerRules, err = parseDstRules(p.socksServerAllow)
+	return err
+}
+
+// socksGreet negotiates the authentication method with conn and
+// authenticates it
+func (p *Proxy) socksGreet(conn net.Conn) error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[0] != 5 {
+		return fmt.Errorf("not SOCKS5 (version %d)", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+	want := byte(0x00)
+	if p.socksServerUser != "" {
+		want = 0x02
+	}
+	for _, m := range methods {
+		if m != want {
+			continue
+		}
+		if _, err := conn.Write([]byte{5, want}); err != nil {
+			return err
+		}
+		if want == 0x02 {
+			return p.socksCheckAuth(conn)
+		}
+		return nil
+	}
+	conn.Write([]byte{5, 0xff})
+	return errors.New("no acceptable authentication method")
+}
+
+// socksCheckAuth reads an RFC 1929 username and password from conn and
+// checks them
+func (p *Proxy) socksCheckAuth(conn net.Conn) error {
+	var ver [1]byte
+	if _, err := io.ReadFull(conn, ver[:]); err != nil {
+		return err
+	}
+	user, err := readSOCKSString(conn)
+	if err != nil {
+		return err
+	}
+	pass, err := readSOCKSString(conn)
+	if err != nil {
+		return err
+	}
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(p.socksServerUser))
+	passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(p.socksServerPass))
+	if ver[0] != 1 || userOK&passOK != 1 {
+		conn.Write([]byte{1, 1})
+		return fmt.Errorf("authentication failed for user %q", user)
+	}
+	_, err = conn.Write([]byte{1, 0})
+	return err
+}
+
+// readSOCKSString reads a string preceded by its one byte length
+func readSOCKSString(r io.Reader) (string, error) {
+	var n [1]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return "", err
+	}
+	buf := make([]byte, n[0])
+	_, err := io.ReadFull(r, buf)
+	return string(buf), err
+}
+
+// readSOCKSRequest reads a request from conn and returns its CONNECT target
+// as host:port
+func readSOCKSRequest(conn net.Conn) (string, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return "", err
+	}
+	if hdr[0] != 5 {
+		return "", fmt.Errorf("not SOCKS5 (version %d)", hdr[0])
+	}
+	var host string
+	switch hdr[3] {
+	case 1, 4:
+		ip := make([]byte, 4)
+		if hdr[3] == 4 {
+			ip = make([]byte, 16)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		addr, _ := netip.AddrFromSlice(ip)
+		host = addr.String()
+	case 3:
+		var err error
+		if host, err = readSOCKSString(conn); err != nil {
+			return "", err
+		}
+	default:
+		return "", &socksRequestError{socksBadAddressType, fmt.Errorf("address type %d not supported", hdr[3])}
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return "", err
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:]))))
+	if hdr[1] != 1 {
+		names := map[byte]string{2: "BIND", 3: "UDP ASSOCIATE"}
+		cmd, ok := names[hdr[1]]
+		if !ok {
+			cmd = "command " + strconv.Itoa(int(hdr[1]))
+		}
+		return target, &socksRequestError{socksBadCommand, fmt.Errorf("%s not supported", cmd)}
+	}
+	return target, nil
+}
+
+// socksReply sends conn a reply with code and the address we connected from
+func (p *Proxy) socksReply(conn net.Conn, code byte, bound net.Addr) error {
+	reply := []byte{5, code, 0}
+	ap := netip.AddrPortFrom(netip.IPv4Unspecified(), 0)
+	if tcp, ok := bound.(*net.TCPAddr); ok {
+		ap = tcp.AddrPort()
+	}
+	if ip := ap.Addr().Unmap(); ip.Is4() {
+		reply = append(append(reply, 1), ip.AsSlice()...)
+	} else {
+		reply = append(append(reply, 4), ip.AsSlice()...)
+	}
+	reply = binary.BigEndian.AppendUint16(reply, ap.Port())
+	conn.SetWriteDeadline(time.Now().Add(p.socksServerTimeout))
+	defer conn.SetWriteDeadline(time.Time{})
+	_, err := conn.Write(reply)
+	return err
+}
+
+// socksCode picks the reply code for a failed dial
+func socksCode(err error) byte {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socksRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socksNetUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), isDNSError(err):
+		return socksHostUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return socksTTLExpired
+	}
+	return socksFailure
+}
+
+// routeSOCKS does the SOCKS5 handshake with c and points c at the target it
+// asks for. If that fails the client is told why, if it got as far as
+// asking, and false returned.
+func (c *client) routeSOCKS() bool {
+	c.conn.SetReadDeadline(time.Now().Add(c.p.socksServerTimeout))
+	err := c.p.socksGreet(c.conn)
+	var target string
+	if err == nil {
+		target, err = readSOCKSRequest(c.conn)
+	}
+	c.conn.SetReadDeadline(time.Time{})
+	var dst netip.AddrPort
+	if err == nil {
+		dst, err = c.p.resolveAllowed(target, c.p.socksServerRules, c.p.socksServerTimeout)
+	}
+	if err != nil {
+		if !c.p.logRejection(c.name, c.conn, "socks5", "target", target, "error", err.Error()) {
+			c.p.logger.Warn("socks5 request rejected", "client", c.name, "target", target, "error", err.Error())
+		}
+		var reqErr *socksRequestError
+		switch {
+		case errors.As(err, &reqErr):
+			c.p.socksReply(c.conn, reqErr.code, nil)
+		case errors.Is(err, errDynamicNotAllowed):
+			c.p.socksReply(c.conn, socksNotAllowed, nil)
+		case target != "":
+			c.p.socksReply(c.conn, socksHostUnreachable, nil)
+		}
+		return false
+	}
+	c.trace("socks5_request", "target", target, "backend", dst.String())
+	c.target = target
+	c.route = c.p.socksRoutes.get(dst)
+	return true
+}
+
+// replySOCKS tells a SOCKS client how its dial went
+func (c *client) replySOCKS() {
+	if !c.p.socksServer {
+		return
+	}
+	if c.err != nil {
+		c.p.socksReply(c.conn, socksCode(c.err), nil)
+		return
+	}
+	c.p.socksReply(c.conn, socksSucceeded, c.server.LocalAddr())
+}
+
+// statsSOCKSServer adds the targets SOCKS clients asked for to the backends
+// stats
+func (p *Proxy) statsSOCKSServer(w io.Writer) {
+	for _, b := range p.socksRoutes.backends() {
+		fmt.Fprintf(w, "socks5_dest %s\n", b)
+	}
+}
@@ -0,0 +1,94 @@
+package clproxy
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type sourceRouteSettings struct {
+	// Source routes send clients from a CIDR to a backend of their own, e.g.
+	//
+	//	-route "10.1.0.0/16=newdb:8300;c=20"
+	//
+	// for moving tenants over a few at a time. The route with the longest
+	// matching prefix wins, and clients which match none go to the -p backends,
+	// the default route. Each source route is a route like those of -config: it
+	// has its own backends, its own concurrency limit (-c unless given with c=),
+	// and a line in the stats, and its sessions are logged with route= its CIDR.
+	sourceRoute string
+}
+
+type sourceRouteState struct {
+	// The source routes, longest prefix first
+	sourceRoutes []sourceRouteEntry
+}
+
+type sourceRouteEntry struct {
+	prefix netip.Prefix
+	rt     *route
+}
+
+// setupSourceRoutes parses -route into routes, which follow the default route
+func (p *Proxy) setupSourceRoutes() ([]*route, error) {
+	var rts []*route
+	for _, spec := range splitList(p.sourceRoute) {
+		cidr, rest, ok := strings.Cut(spec, "=")
+		addr, limit, hasLimit := strings.Cut(strings.TrimSpace(rest), ";")
+		addr = strings.TrimSpace(addr)
+		if !ok || addr == "" {
+			return nil, fmt.Errorf("bad -route %q, want cidr=address[;c=limit]", spec)
+		}
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("bad -route %q: %w", spec, err)
+		}
+		prefix = prefix.Masked()
+		if err := checkWeights([]string{addr}); err != nil {
+			return nil, err
+		}
+		rt := p.newRoute(prefix.String())
+		if slices.ContainsFunc(rts, func(other *route) bool { return other.name == rt.name }) {
+			return nil, fmt.Errorf("-route %s given twice", rt.name)
+		}
+		rt.backends.primarySpecs = []string{addr}
+		if hasLimit {
+			n, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(limit), "c="))
+			if err != nil || n < 1 || !strings.HasPrefix(strings.TrimSpace(limit), "c=") {
+				return nil, fmt.Errorf("bad -route %q, want a limit of c=n with n at least 1", spec)
+			}
+			opts := *rt.opts()
+			opts.concurrency = n
+			rt.settings.Store(&opts)
+		}
+		rts = append(rts, rt)
+		p.sourceRoutes = append(p.sourceRoutes, sourceRouteEntry{prefix: prefix, rt: rt})
+	}
+	slices.SortStableFunc(p.sourceRoutes, func(a, b sourceRouteEntry) int {
+		return b.prefix.Bits() - a.prefix.Bits()
+	})
+	return rts, nil
+}
+
+// sourceRouteFor returns the source route for a client address, if it has
+// one
+func (p *Proxy) sourceRouteFor(ip netip.Addr) (*route, bool) {
+	ip = ip.Unmap()
+	for _, e := range p.sourceRoutes {
+		if e.prefix.Contains(ip) {
+			return e.rt, true
+		}
+	}
+	return nil, false
+}
+
+// logName is the route's name for connection logs and stats. With -route the
+// default route is called default, so that every session says where it went.
+func (rt *route) logName() string {
+	if rt.name == "" && rt.p.sourceRoutes != nil {
+		return "default"
+	}
+	return rt.name
+}
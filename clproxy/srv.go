@@ -0,0 +1,88 @@
+package clproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Backends given as srv://_service._proto.name are discovered from DNS SRV
+// records, re-resolved along with hostnames every -resolve-interval. Each
+// target is resolved to its addresses, which become backends with the
+// record's port and weight. Only the records with the best (lowest) priority
+// are used.
+const srvPrefix = "srv://"
+
+// expandSRV resolves one srv:// spec the way expand resolves a hostname,
+// keeping the last good result if the lookup fails
+func (s *backendSet) expandSRV(spec, name string, from map[string]string, weights map[string]int) []string {
+	ctx, cancel := context.WithTimeout(context.Background(), s.p.resolveTimeout)
+	defer cancel()
+	_, srvs, err := s.p.resolver.LookupSRV(ctx, "", "", name)
+	var addrs []string
+	for _, srv := range srvs {
+		// LookupSRV sorts by priority, best first
+		if srv.Priority != srvs[0].Priority {
+			break
+		}
+		target := strings.TrimSuffix(srv.Target, ".")
+		port := strconv.Itoa(int(srv.Port))
+		ips, lerr := s.p.resolver.LookupIPAddr(ctx, target)
+		if lerr != nil {
+			s.p.logger.Warn("srv target resolution failed", "backend", spec, "target", target, "error", lerr.Error())
+			continue
+		}
+		for _, ip := range ips {
+			addr := net.JoinHostPort(ip.IP.String(), port)
+			addrs = append(addrs, addr)
+			from[addr] = net.JoinHostPort(target, port)
+			weights[addr] = max(int(srv.Weight), 1)
+		}
+	}
+	if len(addrs) == 0 {
+		prev := s.lastResolved[spec]
+		s.p.logger.Warn("backend resolution failed, keeping previous addresses", "backend", spec, "error", errString(err), "addresses", prev)
+		for _, addr := range prev {
+			weights[addr] = s.lastWeights[addr]
+			from[addr] = s.lastFrom[addr]
+		}
+		return prev
+	}
+	slices.Sort(addrs)
+	if s.lastResolved == nil {
+		s.lastResolved = map[string][]string{}
+	}
+	if s.lastWeights == nil {
+		s.lastWeights, s.lastFrom = map[string]int{}, map[string]string{}
+	}
+	s.lastResolved[spec] = addrs
+	for _, addr := range addrs {
+		s.lastWeights[addr], s.lastFrom[addr] = weights[addr], from[addr]
+	}
+	return addrs
+}
+
+// statsResolved answers "resolved" on the stats port with what each backend
+// hostname and SRV name currently resolves to
+func (p *Proxy) statsResolved(w io.Writer, args []string) {
+	p.resolveLock.Lock()
+	defer p.resolveLock.Unlock()
+	for _, rt := range p.allRoutes() {
+		s := rt.backends
+		for _, spec := range append(append([]string(nil), s.primarySpecs...), s.backupSpecs...) {
+			spec, _, _ = splitWeight(spec)
+			addrs, ok := s.lastResolved[spec]
+			if !ok {
+				continue
+			}
+			if rt.name != "" {
+				fmt.Fprintf(w, "route=%s ", rt.name)
+			}
+			fmt.Fprintf(w, "backend=%s addresses=%s\n", spec, strings.Join(addrs, ","))
+		}
+	}
+}
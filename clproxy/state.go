@@ -0,0 +1,154 @@
+package clproxy
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type persistenceSettings struct {
+	// Where cumulative counters are saved so they survive restarts. Empty
+	// disables persistence.
+	stateFile string
+}
+
+type persistenceState struct {
+	// How many times the proxy has been started against the current state file
+	restarts uint64
+}
+
+var stateInterval = time.Minute
+
+// savedBackend holds the monotonic counters for a single backend
+type savedBackend struct {
+	Sessions  uint64 `json:"sessions"`
+	Errors    uint64 `json:"errors"`
+	DialNanos int64  `json:"dial_nanos"`
+	BytesIn   int64  `json:"bytes_in"`
+	BytesOut  int64  `json:"bytes_out"`
+}
+
+// savedState is the on disk format of the state file. Only totals which never
+// go down belong here; gauges like active and waiting start over at zero.
+type savedState struct {
+	Saved       time.Time               `json:"saved"`
+	Restarts    uint64                  `json:"restarts"`
+	Connections uint64                  `json:"connections"`
+	Backends    map[string]savedBackend `json:"backends"`
+}
+
+// loadState picks up the counters from a previous run. A missing or corrupt
+// file is not fatal; we just start counting from zero.
+func (p *Proxy) loadState() {
+	buf, err := os.ReadFile(p.stateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			p.logger.Warn("state file unreadable, starting fresh", "file", p.stateFile, "error", err.Error())
+		}
+		return
+	}
+	var st savedState
+	if err := json.Unmarshal(buf, &st); err != nil {
+		p.logger.Warn("state file corrupt, starting fresh", "file", p.stateFile, "error", err.Error())
+		return
+	}
+	p.restarts = st.Restarts + 1
+	p.count.Store(st.Connections)
+	for key, sb := range st.Backends {
+		b, ok := p.stateBackend(key)
+		if !ok {
+			continue
+		}
+		b.sessions.Add(sb.Sessions)
+		b.errors.Add(sb.Errors)
+		b.dialTime.Add(sb.DialNanos)
+		b.bytesIn.Add(sb.BytesIn)
+		b.bytesOut.Add(sb.BytesOut)
+	}
+	p.logger.Info("state loaded", "file", p.stateFile, "connections", p.count.Load(), "restarts", p.restarts)
+}
+
+// Backends of named routes are saved as route/addr, so that the same address
+// in two routes keeps two sets of counters
+func stateKey(rt *route, b *backend) string {
+	if rt.name == "" {
+		return b.addr
+	}
+	return rt.name + "/" + b.addr
+}
+
+// stateBackend finds the backend saved under key, trying it as the backend
+// of each named route before the unnamed one, which is always first
+func (p *Proxy) stateBackend(key string) (*backend, bool) {
+	var unnamed *route
+	for _, rt := range p.allRoutes() {
+		if rt.name == "" {
+			unnamed = rt
+			continue
+		}
+		if addr, ok := strings.CutPrefix(key, rt.name+"/"); ok {
+			if b, ok := rt.backends.lookup(addr); ok {
+				return b, true
+			}
+		}
+	}
+	if unnamed == nil {
+		return nil, false
+	}
+	return unnamed.backends.lookup(key)
+}
+
+// saveState writes the current counters to a temporary file and renames it
+// into place, so a crash mid-write never leaves a truncated state file.
+func (p *Proxy) saveState() error {
+	st := savedState{
+		Saved:       time.Now(),
+		Restarts:    p.restarts,
+		Connections: p.count.Load(),
+		Backends:    map[string]savedBackend{},
+	}
+	for _, rt := range p.allRoutes() {
+		for _, b := range rt.backends.list() {
+			st.Backends[stateKey(rt, b)] = savedBackend{
+				Sessions:  b.sessions.Load(),
+				Errors:    b.errors.Load(),
+				DialNanos: b.dialTime.Load(),
+				BytesIn:   b.bytesIn.Load(),
+				BytesOut:  b.bytesOut.Load(),
+			}
+		}
+	}
+	buf, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p.stateFile), filepath.Base(p.stateFile)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p.stateFile)
+}
+
+// persistState saves the counters every stateInterval. main also saves them
+// once more when we are asked to shut down.
+func (p *Proxy) persistState() {
+	for range p.ticks(stateInterval) {
+		if err := p.saveState(); err != nil {
+			p.logger.Error("state save failed", "file", p.stateFile, "error", err.Error())
+		}
+	}
+}
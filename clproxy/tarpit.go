@@ -0,0 +1,111 @@
+package clproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+type tarpitSettings struct {
+	// With -deny-action tarpit, clients refused by the ACL or an autoban aren't
+	// closed but held open for -tarpit-duration, so that they can't just retry
+	// straight away. Nothing is dialed for them and they take no concurrency
+	// slot; we read and discard what they send a little at a time, then close
+	// them. At most -tarpit-max are held at once, each costing us a file
+	// descriptor and a goroutine, and any more are closed as usual.
+	denyAction     string
+	tarpitDuration time.Duration
+	tarpitMax      int
+}
+
+type tarpitState struct {
+	// Clients being held, held in all, turned away with the tarpit full, and
+	// the bytes read from them
+	tarpitHeld      atomic.Int64
+	tarpitTotal     atomic.Uint64
+	tarpitOverflow  atomic.Uint64
+	tarpitDiscarded atomic.Uint64
+
+	// Whether we've warned that the tarpit is full since it last had room
+	tarpitFullWarned atomic.Bool
+}
+
+// How much of what a tarpitted client sends we read, and how often
+const tarpitReadSize = 16
+const tarpitReadInterval = time.Second
+
+func (p *Proxy) setupTarpit() error {
+	switch p.denyAction {
+	case "close", "tarpit":
+	default:
+		return fmt.Errorf("unknown -deny-action %q (want close or tarpit)", p.denyAction)
+	}
+	if p.denyAction == "tarpit" && (p.tarpitDuration <= 0 || p.tarpitMax <= 0) {
+		return errors.New("-deny-action tarpit needs a positive -tarpit-duration and -tarpit-max")
+	}
+	return nil
+}
+
+// refuse gets rid of a client the ACL or an autoban turned away, holding it
+// in the tarpit with -deny-action tarpit while there's room
+func (p *Proxy) refuse(conn net.Conn) {
+	if p.denyAction != "tarpit" {
+		conn.Close()
+		return
+	}
+	if p.tarpitHeld.Add(1) > int64(p.tarpitMax) {
+		p.tarpitHeld.Add(-1)
+		p.tarpitOverflow.Add(1)
+		if !p.tarpitFullWarned.Swap(true) {
+			p.logger.Warn("tarpit full, closing refused clients instead", "max", p.tarpitMax)
+		}
+		conn.Close()
+		return
+	}
+	p.tarpitFullWarned.Store(false)
+	p.tarpitTotal.Add(1)
+	go p.tarpit(conn)
+}
+
+// tarpit holds conn open for -tarpit-duration, or until the client gives up
+func (p *Proxy) tarpit(conn net.Conn) {
+	defer p.tarpitHeld.Add(-1)
+	defer conn.Close()
+	start := time.Now()
+	end := start.Add(p.tarpitDuration)
+	buf := make([]byte, tarpitReadSize)
+	var discarded int
+	var err error
+	for now := start; now.Before(end); now = time.Now() {
+		conn.SetReadDeadline(now.Add(min(tarpitReadInterval, end.Sub(now))))
+		var n int
+		n, err = conn.Read(buf)
+		discarded += n
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			err = nil
+			continue
+		}
+		if err != nil {
+			break
+		}
+		// Sent something: make it wait for the next read
+		time.Sleep(min(tarpitReadInterval-time.Since(now), time.Until(end)))
+	}
+	p.tarpitDiscarded.Add(uint64(discarded))
+	closedBy := "proxy"
+	if err != nil {
+		closedBy = "client"
+	}
+	p.logger.Debug("tarpit released", "client", p.remoteName(conn), "held", time.Since(start).Seconds(), "discarded", discarded, "closed_by", closedBy)
+}
+
+// statsTarpit adds the tarpit to the stats summary
+func (p *Proxy) statsTarpit(w io.Writer) {
+	if p.denyAction == "tarpit" {
+		fmt.Fprintf(w, "tarpit: held=%d max=%d total=%d overflow=%d discarded=%d\n", p.tarpitHeld.Load(), p.tarpitMax, p.tarpitTotal.Load(), p.tarpitOverflow.Load(), p.tarpitDiscarded.Load())
+	}
+}
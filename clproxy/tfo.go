@@ -0,0 +1,34 @@
+package clproxy
+
+import (
+	"syscall"
+)
+
+type tfoSettings struct {
+	// With -tfo our listeners accept TCP Fast Open, and backend dials use it
+	// where the platform can, saving a round trip on each connection after the
+	// first to a backend: the SYN carries the first data. On Linux the dial
+	// returns before the handshake, so the dial= time no longer includes it.
+	// Where Fast Open isn't available connections are made as usual.
+	tcpFastOpen bool
+}
+
+// How many Fast Open requests a listener may have outstanding
+const tfoQueueLen = 256
+
+// withControl combines two dialer or listener Control functions, either of
+// which may be nil
+func withControl(a, b func(network, address string, raw syscall.RawConn) error) func(network, address string, raw syscall.RawConn) error {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	return func(network, address string, raw syscall.RawConn) error {
+		if err := a(network, address, raw); err != nil {
+			return err
+		}
+		return b(network, address, raw)
+	}
+}
@@ -0,0 +1,61 @@
+package clproxy
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Not in package syscall
+const (
+	tcpFastOpenOpt     = 23
+	tcpFastOpenConnect = 30
+)
+
+// The net.ipv4.tcp_fastopen bits which enable the client and server sides
+const (
+	tfoSysctlClient = 1
+	tfoSysctlServer = 2
+)
+
+// tfoListenControl enables Fast Open on a listening socket. If the kernel
+// won't have it the listener works without.
+func (p *Proxy) tfoListenControl(network, address string, raw syscall.RawConn) error {
+	raw.Control(func(fd uintptr) {
+		if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpenOpt, tfoQueueLen); err != nil {
+			p.logger.Debug("tcp fast open unavailable", "address", address, "error", err.Error())
+		}
+	})
+	return nil
+}
+
+// tfoDialControl has a backend socket's connect return at once, sending the
+// SYN with the first data we write when there is a Fast Open cookie for the
+// backend
+func (p *Proxy) tfoDialControl(network, address string, raw syscall.RawConn) error {
+	raw.Control(func(fd uintptr) {
+		if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpenConnect, 1); err != nil {
+			p.logger.Debug("tcp fast open unavailable", "backend", address, "error", err.Error())
+		}
+	})
+	return nil
+}
+
+// checkTFO warns when the kernel has Fast Open turned off for either side
+func (p *Proxy) checkTFO() {
+	b, err := os.ReadFile("/proc/sys/net/ipv4/tcp_fastopen")
+	if err != nil {
+		return
+	}
+	mode, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return
+	}
+	if mode&tfoSysctlServer == 0 {
+		p.logger.Warn("tcp fast open is off for listeners, set net.ipv4.tcp_fastopen to 3 to enable it", "tcp_fastopen", mode)
+	}
+	if mode&tfoSysctlClient == 0 {
+		p.logger.Warn("tcp fast open is off for backend dials, set net.ipv4.tcp_fastopen to 3 to enable it", "tcp_fastopen", mode)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package clproxy
+
+import "syscall"
+
+func (p *Proxy) tfoListenControl(network, address string, raw syscall.RawConn) error { return nil }
+
+func (p *Proxy) tfoDialControl(network, address string, raw syscall.RawConn) error { return nil }
+
+func (p *Proxy) checkTFO() {
+	p.logger.Warn("tcp fast open is only supported on Linux, ignoring -tfo")
+}
@@ -0,0 +1,144 @@
+package clproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// "throttle <id> <rate>" on the stats port slows a running session to rate
+// bytes a second each way, for when closing it would be too harsh, and
+// "unthrottle <id>" lets it go again. Sessions aren't wrapped in anything
+// until they are throttled: the command interrupts both directions of the
+// copy with a read deadline in the past, and the copy puts a token bucket in
+// front of the reader and carries on where it was. The bucket reads at most
+// a tenth of a second's worth at a time, so a new rate holds within a
+// second. Throttled sessions are logged with throttled_by=admin, and the
+// throttle goes with the session.
+
+// copyKick marks the directions of a session's copy interrupted by
+// throttle, which resume only if theirs is set. throttle sets it and the
+// deadline under the session's kickLock, and the copy clears both under it,
+// so that a second command can't slip a deadline in after the first was
+// cleared without the copy knowing to resume again.
+type copyKick struct {
+	up, down atomic.Bool
+}
+
+// adminReader holds reads back to the session's admin throttle, while it
+// has one
+type adminReader struct {
+	r io.Reader
+	c *client
+}
+
+func (r *adminReader) Read(p []byte) (int, error) {
+	b := r.c.adminBucket.Load()
+	if b == nil {
+		return r.r.Read(p)
+	}
+	if chunk := max(1, int(b.rate/10)); len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if wait := b.debit(float64(n)); wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+	return n, err
+}
+
+// copy forwards what src sends, which is from, to dst until it ends. A
+// throttle interrupts it once, to put an adminReader in front of src.
+func (c *client) copy(dst io.Writer, src net.Conn, from string) (int64, error) {
+	r := c.source(src, from)
+	kick := &c.kick.up
+	if from == "backend" {
+		kick = &c.kick.down
+	}
+	var total int64
+	for {
+		n, err := io.Copy(dst, r)
+		total += n
+		if !errors.Is(err, os.ErrDeadlineExceeded) || !c.resume(src, kick) {
+			return total, err
+		}
+		if _, ok := r.(*adminReader); !ok {
+			r = &adminReader{r: r, c: c}
+		}
+	}
+}
+
+// resume clears a deadline set by throttle, reporting whether there was one
+func (c *client) resume(src net.Conn, kick *atomic.Bool) bool {
+	c.kickLock.Lock()
+	defer c.kickLock.Unlock()
+	if !kick.Swap(false) {
+		return false
+	}
+	src.SetReadDeadline(time.Time{})
+	return true
+}
+
+// throttle holds c to rate bytes a second each way from now on, or lets it
+// go with a rate of 0
+func (c *client) throttle(rate byteRate) error {
+	if rate <= 0 {
+		c.adminBucket.Store(nil)
+		return nil
+	}
+	burst := max(1, float64(rate)/10)
+	c.adminBucket.Store(&tokenBucket{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()})
+	c.throttledByAdmin.Store(true)
+	c.kickLock.Lock()
+	defer c.kickLock.Unlock()
+	now := time.Now()
+	c.kick.up.Store(true)
+	c.kick.down.Store(true)
+	return errors.Join(c.conn.SetReadDeadline(now), c.server.SetReadDeadline(now))
+}
+
+// statsThrottle answers "throttle <id> <rate>" on the stats port
+func (p *Proxy) statsThrottle(w io.Writer, args []string) {
+	if len(args) != 2 {
+		fmt.Fprintln(w, "error: usage: throttle <id> <rate>")
+		return
+	}
+	var rate byteRate
+	if err := rate.Set(args[1]); err != nil || rate <= 0 {
+		fmt.Fprintf(w, "error: invalid rate %q\n", args[1])
+		return
+	}
+	c := p.findLive(args[0])
+	if c == nil {
+		fmt.Fprintf(w, "error: no session %q\n", args[0])
+		return
+	}
+	if err := c.throttle(rate); err != nil {
+		fmt.Fprintf(w, "error: %v\n", err)
+		return
+	}
+	p.logger.Info("session throttled", "id", c.UID, "client", c.name, "rate", rate.String())
+	fmt.Fprintf(w, "throttling %s to %s\n", c.UID, rate.String())
+}
+
+// statsUnthrottle answers "unthrottle <id>" on the stats port
+func (p *Proxy) statsUnthrottle(w io.Writer, args []string) {
+	if len(args) != 1 {
+		fmt.Fprintln(w, "error: usage: unthrottle <id>")
+		return
+	}
+	c := p.findLive(args[0])
+	if c == nil {
+		fmt.Fprintf(w, "error: no session %q\n", args[0])
+		return
+	}
+	c.throttle(0)
+	p.logger.Info("session unthrottled", "id", c.UID, "client", c.name)
+	fmt.Fprintf(w, "not throttling %s\n", c.UID)
+}
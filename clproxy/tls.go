@@ -0,0 +1,227 @@
+package clproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type tlsSettings struct {
+	// When both are set clients connect to us over TLS, and the decrypted stream
+	// is proxied to the backend as before
+	tlsCert string
+	tlsKey  string
+
+	// How long a client has to complete the TLS handshake. The handshake happens
+	// before the client queues for a slot, so a client which never finishes it
+	// only ever holds its own goroutine and socket. The same limit applies to
+	// handshakes with backends.
+	tlsHandshakeTimeout time.Duration
+
+	// When -backend-tls is set we speak TLS to the backends, whatever the clients
+	// speak to us
+	backendTLS           bool
+	backendTLSCA         string
+	backendTLSServerName string
+	backendTLSInsecure   bool
+}
+
+type tlsState struct {
+	tlsConfig *tls.Config
+
+	// The -tls-cert keypair being served. It is loaded again on SIGHUP and
+	// whenever either file changes; a keypair which doesn't load is logged and
+	// the old one kept, so a botched rotation never breaks the listener.
+	tlsKeypair atomic.Pointer[tls.Certificate]
+
+	// The files as they were when last loaded, guarded by tlsKeypairLock
+	tlsKeypairLock sync.Mutex
+	tlsCertInfo    os.FileInfo
+	tlsKeyInfo     os.FileInfo
+
+	tlsHandshakeFailures atomic.Uint64
+
+	backendTLSConfig *tls.Config
+}
+
+// How often to look for changes to -tls-cert and -tls-key
+const tlsKeypairPoll = 2 * time.Second
+
+// backendTLSError marks a failure in the TLS handshake with a backend, as
+// opposed to one making the TCP connection
+type backendTLSError struct {
+	err error
+}
+
+func (e *backendTLSError) Error() string { return "backend tls handshake: " + e.err.Error() }
+func (e *backendTLSError) Unwrap() error { return e.err }
+
+func (p *Proxy) setupTLS() error {
+	if err := p.loadKeypair(); err != nil {
+		return err
+	}
+	p.tlsConfig = &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return p.tlsKeypair.Load(), nil
+		},
+	}
+	p.onReload = append(p.onReload, func() { p.reloadKeypair(true) })
+	p.background = append(p.background, p.watchKeypair)
+	if p.tlsClientCA != "" {
+		return p.setupClientAuth(p.tlsConfig)
+	}
+	return nil
+}
+
+// loadKeypair reads -tls-cert and -tls-key and serves them from now on
+func (p *Proxy) loadKeypair() error {
+	p.tlsKeypairLock.Lock()
+	defer p.tlsKeypairLock.Unlock()
+	// Stat first, so that a change made while we read is seen next time
+	p.tlsCertInfo, _ = os.Stat(p.tlsCert)
+	p.tlsKeyInfo, _ = os.Stat(p.tlsKey)
+	cert, err := tls.LoadX509KeyPair(p.tlsCert, p.tlsKey)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return err
+		}
+	}
+	p.tlsKeypair.Store(&cert)
+	return nil
+}
+
+// keypairChanged reports whether either file has changed since it was last
+// loaded. A file which can't be seen, perhaps mid-rotation, hasn't.
+func (p *Proxy) keypairChanged() bool {
+	p.tlsKeypairLock.Lock()
+	defer p.tlsKeypairLock.Unlock()
+	changed := func(name string, old os.FileInfo) bool {
+		fi, err := os.Stat(name)
+		return err == nil && (old == nil || !fi.ModTime().Equal(old.ModTime()) || fi.Size() != old.Size())
+	}
+	return changed(p.tlsCert, p.tlsCertInfo) || changed(p.tlsKey, p.tlsKeyInfo)
+}
+
+// reloadKeypair loads the keypair again, if forced or if it has changed,
+// logging the outcome. Handshakes already under way finish with the old one.
+func (p *Proxy) reloadKeypair(force bool) {
+	if !force && !p.keypairChanged() {
+		return
+	}
+	if err := p.loadKeypair(); err != nil {
+		p.logger.Error("tls certificate reload failed, keeping the old one", "cert", p.tlsCert, "key", p.tlsKey, "error", err.Error())
+		return
+	}
+	leaf := p.tlsKeypair.Load().Leaf
+	p.logger.Info("tls certificate loaded", "cert", p.tlsCert, "subject", certIdentity(leaf), "expires", leaf.NotAfter.Format(time.RFC3339))
+}
+
+func (p *Proxy) watchKeypair() {
+	for range p.ticks(tlsKeypairPoll) {
+		p.reloadKeypair(false)
+	}
+}
+
+func (p *Proxy) setupBackendTLS() error {
+	p.backendTLSConfig = &tls.Config{
+		ServerName:         p.backendTLSServerName,
+		InsecureSkipVerify: p.backendTLSInsecure,
+	}
+	if p.backendTLSCA != "" {
+		pem, err := os.ReadFile(p.backendTLSCA)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", p.backendTLSCA)
+		}
+		p.backendTLSConfig.RootCAs = pool
+	}
+	return nil
+}
+
+// backendHandshake runs the TLS handshake over a fresh connection to b. Unless
+// -backend-tls-servername says otherwise the certificate is checked against
+// the name b was configured with.
+func (p *Proxy) backendHandshake(ctx context.Context, conn net.Conn, b *backend, timeout time.Duration) (net.Conn, error) {
+	cfg := p.backendTLSConfig
+	if cfg.ServerName == "" {
+		if host, _, err := net.SplitHostPort(b.spec); err == nil {
+			cfg = cfg.Clone()
+			cfg.ServerName = host
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	tc := tls.Client(conn, cfg)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, &backendTLSError{err}
+	}
+	if err := p.checkPins(tc.ConnectionState()); err != nil {
+		p.logger.Warn("backend tls pin mismatch", "backend", b.addr, "error", err.Error())
+		conn.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+// handshake completes the TLS handshake with a client when TLS is enabled,
+// returning the decrypted connection and the identity of the client's
+// verified certificate if it gave one, and with -log-ja3 its ClientHello.
+// Failures are logged and counted here; the caller just closes the
+// connection.
+func (p *Proxy) handshake(conn net.Conn, timeout time.Duration) (_ net.Conn, cert string, hello *clientHello, ok bool) {
+	if p.tlsConfig == nil {
+		return conn, "", nil, true
+	}
+	tlsConn := conn
+	if p.logJA3 {
+		// The handshake would read the hello first anyway. If it isn't one
+		// the handshake fails over the same bytes.
+		var peeked []byte
+		hello, peeked, _ = p.peekSNI(conn, timeout)
+		tlsConn = replay(conn, peeked)
+	}
+	tc := tls.Server(tlsConn, p.tlsConfig)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := tc.HandshakeContext(ctx); err != nil {
+		p.tlsHandshakeFailures.Add(1)
+		if !p.logRejection(p.remoteName(conn), conn, "tls_handshake", "error", err.Error()) {
+			p.logger.Warn("tls handshake failed", "client", p.remoteName(conn), "local", conn.LocalAddr().String(), "error", err.Error())
+		}
+		p.strike(conn, "tls_handshake")
+		return conn, "", nil, false
+	}
+	if p.isACMEChallenge(tc) {
+		p.logger.Debug("acme challenge answered", "client", p.remoteName(conn))
+		return conn, "", nil, false
+	}
+	if peers := tc.ConnectionState().PeerCertificates; len(peers) > 0 {
+		cert = certIdentity(peers[0])
+	}
+	return tc, cert, hello, true
+}
+
+// statsTLS adds the handshake failure count to the stats summary when TLS is
+// enabled, and the pin mismatch count when backend pinning is
+func (p *Proxy) statsTLS(w io.Writer) {
+	if p.tlsConfig != nil {
+		fmt.Fprintf(w, "tls_handshake_failures: %d\n", p.tlsHandshakeFailures.Load())
+	}
+	if p.backendPins.Load() != nil {
+		fmt.Fprintf(w, "backend_tls_pin_mismatches: %d\n", p.backendPinMismatches.Load())
+	}
+}
@@ -0,0 +1,66 @@
+package clproxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"strings"
+)
+
+type tlsInfoSettings struct {
+	// With -log-tls-info the first bytes each client sends are inspected as they
+	// are forwarded, and if they are a TLS ClientHello its server name, ALPN
+	// protocols, and highest version are added to the connection's log line.
+	// The bytes are never held back or changed, and a client which doesn't
+	// speak TLS just gets no TLS fields.
+	logTLSInfo bool
+}
+
+// helloSniffer is the io.Writer the client's data is teed into while we look
+// for a ClientHello. It gives up once the hello is found, once the data
+// can't be one, or after maxClientHello bytes.
+type helloSniffer struct {
+	c    *client
+	buf  []byte
+	done bool
+}
+
+func (s *helloSniffer) Write(p []byte) (int, error) {
+	if s.done {
+		return len(p), nil
+	}
+	s.buf = append(s.buf, p...)
+	hello, err := s.c.p.readHello(bytes.NewReader(s.buf))
+	switch {
+	case err == nil:
+		s.c.hello = hello
+		s.c.trace("tls_info", "sni", hello.sni)
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		if len(s.buf) <= maxClientHello {
+			// Wait for the rest
+			return len(p), nil
+		}
+	}
+	s.done, s.buf = true, nil
+	return len(p), nil
+}
+
+// tlsInfoArgs returns the log fields describing c's ClientHello, if we saw
+// one
+func (c *client) tlsInfoArgs() []any {
+	if c.hello == nil {
+		return nil
+	}
+	var args []any
+	if c.p.logTLSInfo {
+		args = append(args,
+			"tls_sni", c.hello.sni,
+			"tls_alpn", strings.Join(c.hello.alpn, ","),
+			"tls_version", tls.VersionName(c.hello.version))
+	}
+	if c.p.logJA3 {
+		args = append(args, "tls_ja3", c.hello.ja3)
+	}
+	return args
+}
@@ -0,0 +1,138 @@
+package clproxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type traceSettings struct {
+	// Trace every connection, not just those from addresses given to the trace
+	// stats command
+	traceAll bool
+}
+
+type traceState struct {
+	// Client IPs to trace, managed through the stats port. tracedCount lets
+	// connections skip the lock entirely when nothing is being traced.
+	traced      map[string]bool
+	tracedLock  sync.RWMutex
+	tracedCount atomic.Int64
+}
+
+// shouldTrace decides, once per connection, whether to trace it
+func (p *Proxy) shouldTrace(conn net.Conn) bool {
+	if p.traceAll {
+		return true
+	}
+	if p.tracedCount.Load() == 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return false
+	}
+	p.tracedLock.RLock()
+	defer p.tracedLock.RUnlock()
+	return p.traced[host]
+}
+
+// trace logs a step in the life of a traced connection at debug level. The
+// tracing check is the only cost for connections which aren't traced.
+func (c *client) trace(event string, args ...any) {
+	if !c.tracing {
+		return
+	}
+	c.p.logger.Debug("trace", append([]any{
+		"id", c.UID,
+		"client", c.name,
+		"event", event,
+		"since", time.Since(c.start).Seconds(),
+	}, args...)...)
+}
+
+// firstByteReader calls fn the first time any data is read through it. It is
+// only ever put in the copy path of traced connections.
+type firstByteReader struct {
+	r    io.Reader
+	fn   func()
+	seen bool
+}
+
+func (f *firstByteReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if n > 0 && !f.seen {
+		f.seen = true
+		f.fn()
+	}
+	return n, err
+}
+
+// statsTrace answers "trace [ip]" on the stats port. With no address it lists
+// the addresses being traced.
+func (p *Proxy) statsTrace(w io.Writer, args []string) {
+	if len(args) == 0 {
+		p.tracedLock.RLock()
+		ips := make([]string, 0, len(p.traced))
+		for ip := range p.traced {
+			ips = append(ips, ip)
+		}
+		p.tracedLock.RUnlock()
+		sort.Strings(ips)
+		for _, ip := range ips {
+			fmt.Fprintln(w, ip)
+		}
+		return
+	}
+	ip := net.ParseIP(args[0])
+	if ip == nil {
+		fmt.Fprintf(w, "error: invalid address %q\n", args[0])
+		return
+	}
+	p.tracedLock.Lock()
+	if !p.traced[ip.String()] {
+		p.traced[ip.String()] = true
+		p.tracedCount.Add(1)
+	}
+	p.tracedLock.Unlock()
+	p.logger.Info("tracing enabled", "ip", ip.String())
+	fmt.Fprintf(w, "tracing %s\n", ip)
+}
+
+// statsUntrace answers "untrace <ip>" on the stats port
+func (p *Proxy) statsUntrace(w io.Writer, args []string) {
+	if len(args) != 1 {
+		fmt.Fprintln(w, "error: usage: untrace <ip>")
+		return
+	}
+	ip := net.ParseIP(args[0])
+	if ip == nil {
+		fmt.Fprintf(w, "error: invalid address %q\n", args[0])
+		return
+	}
+	p.tracedLock.Lock()
+	if p.traced[ip.String()] {
+		delete(p.traced, ip.String())
+		p.tracedCount.Add(-1)
+	}
+	p.tracedLock.Unlock()
+	p.logger.Info("tracing disabled", "ip", ip.String())
+	fmt.Fprintf(w, "not tracing %s\n", ip)
+}
+
+// statsLogLevel answers "loglevel [level]" on the stats port. Trace output is
+// logged at debug, so this lets it be seen without a restart.
+func (p *Proxy) statsLogLevel(w io.Writer, args []string) {
+	if len(args) > 0 {
+		if err := p.logLevel.UnmarshalText([]byte(args[0])); err != nil {
+			fmt.Fprintf(w, "error: invalid level %q\n", args[0])
+			return
+		}
+		p.logger.Info("log level changed", "level", p.logLevel.Level().String())
+	}
+	fmt.Fprintln(w, p.logLevel.Level().String())
+}
@@ -0,0 +1,33 @@
+package clproxy
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// Not in package syscall
+const ipv6Transparent = 75
+
+// transparentControl marks a backend socket IP_TRANSPARENT before it is bound
+// to the client's address, so the kernel lets us use an address which isn't
+// ours
+func transparentControl(network, address string, raw syscall.RawConn) error {
+	var err error
+	cerr := raw.Control(func(fd uintptr) {
+		if network == "tcp6" {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+		} else {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+		}
+	})
+	if cerr != nil {
+		return cerr
+	}
+	if errors.Is(err, syscall.EPERM) {
+		return fmt.Errorf("setting IP_TRANSPARENT for -transparent needs CAP_NET_ADMIN: %w", err)
+	}
+	return err
+}
+
+func checkTransparent() error { return nil }
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package clproxy
+
+import (
+	"errors"
+	"syscall"
+)
+
+func transparentControl(network, address string, raw syscall.RawConn) error {
+	return checkTransparent()
+}
+
+func checkTransparent() error {
+	return errors.New("-transparent is only supported on Linux")
+}
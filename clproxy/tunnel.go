@@ -0,0 +1,275 @@
+package clproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+type tunnelSettings struct {
+	// Tunnel mode carries sessions between two instances over one long lived
+	// connection, multiplexed with yamux, for links where making a connection
+	// per session is expensive. The near instance runs with -tunnel-client
+	// pointing at the far one's -tunnel-server address: its sessions are queued
+	// and logged as usual but open a stream over the tunnel instead of dialing a
+	// backend. The far instance takes each stream as a client of its first route,
+	// so it queues, balances, and logs them like any other, and dials the real
+	// backend locally. Each stream starts with a header line carrying the near
+	// end's connection id and client address, so that both ends log the same
+	// tunnel_id and the far end logs the real client.
+	tunnelClient string
+	tunnelServer string
+
+	// With -tunnel-tls the near end speaks TLS to the far end, which then needs
+	// -tls-cert and -tls-key. The far end's certificate is verified against the
+	// system roots or -tunnel-tls-ca.
+	tunnelTLS   bool
+	tunnelTLSCA string
+}
+
+type tunnelState struct {
+	// The near end's tunnel, nil while it is down
+	tunnel atomic.Pointer[yamux.Session]
+
+	tunnelTLSConfig *tls.Config
+
+	tunnelReconnects atomic.Uint64
+	tunnelSessions   atomic.Uint64
+}
+
+const tunnelHeader = "CLPROXY-TUNNEL"
+
+// How long to wait between attempts to bring the tunnel up, doubling from the
+// first to the last while it stays down
+const tunnelMinBackoff = 500 * time.Millisecond
+const tunnelMaxBackoff = 30 * time.Second
+
+// How long the far end waits for a stream's header
+const tunnelHeaderTimeout = 10 * time.Second
+
+var errTunnelDown = errors.New("tunnel is down")
+
+func tunnelConfig() *yamux.Config {
+	cfg := yamux.DefaultConfig()
+	cfg.LogOutput = io.Discard
+	cfg.StreamOpenTimeout = 10 * time.Second
+	return cfg
+}
+
+// setupTunnel checks the tunnel flags and starts the near end's connection
+// loop
+func (p *Proxy) setupTunnel() error {
+	if p.tunnelClient == "" {
+		if p.tunnelTLS {
+			return errors.New("-tunnel-tls needs -tunnel-client")
+		}
+		return nil
+	}
+	if p.tunnelServer != "" {
+		return errors.New("-tunnel-client and -tunnel-server can't be used together")
+	}
+	if p.tunnelTLS {
+		host, _, err := net.SplitHostPort(p.tunnelClient)
+		if err != nil {
+			return err
+		}
+		p.tunnelTLSConfig = &tls.Config{ServerName: host}
+		if p.tunnelTLSCA != "" {
+			pem, err := os.ReadFile(p.tunnelTLSCA)
+			if err != nil {
+				return err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return fmt.Errorf("no certificates found in %s", p.tunnelTLSCA)
+			}
+			p.tunnelTLSConfig.RootCAs = pool
+		}
+	}
+	p.background = append(p.background, p.maintainTunnel)
+	return nil
+}
+
+// maintainTunnel keeps the near end's tunnel up until Shutdown, reconnecting
+// with backoff whenever it drops. Streams open when it drops fail.
+func (p *Proxy) maintainTunnel() {
+	backoff := tunnelMinBackoff
+	for {
+		sess, err := p.dialTunnel()
+		if err != nil {
+			p.logger.Warn("tunnel connect failed", "address", p.tunnelClient, "error", err.Error(), "retry", backoff.String())
+			if !p.sleep(backoff) {
+				return
+			}
+			backoff = min(backoff*2, tunnelMaxBackoff)
+			continue
+		}
+		backoff = tunnelMinBackoff
+		p.tunnel.Store(sess)
+		p.logger.Info("tunnel up", "address", p.tunnelClient)
+		select {
+		case <-sess.CloseChan():
+		case <-p.done:
+			// Left up for the sessions still on it
+			return
+		}
+		p.tunnel.Store(nil)
+		p.tunnelReconnects.Add(1)
+		p.logger.Warn("tunnel down", "address", p.tunnelClient)
+	}
+}
+
+func (p *Proxy) dialTunnel() (*yamux.Session, error) {
+	d := p.newDialer()
+	d.Timeout = tunnelHeaderTimeout
+	conn, err := d.Dial("tcp", p.tunnelClient)
+	if err != nil {
+		return nil, err
+	}
+	if p.tunnelTLSConfig != nil {
+		tc := tls.Client(conn, p.tunnelTLSConfig)
+		tc.SetDeadline(time.Now().Add(p.tlsHandshakeTimeout))
+		if err := tc.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tc.SetDeadline(time.Time{})
+		conn = tc
+	}
+	sess, err := yamux.Client(conn, tunnelConfig())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return sess, nil
+}
+
+// tunnelDial opens a stream for c over the tunnel in place of dialing b
+func (c *client) tunnelDial(b *backend) dialResult {
+	start := time.Now()
+	sess := c.p.tunnel.Load()
+	if sess == nil {
+		return dialResult{backend: b, err: errTunnelDown}
+	}
+	stream, err := sess.OpenStream()
+	if err == nil {
+		_, err = fmt.Fprintf(stream, "%s %s %s\n", tunnelHeader, c.UID, c.name)
+		if err != nil {
+			stream.Close()
+		}
+	}
+	if err != nil {
+		return dialResult{backend: b, err: fmt.Errorf("tunnel: %w", err), took: time.Since(start)}
+	}
+	return dialResult{backend: b, conn: stream, took: time.Since(start)}
+}
+
+// endTunnelStream passes the client's EOF on to the far end when conn is a
+// tunnel stream, whose Close only ends our side of it. The far end can't
+// otherwise tell that the client is done, and would wait on it forever.
+func endTunnelStream(conn net.Conn) {
+	if s, ok := conn.(*yamux.Stream); ok {
+		s.Close()
+	}
+}
+
+// serveTunnels accepts tunnels at the far end until Shutdown. The caller has
+// bound ln.
+func (p *Proxy) serveTunnels(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			p.abort("net.Listener.Accept error", "address", p.tunnelServer, "error", err.Error())
+			return
+		}
+		go p.serveTunnel(conn)
+	}
+}
+
+// serveTunnel handles each stream of one tunnel as a client connection
+func (p *Proxy) serveTunnel(conn net.Conn) {
+	peer := conn.RemoteAddr().String()
+	conn, _, _, ok := p.handshake(conn, p.tlsHandshakeTimeout)
+	if !ok {
+		conn.Close()
+		return
+	}
+	sess, err := yamux.Server(conn, tunnelConfig())
+	if err != nil {
+		conn.Close()
+		return
+	}
+	p.tunnelSessions.Add(1)
+	p.logger.Info("tunnel accepted", "peer", peer)
+	for {
+		stream, err := sess.Accept()
+		if err != nil {
+			p.logger.Info("tunnel closed", "peer", peer, "error", err.Error())
+			sess.Close()
+			return
+		}
+		go p.serveTunnelStream(stream, peer)
+	}
+}
+
+func (p *Proxy) serveTunnelStream(stream net.Conn, peer string) {
+	stream.SetReadDeadline(time.Now().Add(tunnelHeaderTimeout))
+	br := bufio.NewReader(stream)
+	line, err := br.ReadString('\n')
+	stream.SetReadDeadline(time.Time{})
+	// The client address comes last, as it may have spaces in it
+	fields := strings.SplitN(strings.TrimRight(line, "\r\n"), " ", 3)
+	if err != nil || len(fields) != 3 || fields[0] != tunnelHeader {
+		p.logger.Warn("tunnel stream rejected", "peer", peer, "error", "bad stream header")
+		stream.Close()
+		return
+	}
+	// The stream stands in for the near end's client
+	var src net.Addr = tunnelAddr(fields[2])
+	if ap, err := netip.ParseAddrPort(fields[2]); err == nil {
+		src = net.TCPAddrFromAddrPort(ap)
+	}
+	conn := &proxiedConn{
+		peekedConn: peekedConn{Conn: stream, r: br},
+		src:        src,
+		dst:        stream.LocalAddr(),
+	}
+	c := p.newClient(conn, "", "", p.allRoutes()[0])
+	c.tunnelID = fields[1]
+	c.mind()
+}
+
+// tunnelAddr is a client address we can't parse, such as a Unix socket
+// client's credentials
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string { return "tunnel" }
+func (a tunnelAddr) String() string  { return string(a) }
+
+// statsTunnel adds the tunnel's state to the stats summary
+func (p *Proxy) statsTunnel(w io.Writer) {
+	if p.tunnelClient != "" {
+		state, streams := "down", 0
+		if sess := p.tunnel.Load(); sess != nil {
+			state, streams = "up", sess.NumStreams()
+		}
+		fmt.Fprintf(w, "tunnel: state=%s streams=%d reconnects=%d\n", state, streams, p.tunnelReconnects.Load())
+	}
+	if p.tunnelServer != "" {
+		fmt.Fprintf(w, "tunnel_server: tunnels=%d\n", p.tunnelSessions.Load())
+	}
+}
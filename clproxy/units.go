@@ -0,0 +1,153 @@
+package clproxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ByteSize is a flag.Value for a number of bytes with an optional KB, MB, GB,
+// or TB suffix. Suffixes are powers of 1024.
+type ByteSize int64
+
+var sizeSuffixes = []struct {
+	suffix string
+	mult   int64
+}{
+	{"TB", 1 << 40},
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"T", 1 << 40},
+	{"G", 1 << 30},
+	{"M", 1 << 20},
+	{"K", 1 << 10},
+	{"B", 1},
+}
+
+func parseByteSize(s string) (int64, error) {
+	v := strings.ToUpper(strings.TrimSpace(s))
+	mult := int64(1)
+	for _, sfx := range sizeSuffixes {
+		if strings.HasSuffix(v, sfx.suffix) {
+			v = strings.TrimSpace(strings.TrimSuffix(v, sfx.suffix))
+			mult = sfx.mult
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+func (b *ByteSize) Set(s string) error {
+	n, err := parseByteSize(s)
+	if err != nil {
+		return err
+	}
+	*b = ByteSize(n)
+	return nil
+}
+
+func (b *ByteSize) String() string {
+	if b == nil {
+		return "0"
+	}
+	n := int64(*b)
+	for _, sfx := range sizeSuffixes[:4] {
+		if n != 0 && n%sfx.mult == 0 {
+			return strconv.FormatInt(n/sfx.mult, 10) + sfx.suffix
+		}
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// byteRate is a flag.Value for a rate in bytes a second: a ByteSize with an
+// optional /s, e.g. 5MB/s, or bits a second with a Kbit, Mbit, Gbit, or Tbit
+// suffix, which are powers of 1000 as is usual for links, e.g. 600Mbit
+type byteRate int64
+
+var bitSuffixes = []struct {
+	suffix string
+	mult   float64
+}{
+	{"tbit", 1e12},
+	{"gbit", 1e9},
+	{"mbit", 1e6},
+	{"kbit", 1e3},
+	{"bit", 1},
+}
+
+func (r *byteRate) Set(s string) error {
+	v := strings.TrimSpace(s)
+	if strings.HasSuffix(strings.ToLower(v), "/s") {
+		v = v[:len(v)-2]
+	}
+	for _, sfx := range bitSuffixes {
+		if num, ok := strings.CutSuffix(strings.ToLower(v), sfx.suffix); ok {
+			n, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid rate %q", s)
+			}
+			*r = byteRate(n * sfx.mult / 8)
+			return nil
+		}
+	}
+	n, err := parseByteSize(v)
+	if err != nil {
+		return fmt.Errorf("invalid rate %q", s)
+	}
+	*r = byteRate(n)
+	return nil
+}
+
+func (r *byteRate) String() string {
+	if r == nil || *r == 0 {
+		return "0"
+	}
+	b := ByteSize(*r)
+	return b.String() + "/s"
+}
+
+// fileMode is a flag.Value for file permissions given in octal, e.g. 0660
+type fileMode uint32
+
+func (m *fileMode) Set(s string) error {
+	n, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || n > 0777 {
+		return fmt.Errorf("invalid file mode %q", s)
+	}
+	*m = fileMode(n)
+	return nil
+}
+
+func (m *fileMode) String() string {
+	if m == nil {
+		return "0"
+	}
+	return fmt.Sprintf("%#o", uint32(*m))
+}
+
+// listFlag is a flag.Value for a comma separated list which may also be built
+// up by repeating the flag. The first use replaces the default.
+type listFlag struct {
+	p   *string
+	set bool
+}
+
+func (l *listFlag) Set(s string) error {
+	if l.set && *l.p != "" {
+		s = *l.p + "," + s
+	}
+	*l.p, l.set = s, true
+	return nil
+}
+
+func (l *listFlag) String() string {
+	if l == nil || l.p == nil {
+		return ""
+	}
+	return *l.p
+}
@@ -0,0 +1,109 @@
+package clproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+type unixSockSettings struct {
+	// Permissions, and optionally the group, given to Unix sockets we listen on
+	unixPerm  fileMode
+	unixGroup string
+}
+
+// listen binds addr, which is either a TCP address or unix:///path. A stale
+// socket file left behind by an earlier run is removed first, but one which
+// something is still listening on is left alone. Unix sockets are removed
+// again when we shut down.
+func (p *Proxy) listen(addr string) (net.Listener, error) {
+	return p.listenPerm(addr, p.unixPerm, p.unixGroup)
+}
+
+// listenPerm is listen giving a Unix socket perm and group instead of
+// -unix-perm and -unix-group
+func (p *Proxy) listenPerm(addr string, perm fileMode, group string) (net.Listener, error) {
+	network, path := DialAddr(addr)
+	if network != "unix" {
+		return p.listenConfig().Listen(context.Background(), network, path)
+	}
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+		p.logger.Info("removed stale socket", "path", path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	p.onShutdown = append(p.onShutdown, func() { os.Remove(path) })
+	if err := os.Chmod(path, os.FileMode(perm)); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	if group != "" {
+		gid, err := lookupGroup(group)
+		if err == nil {
+			err = os.Chown(path, -1, gid)
+		}
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+// listenConfig returns the config for our TCP listeners, offering MPTCP and
+// TCP Fast Open if they are on
+func (p *Proxy) listenConfig() *net.ListenConfig {
+	lc := &net.ListenConfig{}
+	if p.multipathTCP {
+		lc.SetMultipathTCP(true)
+	}
+	if p.tcpFastOpen {
+		lc.Control = p.tfoListenControl
+	}
+	return lc
+}
+
+// lookupGroup accepts either a group name or a numeric gid
+func lookupGroup(name string) (int, error) {
+	if gid, err := strconv.Atoi(name); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// remoteName is how a client is identified in the logs. Unix socket clients
+// have no address, so we use their credentials where the platform gives them
+// to us, or failing that the socket they came in on.
+func (p *Proxy) remoteName(conn net.Conn) string {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return conn.RemoteAddr().String()
+	}
+	if cred, err := peerCred(uc); err == nil {
+		return cred
+	} else if !errors.Is(err, syscall.ENOTSUP) {
+		p.logger.Debug("peer credentials unavailable", "error", err.Error())
+	}
+	return unixPrefix + conn.LocalAddr().String()
+}
@@ -0,0 +1,221 @@
+package clproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+type websocketSettings struct {
+	// Either leg of a session can be carried over a WebSocket, for networks where
+	// only HTTP(S) gets through. A listen address of ws://host:port/path (or
+	// wss:// to serve it over TLS with -tls-cert) takes sessions as WebSocket
+	// connections to that path, and a backend of ws:// or wss:// URL delivers
+	// them to a WebSocket server, such as another instance listening that way.
+	// The byte stream is carried in binary messages, unchanged, and pings every
+	// -ws-ping-interval keep idle sessions from being cut off by proxies in
+	// between. Either side closing is a WebSocket close, which the other side
+	// reads as EOF, just as it would a TCP close.
+	wsPingInterval time.Duration
+}
+
+const (
+	wsPrefix  = "ws://"
+	wssPrefix = "wss://"
+)
+
+// How long a ping may go unanswered before the connection is given up on
+const wsPingTimeout = 15 * time.Second
+
+// isWebSocketURL reports whether addr is a ws:// or wss:// address
+func isWebSocketURL(addr string) bool {
+	return strings.HasPrefix(addr, wsPrefix) || strings.HasPrefix(addr, wssPrefix)
+}
+
+// wsConn is one WebSocket carrying a session, seen as a net.Conn
+type wsConn struct {
+	net.Conn
+	local, remote net.Addr
+	cert          string // the client's TLS certificate identity, for wss://
+	cancel        context.CancelFunc
+}
+
+func (c *wsConn) LocalAddr() net.Addr  { return c.local }
+func (c *wsConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *wsConn) Close() error {
+	c.cancel()
+	return c.Conn.Close()
+}
+
+// newWSConn wraps ws as a net.Conn with the addresses of the connection it
+// runs over, pinging the other side every -ws-ping-interval until it is
+// closed
+func (p *Proxy) newWSConn(ws *websocket.Conn, local, remote net.Addr, cert string) *wsConn {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &wsConn{
+		Conn:   websocket.NetConn(ctx, ws, websocket.MessageBinary),
+		local:  local,
+		remote: remote,
+		cert:   cert,
+		cancel: cancel,
+	}
+	if p.wsPingInterval > 0 {
+		go func() {
+			t := time.NewTicker(p.wsPingInterval)
+			defer t.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-t.C:
+				}
+				pctx, pcancel := context.WithTimeout(ctx, wsPingTimeout)
+				err := ws.Ping(pctx)
+				pcancel()
+				if err != nil && ctx.Err() == nil {
+					ws.Close(websocket.StatusGoingAway, "ping timeout")
+					return
+				}
+			}
+		}()
+	}
+	return c
+}
+
+// wsListener accepts sessions arriving as WebSocket connections to one path,
+// serving HTTP on a TCP listener
+type wsListener struct {
+	net.Listener
+	p     *Proxy
+	path  string
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+	srv   *http.Server
+}
+
+// listenWebSocket serves WebSocket sessions for addr, a ws:// or wss://
+// URL, on ln
+func (p *Proxy) listenWebSocket(ln net.Listener, addr string) (*wsListener, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "wss" {
+		if p.tlsConfig == nil {
+			return nil, errors.New("wss:// needs -tls-cert and -tls-key or -acme-domains")
+		}
+		ln = tls.NewListener(ln, p.tlsConfig)
+	}
+	l := &wsListener{
+		p:        p,
+		Listener: ln,
+		path:     u.Path,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	if l.path == "" {
+		l.path = "/"
+	}
+	l.srv = &http.Server{
+		Handler:           l,
+		ReadHeaderTimeout: p.tlsHandshakeTimeout,
+		ErrorLog:          slog.NewLogLogger(p.logger.Handler(), slog.LevelDebug),
+	}
+	go l.srv.Serve(ln)
+	return l, nil
+}
+
+// ServeHTTP upgrades requests for our path and hands them to Accept
+func (l *wsListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != l.path {
+		http.NotFound(w, r)
+		return
+	}
+	// The peers are proxies and tunnel clients rather than browsers, so
+	// there are no cross-origin requests to guard against
+	ws, err := websocket.Accept(w, r, &websocket.AcceptOptions{InsecureSkipVerify: true})
+	if err != nil {
+		l.p.logger.Warn("websocket upgrade failed", "client", r.RemoteAddr, "error", err.Error())
+		return
+	}
+	local, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	var remote net.Addr = tunnelAddr(r.RemoteAddr)
+	if ap, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		remote = net.TCPAddrFromAddrPort(ap)
+	}
+	cert := ""
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		cert = certIdentity(r.TLS.PeerCertificates[0])
+	}
+	conn := l.p.newWSConn(ws, local, remote, cert)
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *wsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *wsListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return l.srv.Close()
+}
+
+// wsError is a WebSocket server refusing the upgrade
+type wsError struct {
+	status string
+	err    error
+}
+
+func (e *wsError) Error() string { return "websocket: " + e.status + ": " + e.err.Error() }
+func (e *wsError) Unwrap() error { return e.err }
+
+// wsDial connects to the WebSocket server at rawURL with d, through -socks5
+// or -http-proxy if set. wss:// is verified with the -backend-tls settings,
+// pins included, if -backend-tls is on.
+func (p *Proxy) wsDial(ctx context.Context, d *net.Dialer, rawURL string) (net.Conn, error) {
+	var raw net.Conn
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := p.dialTCP(ctx, d, addr)
+			raw = conn
+			return conn, err
+		},
+		DisableKeepAlives: true,
+	}
+	if p.backendTLSConfig != nil {
+		transport.TLSClientConfig = p.backendTLSConfig.Clone()
+		transport.TLSClientConfig.VerifyConnection = p.checkPins
+	}
+	ws, resp, err := websocket.Dial(ctx, rawURL, &websocket.DialOptions{
+		HTTPClient: &http.Client{Transport: transport},
+	})
+	if err != nil {
+		if resp != nil {
+			return nil, &wsError{status: resp.Status, err: err}
+		}
+		return nil, fmt.Errorf("websocket: %w", err)
+	}
+	return p.newWSConn(ws, raw.LocalAddr(), raw.RemoteAddr(), ""), nil
+}
@@ -1,211 +1,102 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
-	"log"
-	"net"
+	"os"
+	"os/signal"
 	"runtime"
-	"sync"
-	"time"
-)
-
-var listenOn = "127.0.0.1:8301"
-var proxyTo = "127.0.0.1:8300"
-var statsOn = "127.0.0.1:8299"
-
-var concurrency = 1
-
-var wCond = &sync.Cond{L: &sync.Mutex{}}
-var waiting = 0
-var active = 0
-var count uint64
-
-var concurrencyBucket chan struct{}
-
-type client struct {
-	ID   uint64
-	name string
-	conn net.Conn
-
-	server net.Conn
-	err    error
-
-	w sync.WaitGroup
-
-	didWait bool
-	start   time.Time
-	waited  time.Time
-	dialed  time.Time
-	done    time.Time
-}
-
-func (c *client) copyTo(conn net.Conn) {
-	io.Copy(conn, c.conn)
-	c.w.Done()
-}
+	"syscall"
 
-func (c *client) copyFrom(conn net.Conn) {
-	io.Copy(c.conn, conn)
-	c.w.Done()
-}
+	"github.com/apokalyptik/tcp-cl-proxy/clproxy"
+)
 
-func (c *client) copyAll() {
-	go c.copyTo(c.server)
-	go c.copyFrom(c.server)
-	// Wait for both copy operations to complete
-	c.w.Wait()
-	// Record when we finished. This way we won't report any of the post
-	// processing time that we took in the logs
-	c.done = time.Now()
-}
+// The command's options, on which a file of your own in package main may set
+// hooks, Balancers, or a DialFunc from its init, to build them into the
+// command
+var opts clproxy.Options
 
-func (c *client) doProxy() {
-	// Dial out to the real TCP service
-	c.server, c.err = net.Dial("tcp", proxyTo)
-	if c.err != nil {
-		c.logError()
-		return
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(replayMain(os.Args[2:]))
 	}
-	// If we ever get a connection we always need to close it.
-	c.dialed = time.Now()
-	c.copyAll()
-	c.logSuccess()
-}
-
-func (c *client) logError() {
-	now := time.Now()
-	log.Printf(
-		"client=%s num=%d status=error took=%f message=\"%s\"",
-		c.name,
-		c.ID,
-		now.Sub(c.start).Seconds(),
-		c.err.Error())
-}
-
-func (c *client) logSuccess() {
-	now := time.Now()
-	waited := 0.0
-	if c.didWait {
-		waited = c.waited.Sub(c.start).Seconds()
+	if len(os.Args) > 1 && (os.Args[1] == "selftest" || os.Args[1] == "-selftest") {
+		os.Exit(selftestMain(os.Args[2:]))
 	}
-	log.Printf(
-		"client=%s num=%d status=success took=%f wait=%f dial=%f copy=%f",
-		c.name,
-		c.ID,
-		now.Sub(c.start).Seconds(),
-		waited,
-		c.dialed.Sub(c.waited).Seconds(),
-		c.done.Sub(c.dialed).Seconds())
-}
-
-func (c *client) setup() {
-	c.w.Add(2)
-	// Lock our condition
-	wCond.L.Lock()
-	defer wCond.L.Unlock()
-	// Record that we're now in a wait state
-	count++
-	c.ID = count
-	waiting++
-	for active == concurrency {
-		// Wait unlocks the conditions lock when called, and re-locks it upon returning.
-		// Otherwise the entire program would deadlock here
-		c.didWait = true
-		wCond.Wait()
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		os.Exit(benchMain(os.Args[2:]))
 	}
-	c.waited = time.Now()
-	// Record that we're no longer waiting
-	waiting--
-	// Record that we're actively processing the connection now.
-	active++
-}
-
-func (c *client) teardown() {
-	c.conn.Close()
-	c.server.Close()
-	// Lock our condition to avoid races when updating the active variable
-	wCond.L.Lock()
-	// Record that we're no longer active
-	active--
-	// Unlock our cond
-	wCond.L.Unlock()
-	// Send a signal to exactly one goroutine waiting on the cond (unless none are waiting
-	// then this is effectively a no-op
-	wCond.Signal()
-}
-
-func (c *client) mind() {
-	c.setup()
-	c.doProxy()
-	c.teardown()
-}
-
-func handleClient(conn net.Conn) {
-	c := &client{
-		name:  conn.RemoteAddr().String(),
-		conn:  conn,
-		start: time.Now(),
+	if len(os.Args) > 1 && os.Args[1] == "stats" {
+		os.Exit(statsMain(os.Args[2:]))
 	}
-	c.mind()
-}
-
-func server() {
-	// Bind our listening TCP socket
-	ln, err := net.Listen("tcp", listenOn)
-	if err != nil {
-		log.Fatal("net.Listen error: " + err.Error())
+	opts.RegisterFlags(flag.CommandLine)
+	// With -t we check the configuration as if starting up, the flags, any
+	// -config, and every file they name, say "configuration OK", and exit,
+	// without listening, health checking, or starting anything else, so that
+	// deployment tooling can check a change before reloading the live process.
+	// Problems are reported as they would be at startup, and the exit status is
+	// the same.
+	testConfig := flag.Bool("t", false, "Check the configuration and every file it names, without listening or connecting anywhere, print configuration OK, and exit")
+	// With -print-config we describe the configuration we would run with and exit
+	printConfig := flag.Bool("print-config", false, "Print the configuration, from flags, CLPROXY_* environment variables, and -config, and exit")
+	flag.Parse()
+	if err := opts.ApplyEnv(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
-	// Setup our accept loop
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			// I'm not exactly sure what could go wrong here but whatever it is
-			// is probably bad...
-			log.Fatal("net.Listener.Accept error: " + err.Error())
+	if *printConfig {
+		if err := opts.PrintConfig(os.Stdout); err != nil {
+			exit(err)
 		}
-		// Send our connection to be proxied in a new goroutine.
-		go handleClient(conn)
+		os.Exit(0)
 	}
-}
-
-func stats() {
-	// Setup our listener. If we fail to do so we bail out before launching a goroutine.
-	// to prevent races where the server is listening to clients (real clients) an but
-	// will fatal unexpectedly while serving them because of this.
-	ln, err := net.Listen("tcp", statsOn)
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	p, err := clproxy.New(opts)
 	if err != nil {
-		log.Fatal("net.Listen error: " + err.Error())
+		exit(err)
 	}
-	go func(ln net.Listener) {
-		// Accept clients in a loop
-		for {
-			conn, err := ln.Accept()
-			if err != nil {
-				log.Fatal("net.Listener.Accept error: " + err.Error())
+	if *testConfig {
+		if err := p.Check(); err != nil {
+			exit(err)
+		}
+		fmt.Println("configuration OK")
+		os.Exit(0)
+	}
+	if err := p.Start(context.Background()); err != nil {
+		exit(err)
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP, os.Interrupt, syscall.SIGTERM)
+	for {
+		select {
+		case s := <-sig:
+			if s == syscall.SIGHUP {
+				p.Reload()
+				p.Logger().Info("reloaded", "signal", "SIGHUP")
+				continue
 			}
-			// Launch the handler for the client connection in a goroutine, to get back
-			// to our loop quickly
-			go func(c net.Conn) {
-				// Spit out our stats and close the connection
-				defer c.Close()
-				fmt.Fprintf(c, "active: %d, waiting: %d\n", active, waiting)
-			}(conn)
+			// Sessions are cut off rather than waited for, as they always
+			// have been
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			p.Shutdown(ctx)
+			p.Logger().Info("shutting down", "signal", s.String())
+			os.Exit(0)
+		case <-p.Failed():
+			os.Exit(1)
 		}
-	}(ln)
-}
-
-func init() {
-	flag.StringVar(&listenOn, "l", listenOn, "Listen for TCP connections at this address")
-	flag.StringVar(&proxyTo, "p", proxyTo, "Proxy connected clients to this address")
-	flag.StringVar(&statsOn, "s", statsOn, "Give stats to clients connecting to this address")
-	flag.IntVar(&concurrency, "c", concurrency, "Number of active connections allowed to proxy address at a given time")
+	}
 }
 
-func main() {
-	flag.Parse()
-	runtime.GOMAXPROCS(runtime.NumCPU())
-	stats()
-	server()
+// exit exits with the status err calls for, saying why unless it has been
+// logged already
+func exit(err error) {
+	var e *clproxy.Error
+	if errors.As(err, &e) && e.Status == 1 {
+		os.Exit(1)
+	}
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(2)
 }
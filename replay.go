@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/apokalyptik/tcp-cl-proxy/clproxy"
+)
+
+// "clproxy replay" plays sessions recorded by capture back against a
+// backend, e.g. a new build of it, and reports how what it sent back
+// compares with what was recorded:
+//
+//	clproxy replay -target 10.0.0.9:8300 -dir capture/session-1234/
+//
+// -dir is one session's directory or a directory of them. Each session's
+// client.bin is written to the target with the recorded timing, scaled by
+// -speed (0 writes it as fast as possible), and what comes back is counted
+// until the target closes or goes quiet for -wait. A session passes when it
+// got back the recorded number of bytes, give or take -tolerance, or at
+// least as many when the recording was cut short. Up to -c sessions are
+// replayed at once, waiting their turn in a route's limiter as the proxy's
+// clients do. Every session gets a line on stdout, followed by a summary,
+// and the exit status is 0 only if they all passed, so it can gate a CI job.
+
+// replayResult is how one session's replay went
+type replayResult struct {
+	dir      string
+	sent     int64
+	received int64
+	recorded int64
+	took     time.Duration
+	err      error
+	ok       bool
+}
+
+// replayMain runs the replay subcommand and returns the exit status
+func replayMain(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	target := fs.String("target", "", "Replay the sessions against this address (host:port or unix:///path)")
+	dir := fs.String("dir", "", "A session directory written by capture, or a directory of them")
+	speed := fs.Float64("speed", 1, "Replay at this multiple of the recorded speed, e.g. 2 for twice as fast (0 is as fast as possible)")
+	c := fs.Int("c", 1, "Sessions to replay at once")
+	wait := fs.Duration("wait", 2*time.Second, "Stop reading a session's replies once the target has sent nothing for this long after the last write")
+	timeout := fs.Duration("timeout", 5*time.Second, "How long to wait for a connection to the target")
+	tolerance := fs.Float64("tolerance", 0, "Fraction by which the bytes sent back may differ from the recording and still pass")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *target == "" || *dir == "" || fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "usage: replay -target host:port -dir capture/session-id/ [flags]")
+		return 2
+	}
+	if *speed < 0 || *c <= 0 || *tolerance < 0 {
+		fmt.Fprintln(os.Stderr, "-speed and -tolerance can't be negative, and -c must be positive")
+		return 2
+	}
+	dirs, err := replayDirs(*dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	// Holds a token for each session being replayed
+	running := make(chan struct{}, *c)
+	r := &replayer{target: *target, speed: *speed, wait: *wait, timeout: *timeout, tolerance: *tolerance}
+	start := time.Now()
+	results := make([]replayResult, len(dirs))
+	var wg sync.WaitGroup
+	for i, d := range dirs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			running <- struct{}{}
+			defer func() { <-running }()
+			results[i] = r.replay(d)
+		}()
+	}
+	wg.Wait()
+	passed, failed, mismatched := 0, 0, 0
+	for _, res := range results {
+		fmt.Printf("session=%s sent=%d received=%d recorded=%d took=%f ", res.dir, res.sent, res.received, res.recorded, res.took.Seconds())
+		switch {
+		case res.err != nil:
+			failed++
+			fmt.Printf("status=error error=%q\n", res.err.Error())
+		case !res.ok:
+			mismatched++
+			fmt.Println("status=mismatch")
+		default:
+			passed++
+			fmt.Println("status=ok")
+		}
+	}
+	fmt.Printf("replayed=%d ok=%d mismatch=%d error=%d took=%f\n", len(results), passed, mismatched, failed, time.Since(start).Seconds())
+	if passed < len(results) {
+		return 1
+	}
+	return 0
+}
+
+// replayDirs returns the session directories under dir, which may be one
+func replayDirs(dir string) ([]string, error) {
+	if _, err := os.Stat(filepath.Join(dir, "session.json")); err == nil {
+		return []string{dir}, nil
+	}
+	found, err := filepath.Glob(filepath.Join(dir, "*", "session.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("no captured sessions in %s", dir)
+	}
+	dirs := make([]string, len(found))
+	for i, f := range found {
+		dirs[i] = filepath.Dir(f)
+	}
+	sort.Strings(dirs)
+	return dirs, nil
+}
+
+type replayer struct {
+	target    string
+	speed     float64
+	wait      time.Duration
+	timeout   time.Duration
+	tolerance float64
+}
+
+// replay plays one session back
+func (r *replayer) replay(dir string) (res replayResult) {
+	res.dir = dir
+	start := time.Now()
+	defer func() { res.took = time.Since(start) }()
+	var side clproxy.CaptureSession
+	b, err := os.ReadFile(filepath.Join(dir, "session.json"))
+	if err == nil {
+		err = json.Unmarshal(b, &side)
+	}
+	if err != nil {
+		res.err = err
+		return
+	}
+	res.recorded = side.BackendBytes
+	data, err := os.ReadFile(filepath.Join(dir, "client.bin"))
+	if err != nil {
+		res.err = err
+		return
+	}
+	network, address := clproxy.DialAddr(r.target)
+	conn, err := net.DialTimeout(network, address, r.timeout)
+	if err != nil {
+		res.err = err
+		return
+	}
+	defer conn.Close()
+	received := make(chan int64, 1)
+	sent := make(chan struct{})
+	go func() {
+		received <- r.drain(conn, sent)
+	}()
+	res.sent, err = r.send(conn, data, side.ClientReads)
+	close(sent)
+	res.received = <-received
+	if err != nil {
+		res.err = err
+		return
+	}
+	switch {
+	case side.Truncated:
+		res.ok = res.received >= res.recorded
+	default:
+		diff := float64(res.received - res.recorded)
+		res.ok = max(diff, -diff) <= r.tolerance*float64(res.recorded)
+	}
+	return
+}
+
+// send writes data to conn as the client's recorded reads did, returning
+// how much it wrote
+func (r *replayer) send(conn net.Conn, data []byte, reads [][2]float64) (int64, error) {
+	start := time.Now()
+	var sent int64
+	for _, rd := range reads {
+		if r.speed > 0 {
+			at := time.Duration(rd[0] / r.speed * float64(time.Second))
+			time.Sleep(time.Until(start.Add(at)))
+		}
+		n := min(int64(rd[1]), int64(len(data))-sent)
+		if _, err := conn.Write(data[sent : sent+n]); err != nil {
+			return sent, err
+		}
+		sent += n
+	}
+	// Anything the reads don't account for goes last
+	if sent < int64(len(data)) {
+		if _, err := conn.Write(data[sent:]); err != nil {
+			return sent, err
+		}
+		sent = int64(len(data))
+	}
+	return sent, nil
+}
+
+// drain counts what the target sends until it closes, or until it has
+// been quiet for r.wait after sent is closed
+func (r *replayer) drain(conn net.Conn, sent chan struct{}) int64 {
+	buf := make([]byte, 32<<10)
+	var n int64
+	for {
+		finished := false
+		select {
+		case <-sent:
+			finished = true
+		default:
+		}
+		conn.SetReadDeadline(time.Now().Add(r.wait))
+		m, err := conn.Read(buf)
+		n += int64(m)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() && !finished {
+			continue
+		}
+		if err != nil {
+			return n
+		}
+	}
+}
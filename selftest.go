@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apokalyptik/tcp-cl-proxy/clproxy"
+)
+
+// "clproxy selftest [flags]" checks that the proxy works, as built and with
+// the flags given, without a backend of its own: it starts an echo backend
+// in process, runs a copy of itself pointed at it with the flags plus -l,
+// -p, and -s on free local ports, and runs some scenarios through it:
+//
+//	clproxy selftest -c 4 -max-rate-per-conn 10MB/s
+//
+// Each scenario gets a line on stdout, ok or FAIL with why, and the proxy's
+// log is printed if any failed. The exit status is 0 only if they all
+// passed, so it can serve as an install time smoke test or in CI.
+//
+// The backend reads an 8 byte big-endian count, echoes that many bytes, and
+// hangs up, so every session ends with the backend closing, as the proxy
+// doesn't pass on a client's half close.
+
+// How many bytes the large transfer sends, and how long a scenario may take
+const selftestLarge = 16 << 20
+const selftestTimeout = 2 * time.Minute
+
+// selftestPinned are the flags selftest sets itself
+var selftestPinned = []string{"l", "p", "s", "config", "backends-file"}
+
+type selftest struct {
+	proxy string // the proxy's listen address
+	stats string
+	c     int
+}
+
+// selftestMain runs the selftest subcommand and returns the exit status
+func selftestMain(args []string) int {
+	c, err := selftestArgs(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, "usage: selftest [proxy flags]")
+		return 2
+	}
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer backend.Close()
+	go serveSelftestBackend(backend)
+	t := &selftest{proxy: freeAddr(), stats: freeAddr(), c: c}
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	args = append(args, "-l", t.proxy, "-p", backend.Addr().String(), "-s", t.stats)
+	var log lockedBuffer
+	cmd := exec.Command(exe, args...)
+	cmd.Stdout, cmd.Stderr = &log, &log
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	stop := func() {
+		cmd.Process.Kill()
+		<-exited
+	}
+	if err := t.waitReady(exited); err != nil {
+		stop()
+		fmt.Fprintf(os.Stderr, "the proxy didn't start: %v\n%s", err, log.String())
+		return 1
+	}
+	scenarios := []struct {
+		name string
+		run  func() error
+	}{
+		{"echo", t.echo},
+		{"large-transfer", t.large},
+		{"over-limit", t.overLimit},
+		{"disconnect-while-queued", t.abandon},
+		{"backend-close", t.backendClose},
+	}
+	failed := 0
+	for _, s := range scenarios {
+		start := time.Now()
+		err := s.run()
+		if err == nil {
+			err = t.waitCounts(0, 0)
+		}
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL %s: %v\n", s.name, err)
+			continue
+		}
+		fmt.Printf("ok   %s (%.3fs)\n", s.name, time.Since(start).Seconds())
+	}
+	stop()
+	if failed > 0 {
+		fmt.Printf("selftest failed: %d of %d scenarios\n", failed, len(scenarios))
+		fmt.Printf("proxy log:\n%s", log.String())
+		return 1
+	}
+	fmt.Printf("selftest passed: %d scenarios\n", len(scenarios))
+	return 0
+}
+
+// selftestArgs checks the proxy flags given to selftest, returning the -c
+// the scenarios should expect
+func selftestArgs(args []string) (int, error) {
+	c := clproxy.DefaultConcurrency
+	for i, arg := range args {
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		for _, pinned := range selftestPinned {
+			if name == pinned {
+				return 0, fmt.Errorf("selftest sets -%s itself", name)
+			}
+		}
+		if name != "c" {
+			continue
+		}
+		if !hasValue && i+1 < len(args) {
+			value = args[i+1]
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return 0, fmt.Errorf("invalid -c %q", value)
+		}
+		c = n
+	}
+	return c, nil
+}
+
+// freeAddr returns a local address with a port nothing is listening on
+func freeAddr() string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "127.0.0.1:0"
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// lockedBuffer collects the proxy's output
+type lockedBuffer struct {
+	sync.Mutex
+	b bytes.Buffer
+}
+
+func (l *lockedBuffer) Write(p []byte) (int, error) {
+	l.Lock()
+	defer l.Unlock()
+	return l.b.Write(p)
+}
+
+func (l *lockedBuffer) String() string {
+	l.Lock()
+	defer l.Unlock()
+	return l.b.String()
+}
+
+func serveSelftestBackend(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			var n uint64
+			if binary.Read(conn, binary.BigEndian, &n) == nil {
+				io.CopyN(conn, conn, int64(n))
+			}
+		}()
+	}
+}
+
+// waitReady waits for the proxy's stats port to answer
+func (t *selftest) waitReady(exited chan error) error {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		select {
+		case err := <-exited:
+			exited <- err
+			return fmt.Errorf("it exited: %v", err)
+		default:
+		}
+		if _, err := t.query("stats"); err == nil {
+			return nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return errors.New("its stats port didn't answer within 10s")
+}
+
+// query sends a command to the stats port and returns the answer
+func (t *selftest) query(cmd string) (string, error) {
+	return statsQuery(t.stats, cmd)
+}
+
+// waitCounts waits for the proxy to report active sessions and waiting
+// clients
+func (t *selftest) waitCounts(active, waiting int) error {
+	want := fmt.Sprintf("active: %d, waiting: %d", active, waiting)
+	var got string
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		out, err := t.query("stats")
+		if err != nil {
+			return err
+		}
+		if got, _, _ = strings.Cut(out, "\n"); got == want {
+			return nil
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return fmt.Errorf("stats say %q, want %q", got, want)
+}
+
+// recentFor waits for the session of the client on conn to be listed by
+// "recent", and returns its fields
+func (t *selftest) recentFor(conn net.Conn) (map[string]string, error) {
+	match := "client=" + conn.LocalAddr().String()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		out, err := t.query("recent")
+		if err != nil {
+			return nil, err
+		}
+		sc := bufio.NewScanner(strings.NewReader(out))
+		for sc.Scan() {
+			fields := strings.Fields(sc.Text())
+			if !slices.Contains(fields, match) {
+				continue
+			}
+			m := map[string]string{}
+			for _, f := range fields {
+				if k, v, ok := strings.Cut(f, "="); ok {
+					m[k] = v
+				}
+			}
+			return m, nil
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return nil, fmt.Errorf("no session for %s in recent", conn.LocalAddr())
+}
+
+// checkRecent checks the fields "recent" gives for the session on conn
+func (t *selftest) checkRecent(conn net.Conn, want map[string]string) error {
+	got, err := t.recentFor(conn)
+	if err != nil {
+		return err
+	}
+	for k, v := range want {
+		if got[k] != v {
+			return fmt.Errorf("recent says %s=%s, want %s", k, got[k], v)
+		}
+	}
+	return nil
+}
+
+// dial connects to the proxy and asks the backend to echo n bytes
+func (t *selftest) dial(n int) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", t.proxy, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(selftestTimeout))
+	if err := binary.Write(conn, binary.BigEndian, uint64(n)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// roundTrip sends b on conn and checks it comes back within wait
+func roundTrip(conn net.Conn, b []byte, wait time.Duration) error {
+	if _, err := conn.Write(b); err != nil {
+		return err
+	}
+	return expect(conn, b, wait)
+}
+
+// expect checks that b comes back on conn within wait
+func expect(conn net.Conn, b []byte, wait time.Duration) error {
+	conn.SetReadDeadline(time.Now().Add(wait))
+	got := make([]byte, len(b))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		return err
+	}
+	if !bytes.Equal(got, b) {
+		return fmt.Errorf("got %q back, want %q", got, b)
+	}
+	return nil
+}
+
+// echo checks a small session's bytes and counters
+func (t *selftest) echo() error {
+	data := make([]byte, 4096)
+	rand.Read(data)
+	conn, err := t.dial(len(data))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := roundTrip(conn, data, 10*time.Second); err != nil {
+		return err
+	}
+	conn.Close()
+	return t.checkRecent(conn, map[string]string{
+		"status": "success",
+		"in":     strconv.Itoa(len(data) + 8),
+		"out":    strconv.Itoa(len(data)),
+	})
+}
+
+// large sends selftestLarge random bytes both ways at once and compares
+// their checksums
+func (t *selftest) large() error {
+	data := make([]byte, selftestLarge)
+	rand.Read(data)
+	conn, err := t.dial(len(data))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	written := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(data)
+		written <- err
+	}()
+	h := sha256.New()
+	n, err := io.CopyN(h, conn, int64(len(data)))
+	if err := <-written; err != nil {
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if n != int64(len(data)) {
+		return fmt.Errorf("got %d bytes back, want %d", n, len(data))
+	}
+	if sum := sha256.Sum256(data); !bytes.Equal(h.Sum(nil), sum[:]) {
+		return errors.New("the bytes came back different")
+	}
+	conn.Close()
+	return t.checkRecent(conn, map[string]string{
+		"in":  strconv.Itoa(len(data) + 8),
+		"out": strconv.Itoa(len(data)),
+	})
+}
+
+// hold opens -c sessions which each wait to be released with release
+func (t *selftest) hold() ([]net.Conn, error) {
+	var held []net.Conn
+	for range t.c {
+		conn, err := t.dial(8)
+		if err == nil {
+			err = roundTrip(conn, []byte("hold"), 5*time.Second)
+		}
+		if err != nil {
+			closeAll(held)
+			return nil, fmt.Errorf("holding session %d of %d: %v", len(held)+1, t.c, err)
+		}
+		held = append(held, conn)
+	}
+	return held, nil
+}
+
+// release ends a session opened by hold
+func release(conn net.Conn) error {
+	defer conn.Close()
+	return roundTrip(conn, []byte("done"), 5*time.Second)
+}
+
+func closeAll(conns []net.Conn) {
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// queue opens a client which sends ping, to wait behind held sessions
+func (t *selftest) queue() (net.Conn, error) {
+	conn, err := t.dial(4)
+	if err == nil {
+		_, err = conn.Write([]byte("ping"))
+	}
+	return conn, err
+}
+
+// overLimit checks that clients past -c wait, and are let in one at a time
+// as sessions end, in the order they came
+func (t *selftest) overLimit() error {
+	held, err := t.hold()
+	if err != nil {
+		return err
+	}
+	defer closeAll(held)
+	var queued []net.Conn
+	defer func() { closeAll(queued) }()
+	for i := range 2 {
+		conn, err := t.queue()
+		if err != nil {
+			return err
+		}
+		queued = append(queued, conn)
+		if err := t.waitCounts(t.c, i+1); err != nil {
+			return err
+		}
+	}
+	if err := release(held[0]); err != nil {
+		return fmt.Errorf("releasing a held session: %v", err)
+	}
+	// Each queued session lasts until its client hangs up, letting the next
+	// one in
+	for i, conn := range queued {
+		if err := expect(conn, []byte("ping"), 5*time.Second); err != nil {
+			return fmt.Errorf("queued client %d wasn't let in: %v", i+1, err)
+		}
+		if i+1 < len(queued) {
+			if err := expect(queued[i+1], []byte("ping"), 200*time.Millisecond); err == nil {
+				return fmt.Errorf("queued client %d was let in past the limit", i+2)
+			}
+		}
+		conn.Close()
+	}
+	for _, conn := range held[1:] {
+		if err := release(conn); err != nil {
+			return fmt.Errorf("releasing a held session: %v", err)
+		}
+	}
+	return nil
+}
+
+// abandon checks that a client which hangs up while queued doesn't keep
+// its slot once let in
+func (t *selftest) abandon() error {
+	held, err := t.hold()
+	if err != nil {
+		return err
+	}
+	defer closeAll(held)
+	gone, err := t.queue()
+	if err != nil {
+		return err
+	}
+	gone.Close()
+	next, err := t.queue()
+	if err != nil {
+		return err
+	}
+	defer next.Close()
+	if err := t.waitCounts(t.c, 2); err != nil {
+		return err
+	}
+	if err := release(held[0]); err != nil {
+		return fmt.Errorf("releasing a held session: %v", err)
+	}
+	if err := expect(next, []byte("ping"), 5*time.Second); err != nil {
+		return fmt.Errorf("the client behind the one which hung up wasn't let in: %v", err)
+	}
+	for _, conn := range held[1:] {
+		if err := release(conn); err != nil {
+			return fmt.Errorf("releasing a held session: %v", err)
+		}
+	}
+	return nil
+}
+
+// backendClose checks that a backend hanging up mid-stream, with the client
+// sending more, ends the session once the proxy finds it gone, with what it
+// sent first delivered
+func (t *selftest) backendClose() error {
+	data := make([]byte, 64<<10)
+	rand.Read(data)
+	conn, err := t.dial(len(data))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := roundTrip(conn, data, 10*time.Second); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if time.Now().After(deadline) {
+			return errors.New("the proxy didn't hang up on the client")
+		}
+		if _, err := conn.Write(data[:1024]); err != nil {
+			break
+		}
+		conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		if _, err := conn.Read(make([]byte, 1)); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			break
+		}
+	}
+	return t.checkRecent(conn, map[string]string{
+		"closed_by": "backend",
+		"out":       strconv.Itoa(len(data)),
+	})
+}
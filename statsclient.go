@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/apokalyptik/tcp-cl-proxy/clproxy"
+)
+
+// "clproxy stats" shows what a running proxy's stats port says, laid out for
+// reading rather than grepping:
+//
+//	clproxy stats -addr 10.0.0.5:8299
+//
+// It asks for the summary, the backends, the sessions copying data, and the
+// recent sessions, and prints the summary, a table of the backends, the
+// clients which moved the most bytes in the recent sessions, with their
+// -client-names labels, and a table of the sessions. -json prints the answers as JSON instead, each line of them
+// split into its fields, and -watch 2s clears the terminal and shows them
+// afresh every 2s until interrupted. The exit status is 1 if the stats port
+// can't be reached, so it doubles as a liveness probe.
+
+// How many top talkers to show
+const statsTopTalkers = 10
+
+// statsSnapshot is what a proxy's stats port said at one time
+type statsSnapshot struct {
+	Summary  []string            `json:"summary"`
+	Backends []map[string]string `json:"backends"`
+	Conns    []map[string]string `json:"conns"`
+	Recent   []map[string]string `json:"recent"`
+}
+
+// statsMain runs the stats subcommand and returns the exit status
+func statsMain(args []string) int {
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	addr := fs.String("addr", clproxy.DefaultStatsAddr, "The proxy's stats port, as given to its -s")
+	asJSON := fs.Bool("json", false, "Print the stats as JSON")
+	watch := fs.Duration("watch", 0, "Show the stats afresh this often until interrupted, e.g. 2s")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() > 0 || *watch < 0 {
+		fmt.Fprintln(os.Stderr, "usage: stats [-addr host:port] [-json] [-watch interval]")
+		return 2
+	}
+	if *watch == 0 {
+		snap, err := takeStatsSnapshot(*addr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		snap.print(os.Stdout, *asJSON)
+		return 0
+	}
+	for {
+		snap, err := takeStatsSnapshot(*addr)
+		// Home and clear the screen, as watch(1) does
+		fmt.Print("\x1b[H\x1b[2J")
+		if !*asJSON {
+			fmt.Printf("%s every %s: %s\n\n", *addr, *watch, time.Now().Format(time.DateTime))
+		}
+		if err != nil {
+			fmt.Println(err)
+		} else {
+			snap.print(os.Stdout, *asJSON)
+		}
+		time.Sleep(*watch)
+	}
+}
+
+// statsQuery sends cmd to the stats port at addr and returns the answer
+func statsQuery(addr, cmd string) (string, error) {
+	network, address := clproxy.DialAddr(addr)
+	conn, err := net.DialTimeout(network, address, 2*time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := fmt.Fprintln(conn, cmd); err != nil {
+		return "", err
+	}
+	b, err := io.ReadAll(conn)
+	if err != nil {
+		return "", err
+	}
+	if msg, ok := strings.CutPrefix(string(b), "error: "); ok {
+		return "", errors.New(strings.TrimSpace(msg))
+	}
+	return string(b), nil
+}
+
+func takeStatsSnapshot(addr string) (*statsSnapshot, error) {
+	var snap statsSnapshot
+	for _, q := range []struct {
+		cmd   string
+		lines *[]string
+		maps  *[]map[string]string
+	}{
+		{"stats", &snap.Summary, nil},
+		{"backends", nil, &snap.Backends},
+		{"conns", nil, &snap.Conns},
+		{"recent", nil, &snap.Recent},
+	} {
+		out, err := statsQuery(addr, q.cmd)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", addr, err)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+			switch {
+			case line == "":
+			case q.lines != nil:
+				*q.lines = append(*q.lines, line)
+			default:
+				*q.maps = append(*q.maps, statsFields(line))
+			}
+		}
+	}
+	return &snap, nil
+}
+
+// statsFields splits a line of key=value fields, with quoted values, into a
+// map. A leading word without a value, such as picked_backend, is kept as
+// "kind".
+func statsFields(line string) map[string]string {
+	m := map[string]string{}
+	for line != "" {
+		line = strings.TrimLeft(line, " ")
+		word, rest, _ := strings.Cut(line, " ")
+		key, value, ok := strings.Cut(word, "=")
+		if !ok {
+			if len(m) == 0 {
+				m["kind"] = word
+			}
+			line = rest
+			continue
+		}
+		if strings.HasPrefix(value, `"`) {
+			quoted := line[len(key)+1:]
+			if q, err := strconv.QuotedPrefix(quoted); err == nil {
+				value, _ = strconv.Unquote(q)
+				rest = quoted[len(q):]
+			}
+		}
+		m[key] = value
+		line = rest
+	}
+	return m
+}
+
+func (snap *statsSnapshot) print(w io.Writer, asJSON bool) {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(snap)
+		return
+	}
+	for _, line := range snap.Summary {
+		fmt.Fprintln(w, line)
+	}
+	fmt.Fprintln(w)
+	statsTable(w, "BACKEND", snap.Backends, "backend", "role", "weight", "health", "mode", "circuit", "active", "sessions", "errors", "dial_avg", "in", "out", "share")
+	fmt.Fprintln(w)
+	talkers := snap.talkers()
+	statsTable(w, "TOP TALKER", talkers, "client", "client_name", "sessions", "in", "out")
+	fmt.Fprintln(w)
+	statsTable(w, "SESSION", snap.Conns, "id", "client", "client_name", "backend", "age", "route", "throttle", "capture")
+}
+
+// talkers sums the recent sessions' bytes by client IP, most first, with
+// the client's -client-names label if it has one
+func (snap *statsSnapshot) talkers() []map[string]string {
+	type talker struct {
+		client            string
+		label             string
+		sessions          int
+		bytesIn, bytesOut int64
+	}
+	by := map[string]*talker{}
+	for _, s := range snap.Recent {
+		client := s["client"]
+		if host, _, err := net.SplitHostPort(client); err == nil {
+			client = host
+		}
+		t, ok := by[client]
+		if !ok {
+			t = &talker{client: client, label: s["client_name"]}
+			by[client] = t
+		}
+		in, _ := strconv.ParseInt(s["in"], 10, 64)
+		out, _ := strconv.ParseInt(s["out"], 10, 64)
+		t.sessions++
+		t.bytesIn += in
+		t.bytesOut += out
+	}
+	ts := make([]*talker, 0, len(by))
+	for _, t := range by {
+		ts = append(ts, t)
+	}
+	sort.Slice(ts, func(i, j int) bool {
+		return ts[i].bytesIn+ts[i].bytesOut > ts[j].bytesIn+ts[j].bytesOut
+	})
+	var rows []map[string]string
+	for _, t := range ts[:min(len(ts), statsTopTalkers)] {
+		rows = append(rows, map[string]string{
+			"client":      t.client,
+			"client_name": t.label,
+			"sessions":    strconv.Itoa(t.sessions),
+			"in":          strconv.FormatInt(t.bytesIn, 10),
+			"out":         strconv.FormatInt(t.bytesOut, 10),
+		})
+	}
+	return rows
+}
+
+// statsTable prints rows as a table of the given columns, leaving out any
+// which no row has, headed by title in place of the first
+func statsTable(w io.Writer, title string, rows []map[string]string, columns ...string) {
+	if len(rows) == 0 {
+		fmt.Fprintf(w, "%s: none\n", strings.ToLower(title))
+		return
+	}
+	var used []string
+	for i, col := range columns {
+		for _, row := range rows {
+			if row[col] != "" || i == 0 {
+				used = append(used, col)
+				break
+			}
+		}
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	header := make([]string, len(used))
+	for i, col := range used {
+		header[i] = strings.ToUpper(col)
+	}
+	header[0] = title
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, row := range rows {
+		cells := make([]string, len(used))
+		for i, col := range used {
+			cells[i] = row[col]
+		}
+		if row["kind"] != "" {
+			cells[0] += " (" + row["kind"] + ")"
+		}
+		fmt.Fprintln(tw, strings.Join(cells, "\t"))
+	}
+	tw.Flush()
+}